@@ -0,0 +1,191 @@
+package telemetry_admin
+
+import (
+       "fmt"
+       "log"
+       "net/http"
+       "strconv"
+       "strings"
+       "encoding/json"
+       "crypto/subtle"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////               A D M I N   A P I                          ///////
+///////////////////////////////////////////////////////////////////////
+// HTTP api for controlling a running collector, every request must carry
+// the admin token in authorization header,
+//   curl -H "Authorization: Bearer <token>" https://<admin_listen>/stats
+//
+//   GET  /stats              stats of all the sessions
+//   POST /pause              stop processing messages
+//   POST /resume             resume processing messages
+//   POST /rate?msgs=<n>      process at most n messages per second, 0 for no limit,
+//        &bytes=<n>          and n bytes per second, with a burst of
+//        &burst=<duration>   duration of the rates, of subscription only
+//        &subscription=<s>   or of all the messages if not given
+//   POST /shutdown           stop the collector
+//
+// Collectors can add more endpoints using HandleFunc.
+type AdminServer struct {
+     Shutdown func()
+
+     mux      *http.ServeMux
+     token    string
+}
+
+// token is read from tokenFile, admin api is not started without a token
+func NewAdminServer(tokenFile string) (*AdminServer, error) {
+     if tokenFile == "" {
+         return nil, fmt.Errorf("admin token file is required for admin api")
+     }
+     token, err := readToken(tokenFile)
+     if err != nil {
+         return nil, err
+     }
+
+     a := &AdminServer{mux: http.NewServeMux(), token: token}
+     a.HandleFunc("/stats", a.stats)
+     a.HandleFunc("/pause", a.post(func() { telemetry_decode.MdtOutPause(true) }))
+     a.HandleFunc("/resume", a.post(func() { telemetry_decode.MdtOutPause(false) }))
+     a.HandleFunc("/rate", a.rate)
+     a.HandleFunc("/shutdown", a.shutdown)
+     return a, nil
+}
+
+// add an endpoint, requests are authenticated before handler is called
+func (a *AdminServer) HandleFunc(pattern string, handler http.HandlerFunc) {
+     a.mux.HandleFunc(pattern, func(w http.ResponseWriter, r *http.Request) {
+         if !a.authorized(r) {
+             w.Header().Set("WWW-Authenticate", "Bearer")
+             http.Error(w, "unauthorized", http.StatusUnauthorized)
+             return
+         }
+         handler(w, r)
+     })
+}
+
+func (a *AdminServer) authorized(r *http.Request) bool {
+     auth := r.Header.Get("Authorization")
+     if !strings.HasPrefix(auth, "Bearer ") {
+         return false
+     }
+     return subtle.ConstantTimeCompare([]byte(auth[len("Bearer "):]), []byte(a.token)) == 1
+}
+
+// serve the api, uses TLS if cert and key files are given, runs forever
+func (a *AdminServer) ListenAndServe(addr, certFile, keyFile string, tlsReload time.Duration) error {
+     srv := &http.Server{Addr: addr, Handler: a.mux}
+
+     lis, err := controlListen("Admin api", addr)
+     if err != nil {
+         return err
+     }
+     if certFile != "" {
+         srv.TLSConfig, err = telemetry_tls.NewServerConfig(certFile, keyFile, tlsReload)
+         if err != nil {
+             return err
+         }
+         telemetry_log.Println("Admin api listening at https://" + addr)
+         return srv.ServeTLS(lis, "", "")
+     }
+     log.Printf("Admin api at %s is not using TLS, token is sent in clear", addr)
+     telemetry_log.Println("Admin api listening at http://" + addr)
+     return srv.Serve(lis)
+}
+
+// reply with v as json
+func WriteJSON(w http.ResponseWriter, v interface{}) {
+     w.Header().Set("Content-Type", "application/json")
+     b, err := json.MarshalIndent(v, "", "  ")
+     if err != nil {
+         http.Error(w, err.Error(), http.StatusInternalServerError)
+         return
+     }
+     w.Write(append(b, '\n'))
+}
+
+// POST only handler that replies with status
+func (a *AdminServer) post(f func()) http.HandlerFunc {
+     return func(w http.ResponseWriter, r *http.Request) {
+         if r.Method != http.MethodPost {
+             http.Error(w, "use POST", http.StatusMethodNotAllowed)
+             return
+         }
+         f()
+         a.stats(w, r)
+     }
+}
+
+type adminStats struct {
+     Paused   bool                          `json:"paused"`
+     Rate     float64                       `json:"rate"`
+     Limits   []telemetry_decode.MdtRateLimit `json:"rate_limits"`
+     Sessions []telemetry_decode.MdtOutStat `json:"sessions"`
+}
+
+func (a *AdminServer) stats(w http.ResponseWriter, r *http.Request) {
+     WriteJSON(w, &adminStats{
+                     Paused:   telemetry_decode.MdtOutPaused(),
+                     Rate:     telemetry_decode.MdtOutRate(),
+                     Limits:   telemetry_decode.MdtRateLimits(),
+                     Sessions: telemetry_decode.MdtOutStats(),
+                  })
+}
+
+func (a *AdminServer) rate(w http.ResponseWriter, r *http.Request) {
+     if r.Method != http.MethodPost {
+         http.Error(w, "use POST", http.StatusMethodNotAllowed)
+         return
+     }
+     // values not given are kept
+     q := r.URL.Query()
+     l := telemetry_decode.MdtRateLimitOf(q.Get("subscription"))
+     for _, p := range []struct {
+          name  string
+          value *float64
+     }{{"msgs", &l.Msgs}, {"bytes", &l.Bytes}} {
+          if v := q.Get(p.name); v != "" {
+              f, err := strconv.ParseFloat(v, 64)
+              if err != nil || f < 0 {
+                  http.Error(w, "expected msgs=<messages per second> or bytes=<bytes per second>", http.StatusBadRequest)
+                  return
+              }
+              *p.value = f
+          }
+     }
+     if v := q.Get("burst"); v != "" {
+         d, err := time.ParseDuration(v)
+         if err != nil || d <= 0 {
+             http.Error(w, "expected burst=<duration>", http.StatusBadRequest)
+             return
+         }
+         l.Burst = d.Seconds()
+     }
+     telemetry_decode.MdtSetRateLimit(l)
+     a.stats(w, r)
+}
+
+func (a *AdminServer) shutdown(w http.ResponseWriter, r *http.Request) {
+     if r.Method != http.MethodPost {
+         http.Error(w, "use POST", http.StatusMethodNotAllowed)
+         return
+     }
+     fmt.Fprintln(w, "shutting down")
+     if f, ok := w.(http.Flusher); ok {
+         f.Flush()
+     }
+     telemetry_log.Printf("Admin api: shutdown requested from %s\n", r.RemoteAddr)
+     if a.Shutdown != nil {
+         // let the reply go out before exiting
+         go func() {
+             time.Sleep(100 * time.Millisecond)
+             a.Shutdown()
+         }()
+     }
+}
@@ -0,0 +1,50 @@
+package telemetry_admin
+
+import (
+       "fmt"
+       "io"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////               C O N F I G   C H E C K                    ///////
+///////////////////////////////////////////////////////////////////////
+// -check_config runs checks of the options instead of starting the
+// collector, a line per check is written, ok or FAIL with the error.
+
+type Check struct {
+     Name string
+     Run  func() error
+}
+
+// run all the checks, exit status is 1 if any failed
+func RunChecks(w io.Writer, checks []Check) int {
+     failed := 0
+     for _, c := range checks {
+         if err := c.Run(); err != nil {
+             failed++
+             fmt.Fprintf(w, "FAIL  %-20s %v\n", c.Name, err)
+         } else {
+             fmt.Fprintf(w, "ok    %s\n", c.Name)
+         }
+     }
+     if failed != 0 {
+         fmt.Fprintf(w, "%d of %d checks failed\n", failed, len(checks))
+         return 1
+     }
+     fmt.Fprintf(w, "%d checks passed\n", len(checks))
+     return 0
+}
+
+// cert and key of a listener, both or none
+func CheckCertKey(certFile, keyFile string) error {
+     if certFile == "" && keyFile == "" {
+         return nil
+     }
+     if certFile == "" || keyFile == "" {
+         return fmt.Errorf("TLS needs both cert and key")
+     }
+     _, err := telemetry_tls.NewServerConfig(certFile, keyFile, 0)
+     return err
+}
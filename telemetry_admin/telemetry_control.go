@@ -0,0 +1,170 @@
+package telemetry_admin
+
+import (
+       "fmt"
+       "log"
+       "net"
+       "net/http"
+       "strings"
+       "io/ioutil"
+       "crypto/subtle"
+       "sync"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////           C O N T R O L   A C C E S S                    ///////
+///////////////////////////////////////////////////////////////////////
+// Access to the control listeners, admin api, debug endpoint and
+// dashboard. They are bound to the address of their option, 127.0.0.1:6060
+// for local access only. With -control_allow, addresses or prefixes, only
+// those sources may connect, connections from others are closed as they
+// are accepted and every rejected address is logged once. With
+// -control_token_file the debug endpoint and dashboard take the token the
+// way the admin api takes its own,
+//   curl -H "Authorization: Bearer <token>" http://<debug_listen>/debug/vars
+// or as ?token=<token>, for go tool pprof, and browsers opening the
+// dashboard, the token is then kept in a cookie. Health probes are left open, they tell nothing and
+// change nothing.
+
+const controlCookie = "mdt_control_token"
+
+var controlAccess struct {
+    nets   []*net.IPNet
+    token  string
+    mu     sync.Mutex
+    logged map[string]bool
+}
+
+// trimmed content of tokenFile, an error if empty
+func readToken(tokenFile string) (string, error) {
+     b, err := ioutil.ReadFile(tokenFile)
+     if err != nil {
+         return "", err
+     }
+     token := strings.TrimSpace(string(b))
+     if token == "" {
+         return "", fmt.Errorf("token file %s is empty", tokenFile)
+     }
+     return token, nil
+}
+
+// limit control listeners to sources in allow, comma separated addresses
+// or prefixes, and require the token in tokenFile on debug endpoint and
+// dashboard, either can be empty. Called before the listeners are started.
+func ControlAccessSetup(allow, tokenFile string) error {
+     var nets []*net.IPNet
+     for _, s := range strings.Split(allow, ",") {
+         if s = strings.TrimSpace(s); s == "" {
+             continue
+         }
+         prefix := s
+         if !strings.Contains(s, "/") {
+             if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+                 prefix += "/32"
+             } else {
+                 prefix += "/128"
+             }
+         }
+         _, n, err := net.ParseCIDR(prefix)
+         if err != nil {
+             return fmt.Errorf("invalid address %s", s)
+         }
+         nets = append(nets, n)
+     }
+     var token string
+     if tokenFile != "" {
+         var err error
+         if token, err = readToken(tokenFile); err != nil {
+             return err
+         }
+     }
+     controlAccess.nets = nets
+     controlAccess.token = token
+     controlAccess.logged = make(map[string]bool)
+     return nil
+}
+
+// true if source addr may connect to control listeners
+func controlAllowed(addr net.Addr) bool {
+     if len(controlAccess.nets) == 0 {
+         return true
+     }
+     host, _, err := net.SplitHostPort(addr.String())
+     if err != nil {
+         host = addr.String()
+     }
+     if ip := net.ParseIP(host); ip != nil {
+         for _, n := range controlAccess.nets {
+             if n.Contains(ip) {
+                 return true
+             }
+         }
+     }
+     controlAccess.mu.Lock()
+     defer controlAccess.mu.Unlock()
+     if !controlAccess.logged[host] {
+         controlAccess.logged[host] = true
+         telemetry_log.Errorf("Rejected control connection from %s, address not allowed\n", host)
+     }
+     return false
+}
+
+// listener closing connections from sources not allowed
+type controlListener struct {
+     net.Listener
+}
+
+func (l controlListener) Accept() (net.Conn, error) {
+     for {
+         conn, err := l.Listener.Accept()
+         if err != nil || controlAllowed(conn.RemoteAddr()) {
+             return conn, err
+         }
+         conn.Close()
+     }
+}
+
+// listen on addr for a control listener, name is used in logs
+func controlListen(name, addr string) (net.Listener, error) {
+     lis, err := net.Listen("tcp", addr)
+     if err != nil {
+         return nil, err
+     }
+     if host, _, err := net.SplitHostPort(addr); err == nil && host == "" && len(controlAccess.nets) == 0 {
+         log.Printf("%s %s is reachable from any address", name, addr)
+     }
+     return controlListener{lis}, nil
+}
+
+func controlTokenMatch(token string) bool {
+     return subtle.ConstantTimeCompare([]byte(token), []byte(controlAccess.token)) == 1
+}
+
+// h with -control_token_file required, as bearer token, ?token= or the
+// cookie set by ?token=
+func controlAuth(h http.Handler) http.Handler {
+     if controlAccess.token == "" {
+         return h
+     }
+     return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+         if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") && controlTokenMatch(auth[len("Bearer "):]) {
+             h.ServeHTTP(w, r)
+             return
+         }
+         if c, err := r.Cookie(controlCookie); err == nil && controlTokenMatch(c.Value) {
+             h.ServeHTTP(w, r)
+             return
+         }
+         if token := r.URL.Query().Get("token"); token != "" && controlTokenMatch(token) {
+             // for the requests of the dashboard page
+             http.SetCookie(w, &http.Cookie{Name: controlCookie, Value: token, Path: "/",
+                                            HttpOnly: true, SameSite: http.SameSiteStrictMode})
+             h.ServeHTTP(w, r)
+             return
+         }
+         w.Header().Set("WWW-Authenticate", "Bearer")
+         http.Error(w, "unauthorized", http.StatusUnauthorized)
+     })
+}
@@ -0,0 +1,80 @@
+package telemetry_admin
+
+import (
+       "fmt"
+       "net"
+       "os"
+       "strconv"
+       "strings"
+       "time"
+       "io/ioutil"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////     D A E M O N,   P I D F I L E   A N D   S Y S T E M D    ///////
+///////////////////////////////////////////////////////////////////////
+// For running the collector as systemd service with Type=notify,
+//   [Service]
+//   Type=notify
+//   WatchdogSec=30
+//   ExecStart=/usr/local/bin/telemetry_dialin_collector -daemon -pidfile /run/mdt.pid ...
+
+// write pid of the collector to pidFile, fails if pidFile has pid of
+// another running process
+func WritePidFile(pidFile string) error {
+     if b, err := ioutil.ReadFile(pidFile); err == nil {
+         pid, err := strconv.Atoi(strings.TrimSpace(string(b)))
+         if err == nil && pid != os.Getpid() {
+             if _, err := os.Stat("/proc/" + strconv.Itoa(pid)); err == nil {
+                 return fmt.Errorf("pidfile %s: collector already running with pid %d", pidFile, pid)
+             }
+         }
+     }
+     return ioutil.WriteFile(pidFile, []byte(strconv.Itoa(os.Getpid()) + "\n"), 0644)
+}
+
+func RemovePidFile(pidFile string) {
+     if pidFile != "" {
+         os.Remove(pidFile)
+     }
+}
+
+// send state to systemd, e.g. READY=1, does nothing if not started by
+// systemd with NOTIFY_SOCKET
+func SdNotify(state string) error {
+     sock := os.Getenv("NOTIFY_SOCKET")
+     if sock == "" {
+         return nil
+     }
+     if strings.HasPrefix(sock, "@") {
+         // abstract socket
+         sock = "\x00" + sock[1:]
+     }
+
+     conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: sock, Net: "unixgram"})
+     if err != nil {
+         return err
+     }
+     defer conn.Close()
+     _, err = conn.Write([]byte(state))
+     return err
+}
+
+// send WATCHDOG=1 to systemd at half of WatchdogSec, as long as healthy
+// returns true. If collector is not healthy, heartbeats stop and systemd
+// restarts the collector. Does nothing if watchdog is not enabled.
+func SdWatchdog(healthy func() bool) {
+     usec, err := strconv.Atoi(os.Getenv("WATCHDOG_USEC"))
+     if err != nil || usec <= 0 {
+         return
+     }
+     if pid := os.Getenv("WATCHDOG_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+         return
+     }
+
+     for range time.Tick(time.Duration(usec) * time.Microsecond / 2) {
+         if healthy() {
+             SdNotify("WATCHDOG=1")
+         }
+     }
+}
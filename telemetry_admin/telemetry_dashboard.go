@@ -0,0 +1,154 @@
+package telemetry_admin
+
+import (
+       "encoding/json"
+       "fmt"
+       "net/http"
+       "sync"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////              W E B   D A S H B O A R D                  ///////
+///////////////////////////////////////////////////////////////////////
+// A page for watching the collector from a browser, sessions with their
+// message rate over the last 10 minutes, recent errors and decoded rows
+// as they arrive,
+//   GET /              the page
+//   GET /api/status    sessions, rate samples and recent errors as json
+//   GET /api/tail      decoded rows as server-sent events, ?path=<prefix>
+//                      for rows of matching sensor paths only
+//   GET /api/ws        same rows over a WebSocket
+// Read only, meant to be bound to localhost, -control_allow and
+// -control_token_file limit who may see it otherwise.
+
+const (
+      dashboardInterval = 5 * time.Second
+      dashboardSamples  = 120
+      dashboardTailRows = 1000
+)
+
+type dashboardSession struct {
+     telemetry_decode.MdtOutStat
+     // messages per second, oldest first, a sample every 5s
+     Rates []float64 `json:"rates"`
+}
+
+type dashboardStatus struct {
+     Paused   bool                          `json:"paused"`
+     Interval float64                       `json:"interval"`
+     Sessions []*dashboardSession           `json:"sessions"`
+     Errors   []telemetry_log.ErrorEntry    `json:"errors"`
+}
+
+// rates of every session, sampled in background
+type dashboardRates struct {
+     sync.Mutex
+     prev   map[string]uint64
+     rates  map[string][]float64
+     prevAt time.Time
+}
+
+func (d *dashboardRates) sample() {
+     now := time.Now()
+     elapsed := now.Sub(d.prevAt).Seconds()
+     d.Lock()
+     defer d.Unlock()
+     prev := make(map[string]uint64)
+     rates := make(map[string][]float64)
+     for _, s := range telemetry_decode.MdtOutStats() {
+         prev[s.Name] = s.Messages
+         r := d.rates[s.Name]
+         if n, ok := d.prev[s.Name]; ok && elapsed > 0 {
+             r = append(r, float64(s.Messages - n) / elapsed)
+         }
+         if len(r) > dashboardSamples {
+             r = r[len(r) - dashboardSamples:]
+         }
+         rates[s.Name] = r
+     }
+     // sessions gone are dropped
+     d.prev, d.rates, d.prevAt = prev, rates, now
+}
+
+func (d *dashboardRates) status(w http.ResponseWriter, r *http.Request) {
+     status := &dashboardStatus{
+                    Paused:   telemetry_decode.MdtOutPaused(),
+                    Interval: dashboardInterval.Seconds(),
+                    Sessions: []*dashboardSession{},
+                    Errors:   telemetry_log.RecentErrors(),
+                }
+     d.Lock()
+     for _, s := range telemetry_decode.MdtOutStats() {
+         status.Sessions = append(status.Sessions, &dashboardSession{
+                                      MdtOutStat: s,
+                                      Rates:      append([]float64{}, d.rates[s.Name]...),
+                                  })
+     }
+     d.Unlock()
+     WriteJSON(w, status)
+}
+
+// decoded rows as server-sent events till the browser goes away
+func dashboardTail(w http.ResponseWriter, r *http.Request) {
+     flusher, ok := w.(http.Flusher)
+     if !ok {
+         http.Error(w, "streaming not supported", http.StatusInternalServerError)
+         return
+     }
+     w.Header().Set("Content-Type", "text/event-stream")
+     w.Header().Set("Cache-Control", "no-cache")
+     flusher.Flush()
+
+     t := telemetry_decode.MdtTailStart(r.URL.Query().Get("path"), dashboardTailRows)
+     defer t.Stop()
+     for {
+         select {
+         case <-r.Context().Done():
+             return
+         case row := <-t.C:
+             b, err := json.Marshal(row)
+             if err != nil {
+                 continue
+             }
+             if _, err = fmt.Fprintf(w, "data: %s\n\n", b); err != nil {
+                 return
+             }
+             flusher.Flush()
+         }
+     }
+}
+
+// serve the dashboard on addr, runs forever
+func ServeDashboard(addr string) error {
+     d := &dashboardRates{prevAt: time.Now()}
+     d.sample()
+     go func() {
+         for range time.Tick(dashboardInterval) {
+             d.sample()
+         }
+     }()
+
+     mux := http.NewServeMux()
+     mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+         if r.URL.Path != "/" {
+             http.NotFound(w, r)
+             return
+         }
+         w.Header().Set("Content-Type", "text/html; charset=utf-8")
+         fmt.Fprint(w, dashboardPage)
+     })
+     mux.HandleFunc("/api/status", d.status)
+     mux.HandleFunc("/api/tail", dashboardTail)
+     mux.Handle("/api/ws", dashboardWebSocket)
+
+     telemetry_log.Println("Dashboard listening at http://" + addr)
+     lis, err := controlListen("Dashboard", addr)
+     if err != nil {
+         return err
+     }
+     return http.Serve(lis, controlAuth(mux))
+}
@@ -0,0 +1,133 @@
+package telemetry_admin
+
+// page served by the dashboard, no external scripts or styles so it works
+// without internet access
+const dashboardPage = `<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>telemetry collector</title>
+<style>
+body { font-family: sans-serif; font-size: 13px; margin: 16px; color: #222; }
+h2 { font-size: 15px; margin: 20px 0 6px; }
+table { border-collapse: collapse; }
+th, td { text-align: left; padding: 3px 10px 3px 0; }
+td.n { text-align: right; font-family: monospace; }
+svg { background: #f4f6f8; }
+polyline { fill: none; stroke: #2a6fdb; stroke-width: 1.5; }
+#errors div { font-family: monospace; color: #b00; }
+#tail { font-family: monospace; font-size: 12px; height: 320px; overflow-y: auto; background: #f4f6f8; padding: 4px; white-space: pre; }
+#state { font-weight: bold; color: #b60; }
+</style>
+</head>
+<body>
+<div><b>telemetry collector</b> <span id="state"></span></div>
+
+<h2>Sessions</h2>
+<table>
+<thead><tr><th>Session</th><th>msg/s, last 10 minutes</th><th>msg/s</th><th>Messages</th><th>Bytes</th><th>Errors</th><th>Last message</th></tr></thead>
+<tbody id="sessions"></tbody>
+</table>
+
+<h2>Recent errors</h2>
+<div id="errors"></div>
+
+<h2>Live tail</h2>
+<div>
+<input id="path" size="60" placeholder="sensor path prefix, all if empty">
+<button id="follow">Follow</button>
+<button id="pause">Pause</button>
+<span id="tailstate"></span>
+</div>
+<div id="tail"></div>
+
+<script>
+function el(tag, text, cls) {
+  var e = document.createElement(tag);
+  if (text !== undefined) e.textContent = text;
+  if (cls) e.className = cls;
+  return e;
+}
+
+function sparkline(rates) {
+  var w = 240, h = 30, max = Math.max.apply(null, rates.concat([1]));
+  var svg = document.createElementNS("http://www.w3.org/2000/svg", "svg");
+  svg.setAttribute("width", w);
+  svg.setAttribute("height", h);
+  var line = document.createElementNS("http://www.w3.org/2000/svg", "polyline");
+  var points = rates.map(function(r, i) {
+    return (w - (rates.length - 1 - i) * 2) + "," + (h - 1 - r / max * (h - 2));
+  });
+  line.setAttribute("points", points.join(" "));
+  svg.appendChild(line);
+  svg.appendChild(el("title", "max " + max.toFixed(1) + " msg/s"));
+  return svg;
+}
+
+function ago(t) {
+  if (!t) return "-";
+  return Math.round((Date.now() - Date.parse(t)) / 1000) + "s ago";
+}
+
+function refresh() {
+  fetch("api/status").then(function(r) { return r.json(); }).then(function(s) {
+    document.getElementById("state").textContent = s.paused ? "PAUSED" : "";
+    var body = document.getElementById("sessions");
+    body.innerHTML = "";
+    s.sessions.forEach(function(x) {
+      var tr = el("tr"), spark = el("td");
+      spark.appendChild(sparkline(x.rates));
+      var last = x.rates.length ? x.rates[x.rates.length - 1] : 0;
+      tr.appendChild(el("td", x.name));
+      tr.appendChild(spark);
+      tr.appendChild(el("td", last.toFixed(1), "n"));
+      tr.appendChild(el("td", x.messages, "n"));
+      tr.appendChild(el("td", x.bytes, "n"));
+      tr.appendChild(el("td", x.errors, "n"));
+      tr.appendChild(el("td", ago(x.last_message)));
+      body.appendChild(tr);
+    });
+    var errors = document.getElementById("errors");
+    errors.innerHTML = "";
+    if (!s.errors || !s.errors.length) errors.appendChild(el("span", "none"));
+    (s.errors || []).slice().reverse().forEach(function(e) {
+      errors.appendChild(el("div", new Date(e.time).toLocaleTimeString() + "  " + e.message));
+    });
+  }).catch(function() {
+    document.getElementById("state").textContent = "collector not reachable";
+  });
+}
+
+var source = null, paused = false, maxLines = 500;
+
+function follow() {
+  if (source) source.close();
+  var path = document.getElementById("path").value.trim();
+  source = new EventSource("api/tail" + (path ? "?path=" + encodeURIComponent(path) : ""));
+  document.getElementById("tailstate").textContent = path ? "following " + path : "following all paths";
+  source.onmessage = function(m) {
+    if (paused) return;
+    var row = JSON.parse(m.data), tail = document.getElementById("tail");
+    var bottom = tail.scrollTop + tail.clientHeight >= tail.scrollHeight - 4;
+    var ts = new Date(row.timestamp).toLocaleTimeString();
+    tail.appendChild(el("div", ts + " " + row.node_id + " " + row.encoding_path + " " +
+                                JSON.stringify(row.keys) + " " + JSON.stringify(row.content)));
+    while (tail.childNodes.length > maxLines) tail.removeChild(tail.firstChild);
+    if (bottom) tail.scrollTop = tail.scrollHeight;
+  };
+}
+
+document.getElementById("follow").onclick = follow;
+document.getElementById("path").onkeydown = function(e) { if (e.key === "Enter") follow(); };
+document.getElementById("pause").onclick = function() {
+  paused = !paused;
+  this.textContent = paused ? "Resume" : "Pause";
+};
+
+refresh();
+setInterval(refresh, 5000);
+follow();
+</script>
+</body>
+</html>
+`
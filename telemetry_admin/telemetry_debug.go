@@ -0,0 +1,37 @@
+package telemetry_admin
+
+import (
+       "expvar"
+       "net/http"
+       _ "net/http/pprof"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////               D E B U G   E N D P O I N T                ///////
+///////////////////////////////////////////////////////////////////////
+// pprof and expvar for profiling a live collector, e.g.
+//   go tool pprof http://<debug_listen>/debug/pprof/profile?seconds=30
+//   go tool pprof http://<debug_listen>/debug/pprof/heap
+//   curl http://<debug_listen>/debug/vars
+// Meant to be bound to localhost, -control_allow and -control_token_file
+// limit who may use it otherwise.
+
+func init() {
+     expvar.Publish("mdt_out", expvar.Func(func() interface{} {
+         return telemetry_decode.MdtOutStats()
+     }))
+}
+
+// serve pprof and expvar on addr, runs forever
+func ServeDebug(addr string) error {
+     telemetry_log.Println("Debug endpoint listening at http://" + addr + "/debug/pprof/")
+     lis, err := controlListen("Debug endpoint", addr)
+     if err != nil {
+         return err
+     }
+     // pprof and expvar register on the default mux
+     return http.Serve(lis, controlAuth(http.DefaultServeMux))
+}
@@ -0,0 +1,96 @@
+package telemetry_admin
+
+import (
+       "flag"
+       "fmt"
+       "io/ioutil"
+       "os"
+       "strings"
+       "sync"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////      O P T I O N S   F R O M   F I L E S   A N D   E N V    ///////
+///////////////////////////////////////////////////////////////////////
+// Value of a string option can be read from a file, -password
+// @/run/secrets/mdt, file content with surrounding white space trimmed is
+// the value, @@ for a value starting with @. Options not given on the
+// command line are taken from environment variables, MDT_ and the option
+// name in upper case, MDT_OUT_COMPRESS for -out_compress, their values can
+// be @file as well. Command line wins over environment, environment over
+// config file.
+
+// values read from files, by option, not read again if option still has it
+var flagFiles = struct {
+    sync.Mutex
+    values map[string]string
+}{values: make(map[string]string)}
+
+// replace values of options of fs that are @file with the file content
+func FlagFiles(fs *flag.FlagSet) error {
+     flagFiles.Lock()
+     defer flagFiles.Unlock()
+     var err error
+     fs.VisitAll(func(f *flag.Flag) {
+         value := f.Value.String()
+         if err != nil || !strings.HasPrefix(value, "@") {
+             return
+         }
+         if v, ok := flagFiles.values[f.Name]; ok && v == value {
+             return
+         }
+         value, e := FileValue(value)
+         if e != nil {
+             err = fmt.Errorf("option %s: %v", f.Name, e)
+             return
+         }
+         if e := f.Value.Set(value); e != nil {
+             err = fmt.Errorf("option %s: %v", f.Name, e)
+             return
+         }
+         flagFiles.values[f.Name] = value
+     })
+     return err
+}
+
+// value, or content of file if value is @file
+func FileValue(value string) (string, error) {
+     if !strings.HasPrefix(value, "@") {
+         return value, nil
+     }
+     if strings.HasPrefix(value, "@@") {
+         return value[1:], nil
+     }
+     b, err := ioutil.ReadFile(value[1:])
+     if err != nil {
+         return "", err
+     }
+     return strings.TrimSpace(string(b)), nil
+}
+
+// environment variable of option name
+func FlagEnvName(prefix, name string) string {
+     return prefix + strings.ToUpper(strings.NewReplacer("-", "_", ".", "_").Replace(name))
+}
+
+// set options of fs not given on the command line from environment, they
+// are then seen as given
+func FlagsFromEnv(fs *flag.FlagSet, prefix string) error {
+     given := make(map[string]bool)
+     fs.Visit(func(f *flag.Flag) {
+         given[f.Name] = true
+     })
+     var err error
+     fs.VisitAll(func(f *flag.Flag) {
+         if err != nil || given[f.Name] {
+             return
+         }
+         env := FlagEnvName(prefix, f.Name)
+         if value, ok := os.LookupEnv(env); ok {
+             if e := fs.Set(f.Name, value); e != nil {
+                 err = fmt.Errorf("invalid value %q of %s for option %s: %v", value, env, f.Name, e)
+             }
+         }
+     })
+     return err
+}
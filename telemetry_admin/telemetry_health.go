@@ -0,0 +1,53 @@
+package telemetry_admin
+
+import (
+       "fmt"
+       "net/http"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////               H E A L T H   P R O B E S                  ///////
+///////////////////////////////////////////////////////////////////////
+// Probes for kubernetes and load balancers, served without authentication
+// on their own listener as they expose nothing but status,
+//   GET /healthz   200 while the collector is running
+//   GET /readyz    200 if a message was received within readyWindow, 503 otherwise
+
+// serve the probes on addr, runs forever
+func ServeHealth(addr string, readyWindow time.Duration) error {
+     mux := http.NewServeMux()
+     mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+         fmt.Fprintln(w, "ok")
+     })
+     mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+         last, ok := Ready(readyWindow)
+         if !ok {
+             if last.IsZero() {
+                 http.Error(w, "no messages received", http.StatusServiceUnavailable)
+             } else {
+                 http.Error(w, "last message at " + last.Format(time.RFC3339), http.StatusServiceUnavailable)
+             }
+             return
+         }
+         fmt.Fprintln(w, "ok, last message at " + last.Format(time.RFC3339))
+     })
+
+     telemetry_log.Println("Health probes listening at http://" + addr)
+     return http.ListenAndServe(addr, mux)
+}
+
+// true if any of the sessions received a message within window, also
+// returns time of the latest message
+func Ready(window time.Duration) (time.Time, bool) {
+     var last time.Time
+     for _, s := range telemetry_decode.MdtOutStats() {
+         if s.LastMessage.After(last) {
+             last = s.LastMessage
+         }
+     }
+     return last, !last.IsZero() && time.Since(last) <= window
+}
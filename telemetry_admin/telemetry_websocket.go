@@ -0,0 +1,69 @@
+package telemetry_admin
+
+import (
+       "encoding/json"
+       "fmt"
+       "net/http"
+       "net/url"
+
+       "golang.org/x/net/websocket"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+)
+
+// Decoded rows over a WebSocket on the dashboard listener, a json row per
+// text message, for dashboards and scripts that would rather not parse
+// server-sent events,
+//   GET /api/ws                 all rows
+//   GET /api/ws?path=<prefix>   rows of sensor paths starting with prefix
+// Anything sent by the client is ignored. Browsers can connect only from
+// a page served by the dashboard, clients sending no Origin, e.g. scripts,
+// are accepted.
+
+var dashboardWebSocket = websocket.Server{
+    Handshake: func(config *websocket.Config, r *http.Request) error {
+        origin := r.Header.Get("Origin")
+        if origin == "" {
+            return nil
+        }
+        u, err := url.Parse(origin)
+        if err != nil || u.Host != r.Host {
+            return fmt.Errorf("origin %s not allowed", origin)
+        }
+        return nil
+    },
+    Handler: dashboardTailWebSocket,
+}
+
+func dashboardTailWebSocket(ws *websocket.Conn) {
+     defer ws.Close()
+     t := telemetry_decode.MdtTailStart(ws.Request().URL.Query().Get("path"), dashboardTailRows)
+     defer t.Stop()
+
+     // reads fail once the client goes away
+     gone := make(chan struct{})
+     go func() {
+         buf := make([]byte, 512)
+         for {
+             if _, err := ws.Read(buf); err != nil {
+                 close(gone)
+                 return
+             }
+         }
+     }()
+
+     for {
+         select {
+         case <-gone:
+             return
+         case row := <-t.C:
+             b, err := json.Marshal(row)
+             if err != nil {
+                 continue
+             }
+             if err = websocket.Message.Send(ws, string(b)); err != nil {
+                 return
+             }
+         }
+     }
+}
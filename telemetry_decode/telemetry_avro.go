@@ -0,0 +1,291 @@
+package telemetry_decode
+
+import (
+       "os"
+       "fmt"
+       "sort"
+       "net/url"
+       "io/ioutil"
+       "path/filepath"
+       "encoding/json"
+       "time"
+
+       "github.com/linkedin/goavro/v2"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                    A V R O   S I N K                    ///////
+///////////////////////////////////////////////////////////////////////
+// -out avro:<dir>[?schema=<file.avsc>&codec=..&partition=hour|day]
+// Rows are written to Avro object container files, a file per sensor
+// path, partitioned by row time, same as parquet output,
+//   <dir>/<sensor path>/date=2019-03-06/hour=10/part-<time>-<pid>.avro
+// Schema is derived from the first row of the sensor path in a partition,
+// node_id, subscription, encoding_path, collection_id, timestamp and the
+// flattened keys and content as optional fields, keys__interface_name,
+// content__bytes_received. Leafs not in the schema, or of another type,
+// are dropped. With schema=<file.avsc> the given record schema is used for
+// all sensor paths, fields are matched by the same names. codec is null,
+// deflate (default) or snappy. File has a .tmp suffix until it is
+// complete.
+
+func init() {
+     mdtSinkTypes["avro"] = mdtNewAvroSink
+}
+
+type avroSink struct {
+     dir       string
+     partition string
+     codec     string
+     schema    *goavro.Codec             // given schema, nil to derive
+     fields    map[string]string         // fields of given schema
+     files     map[string]*avroFile
+}
+
+type avroFile struct {
+     name      string
+     partition string
+     file      *os.File
+     codec     *goavro.Codec
+     ow        *goavro.OCFWriter
+     fields    map[string]string         // field name to avro type, "" if not derived
+     pending   []interface{}             // records of the next block
+}
+
+func mdtNewAvroSink(address string, options url.Values) (mdtSink, error) {
+     if address == "" {
+         return nil, fmt.Errorf("avro output needs a directory, avro:<dir>")
+     }
+     s := &avroSink{dir: address, partition: "hour", codec: "deflate", files: map[string]*avroFile{}}
+
+     switch p := options.Get("partition"); p {
+     case "":
+     case "hour", "day":
+         s.partition = p
+     default:
+         return nil, fmt.Errorf("unsupported partition %s, Options: hour,day", p)
+     }
+     switch c := options.Get("codec"); c {
+     case "":
+     case "null", "deflate", "snappy":
+         s.codec = c
+     default:
+         return nil, fmt.Errorf("unsupported codec %s, Options: null,deflate,snappy", c)
+     }
+     if file := options.Get("schema"); file != "" {
+         b, err := ioutil.ReadFile(file)
+         if err != nil {
+             return nil, err
+         }
+         if s.schema, err = goavro.NewCodecForStandardJSONFull(string(b)); err != nil {
+             return nil, fmt.Errorf("avro schema %s: %v", file, err)
+         }
+         var record struct {
+             Fields []struct {
+                 Name string `json:"name"`
+             } `json:"fields"`
+         }
+         if err = json.Unmarshal(b, &record); err != nil || len(record.Fields) == 0 {
+             return nil, fmt.Errorf("avro schema %s: not a record schema", file)
+         }
+         s.fields = map[string]string{}
+         for _, f := range record.Fields {
+             s.fields[f.Name] = ""
+         }
+     }
+     return s, nil
+}
+
+func (s *avroSink) partitionDir(t time.Time) string {
+     t = t.UTC()
+     if s.partition == "day" {
+         return "date=" + t.Format("2006-01-02")
+     }
+     return "date=" + t.Format("2006-01-02") + "/hour=" + t.Format("15")
+}
+
+func (s *avroSink) writeRows(rows []*MdtRow) error {
+     for _, row := range rows {
+         fields := row.Flatten()
+         partition := s.partitionDir(time.Unix(0, int64(row.Timestamp) * int64(time.Millisecond)))
+
+         f := s.files[row.EncodingPath]
+         if f != nil && f.partition != partition {
+             delete(s.files, row.EncodingPath)
+             if err := f.close(); err != nil {
+                 return err
+             }
+             f = nil
+         }
+         if f == nil {
+             var err error
+             f, err = s.open(row.EncodingPath, partition, fields)
+             if err != nil {
+                 return err
+             }
+             s.files[row.EncodingPath] = f
+         }
+         if err := f.write(row, fields); err != nil {
+             return err
+         }
+     }
+     // rows of a message are a block
+     for _, f := range s.files {
+         if err := f.flush(); err != nil {
+             return err
+         }
+     }
+     return nil
+}
+
+func (s *avroSink) close() error {
+     var err error
+     for path, f := range s.files {
+         if e := f.close(); e != nil {
+             err = e
+         }
+         delete(s.files, path)
+     }
+     return err
+}
+
+func avroType(v interface{}) string {
+     switch v.(type) {
+     case int64, uint64:
+         return "long"
+     case float64:
+         return "double"
+     case bool:
+         return "boolean"
+     default:
+         return "string"
+     }
+}
+
+// record schema from the leafs of a row
+func avroSchema(fields map[string]interface{}) (string, map[string]string, error) {
+     schemaFields := []map[string]interface{}{
+                         {"name": "node_id", "type": "string"},
+                         {"name": "subscription", "type": "string"},
+                         {"name": "encoding_path", "type": "string"},
+                         {"name": "collection_id", "type": "long"},
+                         {"name": "timestamp", "type": map[string]string{"type": "long", "logicalType": "timestamp-millis"}},
+                     }
+     types := map[string]string{}
+     for _, f := range schemaFields {
+         types[f["name"].(string)] = ""
+     }
+     var names []string
+     for name := range fields {
+         names = append(names, name)
+     }
+     sort.Strings(names)
+     for _, name := range names {
+         col := mdtSafeName(name)
+         if _, ok := types[col]; ok {
+             continue
+         }
+         types[col] = avroType(fields[name])
+         schemaFields = append(schemaFields, map[string]interface{}{
+                                                 "name":    col,
+                                                 "type":    []string{"null", types[col]},
+                                                 "default": nil,
+                                             })
+     }
+     b, err := json.Marshal(map[string]interface{}{"type": "record", "name": "mdt", "fields": schemaFields})
+     return string(b), types, err
+}
+
+func (s *avroSink) open(encodingPath string, partition string, fields map[string]interface{}) (*avroFile, error) {
+     f := &avroFile{partition: partition, codec: s.schema, fields: s.fields}
+     if f.codec == nil {
+         schema, types, err := avroSchema(fields)
+         if err != nil {
+             return nil, err
+         }
+         if f.codec, err = goavro.NewCodecForStandardJSONFull(schema); err != nil {
+             return nil, fmt.Errorf("avro schema for %s: %v", encodingPath, err)
+         }
+         f.fields = types
+     }
+
+     dir := filepath.Join(s.dir, mdtSafeName(encodingPath), partition)
+     if err := os.MkdirAll(dir, 0755); err != nil {
+         return nil, err
+     }
+     f.name = filepath.Join(dir, fmt.Sprintf("part-%s-%d.avro", time.Now().UTC().Format("20060102T150405.000000000"), os.Getpid()))
+
+     var err error
+     f.file, err = os.Create(f.name + ".tmp")
+     if err != nil {
+         return nil, err
+     }
+     f.ow, err = goavro.NewOCFWriter(goavro.OCFConfig{W: f.file, Codec: f.codec, CompressionName: s.codec})
+     if err != nil {
+         f.file.Close()
+         os.Remove(f.name + ".tmp")
+         return nil, fmt.Errorf("avro file %s: %v", f.name, err)
+     }
+     return f, nil
+}
+
+func (f *avroFile) write(row *MdtRow, fields map[string]interface{}) error {
+     rec := map[string]interface{}{}
+     for name, v := range map[string]interface{}{
+                                "node_id":       row.NodeId,
+                                "subscription":  row.Subscription,
+                                "encoding_path": row.EncodingPath,
+                                "collection_id": row.CollectionId,
+                                "timestamp":     row.Timestamp,
+                            } {
+         if _, ok := f.fields[name]; ok {
+             rec[name] = v
+         }
+     }
+     for name, v := range fields {
+         col := mdtSafeName(name)
+         typ, ok := f.fields[col]
+         if !ok {
+             continue
+         }
+         // leaf of different type than in the derived schema is dropped
+         if typ != "" && avroType(v) != typ {
+             continue
+         }
+         rec[col] = v
+     }
+
+     b, err := json.Marshal(rec)
+     if err != nil {
+         return err
+     }
+     native, _, err := f.codec.NativeFromTextual(b)
+     if err != nil {
+         return fmt.Errorf("avro record for %s: %v", row.EncodingPath, err)
+     }
+     f.pending = append(f.pending, native)
+     return nil
+}
+
+func (f *avroFile) flush() error {
+     if len(f.pending) == 0 {
+         return nil
+     }
+     err := f.ow.Append(f.pending)
+     f.pending = nil
+     return err
+}
+
+func (f *avroFile) close() error {
+     err := f.flush()
+     if e := f.file.Close(); err == nil {
+         err = e
+     }
+     if err != nil {
+         return fmt.Errorf("avro file %s: %v", f.name, err)
+     }
+     telemetry_log.Println("Out file:", f.name)
+     return os.Rename(f.name + ".tmp", f.name)
+}
@@ -0,0 +1,242 @@
+package telemetry_decode
+
+import (
+       "io"
+       "os"
+       "fmt"
+       "sync"
+       "bufio"
+       "strconv"
+       "net/url"
+       "path/filepath"
+       "encoding/binary"
+       "sync/atomic"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                C A P T U R E   S I N K                  ///////
+///////////////////////////////////////////////////////////////////////
+// -out capture:<dir>[?size=..&interval=..&compress=..]
+// Messages are recorded as received, with the 12 byte tcp dialout header,
+// the same as a tcp dialout session saved with nc, into segment files
+//   <dir>/mdt-20190306T100002Z-<pid>-<n>.bin.zst
+// that replay, index, search and decode read. A segment is written to
+// <name>.part and renamed when it has size bytes (default 256MB, before
+// compression) or is interval old (default 1h). compress is none
+// (default), zstd or gzip, replay and the other commands read compressed
+// segments as they are. Segments are flushed every second, and encrypted
+// with -encrypt_key. jti messages have no dialout header and are not
+// recorded.
+
+func init() {
+     mdtSinkTypes["capture"] = mdtNewCaptureSink
+}
+
+// tcp dialout header values
+const (
+      captureTcpMsgData   = 1
+      captureTcpEncapGPB  = 1
+      captureTcpEncapJSON = 2
+)
+
+// segments of all the capture sinks of the collector
+var captureSeq uint64
+
+type captureSink struct {
+     sync.Mutex
+     dir      string
+     compress string
+     size     int64
+     interval time.Duration
+
+     file     *os.File                // segment being written
+     bw       *bufio.Writer
+     zw       mdtCompressWriter
+     w        io.Writer               // zw if compressed, bw if not
+     name     string
+     written  int64
+     opened   time.Time
+     jtiSkipped sync.Once
+
+     done     chan struct{}
+     stopped  chan struct{}
+}
+
+func mdtNewCaptureSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("capture output needs a directory, capture:<dir>")
+     }
+     s := &captureSink{
+              dir:      address,
+              size:     256 << 20,
+              interval: time.Hour,
+              done:     make(chan struct{}),
+              stopped:  make(chan struct{}),
+          }
+     if c := options.Get("compress"); c != "" && c != "none" {
+         if c != "zstd" && c != "gzip" {
+             return nil, fmt.Errorf("unsupported compress %s, Options: zstd,gzip,none", c)
+         }
+         s.compress = c
+     }
+     if sz := options.Get("size"); sz != "" {
+         if s.size, err = strconv.ParseInt(sz, 10, 64); err != nil || s.size <= 0 {
+             return nil, fmt.Errorf("invalid size %s", sz)
+         }
+     }
+     if i := options.Get("interval"); i != "" {
+         if s.interval, err = time.ParseDuration(i); err != nil || s.interval <= 0 {
+             return nil, fmt.Errorf("invalid interval %s", i)
+         }
+     }
+     if err = os.MkdirAll(s.dir, 0755); err != nil {
+         return nil, err
+     }
+     go s.flushLoop()
+     return s, nil
+}
+
+func (s *captureSink) raw() bool {
+     return true
+}
+
+func (s *captureSink) writeRaw(data []byte, encoding string) error {
+     if encoding == "jti" {
+         s.jtiSkipped.Do(func() {
+             telemetry_log.Errorf("capture: %s: jti messages are not recorded\n", s.dir)
+         })
+         return nil
+     }
+     encap := uint16(captureTcpEncapGPB)
+     if encoding == "json" {
+         encap = captureTcpEncapJSON
+     }
+     hdr := make([]byte, 12)
+     binary.BigEndian.PutUint16(hdr[0:], captureTcpMsgData)
+     binary.BigEndian.PutUint16(hdr[2:], encap)
+     binary.BigEndian.PutUint16(hdr[4:], 1)
+     binary.BigEndian.PutUint32(hdr[8:], uint32(len(data)))
+
+     s.Lock()
+     defer s.Unlock()
+     if s.file == nil {
+         if err := s.open(); err != nil {
+             return err
+         }
+     }
+     for _, b := range [][]byte{hdr, data} {
+         if _, err := s.w.Write(b); err != nil {
+             return err
+         }
+     }
+     s.written += int64(len(hdr) + len(data))
+     if s.written >= s.size {
+         return s.seal()
+     }
+     return nil
+}
+
+func (s *captureSink) writeRows(rows []*MdtRow) error {
+     return fmt.Errorf("capture records messages as received")
+}
+
+// new segment, called with lock held
+func (s *captureSink) open() error {
+     now := time.Now()
+     s.name = filepath.Join(s.dir, fmt.Sprintf("mdt-%s-%d-%d.bin%s", now.UTC().Format("20060102T150405Z"),
+                                      os.Getpid(), atomic.AddUint64(&captureSeq, 1), mdtCompressSuffix(s.compress) + mdtEncryptSuffix()))
+     f, err := os.OpenFile(s.name + ".part", os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+     if err != nil {
+         return err
+     }
+     s.file = f
+     s.bw = bufio.NewWriterSize(f, 1 << 16)
+     s.w = s.bw
+     if s.zw, err = mdtNewFileWriter(s.bw, s.compress); err != nil {
+         f.Close()
+         os.Remove(f.Name())
+         s.file = nil
+         return err
+     }
+     if s.zw != nil {
+         s.w = s.zw
+     }
+     s.written = 0
+     s.opened = now
+     return nil
+}
+
+func (s *captureSink) flush() error {
+     if s.zw != nil {
+         if err := s.zw.Flush(); err != nil {
+             return err
+         }
+     }
+     return s.bw.Flush()
+}
+
+// segment is complete, renamed to its name, called with lock held
+func (s *captureSink) seal() error {
+     if s.file == nil {
+         return nil
+     }
+     var err error
+     if s.zw != nil {
+         err = s.zw.Close()
+     }
+     if ferr := s.bw.Flush(); err == nil {
+         err = ferr
+     }
+     if cerr := s.file.Close(); err == nil {
+         err = cerr
+     }
+     if err == nil {
+         err = os.Rename(s.name + ".part", s.name)
+     }
+     if err == nil {
+         telemetry_log.Println("Out file:", s.name)
+     }
+     s.file, s.bw, s.zw, s.w = nil, nil, nil, nil
+     return err
+}
+
+func (s *captureSink) flushLoop() {
+     defer close(s.stopped)
+
+     t := time.NewTicker(time.Second)
+     defer t.Stop()
+     for {
+         select {
+         case <-s.done:
+             return
+         case now := <-t.C:
+             s.Lock()
+             var err error
+             if s.file != nil {
+                 if now.Sub(s.opened) >= s.interval {
+                     err = s.seal()
+                 } else {
+                     err = s.flush()
+                 }
+             }
+             s.Unlock()
+             if err != nil {
+                 telemetry_log.Errorln("capture:", err)
+             }
+         }
+     }
+}
+
+func (s *captureSink) close() error {
+     close(s.done)
+     <-s.stopped
+
+     s.Lock()
+     defer s.Unlock()
+     return s.seal()
+}
@@ -0,0 +1,30 @@
+package telemetry_decode
+
+import (
+       "log"
+
+       "github.com/fxamacker/cbor/v2"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                   C B O R   F O R M A T                 ///////
+///////////////////////////////////////////////////////////////////////
+// format=cbor, or -out cbor:<file>. Row is a map with the same names as
+// json, integers and floats are encoded in the fewest bytes that keep the
+// value, 0.5 takes 3 bytes. Files are CBOR sequences, rows one after the
+// other, for compact archival.
+
+var cborEncMode cbor.EncMode
+
+func init() {
+     var err error
+     cborEncMode, err = cbor.EncOptions{ShortestFloat: cbor.ShortestFloat16}.EncMode()
+     if err != nil {
+         log.Fatal("cbor encoder: ", err)
+     }
+     mdtRegisterRowFormat(&mdtRowFormat{
+                              name:    "cbor",
+                              suffix:  ".cbor",
+                              marshal: func(row *MdtRow) ([]byte, error) { return cborEncMode.Marshal(row) },
+                          })
+}
@@ -0,0 +1,124 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "math/rand"
+       "strconv"
+       "strings"
+       "sync"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////              F A U L T   I N J E C T I O N              ///////
+///////////////////////////////////////////////////////////////////////
+// -chaos injects faults at random, for testing how outputs downstream and
+// routers cope with a collector misbehaving. Every fault has the chance of
+// a message getting it,
+//   -chaos delay=0.1:500ms,drop=0.01,fail=0.01,disconnect=0.001,seed=1
+// delay holds a message for up to the duration, drop skips it, fail cuts
+// it short so that it fails to decode, and disconnect closes the grpc or
+// tcp stream it came on, dialin subscriptions are retried and dialout
+// routers reconnect. seed makes the faults the same run after run. Never
+// for production.
+
+type mdtChaosConfig struct {
+     delay      float64
+     maxDelay   time.Duration
+     drop       float64
+     fail       float64
+     disconnect float64
+
+     mu         sync.Mutex
+     rand       *rand.Rand
+}
+
+var mdtChaos *mdtChaosConfig
+
+// faults are injected from now on
+func MdtChaosSetup(spec string) error {
+     c := &mdtChaosConfig{maxDelay: time.Second}
+     seed := time.Now().UnixNano()
+     for _, kv := range strings.Split(spec, ",") {
+         if kv = strings.TrimSpace(kv); kv == "" {
+             continue
+         }
+         i := strings.Index(kv, "=")
+         if i < 0 {
+             return fmt.Errorf("invalid chaos %s, expected <fault>=<chance>", kv)
+         }
+         k, v := kv[:i], kv[i+1:]
+         var p *float64
+         switch k {
+         case "delay":
+             p = &c.delay
+             if j := strings.Index(v, ":"); j >= 0 {
+                 d, err := time.ParseDuration(v[j+1:])
+                 if err != nil || d <= 0 {
+                     return fmt.Errorf("invalid chaos delay %s", v[j+1:])
+                 }
+                 c.maxDelay, v = d, v[:j]
+             }
+         case "drop":
+             p = &c.drop
+         case "fail":
+             p = &c.fail
+         case "disconnect":
+             p = &c.disconnect
+         case "seed":
+             var err error
+             if seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+                 return fmt.Errorf("invalid chaos seed %s", v)
+             }
+             continue
+         default:
+             return fmt.Errorf("unknown chaos fault %s, Options: delay,drop,fail,disconnect,seed", k)
+         }
+         f, err := strconv.ParseFloat(v, 64)
+         if err != nil || f < 0 || f > 1 {
+             return fmt.Errorf("invalid chaos %s, chance is 0 to 1", kv)
+         }
+         *p = f
+     }
+     c.rand = rand.New(rand.NewSource(seed))
+     mdtChaos = c
+     return nil
+}
+
+func (c *mdtChaosConfig) hit(p float64) bool {
+     if p == 0 {
+         return false
+     }
+     c.mu.Lock()
+     defer c.mu.Unlock()
+     return c.rand.Float64() < p
+}
+
+// faults of a message of o, false if the message is dropped
+func (o *MdtOut) mdtChaosMessage(data []byte) ([]byte, bool) {
+     c := mdtChaos
+     if c.hit(c.delay) {
+         c.mu.Lock()
+         d := time.Duration(c.rand.Int63n(int64(c.maxDelay)))
+         c.mu.Unlock()
+         telemetry_log.Debugf("Chaos: %s: message delayed %v\n", o.Name, d)
+         time.Sleep(d)
+     }
+     if c.hit(c.drop) {
+         telemetry_log.Debugf("Chaos: %s: message dropped\n", o.Name)
+         return nil, false
+     }
+     if c.hit(c.fail) && len(data) > 1 {
+         telemetry_log.Debugf("Chaos: %s: message cut short to fail decoding\n", o.Name)
+         // data may be shared with other outputs
+         data = append([]byte(nil), data[:len(data) / 2]...)
+     }
+     return data, true
+}
+
+// true if the stream a message was just received on is to be closed
+func MdtChaosDisconnect() bool {
+     return mdtChaos != nil && mdtChaos.hit(mdtChaos.disconnect)
+}
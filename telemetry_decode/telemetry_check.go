@@ -0,0 +1,118 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "io/ioutil"
+       "net"
+       "net/url"
+       "os"
+       "path/filepath"
+       "strconv"
+       "strings"
+       "time"
+)
+
+// Output checks of -check_config, options are checked as the output loop
+// takes them, without opening the output.
+
+// format against encoding, decoding and output
+func (o *MdtOut)mdtCheckFormat() error {
+     switch o.OutFormat {
+     case "", "json":
+     case "text":
+        if o.Encoding == "json" {
+            return fmt.Errorf("text format needs gpb or self-describing-gpb encoding")
+        }
+     case "table":
+        if o.Decode_raw || (len(o.ProtoFile) != 0) {
+            return fmt.Errorf("table format is not supported with protoc decode")
+        }
+     default:
+        return fmt.Errorf("unsupported format %s, Options: json,text,table", o.OutFormat)
+     }
+     if mdtIsSink(o.OutFile) {
+        name := strings.SplitN(o.OutFile, ":", 2)[0]
+        if o.OutFormat == "text" || o.OutFormat == "table" {
+            return fmt.Errorf("%s format is not supported with %s output", o.OutFormat, name)
+        }
+        if o.Decode_raw || (len(o.ProtoFile) != 0) {
+            return fmt.Errorf("protoc decode is not supported with %s output", name)
+        }
+     }
+     return nil
+}
+
+// MdtOutCheck checks format, output and compression of o
+func (o *MdtOut)MdtOutCheck() error {
+     if err := o.mdtCheckFormat(); err != nil {
+         return err
+     }
+     if mdtIsSink(o.OutFile) {
+         _, _, _, err := mdtParseSink(o.OutFile)
+         return err
+     }
+     if o.OutCompress != "" {
+         if _, err := mdtNewCompressWriter(ioutil.Discard, o.OutCompress); err != nil {
+             return err
+         }
+     }
+     if mdtIsOutTemplate(o.OutFile) {
+         return o.mdtParseOutTemplate()
+     }
+     if o.OutFile != "" {
+         dir := filepath.Dir(o.OutFile)
+         if fi, err := os.Stat(dir); err != nil {
+             return err
+         } else if !fi.IsDir() {
+             return fmt.Errorf("%s is not a directory", dir)
+         }
+     }
+     return nil
+}
+
+// MdtOutReachable connects to the host:port of a sink sending over tcp,
+// nil for files and sinks without one
+func MdtOutReachable(out string, timeout time.Duration) error {
+     if !mdtIsSink(out) {
+         return nil
+     }
+     name, address, options, err := mdtParseSink(out)
+     if err != nil {
+         return err
+     }
+     if name == "statsd" || (name == "gelf" && options.Get("proto") != "tcp") {
+         // udp
+         return nil
+     }
+     hostPort := mdtSinkHostPort(address)
+     if hostPort == "" {
+         return nil
+     }
+     conn, err := net.DialTimeout("tcp", hostPort, timeout)
+     if err != nil {
+         return err
+     }
+     return conn.Close()
+}
+
+// host:port of address, user:password@host:port/db, http://host:port,
+// empty if it has none
+func mdtSinkHostPort(address string) string {
+     if u, err := url.Parse(address); err == nil && u.Host != "" {
+         address = u.Host
+     }
+     if i := strings.LastIndex(address, "@"); i >= 0 {
+         address = address[i+1:]
+     }
+     if i := strings.Index(address, "/"); i >= 0 {
+         address = address[:i]
+     }
+     _, port, err := net.SplitHostPort(address)
+     if err != nil {
+         return ""
+     }
+     if _, err = strconv.Atoi(port); err != nil {
+         return ""
+     }
+     return address
+}
@@ -0,0 +1,288 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sync"
+       "bytes"
+       "strings"
+       "strconv"
+       "net/url"
+       "net/http"
+       "io/ioutil"
+       "encoding/json"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////              C L I C K H O U S E   S I N K              ///////
+///////////////////////////////////////////////////////////////////////
+// -out clickhouse:<host:port>[?table=..&database=..&batch=..&flush=..]
+// Rows are inserted in batches over the HTTP interface (port 8123), a
+// batch is sent when it has batch rows (default 10000) or every flush
+// interval (default 5s). Default table is created if it does not exist,
+//   timestamp DateTime64(3, 'UTC'), node, subscription, encoding_path,
+//   collection_id UInt64, keys and content as json strings
+// Column mapping can be given with columns=<column>:<field>,.. where
+// field is timestamp, node, subscription, encoding_path, collection_id,
+// keys, content or a leaf, keys.interface-name, content.bytes-received,
+// table must exist in that case. Other options, user, password, and
+// https with address https://<host:port>.
+// Failed batches are retried with the next flush, rows are dropped if
+// more than 10 batches are pending.
+
+func init() {
+     mdtSinkTypes["clickhouse"] = mdtNewClickhouseSink
+}
+
+type clickhouseColumn struct {
+     name  string
+     field string
+}
+
+type clickhouseSink struct {
+     sync.Mutex
+     url      string
+     user     string
+     password string
+     insert   string
+     // default table, till it is created
+     create   string
+     columns  []clickhouseColumn
+     leafs    bool               // columns have leafs, rows are flattened
+     batch    int
+     rows     [][]byte
+     done     chan struct{}
+     client   *http.Client
+}
+
+var clickhouseDefaultColumns = []clickhouseColumn{
+    {"timestamp", "timestamp"},
+    {"node", "node"},
+    {"subscription", "subscription"},
+    {"encoding_path", "encoding_path"},
+    {"collection_id", "collection_id"},
+    {"keys", "keys"},
+    {"content", "content"},
+}
+
+func mdtNewClickhouseSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("clickhouse output needs an address, clickhouse:<host:port>")
+     }
+     if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+         address = "http://" + address
+     }
+     s := &clickhouseSink{
+              url:      strings.TrimSuffix(address, "/") + "/",
+              user:     options.Get("user"),
+              password: options.Get("password"),
+              columns:  clickhouseDefaultColumns,
+              batch:    10000,
+              done:     make(chan struct{}),
+              client:   &http.Client{Timeout: 30 * time.Second},
+          }
+
+     table := options.Get("table")
+     if table == "" {
+         table = "mdt"
+     }
+     if db := options.Get("database"); db != "" {
+         table = db + "." + table
+     }
+     if b := options.Get("batch"); b != "" {
+         if s.batch, err = strconv.Atoi(b); err != nil || s.batch <= 0 {
+             return nil, fmt.Errorf("invalid batch %s", b)
+         }
+     }
+     flush := 5 * time.Second
+     if f := options.Get("flush"); f != "" {
+         if flush, err = time.ParseDuration(f); err != nil || flush <= 0 {
+             return nil, fmt.Errorf("invalid flush interval %s", f)
+         }
+     }
+
+     if c := options.Get("columns"); c != "" {
+         s.columns = nil
+         for _, m := range strings.Split(c, ",") {
+             cf := strings.SplitN(m, ":", 2)
+             if len(cf) != 2 {
+                 return nil, fmt.Errorf("invalid column mapping %s, expected <column>:<field>", m)
+             }
+             if strings.HasPrefix(cf[1], "keys.") || strings.HasPrefix(cf[1], "content.") {
+                 s.leafs = true
+             } else if !clickhouseField(cf[1]) {
+                 return nil, fmt.Errorf("unknown field %s in column mapping %s", cf[1], m)
+             }
+             s.columns = append(s.columns, clickhouseColumn{cf[0], cf[1]})
+         }
+     } else {
+         // created before the first batch is sent
+         s.create = `CREATE TABLE IF NOT EXISTS ` + table + ` (
+                       timestamp     DateTime64(3, 'UTC'),
+                       node          LowCardinality(String),
+                       subscription  LowCardinality(String),
+                       encoding_path LowCardinality(String),
+                       collection_id UInt64,
+                       keys          String,
+                       content       String
+                     ) ENGINE = MergeTree ORDER BY (encoding_path, node, timestamp)`
+     }
+
+     var names []string
+     for _, c := range s.columns {
+         names = append(names, c.name)
+     }
+     s.insert = "INSERT INTO " + table + " (" + strings.Join(names, ", ") + ") FORMAT JSONEachRow"
+
+     go s.flushLoop(flush)
+     return s, nil
+}
+
+// run query, body is appended to the query
+func (s *clickhouseSink) query(q string, body []byte) error {
+     req, err := http.NewRequest(http.MethodPost, s.url + "?query=" + url.QueryEscape(q), bytes.NewReader(body))
+     if err != nil {
+         return err
+     }
+     if s.user != "" {
+         req.Header.Set("X-ClickHouse-User", s.user)
+         req.Header.Set("X-ClickHouse-Key", s.password)
+     }
+     resp, err := s.client.Do(req)
+     if err != nil {
+         return err
+     }
+     defer resp.Body.Close()
+     if resp.StatusCode != http.StatusOK {
+         msg, _ := ioutil.ReadAll(resp.Body)
+         return fmt.Errorf("clickhouse: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+     }
+     return nil
+}
+
+func (s *clickhouseSink) field(row *MdtRow, fields map[string]interface{}, name string) (interface{}, error) {
+     switch name {
+     case "timestamp":
+         return time.Unix(0, int64(row.Timestamp) * int64(time.Millisecond)).UTC().Format("2006-01-02 15:04:05.000"), nil
+     case "node":
+         return row.NodeId, nil
+     case "subscription":
+         return row.Subscription, nil
+     case "encoding_path":
+         return row.EncodingPath, nil
+     case "collection_id":
+         return row.CollectionId, nil
+     case "keys":
+         b, err := json.Marshal(row.Keys)
+         return string(b), err
+     case "content":
+         b, err := json.Marshal(row.Content)
+         return string(b), err
+     }
+     return fields[name], nil
+}
+
+func clickhouseField(name string) bool {
+     for _, c := range clickhouseDefaultColumns {
+         if c.field == name {
+             return true
+         }
+     }
+     return false
+}
+
+func (s *clickhouseSink) writeRows(rows []*MdtRow) error {
+     s.Lock()
+     defer s.Unlock()
+
+     for _, row := range rows {
+         var fields map[string]interface{}
+         if s.leafs {
+             fields = row.Flatten()
+         }
+         rec := map[string]interface{}{}
+         for _, c := range s.columns {
+             v, err := s.field(row, fields, c.field)
+             if err != nil {
+                 return err
+             }
+             if v != nil {
+                 rec[c.name] = v
+             }
+         }
+         b, err := json.Marshal(rec)
+         if err != nil {
+             return err
+         }
+         s.rows = append(s.rows, b)
+     }
+     if len(s.rows) >= s.batch {
+         return s.flush()
+     }
+     return nil
+}
+
+// send buffered rows, called with lock held
+func (s *clickhouseSink) flush() error {
+     if len(s.rows) == 0 {
+         return nil
+     }
+     n := len(s.rows)
+     if n > s.batch {
+         n = s.batch
+     }
+     var err error
+     if s.create != "" {
+         if err = s.query(s.create, nil); err == nil {
+             s.create = ""
+         }
+     }
+     if err == nil {
+         err = s.query(s.insert, append(bytes.Join(s.rows[:n], []byte("\n")), '\n'))
+     }
+     if err != nil {
+         if len(s.rows) > 10 * s.batch {
+             telemetry_log.Errorf("clickhouse: dropping %d rows\n", len(s.rows) - 10 * s.batch)
+             s.rows = s.rows[len(s.rows) - 10 * s.batch:]
+         }
+         return err
+     }
+     s.rows = s.rows[n:]
+     if len(s.rows) >= s.batch {
+         return s.flush()
+     }
+     return nil
+}
+
+func (s *clickhouseSink) flushLoop(interval time.Duration) {
+     t := time.NewTicker(interval)
+     defer t.Stop()
+     for {
+         select {
+         case <-s.done:
+             return
+         case <-t.C:
+             s.Lock()
+             if err := s.flush(); err != nil {
+                 telemetry_log.Errorln("Failed to write rows:", err)
+             }
+             s.Unlock()
+         }
+     }
+}
+
+func (s *clickhouseSink) close() error {
+     close(s.done)
+     s.Lock()
+     defer s.Unlock()
+     for len(s.rows) != 0 {
+         if err := s.flush(); err != nil {
+             return err
+         }
+     }
+     return nil
+}
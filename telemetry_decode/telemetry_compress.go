@@ -0,0 +1,38 @@
+package telemetry_decode
+
+import (
+       "io"
+       "fmt"
+       "compress/gzip"
+
+       "github.com/klauspost/compress/zstd"
+)
+
+// compressed output writer, gzip and zstd writers both satisfy this
+type mdtCompressWriter interface {
+     io.WriteCloser
+     Flush() error
+}
+
+func mdtNewCompressWriter(w io.Writer, compress string) (mdtCompressWriter, error) {
+     switch compress {
+     case "gzip":
+         return gzip.NewWriter(w), nil
+     case "zstd":
+         return zstd.NewWriter(w)
+     default:
+         return nil, fmt.Errorf("unsupported compression %s, Options: gzip,zstd", compress)
+     }
+}
+
+// file name suffix for compressed output
+func mdtCompressSuffix(compress string) string {
+     switch compress {
+     case "gzip":
+         return ".gz"
+     case "zstd":
+         return ".zst"
+     default:
+         return ""
+     }
+}
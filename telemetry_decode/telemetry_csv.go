@@ -0,0 +1,146 @@
+package telemetry_decode
+
+import (
+       "os"
+       "fmt"
+       "sort"
+       "strings"
+       "strconv"
+       "net/url"
+       "io/ioutil"
+       "path/filepath"
+       "encoding/csv"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                     C S V   S I N K                     ///////
+///////////////////////////////////////////////////////////////////////
+// -out csv:<file>[?path=<sensor path>&fields=<leaf>,<leaf>]
+// Rows of one sensor path are written as csv, columns are time, node,
+// the keys and the selected content leafs, nested leafs are joined with
+// ".", rates.input-rate. If fields are not given all leafs of the first
+// row are used, if path is not given sensor path of the first row is
+// used, rows of other paths are skipped. A "*" in file name is replaced
+// by a random string, as with file output, so every session gets its
+// own file.
+
+func init() {
+     mdtSinkTypes["csv"] = mdtNewCsvSink
+}
+
+type csvSink struct {
+     name    string
+     path    string
+     fields  []string
+     keys    []string
+     file    *os.File
+     w       *csv.Writer
+     skipped map[string]bool
+}
+
+func mdtNewCsvSink(address string, options url.Values) (mdtSink, error) {
+     if address == "" {
+         return nil, fmt.Errorf("csv output needs a file, csv:<file>")
+     }
+     s := &csvSink{path: options.Get("path"), skipped: map[string]bool{}}
+     if f := options.Get("fields"); f != "" {
+         s.fields = strings.Split(f, ",")
+     }
+
+     var err error
+     if strings.Contains(address, "*") {
+         s.file, err = ioutil.TempFile(filepath.Dir(address), filepath.Base(address))
+     } else {
+         s.file, err = os.Create(address)
+     }
+     if err != nil {
+         return nil, err
+     }
+     s.name = s.file.Name()
+     s.w = csv.NewWriter(s.file)
+     telemetry_log.Println("Out file:", s.name)
+     return s, nil
+}
+
+// header is fixed from the first row
+func (s *csvSink) header(row *MdtRow) error {
+     if s.path == "" {
+         s.path = row.EncodingPath
+     }
+     allFields := len(s.fields) == 0
+     s.keys = []string{}
+     for name := range row.Flatten() {
+         if strings.HasPrefix(name, "keys.") {
+             s.keys = append(s.keys, strings.TrimPrefix(name, "keys."))
+         } else if allFields {
+             s.fields = append(s.fields, strings.TrimPrefix(name, "content."))
+         }
+     }
+     sort.Strings(s.keys)
+     if allFields {
+         sort.Strings(s.fields)
+     }
+
+     h := []string{"time", "node"}
+     h = append(h, s.keys...)
+     h = append(h, s.fields...)
+     return s.w.Write(h)
+}
+
+func (s *csvSink) writeRows(rows []*MdtRow) error {
+     for _, row := range rows {
+         if s.keys == nil && (s.path == "" || s.path == row.EncodingPath) {
+             if err := s.header(row); err != nil {
+                 return err
+             }
+         }
+         if row.EncodingPath != s.path {
+             if !s.skipped[row.EncodingPath] {
+                 s.skipped[row.EncodingPath] = true
+                 telemetry_log.Printf("csv: skipping rows of %s, writing only %s\n", row.EncodingPath, s.path)
+             }
+             continue
+         }
+
+         fields := row.Flatten()
+         rec := []string{
+                    time.Unix(0, int64(row.Timestamp) * int64(time.Millisecond)).UTC().Format(time.RFC3339Nano),
+                    row.NodeId,
+                }
+         for _, k := range s.keys {
+             rec = append(rec, csvValue(fields["keys." + k]))
+         }
+         for _, f := range s.fields {
+             rec = append(rec, csvValue(fields["content." + f]))
+         }
+         if err := s.w.Write(rec); err != nil {
+             return err
+         }
+     }
+     // flushed after every message so that file can be opened any time
+     s.w.Flush()
+     return s.w.Error()
+}
+
+func csvValue(v interface{}) string {
+     switch v := v.(type) {
+     case nil:
+         return ""
+     case float64:
+         return strconv.FormatFloat(v, 'f', -1, 64)
+     default:
+         return fmt.Sprint(v)
+     }
+}
+
+func (s *csvSink) close() error {
+     s.w.Flush()
+     err := s.w.Error()
+     if e := s.file.Close(); err == nil {
+         err = e
+     }
+     return err
+}
@@ -3,6 +3,7 @@ package telemetry_decode
 import (
        "os"
        "os/exec"
+       "io"
        "io/ioutil"
        "log"
        "fmt"
@@ -11,16 +12,18 @@ import (
        "encoding/json"
        "unsafe"
        "strings"
-       "strconv"
-       "context"
+       "sync"
+       "time"
+       "sync/atomic"
+       "text/template"
 
        "github.com/golang/protobuf/jsonpb"
        "github.com/golang/protobuf/proto"
-
-       "github.com/elastic/go-elasticsearch"
-       "github.com/elastic/go-elasticsearch/esapi"
+       "google.golang.org/protobuf/reflect/protoreflect"
+       "google.golang.org/protobuf/types/dynamicpb"
 
        "github.com/ios-xr/telemetry-go-collector/telemetry"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
 
 )
 
@@ -32,16 +35,57 @@ const tmpFileName                = "telemetry-msg-*.dat"
 ///////     O U T P U T   M E S S A G E   H A N D L E R         ///////
 ///////////////////////////////////////////////////////////////////////
 type MdtOut struct {
+     Name       string
+     // CreateSubs request id of dialin subscription
+     ReqId      int64
+     Router     string
+     Subscription string
      OutFile    string
+     OutCompress string
+     OutFormat  string
+     TableFields string
      Encoding   string
      Decode_raw bool
      DontClean  bool
      ProtoFile  string
      PluginDir  string
      PluginFile string
+     // peer address and transport of dialout sessions, and whether json
+     // output is wrapped with them
+     Source     string
+     Transport  string
+     Envelope   bool
+     // os family of dialout routers, xr, xe or nxos
+     Platform   string
+     // router protos are fetched from, with -descriptor_cache
+     ProtoSource MdtProtoSource
      DataChan   <-chan []byte
      oFile      *os.File
-     esClient   *elasticsearch.Client
+     zWriter    mdtCompressWriter
+     outTmpl    *template.Template
+     outChecked int64
+     counters   *mdtOutCounters
+     sink       *mdtLockedSink
+     tableFields []string
+     received   time.Time
+     subscription string
+     // messages taken off DataChan and done with
+     handled    uint64
+     // handled when the output was closed without error
+     written    uint64
+}
+
+// messages taken off DataChan that the loop is done with, written to the
+// output or dropped
+func (o *MdtOut) Handled() uint64 {
+     return atomic.LoadUint64(&o.handled)
+}
+
+// messages handled that are known to be written out, sinks and files
+// buffer rows, so it is set once the loop has closed the output without
+// error, 0 till then
+func (o *MdtOut) Written() uint64 {
+     return atomic.LoadUint64(&o.written)
 }
 
 // message handler
@@ -64,8 +108,12 @@ type MdtOut struct {
 //       iii) if not found, write the raw content to out file
 //
 func (o *MdtOut)MdtOutLoop() {
-     var err error
-
+     if err := o.MdtOutOpen(); err != nil {
+         telemetry_log.Errorf("%s: %v, messages are dropped\n", o.Name, err)
+         for range o.DataChan {
+         }
+         return
+     }
      tmpFile, commandString := o.mdtPrepareDecoding()
      if tmpFile != nil {
          if !o.DontClean {
@@ -74,50 +122,224 @@ func (o *MdtOut)MdtOutLoop() {
          defer tmpFile.Close()
      }
      if o.oFile != nil {
-         defer o.oFile.Close()
-         fmt.Println("Out file:", o.oFile.Name())
+         telemetry_log.Println("Out file:", o.oFile.Name())
      }
+     o.counters = mdtOutRegister(o.Name, o.ReqId)
+     defer func() {
+         // unregistered once written out, a bounded run exits when no
+         // loop is registered
+         var err error
+         if o.sink != nil {
+             err = o.sink.close()
+         }
+         if cerr := o.mdtCloseOut(); err == nil {
+             err = cerr
+         }
+         if err != nil {
+             telemetry_log.Errorf("%s: failed to write out output: %v\n", o.Name, err)
+         } else {
+             atomic.StoreUint64(&o.written, o.Handled())
+         }
+         mdtOutUnregister(o.counters)
+     }()
 
+     handling := false
      for {
-         data, ok := <-o.DataChan
+         if handling {
+             // previous message is written
+             atomic.AddUint64(&o.handled, 1)
+         }
+         var data []byte
+         ok := false
+         select {
+         case data, ok = <-o.DataChan:
+         case <-mdtOutBound.stopped:
+             // bounded run is over
+         }
+         handling = ok
 
          if !ok {
              //channel might have been closed
-             fmt.Println("Done with output loop..")
+             telemetry_log.Println("Done with output loop..")
              break
          }
-         if o.Encoding == "json" {
-             o.mdtDumpJsonMessage(data)
-         } else if o.Decode_raw || (len(o.ProtoFile) != 0) {
-             // use protoc to decode
-             /* Write to tmp file and run protoc command to decode */
-             _, err = tmpFile.Write(data)
-             out, err := exec.Command("sh", "-c", commandString).CombinedOutput()
+         // wait if paused or rate limited
+         o.mdtOutWait(data)
+         if mdtChaos != nil {
+             if data, ok = o.mdtChaosMessage(data); !ok {
+                 continue
+             }
+         }
+         if !mdtOutCount() {
+             // past -max_messages, loop is stopped next
+             continue
+         }
+         o.counters.message(len(data))
+         if telemetry_log.Verbose() {
+             o.mdtLogMessage(data)
+         }
+         if mdtTui != nil {
+             o.mdtTuiMessage(data)
+         }
+         if mdtTailActive() {
+             o.mdtTailMessage(data)
+         }
+         if mdtWatchActive() {
+             o.mdtWatchMessage(data)
+         }
+
+         o.mdtHandleMessage(data, tmpFile, commandString)
+     }
+}
+
+// decode message to the output, a panic decoding it is logged and the
+// message quarantined, the loop goes on
+func (o *MdtOut)mdtHandleMessage(data []byte, tmpFile *os.File, commandString string) {
+     defer func() {
+         if r := recover(); r != nil {
+             o.counters.error()
+             telemetry_log.Errorf("%s: panic decoding message: %v\n", o.Name, r)
+             o.mdtQuarantine(data, fmt.Errorf("panic: %v", r))
+         }
+     }()
+
+     if o.sink != nil {
+         o.mdtSinkMessage(data)
+         return
+     }
+     if o.Envelope {
+         o.mdtEnvelopeMessage(data)
+     }
+     if o.OutFormat == "table" {
+         o.mdtDumpTableMessage(data)
+     } else if o.Encoding == "json" {
+         o.mdtDumpJsonMessage(data)
+     } else if o.Encoding == "jti" {
+         o.mdtDumpJtiMessage(data)
+     } else if o.Decode_raw || (len(o.ProtoFile) != 0) {
+         // use protoc to decode
+         /* Write to tmp file and run protoc command to decode */
+         tmpFile.Write(data)
+         out, err := exec.Command("sh", "-c", commandString).CombinedOutput()
+         if err != nil {
+             o.counters.error()
+             telemetry_log.Errorln("Protoc error", err, out)
+             telemetry_log.Errorln("Make sure protoc version in the $PATH is atleast 3.3.0")
+             o.mdtQuarantine(data, fmt.Errorf("protoc: %v: %s", err, out))
+         } else {
+             err := o.mdtWriteOut(string(out))
              if err != nil {
-                 fmt.Println("Protoc error", err, out)
-                 fmt.Println("Make sure protoc version in the $PATH is atleast 3.3.0")
-             } else {
-                 _, err := o.oFile.WriteString(string(out))
-                 if err != nil {
-                     fmt.Println(err)
-                 }
-                 tmpFile.Truncate(0)
-                 tmpFile.Seek(0,0)
+                 telemetry_log.Errorln(err)
              }
+             tmpFile.Truncate(0)
+             tmpFile.Seek(0,0)
+         }
+     } else {
+         telem := &telemetry.Telemetry{}
+
+         err := proto.Unmarshal(data, telem)
+         if (err != nil) {
+             o.counters.error()
+             telemetry_log.Errorln("Failed to unmarshal:", err)
+             o.mdtQuarantine(data, err)
+             return
+         }
+         if o.OutFormat == "text" {
+             o.mdtDumpTextMessage(telem)
+         } else if telem.GetDataGpb() != nil {
+             //this is gpb message
+             o.mdtDumpGPBMessage(telem, data)
          } else {
-             telem := &telemetry.Telemetry{}
+             o.mdtDumpKVGPBMessage(telem)
+         }
+     }
+}
 
-             err = proto.Unmarshal(data, telem)
-             if (err != nil) {
-                 fmt.Println("Failed to unmarshal:", err)
-             }
-             if telem.GetDataGpb() != nil {
-                 //this is gpb message
-                 o.mdtDumpGPBMessage(telem)
-             } else {
-                 o.mdtDumpKVGPBMessage(telem)
-             }
+// node, sensor path, timestamp and row count of a message, rows are not
+// decoded
+func MdtMessageHeader(encoding string, data []byte) (node, path string, timestamp uint64, rows int, err error) {
+     if encoding == "json" {
+         var hdr struct {
+             NodeId       string            `json:"node_id_str"`
+             EncodingPath string            `json:"encoding_path"`
+             MsgTimestamp uint64            `json:"msg_timestamp"`
+             DataJson     []json.RawMessage `json:"data_json"`
          }
+         if err = json.Unmarshal(data, &hdr); err != nil {
+             return
+         }
+         return hdr.NodeId, hdr.EncodingPath, hdr.MsgTimestamp, len(hdr.DataJson), nil
+     } else if encoding == "jti" {
+         r, err := mdtDecodeJtiRows(data)
+         if err != nil {
+             return "", "", 0, 0, err
+         }
+         if len(r) == 0 {
+             return "", "", 0, 0, fmt.Errorf("no rows in jti message")
+         }
+         return r[0].NodeId, r[0].EncodingPath, r[0].Timestamp, len(r), nil
+     }
+     telem := &telemetry.Telemetry{}
+     if err = proto.Unmarshal(data, telem); err != nil {
+         return
+     }
+     rows = len(telem.DataGpbkv) + len(telem.GetDataGpb().GetRow())
+     return telem.GetNodeIdStr(), telem.EncodingPath, telem.MsgTimestamp, rows, nil
+}
+
+// one line per message for -v, header fields only, rows are not decoded
+func (o *MdtOut)mdtLogMessage(data []byte) {
+     node, path, timestamp, rows, err := MdtMessageHeader(o.Encoding, data)
+     if err != nil {
+         return
+     }
+     t := time.Unix(0, int64(timestamp) * int64(time.Millisecond))
+     telemetry_log.Verbosef("%s %s %s %d rows %d bytes\n", telemetry_log.Time(t), node, telemetry_log.Path(path), rows, len(data))
+}
+
+// sensor path and collection of message, end is set if the message is
+// the last of its collection
+func MdtCollection(data []byte, encoding string) (path string, id uint64, end bool, err error) {
+     if encoding == "json" {
+         var hdr struct {
+             EncodingPath      string `json:"encoding_path"`
+             CollectionId      uint64 `json:"collection_id"`
+             CollectionEndTime uint64 `json:"collection_end_time"`
+         }
+         if err = json.Unmarshal(data, &hdr); err != nil {
+             return
+         }
+         return hdr.EncodingPath, hdr.CollectionId, hdr.CollectionEndTime != 0, nil
+     }
+     telem := &telemetry.Telemetry{}
+     if err = proto.Unmarshal(data, telem); err != nil {
+         return
+     }
+     return telem.EncodingPath, telem.CollectionId, telem.CollectionEndTime != 0, nil
+}
+
+// decode message to rows and write to sink
+func (o *MdtOut)mdtSinkMessage(data []byte) {
+     if raw, err := o.sink.writeRaw(data, o.Encoding); raw {
+         if err != nil {
+             o.counters.error()
+             telemetry_log.Errorln("Failed to write message:", err)
+         }
+         return
+     }
+     rows, err := o.mdtDecodeRows(data)
+     if err != nil {
+         o.counters.error()
+         telemetry_log.Errorln("Failed to decode rows:", err)
+         o.mdtQuarantine(data, err)
+         return
+     }
+     if mdtDedup != nil {
+         rows = mdtDedupRows(rows)
+     }
+     if err = o.sink.writeRows(rows); err != nil {
+         o.counters.error()
+         telemetry_log.Errorln("Failed to write rows:", err)
      }
 }
 
@@ -125,34 +347,38 @@ func (o *MdtOut)MdtOutSetEncoding(encoding string) {
      o.Encoding = encoding
 }
 
+// write to output file, compressed output is flushed after every message
+// so that file can be read while collector is still running
+func (o *MdtOut)mdtWriteOut(s string) error {
+     if o.outTmpl != nil {
+         if err := o.mdtRotateOut(); err != nil {
+             return err
+         }
+     }
+     if o.zWriter != nil {
+         _, err := io.WriteString(o.zWriter, s)
+         if err != nil {
+             return err
+         }
+         return o.zWriter.Flush()
+     }
+     _, err := o.oFile.WriteString(s)
+     return err
+}
+
 // json walk and dump
 func (o *MdtOut)mdtDumpJsonMessage(copy []byte) {
     var prettyJSON bytes.Buffer
 
-    if o.esClient != nil {
-        m := make(map[string]interface{})
-        err := json.Unmarshal(copy, &m)
-        if err != nil {
-            log.Fatal(err)
-        }
-
-        for i, row := range m["data_json"].([]interface{}) {
-            j, _ :=  json.Marshal(row)
-            o.elasticSearchOutput(string(j),
-                                m["encoding_path"].(string),
-                                m["node_id_str"].(string),
-                                m["collection_id"].(string),
-                                i)
-        }
+    err := json.Indent(&prettyJSON, copy, "", "\t")
+    if err != nil {
+        o.counters.error()
+        telemetry_log.Errorln("JSON parse error: ", err)
+        o.mdtQuarantine(copy, err)
     } else {
-        err := json.Indent(&prettyJSON, copy, "", "\t")
+        err = o.mdtWriteOut(o.mdtEnvelope(string(prettyJSON.Bytes()), "\t"))
         if err != nil {
-            fmt.Println("JSON parse error: ", err)
-        } else {
-            _, err = o.oFile.WriteString(string(prettyJSON.Bytes()))
-            if err != nil {
-                fmt.Println(err)
-            }
+            telemetry_log.Errorln(err)
         }
     }
 }
@@ -160,31 +386,39 @@ func (o *MdtOut)mdtDumpJsonMessage(copy []byte) {
 // kvgpb walk and dump
 func (o *MdtOut)mdtDumpKVGPBMessage(copy *telemetry.Telemetry) {
 
-    if o.esClient != nil {
-        for i, row := range copy.GetDataGpbkv() {
-            j, _ :=  json.Marshal(row)
-            o.elasticSearchOutput(string(j),
-                                copy.GetEncodingPath(),
-                                copy.GetNodeIdStr(),
-                                strconv.FormatUint(copy.GetCollectionId(), 10),
-                                i)
-        }
-    } else {
-        j, _ :=  json.MarshalIndent(copy, "", "  ")
-        _, err := o.oFile.WriteString(string(j))
-        if err != nil {
-            fmt.Println(err)
-        }
+    j, _ :=  json.MarshalIndent(copy, "", "  ")
+    err := o.mdtWriteOut(o.mdtEnvelope(string(j), "  "))
+    if err != nil {
+        telemetry_log.Errorln(err)
     }
 }
 
 // plugin info
 type gpbPluginInfo struct {
      plug           *plugin.Plugin
+     // messages of the plugin, or descriptors of a compiled proto, rows
+     // are decoded into new messages of them, sessions decode concurrently
      decodedKeys     proto.Message
      decodedContent  proto.Message
+     keysDesc        protoreflect.MessageDescriptor
+     contentDesc     protoreflect.MessageDescriptor
+     // decoder plugin, instead of the messages
+     decoder         MdtDecoder
+}
+
+// new keys and content messages to decode a row into, nil if there are
+// none
+func (p *gpbPluginInfo) messages() (proto.Message, proto.Message) {
+     if p.keysDesc != nil && p.contentDesc != nil {
+         return proto.MessageV1(dynamicpb.NewMessage(p.keysDesc)), proto.MessageV1(dynamicpb.NewMessage(p.contentDesc))
+     }
+     if p.decodedKeys == nil || p.decodedContent == nil {
+         return nil, nil
+     }
+     return proto.MessageV1(proto.MessageReflect(p.decodedKeys).New()), proto.MessageV1(proto.MessageReflect(p.decodedContent).New())
 }
 
+var pluginMu  sync.Mutex
 var pluginTbl map[string]*gpbPluginInfo
 
 // Message type (including header and rows) used for serialisation
@@ -202,19 +436,20 @@ type rowToSerialise struct {
      Content   *json.RawMessage
 }
 
-// try to find plugin to decode the gpb content
-func (o *MdtOut)mdtDumpGPBMessage(copy *telemetry.Telemetry) {
+// try to find plugin to decode the gpb content, data is the message as
+// received, quarantined if a row fails to decode
+func (o *MdtOut)mdtDumpGPBMessage(copy *telemetry.Telemetry, data []byte) {
      var err error
      var s msgToSerialise
 
-     gpbPlugin := mdtGetPlugin(copy.EncodingPath, o.PluginDir, o.PluginFile)
+     gpbPlugin := o.mdtGpbPlugin(copy.EncodingPath)
 
 
      if gpbPlugin == nil {
         j, _ :=  json.MarshalIndent(copy, "", "  ")
-        _, err = o.oFile.WriteString(string(j))
+        err = o.mdtWriteOut(o.mdtEnvelope(string(j), "  "))
         if err != nil {
-           fmt.Println("Error writing the output", err)
+           telemetry_log.Errorln("Error writing the output", err)
         }
         return
      }
@@ -224,69 +459,79 @@ func (o *MdtOut)mdtDumpGPBMessage(copy *telemetry.Telemetry) {
                    OrigName:           true}
 
 
-     for i, row := range copy.GetDataGpb().GetRow() {
-         err = proto.Unmarshal(row.Keys, gpbPlugin.decodedKeys)
+     for _, row := range copy.GetDataGpb().GetRow() {
+         if gpbPlugin.decoder != nil {
+            keys, content, err := mdtDecoderRow(gpbPlugin.decoder, row.Keys, row.Content)
+            if err != nil {
+               o.counters.error()
+               telemetry_log.Errorln("decoder plugin failed", err)
+               o.mdtQuarantine(data, fmt.Errorf("decoder plugin: %v", err))
+               return
+            }
+            s.Rows = append(s.Rows, &rowToSerialise{row.Timestamp, &keys, &content})
+            continue
+         }
+         decodedKeys, decodedContent := gpbPlugin.messages()
+         if decodedKeys == nil {
+            o.counters.error()
+            telemetry_log.Errorln("plugin has no keys and content messages of", copy.EncodingPath)
+            return
+         }
+         err = proto.Unmarshal(row.Keys, decodedKeys)
          if (err != nil) {
-            fmt.Println("plugin unmarshal failed", err)
+            o.counters.error()
+            telemetry_log.Errorln("plugin unmarshal failed", err)
+            o.mdtQuarantine(data, fmt.Errorf("plugin unmarshal: %v", err))
             return
          }
 
-         err = proto.Unmarshal(row.Content, gpbPlugin.decodedContent)
+         err = proto.Unmarshal(row.Content, decodedContent)
          if (err != nil) {
-            fmt.Println("plugin unmarshal failed", err)
+            o.counters.error()
+            telemetry_log.Errorln("plugin unmarshal failed", err)
+            o.mdtQuarantine(data, fmt.Errorf("plugin unmarshal: %v", err))
             return
          }
 
          var keys      json.RawMessage
          var content   json.RawMessage
 
-         decodedContentJSON, err := marshaller.MarshalToString(gpbPlugin.decodedContent)
+         decodedContentJSON, err := marshaller.MarshalToString(decodedContent)
          if err != nil {
-             fmt.Println(err)
+             telemetry_log.Errorln(err)
          } else {
             content = json.RawMessage(decodedContentJSON)
          }
 
-         decodedKeysJSON, err := marshaller.MarshalToString(gpbPlugin.decodedKeys)
+         decodedKeysJSON, err := marshaller.MarshalToString(decodedKeys)
          if err != nil {
-             fmt.Println(err)
+             telemetry_log.Errorln(err)
          } else {
              keys = json.RawMessage(decodedKeysJSON)
          }
 
          s.Rows = append(s.Rows, &rowToSerialise{row.Timestamp, &keys, &content})
+     }
+
+    copy.DataGpb = nil
+    telemetryJSON, err := marshaller.MarshalToString(copy)
+    if err != nil {
+        return
+    }
+    telemetryJSONRaw := json.RawMessage(telemetryJSON)
+    s.Telemetry = &telemetryJSONRaw
 
-         if o.esClient != nil {
-            b, _ := json.Marshal(&rowToSerialise{row.Timestamp, &keys, &content})
-            o.elasticSearchOutput(string(b),
-                                copy.GetEncodingPath(),
-                                copy.GetNodeIdStr(),
-                                strconv.FormatUint(copy.GetCollectionId(), 10),
-                                i)
-         }
-     }
-
-    if o.esClient == nil {
-       copy.DataGpb = nil
-       telemetryJSON, err := marshaller.MarshalToString(copy)
-       if err != nil {
-           return
-       }
-       telemetryJSONRaw := json.RawMessage(telemetryJSON)
-       s.Telemetry = &telemetryJSONRaw
-
-       b, err := json.Marshal(s)
-       if err != nil {
-           fmt.Errorf("Marshalling collected content, [%+v][%+v]",
-                          s, err)
-       }
-
-       var out bytes.Buffer
-       json.Indent(&out, b, "", "    ")
-       _, err = o.oFile.WriteString(out.String())
-       if err != nil {
-           fmt.Println("Error writing the output", err)
-       }
+    b, err := json.Marshal(s)
+    if err != nil {
+        fmt.Errorf("Marshalling collected content, [%+v][%+v]",
+                       s, err)
+    }
+
+    var out bytes.Buffer
+    json.Indent(&out, b, "", "    ")
+    err = o.mdtWriteOut(o.mdtEnvelope(out.String(), "    "))
+    if err != nil {
+        telemetry_log.Errorln("Error writing the output", err)
     }
 
 }
@@ -309,16 +554,21 @@ func mdtGetPlugin(encodingPath string, pluginDir string, pluginFile string) *gpb
      var plug            *plugin.Plugin
      var err             error
 
+     // sessions look plugins up concurrently
+     pluginMu.Lock()
+     defer pluginMu.Unlock()
      if pluginTbl == nil {
         pluginTbl = make(map[string]*gpbPluginInfo)
      }
 
+     // a path without plugin is kept too, not looked up for every message
      p, ok := pluginTbl[encodingPath]
      if !ok {
         if pluginFile != "" {
             plug, err = plugin.Open(pluginFile)
             if (err != nil) {
-                fmt.Println("plugin open failed", err)
+                telemetry_log.Errorln("plugin open failed", err)
+                pluginTbl[encodingPath] = nil
                 return nil
             }
             symStr := strings.ToLower(encodingPath)
@@ -328,12 +578,14 @@ func mdtGetPlugin(encodingPath string, pluginDir string, pluginFile string) *gpb
 
             symKey, err := plug.Lookup("KEYS_" + symStr)
             if (err != nil) {
-                fmt.Println("plugin symbol not found", err)
+                telemetry_log.Errorln("plugin symbol not found", err)
+                pluginTbl[encodingPath] = nil
                 return nil
             }
             symContent, err := plug.Lookup("CONTENT_" + symStr)
             if (err != nil) {
-                fmt.Println("plugin symbol not found", err)
+                telemetry_log.Errorln("plugin symbol not found", err)
+                pluginTbl[encodingPath] = nil
                 return nil
             }
             decodedKeys, _ = symKey.(proto.Message)
@@ -345,7 +597,8 @@ func mdtGetPlugin(encodingPath string, pluginDir string, pluginFile string) *gpb
             }
             plug, err = plugin.Open(pluginDir + pluginFileName)
             if (err != nil) {
-                fmt.Println("plugin open failed", err)
+                telemetry_log.Errorln("plugin open failed", err)
+                pluginTbl[encodingPath] = nil
                 return nil
             }
 
@@ -359,7 +612,7 @@ func mdtGetPlugin(encodingPath string, pluginDir string, pluginFile string) *gpb
             }
         }
 
-        p = &gpbPluginInfo{plug, decodedKeys, decodedContent}
+        p = &gpbPluginInfo{plug: plug, decodedKeys: decodedKeys, decodedContent: decodedContent}
         pluginTbl[encodingPath] = p
      }
      return p
@@ -372,25 +625,86 @@ func mdtGetPluginFileName(encodingPath string) string {
 }
 
 // create tmp and output file
+// open the sink of -out, if it is one. Sessions call it before starting
+// the output loop so that a sink failing to open fails only the session,
+// the loop opens it otherwise.
+func (o *MdtOut) MdtOutOpen() error {
+     if o.sink != nil || !mdtIsSink(o.OutFile) {
+         return nil
+     }
+     name := strings.SplitN(o.OutFile, ":", 2)[0]
+     sink, err := mdtOpenSink(o.OutFile)
+     if err != nil {
+         return fmt.Errorf("Failed to open %s output: %v", name, err)
+     }
+     o.sink = sink
+     if mdtRedact != nil && !o.mdtRedacted() {
+         o.sink.close()
+         o.sink = nil
+         return fmt.Errorf("-redact: %s output writes messages as received, they cannot be redacted", name)
+     }
+     return nil
+}
+
 func (o *MdtOut)mdtPrepareDecoding() (*os.File, string) {
      var commandString string
      var err error
 
-     outN := strings.SplitN(o.OutFile, ":", 2)
-     if outN[0] == "elasticsearch" {
-        o.esClient = elasticSearchClientInit("http://" + outN[1])
+     if err = o.mdtCheckFormat(); err != nil {
+        log.Fatal(err)
+     }
+     if o.OutFormat == "table" && len(o.TableFields) != 0 {
+        o.tableFields = strings.Split(o.TableFields, ",")
+     }
+
+     if mdtIsSink(o.OutFile) {
+        // opened by MdtOutOpen
         return nil, ""
      }
 
+     if mdtRedact != nil && !o.mdtRedacted() {
+         log.Fatal("-redact: messages written as they are cannot be redacted, write rows with a sink, csv:<file> etc, or -format table")
+     }
+
      // create/open output file
-     if len(o.OutFile) != 0 {
-         o.oFile, err = ioutil.TempFile(".", o.OutFile)
+     if mdtIsOutTemplate(o.OutFile) {
+         // opened on first message
+         err = o.mdtParseOutTemplate()
+         if (err != nil) {
+             log.Fatal("Failed to parse output file template ", err)
+         }
+     } else if len(o.OutFile) != 0 {
+         // random part replaces the last * of -out, or is added to it,
+         // before the compression and encryption suffixes
+         pattern := o.OutFile
+         if !strings.Contains(pattern, "*") {
+             pattern += "*"
+         }
+         o.oFile, err = ioutil.TempFile(".", pattern + mdtCompressSuffix(o.OutCompress) + mdtEncryptSuffix())
          if (err != nil) {
              log.Fatal("Failed to create output file for writing", err)
          }
+     } else if mdtTui != nil {
+         // screen belongs to live view
+         o.oFile, err = os.OpenFile(os.DevNull, os.O_WRONLY, 0)
+         if (err != nil) {
+             log.Fatal("Failed to open ", os.DevNull, err)
+         }
      } else {
          o.oFile = os.Stdout
      }
+     if len(o.OutFile) != 0 && o.oFile != nil {
+         o.zWriter, err = mdtNewFileWriter(o.oFile, o.OutCompress)
+         if (err != nil) {
+             log.Fatal("Failed to setup output compression ", err)
+         }
+     } else if len(o.OutCompress) != 0 && o.oFile != nil {
+         // stdout is compressed, not encrypted
+         o.zWriter, err = mdtNewCompressWriter(o.oFile, o.OutCompress)
+         if (err != nil) {
+             log.Fatal("Failed to setup output compression ", err)
+         }
+     }
 
      if o.Decode_raw || (len(o.ProtoFile) != 0) {
          // temp file to write message to for decoding
@@ -410,82 +724,3 @@ func (o *MdtOut)mdtPrepareDecoding() (*os.File, string) {
 
      return nil, ""
 }
-
-var replacer = strings.NewReplacer("/", "_", ":", "_")
-
-// elastic search functions
-func (o *MdtOut)elasticSearchOutput(data string, index string, node_id string, coll_id string, i int) {
-     if o.esClient != nil {
-
-        req := esapi.IndexRequest{
-            Index:      strings.ToLower(replacer.Replace(index)),
-            DocumentID: fmt.Sprintf("%s.%s.%d", node_id, coll_id, i),
-            Body:       strings.NewReader(data),
-            Refresh:    "true",
-        }
-
-        // Perform the request with the client.
-        res, err := req.Do(context.Background(), o.esClient)
-        if err != nil {
-           log.Fatalf("Error getting response: %s", err)
-        }
-        defer res.Body.Close()
-
-        if res.IsError() {
-           log.Printf("[%s] Error indexing document", res.Status())
-        } else {
-           // Deserialize the response into a map.
-           var r map[string]interface{}
-           if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-              log.Printf("Error parsing the response body: %s", err)
-           } else {
-              // Print the response status and indexed document version.
-              log.Printf("[%s] %s; version=%d", res.Status(), r["result"], int(r["_version"].(float64)))
-           }
-        }
-
-     } else {
-        // last resort, dump to stdout
-        fmt.Println(data)
-     }
-}
-
-func elasticSearchClientInit(esServer string) *elasticsearch.Client {
-     var r  map[string]interface{}
-
-     //esServer := "http://localhost:9200"
-
-     // Initialize a client with the default settings.
-     // An `ELASTICSEARCH_URL` environment variable will be used when exported.
-     //es, err := elasticsearch.NewDefaultClient()
-     cfg := elasticsearch.Config{
-                Addresses: []string{
-                           esServer,
-                },
-            }
-     es, err := elasticsearch.NewClient(cfg)
-
-     if err != nil {
-        log.Fatalf("Error creating the client: %s", err)
-     }
-
-     // 1. Get cluster info
-     //
-     res, err := es.Info()
-     if err != nil {
-        log.Fatalf("Error getting response: %s", err)
-     }
-     // Check response status
-     if res.IsError() {
-        log.Fatalf("Error: %s", res.String())
-     }
-     // Deserialize the response into a map.
-     if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
-        log.Fatalf("Error parsing the response body: %s", err)
-     }
-     // Print client and server version numbers.
-     log.Printf("Client: %s", elasticsearch.Version)
-     log.Printf("Server: %s", r["version"].(map[string]interface{})["number"])
-     log.Println(strings.Repeat("~", 37))
-     return es
-}
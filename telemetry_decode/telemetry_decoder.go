@@ -0,0 +1,139 @@
+package telemetry_decode
+
+import (
+       "encoding/json"
+       "path/filepath"
+       "plugin"
+       "reflect"
+       "sync"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// Decoder plugins decode keys and content of gpb rows of the sensor paths
+// they match, with any decoding of their own, not only generated protos.
+// A decoder plugin exports its version and a decoder,
+//   var DecoderVersion = 1
+//   var Decoder = &myDecoder{}
+// with the methods of MdtDecoder, so plugins do not import the collector.
+// Plugins of -plugin and the .so files at top of -plugin_dir are decoder
+// plugins if they export Decoder, first one matching a sensor path
+// decodes it. Plugins of another version, and sensor paths no decoder
+// matches, fall back to the proto symbols of -plugin, KEYS_<path> and
+// CONTENT_<path>, or of <path>/plugin/plugin.so under -plugin_dir.
+
+// version of MdtDecoder plugins are loaded with
+const MdtDecoderVersion = 1
+
+type MdtDecoder interface {
+     Match(encodingPath string) bool
+     // values returned are marshalled as json
+     DecodeKeys(data []byte) (interface{}, error)
+     DecodeContent(data []byte) (interface{}, error)
+}
+
+var decodersOnce sync.Once
+var decoders     []MdtDecoder
+
+// decoders of programs built with the collector packages, tried before
+// decoder plugins
+var registeredMu       sync.Mutex
+var registeredDecoders []MdtDecoder
+
+// decoder used for the sensor paths it matches from now on, as a decoder
+// plugin, without building one
+func MdtRegisterDecoder(d MdtDecoder) {
+     registeredMu.Lock()
+     registeredDecoders = append(registeredDecoders, d)
+     registeredMu.Unlock()
+}
+
+// decoder of sensor path, nil if no decoder plugin matches
+func mdtGetDecoder(encodingPath string, pluginDir string, pluginFile string) MdtDecoder {
+     registeredMu.Lock()
+     for _, d := range registeredDecoders {
+         if d.Match(encodingPath) {
+             registeredMu.Unlock()
+             return d
+         }
+     }
+     registeredMu.Unlock()
+     decodersOnce.Do(func() {
+         var files []string
+         if pluginFile != "" {
+             files = append(files, pluginFile)
+         }
+         if pluginDir != "" {
+             found, _ := filepath.Glob(filepath.Join(pluginDir, "*.so"))
+             files = append(files, found...)
+         }
+         for _, file := range files {
+             if d := mdtLoadDecoder(file); d != nil {
+                 decoders = append(decoders, d)
+             }
+         }
+     })
+     for _, d := range decoders {
+         if d.Match(encodingPath) {
+             return d
+         }
+     }
+     return nil
+}
+
+func mdtLoadDecoder(file string) MdtDecoder {
+     plug, err := plugin.Open(file)
+     if err != nil {
+         telemetry_log.Errorln("plugin open failed", err)
+         return nil
+     }
+     sym, err := plug.Lookup("Decoder")
+     if err != nil {
+         // plugin of proto symbols
+         return nil
+     }
+     version := 0
+     if v, err := plug.Lookup("DecoderVersion"); err == nil {
+         if p, ok := v.(*int); ok {
+             version = *p
+         }
+     }
+     if version != MdtDecoderVersion {
+         telemetry_log.Errorf("Decoder plugin %s is version %d, version %d is supported, not used\n", file, version, MdtDecoderVersion)
+         return nil
+     }
+     // symbol of a variable is a pointer to it
+     d, ok := sym.(MdtDecoder)
+     if !ok {
+         if v := reflect.ValueOf(sym); v.Kind() == reflect.Ptr && !v.IsNil() {
+             d, ok = v.Elem().Interface().(MdtDecoder)
+         }
+     }
+     if !ok {
+         telemetry_log.Errorf("Decoder of plugin %s does not have the decoder methods, not used\n", file)
+         return nil
+     }
+     telemetry_log.Printf("Loaded decoder plugin %s\n", file)
+     return d
+}
+
+// keys and content of row as json
+func mdtDecoderRow(d MdtDecoder, keys, content []byte) (json.RawMessage, json.RawMessage, error) {
+     k, err := d.DecodeKeys(keys)
+     if err != nil {
+         return nil, nil, err
+     }
+     c, err := d.DecodeContent(content)
+     if err != nil {
+         return nil, nil, err
+     }
+     kj, err := json.Marshal(k)
+     if err != nil {
+         return nil, nil, err
+     }
+     cj, err := json.Marshal(c)
+     if err != nil {
+         return nil, nil, err
+     }
+     return kj, cj, nil
+}
@@ -0,0 +1,153 @@
+package telemetry_decode
+
+import (
+       "context"
+       "crypto/sha256"
+       "encoding/hex"
+       "encoding/json"
+       "fmt"
+       "net/url"
+       "strconv"
+       "sync"
+       "time"
+
+       "github.com/redis/go-redis/v9"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////           D U P L I C A T E   S U P P R E S S I O N     ///////
+///////////////////////////////////////////////////////////////////////
+// With -dedup, a row written to a sink is dropped if a row of the same
+// node, sensor path, keys and timestamp was written within the window, so
+// sinks see a row once when two sessions, or two collectors, get the same
+// stream for redundancy. Rows seen are kept in memory, or in Redis, shared
+// by all the collectors using it,
+//   -dedup memory
+//   -dedup redis:<host:port>[?db=..&user=..&password=..&tls=true&ca=..]
+// Redis keys are mdt:dedup:<hash>, set with the window as expiry. If Redis
+// fails rows are written, a duplicate is better than a gap. Raw outputs,
+// relay, get every message.
+
+var mdtDedup mdtDedupStore
+
+type mdtDedupStore interface {
+     // true for hashes not seen within window, they are recorded as seen
+     first(hashes []string) ([]bool, error)
+}
+
+// rows are deduplicated from now on
+func MdtDedupSetup(spec string, window time.Duration) error {
+     if window <= 0 {
+         return fmt.Errorf("dedup window must be more than 0")
+     }
+     if spec == "memory" {
+         mdtDedup = &mdtDedupMemory{window: window, seen: make(map[string]time.Time)}
+         return nil
+     }
+     u, err := url.Parse(spec)
+     if err != nil || u.Scheme != "redis" {
+         return fmt.Errorf("expected -dedup memory or redis:<host:port>")
+     }
+     address := u.Opaque
+     if address == "" {
+         address = u.Host
+     }
+     client, err := mdtRedisClient(address, u.Query())
+     if err != nil {
+         return err
+     }
+     ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+     defer cancel()
+     if err = client.Ping(ctx).Err(); err != nil {
+         client.Close()
+         return err
+     }
+     mdtDedup = &mdtDedupRedis{client: client, window: window}
+     return nil
+}
+
+// hash of node, sensor path, keys and timestamp of row
+func mdtDedupHash(row *MdtRow) string {
+     // maps are marshalled with sorted keys
+     keys, _ := json.Marshal(row.Keys)
+     h := sha256.New()
+     h.Write([]byte(row.NodeId + "\x00" + row.EncodingPath + "\x00"))
+     h.Write(keys)
+     h.Write([]byte("\x00" + strconv.FormatUint(row.Timestamp, 10)))
+     return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// rows not seen before
+func mdtDedupRows(rows []*MdtRow) []*MdtRow {
+     hashes := make([]string, len(rows))
+     for i, row := range rows {
+         hashes[i] = mdtDedupHash(row)
+     }
+     first, err := mdtDedup.first(hashes)
+     if err != nil {
+         telemetry_log.Errorln("Dedup:", err)
+         return rows
+     }
+     var out []*MdtRow
+     for i, row := range rows {
+         if first[i] {
+             out = append(out, row)
+         }
+     }
+     return out
+}
+
+type mdtDedupMemory struct {
+     mu     sync.Mutex
+     window time.Duration
+     seen   map[string]time.Time
+     pruned time.Time
+}
+
+func (d *mdtDedupMemory) first(hashes []string) ([]bool, error) {
+     d.mu.Lock()
+     defer d.mu.Unlock()
+     now := time.Now()
+     if now.Sub(d.pruned) > d.window {
+         for h, t := range d.seen {
+             if now.Sub(t) > d.window {
+                 delete(d.seen, h)
+             }
+         }
+         d.pruned = now
+     }
+     first := make([]bool, len(hashes))
+     for i, h := range hashes {
+         if t, ok := d.seen[h]; !ok || now.Sub(t) > d.window {
+             first[i] = true
+             d.seen[h] = now
+         }
+     }
+     return first, nil
+}
+
+type mdtDedupRedis struct {
+     client *redis.Client
+     window time.Duration
+}
+
+// SET NX of all the hashes in one pipeline
+func (d *mdtDedupRedis) first(hashes []string) ([]bool, error) {
+     ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+     defer cancel()
+     pipe := d.client.Pipeline()
+     cmds := make([]*redis.BoolCmd, len(hashes))
+     for i, h := range hashes {
+         cmds[i] = pipe.SetNX(ctx, "mdt:dedup:" + h, 1, d.window)
+     }
+     if _, err := pipe.Exec(ctx); err != nil {
+         return nil, err
+     }
+     first := make([]bool, len(hashes))
+     for i, cmd := range cmds {
+         first[i] = cmd.Val()
+     }
+     return first, nil
+}
@@ -0,0 +1,198 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "io/ioutil"
+       "os"
+       "os/exec"
+       "path/filepath"
+       "strings"
+       "sync"
+
+       protov2 "google.golang.org/protobuf/proto"
+       "google.golang.org/protobuf/reflect/protodesc"
+       "google.golang.org/protobuf/reflect/protoreflect"
+       "google.golang.org/protobuf/types/descriptorpb"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// Rows of gpb messages without a plugin are decoded with the proto of
+// their sensor path, fetched from the router and compiled by protoc into
+// a descriptor set. Descriptor sets are kept in the cache directory, by
+// router version and sensor path,
+//   <dir>/<version>/cisco_ios_xr_cdp_oper/cdp/nodes/node/neighbors/details/detail.pb
+// so restarts, and sessions to routers of the same version, find them
+// without GetProtoFile rpc or protoc. Protos are fetched only when a
+// source, a dialin session, is given. A sensor path that failed is not
+// tried again till restart.
+
+// source of protos of sensor paths, the router of a session
+type MdtProtoSource interface {
+     // software version of the router, descriptors are kept per version
+     Version() string
+     GetProto(yangPath string) (string, error)
+}
+
+var mdtDescriptorCache string
+
+// descriptor of a sensor path and version, ready once done is closed.
+// Sessions wanting one being fetched wait on it, others go on.
+type descriptorEntry struct {
+     done chan struct{}
+     p    *gpbPluginInfo
+}
+
+// held only for the map, not for fetching and compiling
+var descriptorMu  sync.Mutex
+var descriptorTbl = map[string]*descriptorEntry{}
+
+// cache directory, descriptors are compiled and used from now on
+func MdtDescriptorCacheSetup(dir string) error {
+     if err := os.MkdirAll(dir, 0755); err != nil {
+         return err
+     }
+     mdtDescriptorCache = dir
+     return nil
+}
+
+// decoder plugin of sensor path, proto plugin, messages of its cached
+// descriptor set, or -wasm_decoder
+func (o *MdtOut)mdtGpbPlugin(encodingPath string) *gpbPluginInfo {
+     if d := mdtGetDecoder(encodingPath, o.PluginDir, o.PluginFile); d != nil {
+         return &gpbPluginInfo{decoder: d}
+     }
+     if p := o.mdtProtoPlugin(encodingPath); p != nil {
+         return p
+     }
+     if mdtWasmDecoder != nil {
+         return &gpbPluginInfo{decoder: &mdtWasmPathDecoder{w: mdtWasmDecoder, path: encodingPath}}
+     }
+     return nil
+}
+
+// proto plugin of sensor path, or messages of its cached descriptor set
+func (o *MdtOut)mdtProtoPlugin(encodingPath string) *gpbPluginInfo {
+     if mdtDescriptorCache == "" || o.ProtoSource == nil || o.PluginDir != "" || o.PluginFile != "" {
+         return mdtGetPlugin(encodingPath, o.PluginDir, o.PluginFile)
+     }
+     version := o.ProtoSource.Version()
+     key := version + " " + encodingPath
+
+     descriptorMu.Lock()
+     e, ok := descriptorTbl[key]
+     if ok {
+         descriptorMu.Unlock()
+         <-e.done
+         return e.p
+     }
+     e = &descriptorEntry{done: make(chan struct{})}
+     descriptorTbl[key] = e
+     descriptorMu.Unlock()
+     // closed on a panic too, recovered by the output loop
+     defer close(e.done)
+
+     file := filepath.Join(mdtDescriptorCache, mdtPathName(version), mdtDescriptorFileName(encodingPath))
+     var err error
+     if e.p, err = mdtDescriptorPlugin(file, encodingPath, o.ProtoSource); err != nil {
+         telemetry_log.Errorf("No descriptor for %s: %v\n", encodingPath, err)
+     }
+     return e.p
+}
+
+func mdtDescriptorPlugin(file, encodingPath string, source MdtProtoSource) (*gpbPluginInfo, error) {
+     b, err := ioutil.ReadFile(file)
+     if os.IsNotExist(err) {
+         telemetry_log.Printf("Fetching proto of %s\n", encodingPath)
+         var protoContent string
+         if protoContent, err = source.GetProto(encodingPath); err != nil {
+             return nil, err
+         }
+         if b, err = mdtCompileProto(protoContent); err != nil {
+             return nil, err
+         }
+         if err = mdtWriteDescriptor(file, b); err != nil {
+             telemetry_log.Errorf("Failed to cache descriptor of %s: %v\n", encodingPath, err)
+         }
+     } else if err != nil {
+         return nil, err
+     }
+
+     set := &descriptorpb.FileDescriptorSet{}
+     if err = protov2.Unmarshal(b, set); err != nil {
+         return nil, fmt.Errorf("%s: %v", file, err)
+     }
+     files, err := protodesc.NewFiles(set)
+     if err != nil {
+         return nil, fmt.Errorf("%s: %v", file, err)
+     }
+     // row messages are <name>_KEYS and <name>
+     var keys, content protoreflect.MessageDescriptor
+     files.RangeFiles(func(f protoreflect.FileDescriptor) bool {
+         msgs := f.Messages()
+         for i := 0; i < msgs.Len(); i++ {
+             name := string(msgs.Get(i).Name())
+             if strings.HasSuffix(name, "_KEYS") {
+                 keys = msgs.Get(i)
+                 content = msgs.ByName(protoreflect.Name(strings.TrimSuffix(name, "_KEYS")))
+             }
+         }
+         return keys == nil
+     })
+     if keys == nil || content == nil {
+         return nil, fmt.Errorf("%s: no _KEYS and content messages", file)
+     }
+     return &gpbPluginInfo{keysDesc: keys, contentDesc: content}, nil
+}
+
+// descriptor set of proto, by protoc
+func mdtCompileProto(protoContent string) ([]byte, error) {
+     dir, err := ioutil.TempDir("", "telemetry-proto-")
+     if err != nil {
+         return nil, err
+     }
+     defer os.RemoveAll(dir)
+     if err = ioutil.WriteFile(filepath.Join(dir, "sensor.proto"), []byte(protoContent), 0644); err != nil {
+         return nil, err
+     }
+     out := filepath.Join(dir, "sensor.pb")
+     cmd := exec.Command("protoc", "-I", dir, "--include_imports", "--descriptor_set_out=" + out, "sensor.proto")
+     if msg, err := cmd.CombinedOutput(); err != nil {
+         return nil, fmt.Errorf("protoc: %v %s", err, strings.TrimSpace(string(msg)))
+     }
+     return ioutil.ReadFile(out)
+}
+
+// written whole, other collectors sharing the cache read it or nothing
+func mdtWriteDescriptor(file string, b []byte) error {
+     if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+         return err
+     }
+     tmp := file + ".tmp" + fmt.Sprint(os.Getpid())
+     if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+         return err
+     }
+     return os.Rename(tmp, file)
+}
+
+// sensor path as cache file, as plugin directories are named
+func mdtDescriptorFileName(encodingPath string) string {
+     str := strings.ToLower(encodingPath)
+     str = strings.Replace(str, "-", "_", -1)
+     str = strings.Replace(str, ":", "/", 1)
+     return mdtPathName(str) + ".pb"
+}
+
+// name safe as file path, no .. or empty elements
+func mdtPathName(s string) string {
+     var elems []string
+     for _, e := range strings.Split(s, "/") {
+         if e != "" && e != "." && e != ".." {
+             elems = append(elems, e)
+         }
+     }
+     if len(elems) == 0 {
+         return "unknown"
+     }
+     return filepath.Join(elems...)
+}
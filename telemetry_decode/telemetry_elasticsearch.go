@@ -0,0 +1,296 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sync"
+       "bytes"
+       "strings"
+       "strconv"
+       "net/url"
+       "net/http"
+       "io/ioutil"
+       "hash/fnv"
+       "encoding/json"
+       "text/template"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////    E L A S T I C S E A R C H / O P E N S E A R C H   S I N K  ///////
+///////////////////////////////////////////////////////////////////////
+// -out elasticsearch:<host:port>[?index=..&batch=..&flush=..&user=..&password=..]
+// -out opensearch:<host:port>, same as elasticsearch
+// Rows are indexed with the bulk api, a request is sent when it has batch
+// rows (default 1000) or every flush interval (default 5s). Index name is
+// a template, default {{.Path}}, fields are
+//   .Path          sensor path, lower case, "/" and ":" replaced by "_"
+//   .Node          node the row is from
+//   .Date          2006.01.02 of the row time, mdt-{{.Date}} for daily indices
+// Document id is derived from sensor path, node, keys and row time so that
+// resending the same data does not create duplicates. Rows rejected with
+// 429 are retried with backoff, https with address https://<host:port>.
+
+func init() {
+     mdtSinkTypes["elasticsearch"] = mdtNewElasticsearchSink
+     mdtSinkTypes["opensearch"] = mdtNewElasticsearchSink
+}
+
+type esIndexVars struct {
+     Path string
+     Node string
+     Date string
+}
+
+type esDocument struct {
+     Timestamp    string                 `json:"@timestamp"`
+     Node         string                 `json:"node"`
+     Subscription string                 `json:"subscription"`
+     EncodingPath string                 `json:"encoding_path"`
+     CollectionId uint64                 `json:"collection_id"`
+     Keys         map[string]interface{} `json:"keys"`
+     Content      map[string]interface{} `json:"content"`
+}
+
+type elasticsearchSink struct {
+     sync.Mutex
+     url      string
+     user     string
+     password string
+     index    *template.Template
+     batch    int
+     actions  [][]byte           // action and document lines of a row
+     done     chan struct{}
+     client   *http.Client
+}
+
+var esReplacer = strings.NewReplacer("/", "_", ":", "_")
+
+const esMaxRetries = 5
+
+func mdtNewElasticsearchSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("elasticsearch output needs an address, elasticsearch:<host:port>")
+     }
+     if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+         address = "http://" + address
+     }
+     s := &elasticsearchSink{
+              url:      strings.TrimSuffix(address, "/") + "/_bulk",
+              user:     options.Get("user"),
+              password: options.Get("password"),
+              batch:    1000,
+              done:     make(chan struct{}),
+              client:   &http.Client{Timeout: 60 * time.Second},
+          }
+
+     index := options.Get("index")
+     if index == "" {
+         index = "{{.Path}}"
+     }
+     if s.index, err = template.New("index").Parse(index); err != nil {
+         return nil, fmt.Errorf("index template %s: %v", index, err)
+     }
+     if err = s.index.Execute(ioutil.Discard, &esIndexVars{}); err != nil {
+         return nil, fmt.Errorf("index template %s: %v", index, err)
+     }
+     if b := options.Get("batch"); b != "" {
+         if s.batch, err = strconv.Atoi(b); err != nil || s.batch <= 0 {
+             return nil, fmt.Errorf("invalid batch %s", b)
+         }
+     }
+     flush := 5 * time.Second
+     if f := options.Get("flush"); f != "" {
+         if flush, err = time.ParseDuration(f); err != nil || flush <= 0 {
+             return nil, fmt.Errorf("invalid flush interval %s", f)
+         }
+     }
+
+     go s.flushLoop(flush)
+     return s, nil
+}
+
+// same row always gets the same id
+func esDocumentId(row *MdtRow, keys []byte) string {
+     h := fnv.New64a()
+     h.Write([]byte(row.EncodingPath))
+     h.Write([]byte{0})
+     h.Write([]byte(row.NodeId))
+     h.Write([]byte{0})
+     h.Write(keys)
+     return fmt.Sprintf("%d-%016x", row.Timestamp, h.Sum64())
+}
+
+func (s *elasticsearchSink) writeRows(rows []*MdtRow) error {
+     s.Lock()
+     defer s.Unlock()
+
+     for _, row := range rows {
+         t := time.Unix(0, int64(row.Timestamp) * int64(time.Millisecond)).UTC()
+
+         var index bytes.Buffer
+         err := s.index.Execute(&index, &esIndexVars{
+                                          Path: strings.ToLower(esReplacer.Replace(row.EncodingPath)),
+                                          Node: row.NodeId,
+                                          Date: t.Format("2006.01.02"),
+                                       })
+         if err != nil {
+             return err
+         }
+         // keys are marshalled sorted, so id is stable
+         keys, err := json.Marshal(row.Keys)
+         if err != nil {
+             return err
+         }
+         action, err := json.Marshal(map[string]interface{}{
+                            "index": map[string]string{
+                                         "_index": strings.ToLower(index.String()),
+                                         "_id":    esDocumentId(row, keys),
+                                     },
+                        })
+         if err != nil {
+             return err
+         }
+         doc, err := json.Marshal(&esDocument{
+                                     Timestamp:    t.Format("2006-01-02T15:04:05.000Z"),
+                                     Node:         row.NodeId,
+                                     Subscription: row.Subscription,
+                                     EncodingPath: row.EncodingPath,
+                                     CollectionId: row.CollectionId,
+                                     Keys:         row.Keys,
+                                     Content:      row.Content,
+                                 })
+         if err != nil {
+             return err
+         }
+         s.actions = append(s.actions, append(append(append(action, '\n'), doc...), '\n'))
+     }
+     if len(s.actions) >= s.batch {
+         return s.flush()
+     }
+     return nil
+}
+
+type esBulkResponse struct {
+     Errors bool `json:"errors"`
+     Items  []map[string]struct {
+         Status int             `json:"status"`
+         Error  json.RawMessage `json:"error"`
+     } `json:"items"`
+}
+
+// send buffered rows, called with lock held
+func (s *elasticsearchSink) flush() error {
+     for len(s.actions) != 0 {
+         n := len(s.actions)
+         if n > s.batch {
+             n = s.batch
+         }
+         retry, err := s.bulk(s.actions[:n])
+         if err != nil {
+             if len(s.actions) > 10 * s.batch {
+                 telemetry_log.Errorf("elasticsearch: dropping %d rows\n", len(s.actions) - 10 * s.batch)
+                 s.actions = s.actions[len(s.actions) - 10 * s.batch:]
+             }
+             return err
+         }
+         s.actions = append(retry, s.actions[n:]...)
+         if len(retry) != 0 {
+             // rest is sent on next flush
+             return nil
+         }
+     }
+     return nil
+}
+
+// send a bulk request, retried with backoff while cluster replies with
+// 429, returns rows rejected with 429 after retries
+func (s *elasticsearchSink) bulk(actions [][]byte) ([][]byte, error) {
+     backoff := time.Second
+
+     for i := 0; ; i++ {
+         req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(bytes.Join(actions, nil)))
+         if err != nil {
+             return nil, err
+         }
+         req.Header.Set("Content-Type", "application/x-ndjson")
+         if s.user != "" {
+             req.SetBasicAuth(s.user, s.password)
+         }
+         resp, err := s.client.Do(req)
+         if err != nil {
+             return nil, err
+         }
+         body, err := ioutil.ReadAll(resp.Body)
+         resp.Body.Close()
+         if err != nil {
+             return nil, err
+         }
+
+         var retry [][]byte
+         switch {
+         case resp.StatusCode == http.StatusTooManyRequests:
+             retry = actions
+         case resp.StatusCode != http.StatusOK:
+             return nil, fmt.Errorf("elasticsearch: %s: %s", resp.Status, strings.TrimSpace(string(body)))
+         default:
+             var r esBulkResponse
+             if err = json.Unmarshal(body, &r); err != nil {
+                 return nil, fmt.Errorf("elasticsearch: bulk response: %v", err)
+             }
+             if r.Errors {
+                 var failed int
+                 var firstErr json.RawMessage
+                 for j, item := range r.Items {
+                     for _, result := range item {
+                         if result.Status == http.StatusTooManyRequests && j < len(actions) {
+                             retry = append(retry, actions[j])
+                         } else if result.Status >= 300 {
+                             failed++
+                             if firstErr == nil {
+                                 firstErr = result.Error
+                             }
+                         }
+                     }
+                 }
+                 if failed != 0 {
+                     telemetry_log.Errorf("elasticsearch: %d rows failed, %s\n", failed, firstErr)
+                 }
+             }
+         }
+
+         if len(retry) == 0 || i == esMaxRetries {
+             return retry, nil
+         }
+         actions = retry
+         time.Sleep(backoff)
+         backoff *= 2
+     }
+}
+
+func (s *elasticsearchSink) flushLoop(interval time.Duration) {
+     t := time.NewTicker(interval)
+     defer t.Stop()
+     for {
+         select {
+         case <-s.done:
+             return
+         case <-t.C:
+             s.Lock()
+             if err := s.flush(); err != nil {
+                 telemetry_log.Errorln("Failed to write rows:", err)
+             }
+             s.Unlock()
+         }
+     }
+}
+
+func (s *elasticsearchSink) close() error {
+     close(s.done)
+     s.Lock()
+     defer s.Unlock()
+     return s.flush()
+}
@@ -0,0 +1,277 @@
+package telemetry_decode
+
+import (
+       "io"
+       "fmt"
+       "bytes"
+       "strings"
+       "io/ioutil"
+       "crypto/aes"
+       "crypto/rand"
+       "crypto/cipher"
+       "encoding/hex"
+       "encoding/binary"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////           A T - R E S T   E N C R Y P T I O N           ///////
+///////////////////////////////////////////////////////////////////////
+// With -encrypt_key <file>, output files, plain and templated -out files
+// and capture segments, are encrypted with AES-GCM, after compression.
+// Key file has a 32 byte key, raw or as 64 hex digits, such as made with
+//   openssl rand -hex 32 > mdt.key
+// Encrypted file is a header, MDTAES2\n, then chunks of 4 byte big endian
+// length, 12 byte random nonce and sealed data with its tag. A chunk is
+// sealed on every flush, so a file can be read up to the last message
+// while being written, and a header may come again between chunks where
+// a file was appended to. Chunks after a header are numbered from 0, the
+// number and whether the chunk is the last one, sealed on close, are the
+// additional data of the chunk, so chunks dropped, reordered or cut off
+// at the end fail to decrypt, a file missing its last chunk is truncated.
+// replay, decode, index and search decrypt with the same -encrypt_key,
+// decrypt prints files decrypted.
+
+var mdtEncryptMagic = []byte("MDTAES2\n")
+
+const (
+      encryptMaxChunk = 64 << 10
+      encryptNonceLen = 12
+)
+
+// additional data of chunk n after a header, last if sealed on close
+func mdtEncryptAD(n uint64, last bool) []byte {
+     ad := make([]byte, 9)
+     binary.BigEndian.PutUint64(ad, n)
+     if last {
+         ad[8] = 1
+     }
+     return ad
+}
+
+// cipher of -encrypt_key, nil if files are not encrypted
+var mdtEncryptAEAD cipher.AEAD
+
+func mdtReadKey(fileName string) (cipher.AEAD, error) {
+     data, err := ioutil.ReadFile(fileName)
+     if err != nil {
+         return nil, err
+     }
+     key := data
+     if k, err := hex.DecodeString(strings.TrimSpace(string(data))); err == nil {
+         key = k
+     }
+     if len(key) != 32 {
+         return nil, fmt.Errorf("%s: expected a 32 byte key, raw or as 64 hex digits", fileName)
+     }
+     block, err := aes.NewCipher(key)
+     if err != nil {
+         return nil, err
+     }
+     return cipher.NewGCM(block)
+}
+
+// files are encrypted with, and decrypted by, the key in fileName
+func MdtEncryptSetup(fileName string) error {
+     aead, err := mdtReadKey(fileName)
+     if err != nil {
+         return err
+     }
+     mdtEncryptAEAD = aead
+     return nil
+}
+
+// file name suffix for encrypted output
+func mdtEncryptSuffix() string {
+     if mdtEncryptAEAD == nil {
+         return ""
+     }
+     return ".enc"
+}
+
+// true if data starts as an encrypted file
+func MdtEncrypted(data []byte) bool {
+     return bytes.HasPrefix(data, mdtEncryptMagic)
+}
+
+type mdtEncryptWriter struct {
+     w      io.Writer
+     aead   cipher.AEAD
+     buf    []byte
+     header bool
+     n      uint64 // chunks sealed since the header
+}
+
+func (e *mdtEncryptWriter) Write(p []byte) (int, error) {
+     n := len(p)
+     for len(p) > 0 {
+         room := encryptMaxChunk - len(e.buf)
+         if room > len(p) {
+             room = len(p)
+         }
+         e.buf = append(e.buf, p[:room]...)
+         p = p[room:]
+         if len(e.buf) == encryptMaxChunk {
+             if err := e.Flush(); err != nil {
+                 return 0, err
+             }
+         }
+     }
+     return n, nil
+}
+
+// seal buffered data into a chunk
+func (e *mdtEncryptWriter) Flush() error {
+     if len(e.buf) == 0 {
+         return nil
+     }
+     return e.seal(false)
+}
+
+func (e *mdtEncryptWriter) seal(last bool) error {
+     var out []byte
+     if !e.header {
+         out = append(out, mdtEncryptMagic...)
+         e.header = true
+         e.n = 0
+     }
+     nonce := make([]byte, encryptNonceLen)
+     if _, err := rand.Read(nonce); err != nil {
+         return err
+     }
+     sealed := e.aead.Seal(nil, nonce, e.buf, mdtEncryptAD(e.n, last))
+     e.n++
+     size := make([]byte, 4)
+     binary.BigEndian.PutUint32(size, uint32(len(sealed)))
+     out = append(append(append(out, size...), nonce...), sealed...)
+     e.buf = e.buf[:0]
+     _, err := e.w.Write(out)
+     return err
+}
+
+// seal the last chunk, with data still buffered
+func (e *mdtEncryptWriter) Close() error {
+     return e.seal(true)
+}
+
+// compressed and then encrypted writer
+type mdtChainWriter struct {
+     z mdtCompressWriter
+     e *mdtEncryptWriter
+}
+
+func (c *mdtChainWriter) Write(p []byte) (int, error) {
+     return c.z.Write(p)
+}
+
+func (c *mdtChainWriter) Flush() error {
+     if err := c.z.Flush(); err != nil {
+         return err
+     }
+     return c.e.Flush()
+}
+
+func (c *mdtChainWriter) Close() error {
+     err := c.z.Close()
+     if eerr := c.e.Close(); err == nil {
+         err = eerr
+     }
+     return err
+}
+
+// writer of output file w, compressed with compress and encrypted with
+// -encrypt_key, nil if neither
+func mdtNewFileWriter(w io.Writer, compress string) (mdtCompressWriter, error) {
+     var e *mdtEncryptWriter
+     if mdtEncryptAEAD != nil {
+         e = &mdtEncryptWriter{w: w, aead: mdtEncryptAEAD}
+         w = e
+     }
+     if compress == "" {
+         if e == nil {
+             return nil, nil
+         }
+         return e, nil
+     }
+     z, err := mdtNewCompressWriter(w, compress)
+     if err != nil || e == nil {
+         return z, err
+     }
+     return &mdtChainWriter{z: z, e: e}, nil
+}
+
+type mdtDecryptReader struct {
+     r      io.Reader
+     aead   cipher.AEAD
+     buf    []byte
+     header bool   // header read, chunks are expected
+     n      uint64 // chunks opened since the header
+     last   bool   // last chunk after the header opened
+}
+
+// reader decrypting r, an encrypted file, with -encrypt_key
+func MdtDecryptReader(r io.Reader) (io.Reader, error) {
+     if mdtEncryptAEAD == nil {
+         return nil, fmt.Errorf("file is encrypted, decrypt with -encrypt_key <file>")
+     }
+     return &mdtDecryptReader{r: r, aead: mdtEncryptAEAD}, nil
+}
+
+func (d *mdtDecryptReader) Read(p []byte) (int, error) {
+     for len(d.buf) == 0 {
+         if err := d.next(); err != nil {
+             return 0, err
+         }
+     }
+     n := copy(p, d.buf)
+     d.buf = d.buf[n:]
+     return n, nil
+}
+
+// open the next chunk, headers are skipped. Data of a header not ending
+// with its last chunk is truncated, io.ErrUnexpectedEOF.
+func (d *mdtDecryptReader) next() error {
+     hdr := make([]byte, 4)
+     if _, err := io.ReadFull(d.r, hdr); err != nil {
+         if err == io.EOF && d.header && !d.last {
+             err = io.ErrUnexpectedEOF
+         }
+         return err
+     }
+     if bytes.Equal(hdr, mdtEncryptMagic[:4]) {
+         if _, err := io.ReadFull(d.r, hdr); err != nil || !bytes.Equal(hdr, mdtEncryptMagic[4:]) {
+             return fmt.Errorf("corrupt encrypted file header")
+         }
+         if d.header && !d.last {
+             return io.ErrUnexpectedEOF
+         }
+         d.header, d.n, d.last = true, 0, false
+         return nil
+     }
+     if !d.header || d.last {
+         return fmt.Errorf("corrupt encrypted file, chunk out of place")
+     }
+     n := binary.BigEndian.Uint32(hdr)
+     if n > encryptMaxChunk + uint32(d.aead.Overhead()) {
+         return fmt.Errorf("corrupt encrypted file, chunk of %d bytes", n)
+     }
+     chunk := make([]byte, encryptNonceLen + int(n))
+     if _, err := io.ReadFull(d.r, chunk); err != nil {
+         if err == io.EOF {
+             err = io.ErrUnexpectedEOF
+         }
+         return err
+     }
+     nonce, sealed := chunk[:encryptNonceLen], chunk[encryptNonceLen:]
+     var err error
+     d.buf, err = d.aead.Open(nil, nonce, sealed, mdtEncryptAD(d.n, false))
+     if err != nil {
+         if d.buf, err = d.aead.Open(nil, nonce, sealed, mdtEncryptAD(d.n, true)); err == nil {
+             d.last = true
+         }
+     }
+     if err != nil {
+         return fmt.Errorf("decrypt: %v, wrong key or corrupt file", err)
+     }
+     d.n++
+     return nil
+}
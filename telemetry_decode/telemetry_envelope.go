@@ -0,0 +1,56 @@
+package telemetry_decode
+
+import (
+       "bytes"
+       "encoding/json"
+       "time"
+)
+
+// With Envelope every message written in json format to the output file
+// is wrapped with where it came from, for files collecting messages of
+// many routers,
+//   {
+//     "source": "10.1.1.1:54321",
+//     "transport": "grpc",
+//     "received": "2020-05-04T10:11:12.123456789Z",
+//     "subscription": "intf-counters",
+//     "message": { ... }
+//   }
+// received is when the session passed the message on for decoding.
+
+type mdtEnvelope struct {
+     Source       string          `json:"source"`
+     Transport    string          `json:"transport"`
+     Received     string          `json:"received"`
+     Subscription string          `json:"subscription"`
+     Message      json.RawMessage `json:"message"`
+}
+
+// remember what goes in the envelope of the message being decoded
+func (o *MdtOut)mdtEnvelopeMessage(data []byte) {
+     o.received = time.Now()
+     o.subscription = o.Subscription
+     if o.subscription == "" {
+         o.subscription = o.mdtMessageSubscription(data)
+     }
+}
+
+// wrap json of a message in its envelope, indented as the message was
+func (o *MdtOut)mdtEnvelope(s string, indent string) string {
+     if !o.Envelope {
+         return s
+     }
+     b, err := json.Marshal(&mdtEnvelope{
+                   Source:       o.Source,
+                   Transport:    o.Transport,
+                   Received:     o.received.UTC().Format(time.RFC3339Nano),
+                   Subscription: o.subscription,
+                   Message:      json.RawMessage(s),
+               })
+     if err != nil {
+         return s
+     }
+     var out bytes.Buffer
+     json.Indent(&out, b, "", indent)
+     return out.String()
+}
@@ -0,0 +1,407 @@
+package telemetry_decode
+
+import (
+       "os"
+       "fmt"
+       "net"
+       "sync"
+       "bytes"
+       "strings"
+       "strconv"
+       "net/url"
+       "io/ioutil"
+       "crypto/tls"
+       "crypto/rand"
+       "crypto/sha512"
+       "encoding/hex"
+       "encoding/base64"
+       "encoding/binary"
+       "text/template"
+       "time"
+
+       "github.com/vmihailenco/msgpack/v5"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////              F L U E N T D   S I N K                    ///////
+///////////////////////////////////////////////////////////////////////
+// -out fluentd:<host:port>[?tag=..&ack=true&shared_key=..&user=..&password=..&tls=true&ca=..&flush=..&buffer=..]
+// Rows are sent to a Fluentd/Fluent Bit forward input as events, time is
+// the row time, record has node_id, subscription, encoding_path,
+// collection_id, keys and content. Tag is a template, default
+// telemetry.{{.Path}}, fields are
+//   .Node          node the row is from
+//   .Model         model name, Cisco-IOS-XR-infra-statsd-oper
+//   .Path          sensor path without model name, "/" replaced by "."
+//   .Subscription  subscription the row is from
+// Events of a tag are sent in Forward mode every flush interval (default
+// 1s), with ack=true each chunk waits for the ack. shared_key, and user
+// and password, do the handshake of the secure forward input. While the
+// connection is down events are buffered, up to buffer events (default
+// 100000), and connection is retried on every flush.
+
+func init() {
+     mdtSinkTypes["fluentd"] = mdtNewFluentdSink
+     msgpack.RegisterExt(0, (*fluentEventTime)(nil))
+}
+
+// fluentd EventTime, msgpack ext 0 with seconds and nanoseconds
+type fluentEventTime struct {
+     time.Time
+}
+
+func (t *fluentEventTime) MarshalMsgpack() ([]byte, error) {
+     b := make([]byte, 8)
+     binary.BigEndian.PutUint32(b, uint32(t.Unix()))
+     binary.BigEndian.PutUint32(b[4:], uint32(t.Nanosecond()))
+     return b, nil
+}
+
+func (t *fluentEventTime) UnmarshalMsgpack(b []byte) error {
+     if len(b) != 8 {
+         return fmt.Errorf("invalid EventTime length %d", len(b))
+     }
+     t.Time = time.Unix(int64(binary.BigEndian.Uint32(b)), int64(binary.BigEndian.Uint32(b[4:])))
+     return nil
+}
+
+type fluentdTagVars struct {
+     Node         string
+     Model        string
+     Path         string
+     Subscription string
+}
+
+type fluentdSink struct {
+     sync.Mutex
+     address   string
+     tag       *template.Template
+     ack       bool
+     sharedKey string
+     user      string
+     password  string
+     hostname  string
+     tlsConfig *tls.Config
+     max       int
+
+     conn      net.Conn
+     events    map[string][]interface{}  // by tag, [time, record]
+     count     int
+     dropped   int
+     done      chan struct{}
+}
+
+var fluentdReplacer = strings.NewReplacer(".", "_", " ", "_")
+
+func mdtNewFluentdSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("fluentd output needs an address, fluentd:<host:port>")
+     }
+     s := &fluentdSink{
+              address:   address,
+              sharedKey: options.Get("shared_key"),
+              user:      options.Get("user"),
+              password:  options.Get("password"),
+              max:       100000,
+              events:    map[string][]interface{}{},
+              done:      make(chan struct{}),
+          }
+     if s.hostname, err = os.Hostname(); err != nil {
+         s.hostname = "telemetry-go-collector"
+     }
+
+     tag := options.Get("tag")
+     if tag == "" {
+         tag = "telemetry.{{.Path}}"
+     }
+     if s.tag, err = template.New("tag").Parse(tag); err != nil {
+         return nil, fmt.Errorf("tag template %s: %v", tag, err)
+     }
+     if err = s.tag.Execute(ioutil.Discard, &fluentdTagVars{}); err != nil {
+         return nil, fmt.Errorf("tag template %s: %v", tag, err)
+     }
+     if a := options.Get("ack"); a != "" {
+         if s.ack, err = strconv.ParseBool(a); err != nil {
+             return nil, fmt.Errorf("invalid ack %s", a)
+         }
+     }
+     if b := options.Get("buffer"); b != "" {
+         if s.max, err = strconv.Atoi(b); err != nil || s.max <= 0 {
+             return nil, fmt.Errorf("invalid buffer %s", b)
+         }
+     }
+     flush := time.Second
+     if f := options.Get("flush"); f != "" {
+         if flush, err = time.ParseDuration(f); err != nil || flush <= 0 {
+             return nil, fmt.Errorf("invalid flush interval %s", f)
+         }
+     }
+     if options.Get("tls") == "true" || options.Get("ca") != "" {
+         s.tlsConfig = &tls.Config{}
+         if ca := options.Get("ca"); ca != "" {
+             if s.tlsConfig, err = telemetry_tls.NewClientConfig(ca, "", 0); err != nil {
+                 return nil, err
+             }
+         }
+         if s.tlsConfig.ServerName == "" {
+             s.tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+         }
+     }
+
+     // events are buffered until fluentd is reachable
+     if err = s.connect(); err != nil {
+         telemetry_log.Errorln("fluentd:", err)
+     }
+     go s.flushLoop(flush)
+     return s, nil
+}
+
+func (s *fluentdSink) connect() error {
+     var conn net.Conn
+     var err error
+
+     dialer := &net.Dialer{Timeout: 10 * time.Second}
+     if s.tlsConfig != nil {
+         conn, err = tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+     } else {
+         conn, err = dialer.Dial("tcp", s.address)
+     }
+     if err != nil {
+         return err
+     }
+     if s.sharedKey != "" {
+         conn.SetDeadline(time.Now().Add(30 * time.Second))
+         if err = s.handshake(conn); err != nil {
+             conn.Close()
+             return err
+         }
+         conn.SetDeadline(time.Time{})
+     }
+     s.conn = conn
+     return nil
+}
+
+func fluentdDigest(parts ...[]byte) string {
+     h := sha512.New()
+     for _, p := range parts {
+         h.Write(p)
+     }
+     return hex.EncodeToString(h.Sum(nil))
+}
+
+// secure forward handshake, HELO from server, PING and PONG
+func (s *fluentdSink) handshake(conn net.Conn) error {
+     dec := msgpack.NewDecoder(conn)
+
+     var helo []interface{}
+     if err := dec.Decode(&helo); err != nil {
+         return fmt.Errorf("fluentd handshake: %v", err)
+     }
+     if len(helo) != 2 || helo[0] != "HELO" {
+         return fmt.Errorf("fluentd handshake: expected HELO, got %v", helo)
+     }
+     opts, _ := helo[1].(map[string]interface{})
+     nonce := fluentdBytes(opts["nonce"])
+     auth := fluentdBytes(opts["auth"])
+
+     salt := make([]byte, 16)
+     rand.Read(salt)
+     ping := []interface{}{
+                 "PING",
+                 s.hostname,
+                 salt,
+                 fluentdDigest(salt, []byte(s.hostname), nonce, []byte(s.sharedKey)),
+                 "",
+                 "",
+             }
+     if len(auth) != 0 {
+         ping[4] = s.user
+         ping[5] = fluentdDigest(auth, []byte(s.user), []byte(s.password))
+     }
+     b, err := msgpack.Marshal(ping)
+     if err != nil {
+         return err
+     }
+     if _, err = conn.Write(b); err != nil {
+         return err
+     }
+
+     var pong []interface{}
+     if err = dec.Decode(&pong); err != nil {
+         return fmt.Errorf("fluentd handshake: %v", err)
+     }
+     if len(pong) != 5 || pong[0] != "PONG" {
+         return fmt.Errorf("fluentd handshake: expected PONG, got %v", pong)
+     }
+     if ok, _ := pong[1].(bool); !ok {
+         return fmt.Errorf("fluentd handshake: authentication failed, %v", pong[2])
+     }
+     serverHost, _ := pong[3].(string)
+     if pong[4] != fluentdDigest(salt, []byte(serverHost), nonce, []byte(s.sharedKey)) {
+         return fmt.Errorf("fluentd handshake: server shared key mismatch")
+     }
+     return nil
+}
+
+// nonce and salt may come as bin or str
+func fluentdBytes(v interface{}) []byte {
+     switch v := v.(type) {
+     case []byte:
+         return v
+     case string:
+         return []byte(v)
+     }
+     return nil
+}
+
+func (s *fluentdSink) writeRows(rows []*MdtRow) error {
+     s.Lock()
+     defer s.Unlock()
+
+     for _, row := range rows {
+         vars := fluentdTagVars{
+                     Node:         fluentdReplacer.Replace(row.NodeId),
+                     Path:         row.EncodingPath,
+                     Subscription: fluentdReplacer.Replace(row.Subscription),
+                 }
+         if i := strings.Index(row.EncodingPath, ":"); i >= 0 {
+             vars.Model, vars.Path = fluentdReplacer.Replace(row.EncodingPath[:i]), row.EncodingPath[i+1:]
+         }
+         var nodes []string
+         for _, n := range strings.Split(vars.Path, "/") {
+             nodes = append(nodes, fluentdReplacer.Replace(n))
+         }
+         vars.Path = strings.Join(nodes, ".")
+
+         var tag bytes.Buffer
+         if err := s.tag.Execute(&tag, &vars); err != nil {
+             return err
+         }
+         t := &fluentEventTime{time.Unix(0, int64(row.Timestamp) * int64(time.Millisecond))}
+         record := map[string]interface{}{
+                       "node_id":       row.NodeId,
+                       "subscription":  row.Subscription,
+                       "encoding_path": row.EncodingPath,
+                       "collection_id": row.CollectionId,
+                       "keys":          row.Keys,
+                       "content":       row.Content,
+                   }
+         s.events[tag.String()] = append(s.events[tag.String()], []interface{}{t, record})
+         s.count++
+     }
+     // oldest events of the largest tag are dropped
+     for s.count > s.max {
+         var tag string
+         for t, e := range s.events {
+             if len(e) > len(s.events[tag]) {
+                 tag = t
+             }
+         }
+         n := s.count - s.max
+         if n > len(s.events[tag]) {
+             n = len(s.events[tag])
+         }
+         s.events[tag] = s.events[tag][n:]
+         s.count -= n
+         s.dropped += n
+     }
+     return nil
+}
+
+// send buffered events, a chunk per tag, called with lock held
+func (s *fluentdSink) flush() error {
+     if s.dropped != 0 {
+         telemetry_log.Errorf("fluentd: dropped %d events\n", s.dropped)
+         s.dropped = 0
+     }
+     if s.count == 0 {
+         return nil
+     }
+     if s.conn == nil {
+         if err := s.connect(); err != nil {
+             return err
+         }
+         telemetry_log.Println("fluentd: connected to", s.address)
+     }
+
+     for tag, events := range s.events {
+         if len(events) == 0 {
+             delete(s.events, tag)
+             continue
+         }
+         if err := s.send(tag, events); err != nil {
+             // chunk may have been received, it is sent again
+             s.conn.Close()
+             s.conn = nil
+             return err
+         }
+         delete(s.events, tag)
+         s.count -= len(events)
+     }
+     return nil
+}
+
+func (s *fluentdSink) send(tag string, events []interface{}) error {
+     option := map[string]interface{}{"size": len(events)}
+     var chunk string
+     if s.ack {
+         id := make([]byte, 16)
+         rand.Read(id)
+         chunk = base64.StdEncoding.EncodeToString(id)
+         option["chunk"] = chunk
+     }
+     b, err := msgpack.Marshal([]interface{}{tag, events, option})
+     if err != nil {
+         return err
+     }
+
+     s.conn.SetDeadline(time.Now().Add(30 * time.Second))
+     defer s.conn.SetDeadline(time.Time{})
+     if _, err = s.conn.Write(b); err != nil {
+         return err
+     }
+     if !s.ack {
+         return nil
+     }
+     var resp map[string]interface{}
+     if err = msgpack.NewDecoder(s.conn).Decode(&resp); err != nil {
+         return fmt.Errorf("fluentd ack: %v", err)
+     }
+     if resp["ack"] != chunk {
+         return fmt.Errorf("fluentd ack: expected %s, got %v", chunk, resp["ack"])
+     }
+     return nil
+}
+
+func (s *fluentdSink) flushLoop(interval time.Duration) {
+     t := time.NewTicker(interval)
+     defer t.Stop()
+     for {
+         select {
+         case <-s.done:
+             return
+         case <-t.C:
+             s.Lock()
+             if err := s.flush(); err != nil {
+                 telemetry_log.Errorln("Failed to write rows:", err)
+             }
+             s.Unlock()
+         }
+     }
+}
+
+func (s *fluentdSink) close() error {
+     close(s.done)
+     s.Lock()
+     defer s.Unlock()
+     err := s.flush()
+     if s.conn != nil {
+         s.conn.Close()
+     }
+     return err
+}
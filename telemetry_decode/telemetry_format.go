@@ -0,0 +1,115 @@
+package telemetry_decode
+
+import (
+       "os"
+       "fmt"
+       "sort"
+       "bufio"
+       "strings"
+       "net/url"
+       "io/ioutil"
+       "path/filepath"
+       "encoding/json"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                R O W   F O R M A T S                    ///////
+///////////////////////////////////////////////////////////////////////
+// Sinks that publish or store a row as a message, nats, mqtt, pubsub,
+// kinesis and s3, encode it with format=<name>, default json. Formats
+// other than json also get a file sink, <format>:<file>, writing rows one
+// after the other, a "*" in file name is replaced by a random string, as
+// with file output.
+
+type mdtRowFormat struct {
+     name      string
+     suffix    string                                // file name suffix
+     separator []byte                                // between rows of a stream
+     marshal   func(row *MdtRow) ([]byte, error)
+}
+
+// row formats by name, filled by init of the format files
+var mdtRowFormats = map[string]*mdtRowFormat{
+     "json": {
+         name:      "json",
+         suffix:    ".json",
+         separator: []byte("\n"),
+         marshal:   func(row *MdtRow) ([]byte, error) { return json.Marshal(row) },
+     },
+}
+
+func mdtRegisterRowFormat(f *mdtRowFormat) {
+     mdtRowFormats[f.name] = f
+     if _, ok := mdtSinkTypes[f.name]; !ok {
+         mdtSinkTypes[f.name] = func(address string, options url.Values) (mdtSink, error) {
+             return mdtNewRowFileSink(f, address)
+         }
+     }
+}
+
+// format selected with format= option
+func mdtGetRowFormat(options url.Values) (*mdtRowFormat, error) {
+     name := options.Get("format")
+     if name == "" {
+         name = "json"
+     }
+     f, ok := mdtRowFormats[name]
+     if !ok {
+         var names []string
+         for n := range mdtRowFormats {
+             names = append(names, n)
+         }
+         sort.Strings(names)
+         return nil, fmt.Errorf("unsupported format %s, Options: %s", name, strings.Join(names, ","))
+     }
+     return f, nil
+}
+
+type mdtRowFileSink struct {
+     format *mdtRowFormat
+     file   *os.File
+     w      *bufio.Writer
+}
+
+func mdtNewRowFileSink(format *mdtRowFormat, address string) (mdtSink, error) {
+     if address == "" {
+         return nil, fmt.Errorf("%s output needs a file, %s:<file>", format.name, format.name)
+     }
+     s := &mdtRowFileSink{format: format}
+
+     var err error
+     if strings.Contains(address, "*") {
+         s.file, err = ioutil.TempFile(filepath.Dir(address), filepath.Base(address))
+     } else {
+         s.file, err = os.Create(address)
+     }
+     if err != nil {
+         return nil, err
+     }
+     s.w = bufio.NewWriter(s.file)
+     telemetry_log.Println("Out file:", s.file.Name())
+     return s, nil
+}
+
+func (s *mdtRowFileSink) writeRows(rows []*MdtRow) error {
+     for _, row := range rows {
+         b, err := s.format.marshal(row)
+         if err != nil {
+             return err
+         }
+         s.w.Write(b)
+         s.w.Write(s.format.separator)
+     }
+     // flushed after every message so that file can be read any time
+     return s.w.Flush()
+}
+
+func (s *mdtRowFileSink) close() error {
+     err := s.w.Flush()
+     if e := s.file.Close(); err == nil {
+         err = e
+     }
+     return err
+}
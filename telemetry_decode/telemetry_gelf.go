@@ -0,0 +1,253 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "net"
+       "sync"
+       "bytes"
+       "regexp"
+       "strconv"
+       "net/url"
+       "crypto/tls"
+       "crypto/rand"
+       "compress/gzip"
+       "encoding/json"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                  G E L F   S I N K                      ///////
+///////////////////////////////////////////////////////////////////////
+// -out gelf:<host:port>[?proto=..&compress=..&chunk=..&level=..&tls=true&ca=..]
+// Rows are sent to a Graylog GELF input as GELF 1.1 messages, host is the
+// node, short_message the sensor path, timestamp the row time. Additional
+// fields are _subscription, _encoding_path, _collection_id, a field per
+// key and a field per leaf of the content, nested leafs joined with ".",
+//   _interface-name, _bytes-received, _rates.input-rate
+// Keys win if a leaf has the same name. proto is udp (default) or tcp.
+// UDP messages are compressed, compress gzip (default) or none, and
+// chunked if larger than chunk bytes (default 1420). TCP messages are
+// null byte terminated, tls=true and ca=<file> for TLS, connection is
+// retried with the next message if it fails. level is the syslog level of
+// the messages, default 6, informational.
+
+func init() {
+     mdtSinkTypes["gelf"] = mdtNewGelfSink
+}
+
+// GELF chunking limits
+const (
+     gelfChunkHeader = 12
+     gelfMaxChunks   = 128
+)
+
+type gelfSink struct {
+     sync.Mutex
+     address   string
+     proto     string
+     compress  bool
+     chunk     int
+     level     int
+     tlsConfig *tls.Config
+     conn      net.Conn
+}
+
+var gelfFieldRegexp = regexp.MustCompile(`[^\w\.\-]`)
+
+// additional field name, _id is reserved
+func gelfField(name string) string {
+     name = "_" + gelfFieldRegexp.ReplaceAllString(name, "_")
+     if name == "_id" {
+         name = "_id_"
+     }
+     return name
+}
+
+func mdtNewGelfSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("gelf output needs an address, gelf:<host:port>")
+     }
+     if _, _, err = net.SplitHostPort(address); err != nil {
+         return nil, err
+     }
+     s := &gelfSink{address: address, proto: "udp", compress: true, chunk: 1420, level: 6}
+
+     if p := options.Get("proto"); p != "" {
+         if p != "udp" && p != "tcp" {
+             return nil, fmt.Errorf("unsupported proto %s, Options: udp,tcp", p)
+         }
+         s.proto = p
+     }
+     switch c := options.Get("compress"); c {
+     case "", "gzip":
+     case "none":
+         s.compress = false
+     default:
+         return nil, fmt.Errorf("unsupported compress %s, Options: gzip,none", c)
+     }
+     if c := options.Get("chunk"); c != "" {
+         if s.chunk, err = strconv.Atoi(c); err != nil || s.chunk <= gelfChunkHeader {
+             return nil, fmt.Errorf("invalid chunk %s", c)
+         }
+     }
+     if l := options.Get("level"); l != "" {
+         if s.level, err = strconv.Atoi(l); err != nil || s.level < 0 || s.level > 7 {
+             return nil, fmt.Errorf("invalid level %s, 0-7", l)
+         }
+     }
+     if options.Get("tls") == "true" || options.Get("ca") != "" {
+         if s.proto != "tcp" {
+             return nil, fmt.Errorf("gelf tls needs proto=tcp")
+         }
+         s.tlsConfig = &tls.Config{}
+         if ca := options.Get("ca"); ca != "" {
+             if s.tlsConfig, err = telemetry_tls.NewClientConfig(ca, "", 0); err != nil {
+                 return nil, err
+             }
+         }
+         if s.tlsConfig.ServerName == "" {
+             s.tlsConfig.ServerName, _, _ = net.SplitHostPort(address)
+         }
+     }
+
+     if err = s.connect(); err != nil {
+         if s.proto == "udp" {
+             return nil, err
+         }
+         // tcp connection is retried with the next message
+         telemetry_log.Errorln("gelf:", err)
+     }
+     return s, nil
+}
+
+func (s *gelfSink) connect() error {
+     var conn net.Conn
+     var err error
+
+     dialer := &net.Dialer{Timeout: 10 * time.Second}
+     if s.tlsConfig != nil {
+         conn, err = tls.DialWithDialer(dialer, "tcp", s.address, s.tlsConfig)
+     } else {
+         conn, err = dialer.Dial(s.proto, s.address)
+     }
+     if err != nil {
+         return err
+     }
+     s.conn = conn
+     return nil
+}
+
+func (s *gelfSink) message(row *MdtRow) ([]byte, error) {
+     msg := map[string]interface{}{
+                "version":        "1.1",
+                "host":           row.NodeId,
+                "short_message":  row.EncodingPath,
+                "timestamp":      float64(row.Timestamp) / 1000,
+                "level":          s.level,
+                "_subscription":  row.Subscription,
+                "_encoding_path": row.EncodingPath,
+                "_collection_id": row.CollectionId,
+            }
+     if row.NodeId == "" {
+         msg["host"] = "unknown"
+     }
+     for _, m := range []map[string]interface{}{row.Content, row.Keys} {
+         fields := map[string]interface{}{}
+         mdtFlatten(fields, "", m)
+         for k, v := range fields {
+             // values are strings or numbers
+             if b, ok := v.(bool); ok {
+                 v = strconv.FormatBool(b)
+             }
+             msg[gelfField(k)] = v
+         }
+     }
+     return json.Marshal(msg)
+}
+
+func (s *gelfSink) writeRows(rows []*MdtRow) error {
+     s.Lock()
+     defer s.Unlock()
+
+     if s.conn == nil {
+         if err := s.connect(); err != nil {
+             return err
+         }
+         telemetry_log.Println("gelf: connected to", s.address)
+     }
+     for _, row := range rows {
+         b, err := s.message(row)
+         if err != nil {
+             return err
+         }
+         if s.proto == "tcp" {
+             err = s.writeTcp(b)
+         } else {
+             err = s.writeUdp(b)
+         }
+         if err != nil {
+             return err
+         }
+     }
+     return nil
+}
+
+func (s *gelfSink) writeTcp(b []byte) error {
+     s.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+     if _, err := s.conn.Write(append(b, 0)); err != nil {
+         s.conn.Close()
+         s.conn = nil
+         return err
+     }
+     return nil
+}
+
+func (s *gelfSink) writeUdp(b []byte) error {
+     if s.compress {
+         var buf bytes.Buffer
+         zw := gzip.NewWriter(&buf)
+         zw.Write(b)
+         if err := zw.Close(); err != nil {
+             return err
+         }
+         b = buf.Bytes()
+     }
+     if len(b) <= s.chunk {
+         _, err := s.conn.Write(b)
+         return err
+     }
+
+     size := s.chunk - gelfChunkHeader
+     n := (len(b) + size - 1) / size
+     if n > gelfMaxChunks {
+         return fmt.Errorf("gelf: message of %d bytes needs more than %d chunks", len(b), gelfMaxChunks)
+     }
+     id := make([]byte, 8)
+     rand.Read(id)
+     for i := 0; i < n; i++ {
+         end := (i + 1) * size
+         if end > len(b) {
+             end = len(b)
+         }
+         chunk := append([]byte{0x1e, 0x0f}, id...)
+         chunk = append(chunk, byte(i), byte(n))
+         if _, err := s.conn.Write(append(chunk, b[i * size:end]...)); err != nil {
+             return err
+         }
+     }
+     return nil
+}
+
+func (s *gelfSink) close() error {
+     s.Lock()
+     defer s.Unlock()
+     if s.conn != nil {
+         return s.conn.Close()
+     }
+     return nil
+}
@@ -0,0 +1,208 @@
+package telemetry_decode
+
+import (
+       "encoding/json"
+       "fmt"
+       "time"
+
+       "github.com/golang/protobuf/proto"
+       "google.golang.org/protobuf/encoding/protowire"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry"
+)
+
+// Made up interface counters, for the generate and loadgen commands and
+// the test harness.
+
+// names of counters of generated rows, counter-<n> after these
+var mdtGenerateCounterNames = []string{
+     "packets-received", "bytes-received", "packets-sent", "bytes-sent",
+     "input-drops", "output-drops", "input-errors", "output-errors",
+     "multicast-packets-received", "broadcast-packets-received",
+     "multicast-packets-sent", "broadcast-packets-sent", "crc-errors", "input-overruns",
+}
+
+// name of counter i
+func mdtGenerateCounterName(i int) string {
+     if i < len(mdtGenerateCounterNames) {
+         return mdtGenerateCounterNames[i]
+     }
+     return fmt.Sprintf("counter-%d", i + 1)
+}
+
+// counters of message id, packets and bytes go up faster than errors
+func mdtGenerateCounters(id uint64, fields int) ([]string, []uint64) {
+     names := make([]string, fields)
+     values := make([]uint64, fields)
+     for i := range names {
+         names[i] = mdtGenerateCounterName(i)
+         switch i {
+         case 0:
+             values[i] = id * 100
+         case 1:
+             values[i] = id * 100 * 512
+         case 2:
+             values[i] = id * 80
+         case 3:
+             values[i] = id * 80 * 512
+         default:
+             values[i] = id * uint64(i % 5 + 1)
+         }
+     }
+     return names, values
+}
+
+// message of a router, rows interfaces with fields counters of message id,
+// in json, self-describing-gpb or gpb, compact rows MdtGenerateDecoder
+// decodes
+func MdtGenerateMessage(encoding, node, subscription, path string, id uint64, rows, fields int) ([]byte, error) {
+     ts := uint64(time.Now().UnixNano() / int64(time.Millisecond))
+     names, values := mdtGenerateCounters(id, fields)
+     if encoding == "gpb" {
+         return mdtGenerateCompact(node, subscription, path, id, ts, rows, values)
+     }
+     if encoding == "json" {
+         type jsonRow struct {
+              Timestamp uint64            `json:"timestamp"`
+              Keys      map[string]string `json:"keys"`
+              Content   map[string]uint64 `json:"content"`
+         }
+         content := make(map[string]uint64)
+         for i, name := range names {
+             content[name] = values[i]
+         }
+         data := make([]jsonRow, rows)
+         for i := range data {
+             data[i] = jsonRow{
+                           Timestamp: ts,
+                           Keys:      map[string]string{"interface-name": fmt.Sprintf("GigabitEthernet0/0/0/%d", i)},
+                           Content:   content,
+                       }
+         }
+         return json.Marshal(map[string]interface{}{
+                                 "node_id_str":           node,
+                                 "subscription_id_str":   subscription,
+                                 "encoding_path":         path,
+                                 "collection_id":         id,
+                                 "collection_start_time": ts,
+                                 "msg_timestamp":         ts,
+                                 "data_json":             data,
+                                 "collection_end_time":   ts,
+                             })
+     }
+
+     data := make([]*telemetry.TelemetryField, rows)
+     for i := range data {
+         var content []*telemetry.TelemetryField
+         for j, name := range names {
+             content = append(content, &telemetry.TelemetryField{
+                           Name:        name,
+                           ValueByType: &telemetry.TelemetryField_Uint64Value{Uint64Value: values[j]},
+                       })
+         }
+         data[i] = &telemetry.TelemetryField{
+                       Timestamp: ts,
+                       Fields: []*telemetry.TelemetryField{
+                           {Name: "keys", Fields: []*telemetry.TelemetryField{{
+                               Name:        "interface-name",
+                               ValueByType: &telemetry.TelemetryField_StringValue{StringValue: fmt.Sprintf("GigabitEthernet0/0/0/%d", i)},
+                           }}},
+                           {Name: "content", Fields: content},
+                       },
+                   }
+     }
+     return proto.Marshal(&telemetry.Telemetry{
+                              NodeId:              &telemetry.Telemetry_NodeIdStr{NodeIdStr: node},
+                              Subscription:        &telemetry.Telemetry_SubscriptionIdStr{SubscriptionIdStr: subscription},
+                              EncodingPath:        path,
+                              CollectionId:        id,
+                              CollectionStartTime: ts,
+                              MsgTimestamp:        ts,
+                              DataGpbkv:           data,
+                              CollectionEndTime:   ts,
+                          })
+}
+
+// compact rows, keys interface name as field 1, content counter n as
+// field n, no proto needed
+func mdtGenerateCompact(node, subscription, path string, id, ts uint64, rows int, values []uint64) ([]byte, error) {
+     var content []byte
+     for i, v := range values {
+         content = protowire.AppendTag(content, protowire.Number(i + 1), protowire.VarintType)
+         content = protowire.AppendVarint(content, v)
+     }
+     data := make([]*telemetry.TelemetryRowGPB, rows)
+     for i := range data {
+         keys := protowire.AppendTag(nil, 1, protowire.BytesType)
+         keys = protowire.AppendString(keys, fmt.Sprintf("GigabitEthernet0/0/0/%d", i))
+         data[i] = &telemetry.TelemetryRowGPB{Timestamp: ts, Keys: keys, Content: content}
+     }
+     return proto.Marshal(&telemetry.Telemetry{
+                              NodeId:              &telemetry.Telemetry_NodeIdStr{NodeIdStr: node},
+                              Subscription:        &telemetry.Telemetry_SubscriptionIdStr{SubscriptionIdStr: subscription},
+                              EncodingPath:        path,
+                              CollectionId:        id,
+                              CollectionStartTime: ts,
+                              MsgTimestamp:        ts,
+                              DataGpb:             &telemetry.TelemetryGPBTable{Row: data},
+                              CollectionEndTime:   ts,
+                          })
+}
+
+// decoder of compact rows of generated messages of Path, as a decoder
+// plugin of a router's sensor path would be
+type MdtGenerateDecoder struct {
+     Path string
+}
+
+func (d MdtGenerateDecoder) Match(encodingPath string) bool {
+     return encodingPath == d.Path
+}
+
+func (d MdtGenerateDecoder) DecodeKeys(data []byte) (interface{}, error) {
+     keys := map[string]interface{}{}
+     err := mdtGenerateFields(data, func(n protowire.Number, b []byte, v uint64) {
+         if n == 1 {
+             keys["interface-name"] = string(b)
+         }
+     })
+     return keys, err
+}
+
+func (d MdtGenerateDecoder) DecodeContent(data []byte) (interface{}, error) {
+     content := map[string]interface{}{}
+     err := mdtGenerateFields(data, func(n protowire.Number, b []byte, v uint64) {
+         content[mdtGenerateCounterName(int(n) - 1)] = v
+     })
+     return content, err
+}
+
+// fields of a compact row, varints as v, strings as b
+func mdtGenerateFields(data []byte, field func(n protowire.Number, b []byte, v uint64)) error {
+     for len(data) > 0 {
+         n, t, l := protowire.ConsumeTag(data)
+         if l < 0 {
+             return protowire.ParseError(l)
+         }
+         data = data[l:]
+         switch t {
+         case protowire.VarintType:
+             v, l := protowire.ConsumeVarint(data)
+             if l < 0 {
+                 return protowire.ParseError(l)
+             }
+             field(n, nil, v)
+             data = data[l:]
+         case protowire.BytesType:
+             b, l := protowire.ConsumeBytes(data)
+             if l < 0 {
+                 return protowire.ParseError(l)
+             }
+             field(n, b, 0)
+             data = data[l:]
+         default:
+             return fmt.Errorf("field %d of wire type %d not generated", n, t)
+         }
+     }
+     return nil
+}
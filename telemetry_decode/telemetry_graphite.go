@@ -0,0 +1,204 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "net"
+       "sync"
+       "sort"
+       "bytes"
+       "strings"
+       "strconv"
+       "net/url"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////               G R A P H I T E   S I N K                 ///////
+///////////////////////////////////////////////////////////////////////
+// -out graphite:<host:port>[?prefix=..&flush=..&buffer=..]
+// Numeric leafs of the content are sent as plaintext metrics over TCP,
+//   <prefix>.<node>.<sensor path>.<key values>.<leaf> <value> <time>
+// sensor path is without model name, "/" replaced by ".", key values are
+// ordered by key name, GigabitEthernet0/0/0/0 becomes
+// GigabitEthernet0_0_0_0. Booleans are sent as 0/1, strings are dropped.
+// Metrics are sent every flush interval (default 1s). While the
+// connection is down metrics are buffered, up to buffer metrics (default
+// 100000), and connection is retried on every flush.
+
+func init() {
+     mdtSinkTypes["graphite"] = mdtNewGraphiteSink
+}
+
+type graphiteSink struct {
+     sync.Mutex
+     address string
+     prefix  string
+     max     int
+     conn    net.Conn
+     lines   [][]byte
+     dropped int
+     done    chan struct{}
+}
+
+var graphiteReplacer = strings.NewReplacer("/", "_", ".", "_", " ", "_")
+
+func mdtNewGraphiteSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("graphite output needs an address, graphite:<host:port>")
+     }
+     if _, _, err = net.SplitHostPort(address); err != nil {
+         return nil, err
+     }
+     s := &graphiteSink{
+              address: address,
+              prefix:  strings.Trim(options.Get("prefix"), "."),
+              max:     100000,
+              done:    make(chan struct{}),
+          }
+     if b := options.Get("buffer"); b != "" {
+         if s.max, err = strconv.Atoi(b); err != nil || s.max <= 0 {
+             return nil, fmt.Errorf("invalid buffer %s", b)
+         }
+     }
+     flush := time.Second
+     if f := options.Get("flush"); f != "" {
+         if flush, err = time.ParseDuration(f); err != nil || flush <= 0 {
+             return nil, fmt.Errorf("invalid flush interval %s", f)
+         }
+     }
+
+     // metrics are buffered until graphite is reachable
+     if err = s.connect(); err != nil {
+         telemetry_log.Errorln("graphite:", err)
+     }
+     go s.flushLoop(flush)
+     return s, nil
+}
+
+// graphite metric node, no dots or spaces
+func graphiteName(s string) string {
+     return graphiteReplacer.Replace(s)
+}
+
+// metric name of the row without leaf name
+func (s *graphiteSink) rowName(row *MdtRow) string {
+     var parts []string
+     if s.prefix != "" {
+         parts = append(parts, s.prefix)
+     }
+     parts = append(parts, graphiteName(row.NodeId))
+     path := row.EncodingPath[strings.Index(row.EncodingPath, ":") + 1:]
+     for _, p := range strings.Split(path, "/") {
+         parts = append(parts, graphiteName(p))
+     }
+
+     fields := map[string]interface{}{}
+     mdtFlatten(fields, "", row.Keys)
+     var keys []string
+     for k := range fields {
+         keys = append(keys, k)
+     }
+     sort.Strings(keys)
+     for _, k := range keys {
+         parts = append(parts, graphiteName(fmt.Sprint(fields[k])))
+     }
+     return strings.Join(parts, ".")
+}
+
+func (s *graphiteSink) writeRows(rows []*MdtRow) error {
+     s.Lock()
+     defer s.Unlock()
+
+     for _, row := range rows {
+         name := s.rowName(row)
+         ts := row.Timestamp / 1000
+
+         fields := map[string]interface{}{}
+         mdtFlatten(fields, "", row.Content)
+         for leaf, v := range fields {
+             value, ok := mdtMetricValue(v)
+             if !ok {
+                 continue
+             }
+             // nested leafs keep the hierarchy, rates.input-rate
+             var nodes []string
+             for _, n := range strings.Split(leaf, ".") {
+                 nodes = append(nodes, graphiteName(n))
+             }
+             s.lines = append(s.lines, []byte(fmt.Sprintf("%s.%s %s %d\n", name, strings.Join(nodes, "."), value, ts)))
+         }
+     }
+     if len(s.lines) > s.max {
+         s.dropped += len(s.lines) - s.max
+         s.lines = s.lines[len(s.lines) - s.max:]
+     }
+     return nil
+}
+
+func (s *graphiteSink) connect() error {
+     conn, err := net.DialTimeout("tcp", s.address, 10 * time.Second)
+     if err != nil {
+         return err
+     }
+     s.conn = conn
+     return nil
+}
+
+// send buffered metrics, reconnecting if needed, called with lock held
+func (s *graphiteSink) flush() error {
+     if s.dropped != 0 {
+         telemetry_log.Errorf("graphite: dropped %d metrics\n", s.dropped)
+         s.dropped = 0
+     }
+     if len(s.lines) == 0 {
+         return nil
+     }
+     if s.conn == nil {
+         if err := s.connect(); err != nil {
+             return err
+         }
+         telemetry_log.Println("graphite: connected to", s.address)
+     }
+     s.conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+     _, err := s.conn.Write(bytes.Join(s.lines, nil))
+     if err != nil {
+         // part of it may have been sent, it is sent again
+         s.conn.Close()
+         s.conn = nil
+         return err
+     }
+     s.lines = nil
+     return nil
+}
+
+func (s *graphiteSink) flushLoop(interval time.Duration) {
+     t := time.NewTicker(interval)
+     defer t.Stop()
+     for {
+         select {
+         case <-s.done:
+             return
+         case <-t.C:
+             s.Lock()
+             if err := s.flush(); err != nil {
+                 telemetry_log.Errorln("Failed to write rows:", err)
+             }
+             s.Unlock()
+         }
+     }
+}
+
+func (s *graphiteSink) close() error {
+     close(s.done)
+     s.Lock()
+     defer s.Unlock()
+     err := s.flush()
+     if s.conn != nil {
+         s.conn.Close()
+     }
+     return err
+}
@@ -0,0 +1,363 @@
+package telemetry_decode
+
+import (
+       "encoding/json"
+       "fmt"
+       "io/ioutil"
+       "strconv"
+       "strings"
+
+       protov2 "google.golang.org/protobuf/proto"
+       "google.golang.org/protobuf/encoding/protowire"
+       "google.golang.org/protobuf/reflect/protodesc"
+       "google.golang.org/protobuf/reflect/protoreflect"
+       "google.golang.org/protobuf/reflect/protoregistry"
+       "google.golang.org/protobuf/types/descriptorpb"
+       "google.golang.org/protobuf/types/dynamicpb"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////               J U N I P E R   J T I                     ///////
+///////////////////////////////////////////////////////////////////////
+// Messages with encoding jti are Juniper native sensors, a TelemetryStream
+// of telemetry_top.proto each. Sensor data is an extension of the
+// enterprise field, a message of its own per sensor, defined in the
+// Juniper protos. Those are loaded as a descriptor set,
+//   protoc --include_imports -o jti.pb telemetry_top.proto port.proto ...
+// and sensors are decoded with field names. Sensors not in the set are
+// decoded as protoc --decode_raw would, fields named by number.
+//
+// A sensor holding a single list, interface_stats of port sensors, gives
+// a row per element, string leafs of the element are the keys, otherwise
+// the sensor is one row. component_id and sub_component_id are keys of
+// every row.
+
+type jtiMessage struct {
+     SystemId       string                 `json:"system_id"`
+     ComponentId    uint32                 `json:"component_id"`
+     SubComponentId uint32                 `json:"sub_component_id"`
+     SensorName     string                 `json:"sensor_name"`
+     SequenceNumber uint32                 `json:"sequence_number"`
+     Timestamp      uint64                 `json:"timestamp"`
+     // name of the sensor extension
+     Sensor         string                 `json:"sensor"`
+     Data           map[string]interface{} `json:"data"`
+     enterprise     []byte
+}
+
+// loaded from descriptor set
+var jtiTypes *protoregistry.Types
+var jtiStream protoreflect.MessageDescriptor
+
+// load descriptor set with TelemetryStream and the sensor extensions
+func MdtJtiLoad(file string) error {
+     b, err := ioutil.ReadFile(file)
+     if err != nil {
+         return err
+     }
+     set := &descriptorpb.FileDescriptorSet{}
+     if err = protov2.Unmarshal(b, set); err != nil {
+         return fmt.Errorf("%s: %v", file, err)
+     }
+     files, err := protodesc.NewFiles(set)
+     if err != nil {
+         return fmt.Errorf("%s: %v, build it with protoc --include_imports", file, err)
+     }
+     types := new(protoregistry.Types)
+     var stream protoreflect.MessageDescriptor
+     files.RangeFiles(func(f protoreflect.FileDescriptor) bool {
+         if d := f.Messages().ByName("TelemetryStream"); d != nil {
+             stream = d
+         }
+         jtiRegister(types, f.Extensions(), f.Messages())
+         return true
+     })
+     if stream == nil {
+         return fmt.Errorf("%s: no TelemetryStream message, telemetry_top.proto is needed", file)
+     }
+     jtiTypes, jtiStream = types, stream
+     return nil
+}
+
+// extensions are declared at top level or in messages
+func jtiRegister(types *protoregistry.Types, exts protoreflect.ExtensionDescriptors, msgs protoreflect.MessageDescriptors) {
+     for i := 0; i < exts.Len(); i++ {
+         types.RegisterExtension(dynamicpb.NewExtensionType(exts.Get(i)))
+     }
+     for i := 0; i < msgs.Len(); i++ {
+         jtiRegister(types, msgs.Get(i).Extensions(), msgs.Get(i).Messages())
+     }
+}
+
+// header fields of TelemetryStream, read without the protos
+func jtiParseHeader(data []byte) (*jtiMessage, error) {
+     m := &jtiMessage{}
+     for len(data) > 0 {
+         num, typ, n := protowire.ConsumeTag(data)
+         if n < 0 {
+             return nil, protowire.ParseError(n)
+         }
+         data = data[n:]
+         switch typ {
+         case protowire.BytesType:
+             v, n := protowire.ConsumeBytes(data)
+             if n < 0 {
+                 return nil, protowire.ParseError(n)
+             }
+             switch num {
+             case 1:
+                 m.SystemId = string(v)
+             case 4:
+                 m.SensorName = string(v)
+             case 101:
+                 m.enterprise = v
+             }
+             data = data[n:]
+         case protowire.VarintType:
+             v, n := protowire.ConsumeVarint(data)
+             if n < 0 {
+                 return nil, protowire.ParseError(n)
+             }
+             switch num {
+             case 2:
+                 m.ComponentId = uint32(v)
+             case 3:
+                 m.SubComponentId = uint32(v)
+             case 5:
+                 m.SequenceNumber = uint32(v)
+             case 6:
+                 m.Timestamp = v
+             }
+             data = data[n:]
+         default:
+             n := protowire.ConsumeFieldValue(num, typ, data)
+             if n < 0 {
+                 return nil, protowire.ParseError(n)
+             }
+             data = data[n:]
+         }
+     }
+     if m.SystemId == "" {
+         return nil, fmt.Errorf("not a jti message, no system_id")
+     }
+     return m, nil
+}
+
+func mdtDecodeJti(data []byte) (*jtiMessage, error) {
+     m, err := jtiParseHeader(data)
+     if err != nil {
+         return nil, err
+     }
+     var sensors map[string]interface{}
+     if jtiTypes != nil {
+         msg := dynamicpb.NewMessage(jtiStream)
+         err = protov2.UnmarshalOptions{Resolver: jtiTypes}.Unmarshal(data, msg)
+         if err == nil {
+             if fd := jtiStream.Fields().ByName("enterprise"); fd != nil {
+                 sensors = jtiMessageValue(msg.Get(fd).Message())
+             }
+         }
+     }
+     m.Sensor, m.Data = jtiSensor(sensors)
+     if m.Data == nil {
+         raw, _ := jtiRawMessage(m.enterprise)
+         m.Sensor, m.Data = jtiSensor(raw)
+     }
+     if m.Data == nil {
+         m.Data = map[string]interface{}{}
+     }
+     return m, nil
+}
+
+// enterprise holds a vendor, juniperNetworks, holding the sensor
+func jtiSensor(enterprise map[string]interface{}) (string, map[string]interface{}) {
+     v := enterprise
+     name := ""
+     for level := 0; level < 2; level++ {
+         if len(v) != 1 {
+             return "", nil
+         }
+         for k, e := range v {
+             sub, ok := e.(map[string]interface{})
+             if !ok {
+                 return "", nil
+             }
+             name, v = k, sub
+         }
+     }
+     return name, v
+}
+
+func jtiMessageValue(m protoreflect.Message) map[string]interface{} {
+     v := map[string]interface{}{}
+     m.Range(func(fd protoreflect.FieldDescriptor, val protoreflect.Value) bool {
+         switch {
+         case fd.IsList():
+             l := val.List()
+             items := make([]interface{}, l.Len())
+             for i := range items {
+                 items[i] = jtiFieldValue(fd, l.Get(i))
+             }
+             v[string(fd.Name())] = items
+         case fd.IsMap():
+             items := map[string]interface{}{}
+             val.Map().Range(func(k protoreflect.MapKey, e protoreflect.Value) bool {
+                 items[k.String()] = jtiFieldValue(fd.MapValue(), e)
+                 return true
+             })
+             v[string(fd.Name())] = items
+         default:
+             v[string(fd.Name())] = jtiFieldValue(fd, val)
+         }
+         return true
+     })
+     return v
+}
+
+func jtiFieldValue(fd protoreflect.FieldDescriptor, val protoreflect.Value) interface{} {
+     switch fd.Kind() {
+     case protoreflect.MessageKind, protoreflect.GroupKind:
+         return jtiMessageValue(val.Message())
+     case protoreflect.EnumKind:
+         if ev := fd.Enum().Values().ByNumber(val.Enum()); ev != nil {
+             return string(ev.Name())
+         }
+         return int64(val.Enum())
+     case protoreflect.BytesKind:
+         return string(val.Bytes())
+     }
+     return val.Interface()
+}
+
+// message without its proto, fields named by number, length delimited
+// fields are messages if they parse as one, strings otherwise
+func jtiRawMessage(b []byte) (map[string]interface{}, bool) {
+     m := map[string]interface{}{}
+     for len(b) > 0 {
+         num, typ, n := protowire.ConsumeTag(b)
+         if n < 0 {
+             return nil, false
+         }
+         b = b[n:]
+         var v interface{}
+         switch typ {
+         case protowire.VarintType:
+             v, n = protowire.ConsumeVarint(b)
+         case protowire.Fixed32Type:
+             v, n = protowire.ConsumeFixed32(b)
+         case protowire.Fixed64Type:
+             v, n = protowire.ConsumeFixed64(b)
+         case protowire.BytesType:
+             var s []byte
+             s, n = protowire.ConsumeBytes(b)
+             if sub, ok := jtiRawMessage(s); ok && len(s) != 0 {
+                 v = sub
+             } else {
+                 v = string(s)
+             }
+         default:
+             return nil, false
+         }
+         if n < 0 {
+             return nil, false
+         }
+         b = b[n:]
+         key := strconv.Itoa(int(num))
+         if old, ok := m[key]; ok {
+             if l, ok := old.([]interface{}); ok {
+                 m[key] = append(l, v)
+             } else {
+                 m[key] = []interface{}{old, v}
+             }
+         } else {
+             m[key] = v
+         }
+     }
+     return m, true
+}
+
+// resource path of the sensor name, sensor_1000:/junos/system/linecard/interface/:...
+func jtiPath(m *jtiMessage) string {
+     if parts := strings.Split(m.SensorName, ":"); len(parts) > 1 && parts[1] != "" {
+         return parts[1]
+     }
+     if m.Sensor != "" {
+         return m.Sensor
+     }
+     return m.SensorName
+}
+
+func mdtDecodeJtiRows(data []byte) ([]*MdtRow, error) {
+     m, err := mdtDecodeJti(data)
+     if err != nil {
+         return nil, err
+     }
+     newRow := func() *MdtRow {
+         return &MdtRow{
+                    NodeId:       m.SystemId,
+                    Subscription: m.SensorName,
+                    EncodingPath: jtiPath(m),
+                    CollectionId: uint64(m.SequenceNumber),
+                    Timestamp:    m.Timestamp,
+                    Keys:         map[string]interface{}{
+                                      "component_id":     m.ComponentId,
+                                      "sub_component_id": m.SubComponentId,
+                                  },
+                    Content:      map[string]interface{}{},
+                }
+     }
+
+     var list string
+     lists := 0
+     for k, v := range m.Data {
+         if _, ok := v.([]interface{}); ok {
+             list = k
+             lists++
+         }
+     }
+     if lists != 1 {
+         row := newRow()
+         row.Content = m.Data
+         return []*MdtRow{row}, nil
+     }
+
+     var rows []*MdtRow
+     for _, e := range m.Data[list].([]interface{}) {
+         row := newRow()
+         for k, v := range m.Data {
+             if k != list {
+                 row.Content[k] = v
+             }
+         }
+         if item, ok := e.(map[string]interface{}); ok {
+             for k, v := range item {
+                 if _, ok := v.(string); ok {
+                     row.Keys[k] = v
+                 } else {
+                     row.Content[k] = v
+                 }
+             }
+         } else {
+             row.Content[list] = e
+         }
+         rows = append(rows, row)
+     }
+     return rows, nil
+}
+
+// decoded sensor as json to output file
+func (o *MdtOut)mdtDumpJtiMessage(data []byte) {
+     m, err := mdtDecodeJti(data)
+     if err != nil {
+         o.counters.error()
+         telemetry_log.Errorln("Failed to decode jti message:", err)
+         o.mdtQuarantine(data, err)
+         return
+     }
+     j, _ := json.MarshalIndent(m, "", "  ")
+     if err = o.mdtWriteOut(o.mdtEnvelope(string(j), "  ")); err != nil {
+         telemetry_log.Errorln(err)
+     }
+}
@@ -0,0 +1,220 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sync"
+       "context"
+       "strconv"
+       "net/url"
+       "time"
+
+       "github.com/aws/aws-sdk-go-v2/aws"
+       "github.com/aws/aws-sdk-go-v2/config"
+       "github.com/aws/aws-sdk-go-v2/service/kinesis"
+       "github.com/aws/aws-sdk-go-v2/service/kinesis/types"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////              K I N E S I S   S I N K                    ///////
+///////////////////////////////////////////////////////////////////////
+// -out kinesis:<stream>[?region=..&endpoint=..&format=..&aggregate=true&batch=..&flush=..]
+// Rows are put as json records to a Kinesis data stream with PutRecords,
+// partition key is node and sensor path, <node>/<sensor path>, so rows of
+// a sensor path from a router go to the same shard in order. Records are
+// sent when batch records (default 500, the PutRecords limit) are
+// buffered or every flush interval (default 1s). With aggregate=true rows
+// with the same partition key in a batch are put in one record as
+// newline separated json, or one after the other, up to 1MB. Records rejected with throughput
+// exceeded are retried with the next flush, records are dropped if more
+// than 10 batches are pending. Credentials and region are found the
+// usual way, AWS_REGION, ~/.aws/config, instance role.
+// format=msgpack puts rows as MessagePack records.
+
+func init() {
+     mdtSinkTypes["kinesis"] = mdtNewKinesisSink
+}
+
+// put records limits
+const (
+     kinesisMaxRecords     = 500
+     kinesisMaxRecordSize  = 1 << 20
+     kinesisMaxRequestSize = 5 << 20
+     kinesisMaxKey         = 256
+)
+
+type kinesisSink struct {
+     sync.Mutex
+     client    *kinesis.Client
+     stream    string
+     aggregate bool
+     batch     int
+     format    *mdtRowFormat
+     records   []types.PutRecordsRequestEntry
+     done      chan struct{}
+}
+
+func mdtNewKinesisSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("kinesis output needs a stream name, kinesis:<stream>")
+     }
+     s := &kinesisSink{stream: address, batch: kinesisMaxRecords, done: make(chan struct{})}
+
+     if a := options.Get("aggregate"); a != "" {
+         if s.aggregate, err = strconv.ParseBool(a); err != nil {
+             return nil, fmt.Errorf("invalid aggregate %s", a)
+         }
+     }
+     if b := options.Get("batch"); b != "" {
+         if s.batch, err = strconv.Atoi(b); err != nil || s.batch <= 0 || s.batch > kinesisMaxRecords {
+             return nil, fmt.Errorf("invalid batch %s, 1-%d", b, kinesisMaxRecords)
+         }
+     }
+     if s.format, err = mdtGetRowFormat(options); err != nil {
+         return nil, err
+     }
+     flush := time.Second
+     if f := options.Get("flush"); f != "" {
+         if flush, err = time.ParseDuration(f); err != nil || flush <= 0 {
+             return nil, fmt.Errorf("invalid flush interval %s", f)
+         }
+     }
+
+     ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+     defer cancel()
+     var opts []func(*config.LoadOptions) error
+     if r := options.Get("region"); r != "" {
+         opts = append(opts, config.WithRegion(r))
+     }
+     cfg, err := config.LoadDefaultConfig(ctx, opts...)
+     if err != nil {
+         return nil, err
+     }
+     endpoint := options.Get("endpoint")
+     s.client = kinesis.NewFromConfig(cfg, func(o *kinesis.Options) {
+         if endpoint != "" {
+             o.BaseEndpoint = aws.String(endpoint)
+         }
+     })
+
+     go s.flushLoop(flush)
+     return s, nil
+}
+
+func kinesisPartitionKey(row *MdtRow) string {
+     key := row.NodeId + "/" + row.EncodingPath
+     if len(key) > kinesisMaxKey {
+         key = key[:kinesisMaxKey]
+     }
+     return key
+}
+
+func (s *kinesisSink) writeRows(rows []*MdtRow) error {
+     s.Lock()
+     defer s.Unlock()
+
+     // index of record of a partition key being aggregated
+     open := map[string]int{}
+     for _, row := range rows {
+         data, err := s.format.marshal(row)
+         if err != nil {
+             return err
+         }
+         key := kinesisPartitionKey(row)
+         if s.aggregate {
+             if i, ok := open[key]; ok && len(s.records[i].Data) + len(s.format.separator) + len(data) <= kinesisMaxRecordSize {
+                 s.records[i].Data = append(append(s.records[i].Data, s.format.separator...), data...)
+                 continue
+             }
+             open[key] = len(s.records)
+         }
+         s.records = append(s.records, types.PutRecordsRequestEntry{Data: data, PartitionKey: aws.String(key)})
+     }
+     if len(s.records) >= s.batch {
+         return s.flush()
+     }
+     return nil
+}
+
+// put buffered records, called with lock held
+func (s *kinesisSink) flush() error {
+     for len(s.records) != 0 {
+         n, size := 0, 0
+         for n < len(s.records) && n < s.batch {
+             size += len(s.records[n].Data) + len(*s.records[n].PartitionKey)
+             if n != 0 && size > kinesisMaxRequestSize {
+                 break
+             }
+             n++
+         }
+
+         ctx, cancel := context.WithTimeout(context.Background(), 60 * time.Second)
+         resp, err := s.client.PutRecords(ctx, &kinesis.PutRecordsInput{
+                                                   StreamName: aws.String(s.stream),
+                                                   Records:    s.records[:n],
+                                               })
+         cancel()
+         if err != nil {
+             if len(s.records) > 10 * s.batch {
+                 telemetry_log.Errorf("kinesis: dropping %d records\n", len(s.records) - 10 * s.batch)
+                 s.records = s.records[len(s.records) - 10 * s.batch:]
+             }
+             return err
+         }
+
+         var retry []types.PutRecordsRequestEntry
+         if aws.ToInt32(resp.FailedRecordCount) != 0 {
+             var failed int
+             var firstErr string
+             for i, r := range resp.Records {
+                 if r.ErrorCode == nil {
+                     continue
+                 }
+                 if *r.ErrorCode == "ProvisionedThroughputExceededException" {
+                     retry = append(retry, s.records[i])
+                     continue
+                 }
+                 failed++
+                 if firstErr == "" {
+                     firstErr = *r.ErrorCode + ": " + aws.ToString(r.ErrorMessage)
+                 }
+             }
+             if failed != 0 {
+                 telemetry_log.Errorf("kinesis: %d records failed, %s\n", failed, firstErr)
+             }
+         }
+         s.records = append(retry, s.records[n:]...)
+         if len(retry) != 0 {
+             // shard is busy, rest is sent on next flush
+             return nil
+         }
+     }
+     return nil
+}
+
+func (s *kinesisSink) flushLoop(interval time.Duration) {
+     t := time.NewTicker(interval)
+     defer t.Stop()
+     for {
+         select {
+         case <-s.done:
+             return
+         case <-t.C:
+             s.Lock()
+             if err := s.flush(); err != nil {
+                 telemetry_log.Errorln("Failed to write rows:", err)
+             }
+             s.Unlock()
+         }
+     }
+}
+
+func (s *kinesisSink) close() error {
+     close(s.done)
+     s.Lock()
+     defer s.Unlock()
+     return s.flush()
+}
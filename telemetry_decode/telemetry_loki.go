@@ -0,0 +1,323 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sync"
+       "sort"
+       "bytes"
+       "strings"
+       "strconv"
+       "net/url"
+       "net/http"
+       "io/ioutil"
+       "encoding/json"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                   L O K I   S I N K                     ///////
+///////////////////////////////////////////////////////////////////////
+// -out loki:<host:port>[?labels=..&job=..&paths=..&tenant=..&user=..&password=..&batch=..&flush=..&buffer=..]
+// Rows are pushed to /loki/api/v1/push as log lines, line is the row as
+// json, same as NATS output, time is the row time. Stream labels are job
+// (default telemetry) and labels=<label>[:<field>],.. where field is
+//   node          node the row is from
+//   subscription  subscription the row is from
+//   path          sensor path with model name
+//   model         model name, Cisco-IOS-XR-infra-syslog-oper
+// default node,subscription,path. Keys are not labels, too many streams,
+// they are in the line. paths=<prefix>,.. sends only rows of sensor paths
+// starting with a prefix, for event style paths, syslog, inventory.
+// Lines are pushed every flush interval (default 1s), in requests of batch
+// lines (default 1000). Requests failing with a connection error, 429 or
+// 5xx are retried with backoff, lines are kept for the next flush up to
+// buffer lines (default 100000). Lines rejected with 400 are dropped.
+
+func init() {
+     mdtSinkTypes["loki"] = mdtNewLokiSink
+}
+
+type lokiLabel struct {
+     name  string
+     field string
+}
+
+type lokiEntry struct {
+     stream string             // labels of the stream, sorted
+     labels map[string]string
+     ts     string
+     line   string
+}
+
+type lokiStream struct {
+     Stream map[string]string `json:"stream"`
+     Values [][2]string        `json:"values"`
+}
+
+type lokiSink struct {
+     sync.Mutex
+     url      string
+     job      string
+     labels   []lokiLabel
+     paths    []string
+     tenant   string
+     user     string
+     password string
+     batch    int
+     max      int
+     entries  []*lokiEntry
+     dropped  int
+     done     chan struct{}
+     client   *http.Client
+}
+
+const lokiMaxRetries = 3
+
+func mdtNewLokiSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("loki output needs an address, loki:<host:port>")
+     }
+     if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+         address = "http://" + address
+     }
+     s := &lokiSink{
+              url:      strings.TrimSuffix(address, "/") + "/loki/api/v1/push",
+              job:      "telemetry",
+              tenant:   options.Get("tenant"),
+              user:     options.Get("user"),
+              password: options.Get("password"),
+              batch:    1000,
+              max:      100000,
+              done:     make(chan struct{}),
+              client:   &http.Client{Timeout: 30 * time.Second},
+          }
+     if j, ok := options["job"]; ok {
+         s.job = j[0]
+     }
+
+     labels := options.Get("labels")
+     if labels == "" {
+         labels = "node,subscription,path"
+     }
+     for _, l := range strings.Split(labels, ",") {
+         nf := strings.SplitN(l, ":", 2)
+         label := lokiLabel{name: nf[0], field: nf[0]}
+         if len(nf) == 2 {
+             label.field = nf[1]
+         }
+         switch label.field {
+         case "node", "subscription", "path", "model":
+         default:
+             return nil, fmt.Errorf("unsupported label field %s, Options: node,subscription,path,model", label.field)
+         }
+         if label.name == "" || label.name == "job" {
+             return nil, fmt.Errorf("invalid label name %q", label.name)
+         }
+         s.labels = append(s.labels, label)
+     }
+     if p := options.Get("paths"); p != "" {
+         s.paths = strings.Split(p, ",")
+     }
+     if b := options.Get("batch"); b != "" {
+         if s.batch, err = strconv.Atoi(b); err != nil || s.batch <= 0 {
+             return nil, fmt.Errorf("invalid batch %s", b)
+         }
+     }
+     if b := options.Get("buffer"); b != "" {
+         if s.max, err = strconv.Atoi(b); err != nil || s.max <= 0 {
+             return nil, fmt.Errorf("invalid buffer %s", b)
+         }
+     }
+     flush := time.Second
+     if f := options.Get("flush"); f != "" {
+         if flush, err = time.ParseDuration(f); err != nil || flush <= 0 {
+             return nil, fmt.Errorf("invalid flush interval %s", f)
+         }
+     }
+
+     go s.flushLoop(flush)
+     return s, nil
+}
+
+// rows of other sensor paths are not sent
+func (s *lokiSink) selected(path string) bool {
+     if len(s.paths) == 0 {
+         return true
+     }
+     for _, p := range s.paths {
+         if strings.HasPrefix(path, p) {
+             return true
+         }
+     }
+     return false
+}
+
+func (s *lokiSink) writeRows(rows []*MdtRow) error {
+     s.Lock()
+     defer s.Unlock()
+
+     for _, row := range rows {
+         if !s.selected(row.EncodingPath) {
+             continue
+         }
+         line, err := json.Marshal(row)
+         if err != nil {
+             return err
+         }
+
+         labels := map[string]string{}
+         if s.job != "" {
+             labels["job"] = s.job
+         }
+         for _, l := range s.labels {
+             var value string
+             switch l.field {
+             case "node":
+                 value = row.NodeId
+             case "subscription":
+                 value = row.Subscription
+             case "path":
+                 value = row.EncodingPath
+             case "model":
+                 if i := strings.Index(row.EncodingPath, ":"); i >= 0 {
+                     value = row.EncodingPath[:i]
+                 }
+             }
+             // loki drops labels with empty values
+             if value != "" {
+                 labels[l.name] = value
+             }
+         }
+         var names []string
+         for k := range labels {
+             names = append(names, k)
+         }
+         sort.Strings(names)
+         var stream []string
+         for _, k := range names {
+             stream = append(stream, k + "=" + strconv.Quote(labels[k]))
+         }
+
+         s.entries = append(s.entries, &lokiEntry{
+                                           stream: strings.Join(stream, ","),
+                                           labels: labels,
+                                           ts:     strconv.FormatUint(row.Timestamp * uint64(time.Millisecond), 10),
+                                           line:   string(line),
+                                       })
+     }
+     if len(s.entries) > s.max {
+         s.dropped += len(s.entries) - s.max
+         s.entries = s.entries[len(s.entries) - s.max:]
+     }
+     return nil
+}
+
+// send buffered lines, called with lock held
+func (s *lokiSink) flush() error {
+     if s.dropped != 0 {
+         telemetry_log.Errorf("loki: dropped %d lines\n", s.dropped)
+         s.dropped = 0
+     }
+     for len(s.entries) != 0 {
+         n := len(s.entries)
+         if n > s.batch {
+             n = s.batch
+         }
+         if err := s.push(s.entries[:n]); err != nil {
+             return err
+         }
+         s.entries = s.entries[n:]
+     }
+     s.entries = nil
+     return nil
+}
+
+// send a request, retried with backoff on connection errors, 429 and 5xx
+func (s *lokiSink) push(entries []*lokiEntry) error {
+     var streams []*lokiStream
+     byStream := map[string]*lokiStream{}
+     for _, e := range entries {
+         st, ok := byStream[e.stream]
+         if !ok {
+             st = &lokiStream{Stream: e.labels}
+             byStream[e.stream] = st
+             streams = append(streams, st)
+         }
+         st.Values = append(st.Values, [2]string{e.ts, e.line})
+     }
+     body, err := json.Marshal(map[string]interface{}{"streams": streams})
+     if err != nil {
+         return err
+     }
+
+     backoff := time.Second
+     for i := 0; ; i++ {
+         if i != 0 {
+             time.Sleep(backoff)
+             backoff *= 2
+         }
+         req, err := http.NewRequest("POST", s.url, bytes.NewReader(body))
+         if err != nil {
+             return err
+         }
+         req.Header.Set("Content-Type", "application/json")
+         if s.tenant != "" {
+             req.Header.Set("X-Scope-OrgID", s.tenant)
+         }
+         if s.user != "" {
+             req.SetBasicAuth(s.user, s.password)
+         }
+         resp, err := s.client.Do(req)
+         if err != nil {
+             if i == lokiMaxRetries {
+                 return err
+             }
+             continue
+         }
+         msg, _ := ioutil.ReadAll(resp.Body)
+         resp.Body.Close()
+
+         switch {
+         case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+             if i == lokiMaxRetries {
+                 return fmt.Errorf("loki: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+             }
+             continue
+         case resp.StatusCode == http.StatusBadRequest:
+             // out of order or too old lines, sending them again would not help
+             telemetry_log.Errorf("loki: %d lines rejected, %s\n", len(entries), strings.TrimSpace(string(msg)))
+             return nil
+         case resp.StatusCode >= 300:
+             return fmt.Errorf("loki: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+         }
+         return nil
+     }
+}
+
+func (s *lokiSink) flushLoop(interval time.Duration) {
+     t := time.NewTicker(interval)
+     defer t.Stop()
+     for {
+         select {
+         case <-s.done:
+             return
+         case <-t.C:
+             s.Lock()
+             if err := s.flush(); err != nil {
+                 telemetry_log.Errorln("Failed to write rows:", err)
+             }
+             s.Unlock()
+         }
+     }
+}
+
+func (s *lokiSink) close() error {
+     close(s.done)
+     s.Lock()
+     defer s.Unlock()
+     return s.flush()
+}
@@ -0,0 +1,201 @@
+package telemetry_decode
+
+import (
+       "os"
+       "fmt"
+       "bytes"
+       "strings"
+       "strconv"
+       "net/url"
+       "io/ioutil"
+       "crypto/tls"
+       "text/template"
+       "time"
+
+       mqtt "github.com/eclipse/paho.mqtt.golang"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                   M Q T T   S I N K                     ///////
+///////////////////////////////////////////////////////////////////////
+// -out mqtt:<host:port>[?topic=..&format=..&qos=..&retain=true&client_id=..&user=..&password=..&tls=true&ca=..]
+// Rows are published as json to a topic, a template, default
+// telemetry/{{.Node}}/{{.Path}}, fields are
+//   .Node          node the row is from
+//   .Model         model name, Cisco-IOS-XR-infra-statsd-oper
+//   .Path          sensor path without model name
+//   .Subscription  subscription the row is from
+// so consumers can subscribe to telemetry/+/infra-statistics/#. QoS is
+// 0, 1 or 2 (default 0), with 1 and 2 every message waits for the broker
+// to ack its rows. Client reconnects if connection is lost.
+// Payload is json, format=msgpack, or another row format, changes it.
+
+func init() {
+     mdtSinkTypes["mqtt"] = mdtNewMqttSink
+}
+
+type mqttTopicVars struct {
+     Node         string
+     Model        string
+     Path         string
+     Subscription string
+}
+
+type mqttSink struct {
+     client    mqtt.Client
+     topic     *template.Template
+     qos       byte
+     retain    bool
+     format    *mdtRowFormat
+     // connected with the first rows, reconnected by the client after
+     connected bool
+     address   string
+}
+
+// topic level, no separators or wildcards
+var mqttReplacer = strings.NewReplacer("/", "_", "+", "_", "#", "_")
+
+func mdtNewMqttSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("mqtt output needs an address, mqtt:<host:port>")
+     }
+     tlsOn := options.Get("tls") == "true" || options.Get("ca") != ""
+     if !strings.Contains(address, "://") {
+         if tlsOn {
+             address = "ssl://" + address
+         } else {
+             address = "tcp://" + address
+         }
+     }
+     s := &mqttSink{}
+
+     topic := options.Get("topic")
+     if topic == "" {
+         topic = "telemetry/{{.Node}}/{{.Path}}"
+     }
+     if s.topic, err = template.New("topic").Parse(topic); err != nil {
+         return nil, fmt.Errorf("topic template %s: %v", topic, err)
+     }
+     if err = s.topic.Execute(ioutil.Discard, &mqttTopicVars{}); err != nil {
+         return nil, fmt.Errorf("topic template %s: %v", topic, err)
+     }
+     if q := options.Get("qos"); q != "" {
+         qos, err := strconv.Atoi(q)
+         if err != nil || qos < 0 || qos > 2 {
+             return nil, fmt.Errorf("invalid qos %s, Options: 0,1,2", q)
+         }
+         s.qos = byte(qos)
+     }
+     if r := options.Get("retain"); r != "" {
+         if s.retain, err = strconv.ParseBool(r); err != nil {
+             return nil, fmt.Errorf("invalid retain %s", r)
+         }
+     }
+     if s.format, err = mdtGetRowFormat(options); err != nil {
+         return nil, err
+     }
+
+     // every sink needs its own client id, broker drops a client when
+     // another connects with the same id
+     clientId := options.Get("client_id")
+     if clientId == "" {
+         clientId = "telemetry-go-collector"
+     }
+     clientId = fmt.Sprintf("%s-%d-%d", clientId, os.Getpid(), time.Now().UnixNano() % 1000000)
+
+     opts := mqtt.NewClientOptions().
+                  AddBroker(address).
+                  SetClientID(clientId).
+                  SetAutoReconnect(true).
+                  SetConnectionLostHandler(func(_ mqtt.Client, err error) {
+                      telemetry_log.Errorln("mqtt: connection lost,", err)
+                  })
+     if u := options.Get("user"); u != "" {
+         opts.SetUsername(u)
+         opts.SetPassword(options.Get("password"))
+     }
+     if tlsOn {
+         tlsConfig := &tls.Config{}
+         if ca := options.Get("ca"); ca != "" {
+             if tlsConfig, err = telemetry_tls.NewClientConfig(ca, "", 0); err != nil {
+                 return nil, err
+             }
+         }
+         opts.SetTLSConfig(tlsConfig)
+     }
+
+     s.client = mqtt.NewClient(opts)
+     s.address = address
+     return s, nil
+}
+
+func (s *mqttSink) connect() error {
+     t := s.client.Connect()
+     if !t.WaitTimeout(30 * time.Second) {
+         return fmt.Errorf("mqtt: connect to %s timed out", s.address)
+     }
+     if err := t.Error(); err != nil {
+         return err
+     }
+     s.connected = true
+     return nil
+}
+
+func (s *mqttSink) writeRows(rows []*MdtRow) error {
+     var tokens []mqtt.Token
+
+     if !s.connected {
+         if err := s.connect(); err != nil {
+             return err
+         }
+     }
+
+     for _, row := range rows {
+         vars := mqttTopicVars{
+                     Node:         mqttReplacer.Replace(row.NodeId),
+                     Path:         row.EncodingPath,
+                     Subscription: mqttReplacer.Replace(row.Subscription),
+                 }
+         if i := strings.Index(row.EncodingPath, ":"); i >= 0 {
+             vars.Model, vars.Path = mqttReplacer.Replace(row.EncodingPath[:i]), row.EncodingPath[i+1:]
+         }
+         vars.Path = strings.NewReplacer("+", "_", "#", "_").Replace(vars.Path)
+
+         var topic bytes.Buffer
+         if err := s.topic.Execute(&topic, &vars); err != nil {
+             return err
+         }
+         data, err := s.format.marshal(row)
+         if err != nil {
+             return err
+         }
+         tokens = append(tokens, s.client.Publish(topic.String(), s.qos, s.retain, data))
+     }
+
+     if s.qos == 0 {
+         return nil
+     }
+     for _, t := range tokens {
+         if !t.WaitTimeout(30 * time.Second) {
+             return fmt.Errorf("mqtt: no ack from broker")
+         }
+         if err := t.Error(); err != nil {
+             return err
+         }
+     }
+     return nil
+}
+
+func (s *mqttSink) close() error {
+     if !s.connected {
+         return nil
+     }
+     // wait up to a second for publishes in flight
+     s.client.Disconnect(1000)
+     return nil
+}
@@ -0,0 +1,35 @@
+package telemetry_decode
+
+import (
+       "bytes"
+
+       "github.com/vmihailenco/msgpack/v5"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////            M E S S A G E P A C K   F O R M A T          ///////
+///////////////////////////////////////////////////////////////////////
+// format=msgpack, or -out msgpack:<file>. Row is a map with the same
+// names as json, node_id, subscription, encoding_path, collection_id,
+// timestamp, keys and content, integers are sent in as few bytes as
+// they need. Rows in files or aggregated records follow each other
+// without separator, a msgpack stream.
+
+func init() {
+     mdtRegisterRowFormat(&mdtRowFormat{
+                              name:    "msgpack",
+                              suffix:  ".msgpack",
+                              marshal: mdtMsgpackRow,
+                          })
+}
+
+func mdtMsgpackRow(row *MdtRow) ([]byte, error) {
+     var b bytes.Buffer
+     enc := msgpack.NewEncoder(&b)
+     enc.SetCustomStructTag("json")
+     enc.UseCompactInts(true)
+     if err := enc.Encode(row); err != nil {
+         return nil, err
+     }
+     return b.Bytes(), nil
+}
@@ -0,0 +1,234 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "bytes"
+       "strings"
+       "net/url"
+       "io/ioutil"
+       "crypto/tls"
+       "text/template"
+       "time"
+
+       "github.com/nats-io/nats.go"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                   N A T S   S I N K                     ///////
+///////////////////////////////////////////////////////////////////////
+// -out nats:<host:port>[?subject=..&format=..&jetstream=true&stream=..&user=..&password=..&token=..&tls=true&ca=..]
+// Rows are published as json to a subject, a template, default
+// telemetry.{{.Node}}.{{.Path}}, fields are
+//   .Node          node the row is from, "." replaced by "_"
+//   .Model         model name, Cisco-IOS-XR-infra-statsd-oper
+//   .Path          sensor path without model name, "/" replaced by "."
+//   .Subscription  subscription the row is from
+// so consumers can subscribe to telemetry.*.infra-statistics.>.
+// With jetstream=true rows are published to JetStream and every message
+// waits for the acks. stream=<name> creates the stream if it does not
+// exist, for subjects starting with the subject template up to the first
+// field, telemetry.> by default. Connection is re-established if lost,
+// rows published while disconnected are buffered by the client.
+// format=msgpack publishes rows as MessagePack instead of json.
+
+func init() {
+     mdtSinkTypes["nats"] = mdtNewNatsSink
+}
+
+type natsSubjectVars struct {
+     Node         string
+     Model        string
+     Path         string
+     Subscription string
+}
+
+type natsSink struct {
+     nc      *nats.Conn
+     js      nats.JetStreamContext
+     subject *template.Template
+     format  *mdtRowFormat
+
+     // connected with the first rows
+     address   string
+     opts      []nats.Option
+     jetstream bool
+     stream    string
+     template  string
+}
+
+// subject token, no separators, wildcards or white space
+var natsReplacer = strings.NewReplacer(".", "_", "*", "_", ">", "_", " ", "_", "\t", "_")
+
+func mdtNewNatsSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("nats output needs an address, nats:<host:port>")
+     }
+     if !strings.Contains(address, "://") {
+         address = "nats://" + address
+     }
+     s := &natsSink{}
+
+     subject := options.Get("subject")
+     if subject == "" {
+         subject = "telemetry.{{.Node}}.{{.Path}}"
+     }
+     if s.subject, err = template.New("subject").Parse(subject); err != nil {
+         return nil, fmt.Errorf("subject template %s: %v", subject, err)
+     }
+     if err = s.subject.Execute(ioutil.Discard, &natsSubjectVars{}); err != nil {
+         return nil, fmt.Errorf("subject template %s: %v", subject, err)
+     }
+     if s.format, err = mdtGetRowFormat(options); err != nil {
+         return nil, err
+     }
+
+     opts := []nats.Option{
+                 nats.Name("telemetry-go-collector"),
+                 nats.MaxReconnects(-1),
+                 nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+                     if err != nil {
+                         telemetry_log.Errorln("nats: disconnected,", err)
+                     }
+                 }),
+                 nats.ReconnectHandler(func(nc *nats.Conn) {
+                     telemetry_log.Println("nats: reconnected to", nc.ConnectedUrl())
+                 }),
+             }
+     if u := options.Get("user"); u != "" {
+         opts = append(opts, nats.UserInfo(u, options.Get("password")))
+     }
+     if t := options.Get("token"); t != "" {
+         opts = append(opts, nats.Token(t))
+     }
+     if options.Get("tls") == "true" || options.Get("ca") != "" {
+         tlsConfig := &tls.Config{}
+         if ca := options.Get("ca"); ca != "" {
+             if tlsConfig, err = telemetry_tls.NewClientConfig(ca, "", 0); err != nil {
+                 return nil, err
+             }
+         }
+         opts = append(opts, nats.Secure(tlsConfig))
+     }
+
+     s.address, s.opts = address, opts
+     s.jetstream = options.Get("jetstream") == "true"
+     s.stream, s.template = options.Get("stream"), subject
+     return s, nil
+}
+
+// connect, and set up jetstream, tried again with the next rows if it fails
+func (s *natsSink) connect() error {
+     nc, err := nats.Connect(s.address, s.opts...)
+     if err != nil {
+         return err
+     }
+     if s.jetstream {
+         if s.js, err = nc.JetStream(); err != nil {
+             nc.Close()
+             return err
+         }
+         if s.stream != "" {
+             if err = s.addStream(s.stream, s.template); err != nil {
+                 nc.Close()
+                 return err
+             }
+         }
+     }
+     s.nc = nc
+     return nil
+}
+
+// create stream for the subjects of the template if it does not exist
+func (s *natsSink) addStream(stream string, subject string) error {
+     prefix := subject
+     if i := strings.Index(subject, "{{"); i >= 0 {
+         prefix = subject[:i]
+     }
+     if !strings.HasSuffix(prefix, ".") {
+         return fmt.Errorf("stream %s: subject %s needs a fixed first token, telemetry.{{.Node}}", stream, subject)
+     }
+     if _, err := s.js.StreamInfo(stream); err == nil {
+         return nil
+     }
+     _, err := s.js.AddStream(&nats.StreamConfig{Name: stream, Subjects: []string{prefix + ">"}})
+     if err != nil {
+         return fmt.Errorf("stream %s: %v", stream, err)
+     }
+     telemetry_log.Printf("nats: created stream %s for %s>\n", stream, prefix)
+     return nil
+}
+
+func (s *natsSink) writeRows(rows []*MdtRow) error {
+     var acks []nats.PubAckFuture
+
+     if s.nc == nil {
+         if err := s.connect(); err != nil {
+             return err
+         }
+     }
+
+     for _, row := range rows {
+         vars := natsSubjectVars{
+                     Node:         natsReplacer.Replace(row.NodeId),
+                     Path:         row.EncodingPath,
+                     Subscription: natsReplacer.Replace(row.Subscription),
+                 }
+         if i := strings.Index(row.EncodingPath, ":"); i >= 0 {
+             vars.Model, vars.Path = natsReplacer.Replace(row.EncodingPath[:i]), row.EncodingPath[i+1:]
+         }
+         var tokens []string
+         for _, t := range strings.Split(vars.Path, "/") {
+             tokens = append(tokens, natsReplacer.Replace(t))
+         }
+         vars.Path = strings.Join(tokens, ".")
+
+         var subject bytes.Buffer
+         if err := s.subject.Execute(&subject, &vars); err != nil {
+             return err
+         }
+         data, err := s.format.marshal(row)
+         if err != nil {
+             return err
+         }
+
+         if s.js == nil {
+             if err = s.nc.Publish(subject.String(), data); err != nil {
+                 return err
+             }
+             continue
+         }
+         ack, err := s.js.PublishAsync(subject.String(), data)
+         if err != nil {
+             return err
+         }
+         acks = append(acks, ack)
+     }
+
+     for _, ack := range acks {
+         select {
+         case <-ack.Ok():
+         case err := <-ack.Err():
+             return err
+         case <-time.After(30 * time.Second):
+             return fmt.Errorf("nats: no ack from jetstream")
+         }
+     }
+     return nil
+}
+
+func (s *natsSink) close() error {
+     if s.nc == nil {
+         return nil
+     }
+     // publishes buffered by the client are sent before closing
+     err := s.nc.Drain()
+     for !s.nc.IsClosed() {
+         time.Sleep(10 * time.Millisecond)
+     }
+     return err
+}
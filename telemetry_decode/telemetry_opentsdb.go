@@ -0,0 +1,267 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sync"
+       "bytes"
+       "strings"
+       "strconv"
+       "net/url"
+       "net/http"
+       "io/ioutil"
+       "encoding/json"
+       "text/template"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////               O P E N T S D B   S I N K                 ///////
+///////////////////////////////////////////////////////////////////////
+// -out opentsdb:<host:port>[?metric=..&batch=..&flush=..&buffer=..]
+// Numeric leafs of the content are sent to /api/put as data points, keys
+// of the row and node become tags. Metric name is a template, default
+// {{.Path}}.{{.Leaf}}, fields are
+//   .Model         model name, Cisco-IOS-XR-infra-statsd-oper
+//   .Path          sensor path without model name, "/" replaced by "."
+//   .Leaf          leaf name, nested leafs joined with "."
+// Data points are sent every flush interval (default 1s), in requests of
+// batch data points (default 50). Requests failing with a connection
+// error or 5xx are retried with backoff, data points are kept for the next
+// flush up to buffer data points (default 100000). Data points rejected
+// with 400 are dropped.
+
+func init() {
+     mdtSinkTypes["opentsdb"] = mdtNewOpentsdbSink
+}
+
+type opentsdbMetricVars struct {
+     Model string
+     Path  string
+     Leaf  string
+}
+
+type opentsdbPoint struct {
+     Metric    string            `json:"metric"`
+     Timestamp uint64            `json:"timestamp"`
+     Value     json.Number       `json:"value"`
+     Tags      map[string]string `json:"tags"`
+}
+
+type opentsdbSink struct {
+     sync.Mutex
+     url     string
+     metric  *template.Template
+     batch   int
+     max     int
+     points  []*opentsdbPoint
+     dropped int
+     done    chan struct{}
+     client  *http.Client
+}
+
+const opentsdbMaxRetries = 3
+
+func mdtNewOpentsdbSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("opentsdb output needs an address, opentsdb:<host:port>")
+     }
+     if !strings.HasPrefix(address, "http://") && !strings.HasPrefix(address, "https://") {
+         address = "http://" + address
+     }
+     s := &opentsdbSink{
+              url:    strings.TrimSuffix(address, "/") + "/api/put?details",
+              batch:  50,
+              max:    100000,
+              done:   make(chan struct{}),
+              client: &http.Client{Timeout: 30 * time.Second},
+          }
+
+     metric := options.Get("metric")
+     if metric == "" {
+         metric = "{{.Path}}.{{.Leaf}}"
+     }
+     if s.metric, err = template.New("metric").Parse(metric); err != nil {
+         return nil, fmt.Errorf("metric template %s: %v", metric, err)
+     }
+     if err = s.metric.Execute(ioutil.Discard, &opentsdbMetricVars{}); err != nil {
+         return nil, fmt.Errorf("metric template %s: %v", metric, err)
+     }
+     if b := options.Get("batch"); b != "" {
+         if s.batch, err = strconv.Atoi(b); err != nil || s.batch <= 0 {
+             return nil, fmt.Errorf("invalid batch %s", b)
+         }
+     }
+     if b := options.Get("buffer"); b != "" {
+         if s.max, err = strconv.Atoi(b); err != nil || s.max <= 0 {
+             return nil, fmt.Errorf("invalid buffer %s", b)
+         }
+     }
+     flush := time.Second
+     if f := options.Get("flush"); f != "" {
+         if flush, err = time.ParseDuration(f); err != nil || flush <= 0 {
+             return nil, fmt.Errorf("invalid flush interval %s", f)
+         }
+     }
+
+     go s.flushLoop(flush)
+     return s, nil
+}
+
+// opentsdb allows letters, digits, "-", "_", "." and "/" in names
+func opentsdbName(s string) string {
+     return strings.Map(func(r rune) rune {
+         if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+            r == '-' || r == '_' || r == '.' || r == '/' {
+             return r
+         }
+         return '_'
+     }, s)
+}
+
+func (s *opentsdbSink) writeRows(rows []*MdtRow) error {
+     s.Lock()
+     defer s.Unlock()
+
+     for _, row := range rows {
+         vars := opentsdbMetricVars{Path: row.EncodingPath}
+         if i := strings.Index(row.EncodingPath, ":"); i >= 0 {
+             vars.Model, vars.Path = row.EncodingPath[:i], row.EncodingPath[i+1:]
+         }
+         vars.Path = strings.Replace(vars.Path, "/", ".", -1)
+
+         tags := map[string]string{"node": opentsdbName(row.NodeId)}
+         keys := map[string]interface{}{}
+         mdtFlatten(keys, "", row.Keys)
+         for k, v := range keys {
+             if value := opentsdbName(fmt.Sprint(v)); value != "" {
+                 tags[opentsdbName(k)] = value
+             }
+         }
+
+         fields := map[string]interface{}{}
+         mdtFlatten(fields, "", row.Content)
+         for leaf, v := range fields {
+             value, ok := mdtMetricValue(v)
+             if !ok {
+                 continue
+             }
+             vars.Leaf = leaf
+             var metric bytes.Buffer
+             if err := s.metric.Execute(&metric, &vars); err != nil {
+                 return err
+             }
+             s.points = append(s.points, &opentsdbPoint{
+                                             Metric:    opentsdbName(metric.String()),
+                                             Timestamp: row.Timestamp,
+                                             Value:     json.Number(value),
+                                             Tags:      tags,
+                                         })
+         }
+     }
+     if len(s.points) > s.max {
+         s.dropped += len(s.points) - s.max
+         s.points = s.points[len(s.points) - s.max:]
+     }
+     return nil
+}
+
+// send buffered data points, called with lock held
+func (s *opentsdbSink) flush() error {
+     if s.dropped != 0 {
+         telemetry_log.Errorf("opentsdb: dropped %d data points\n", s.dropped)
+         s.dropped = 0
+     }
+     for len(s.points) != 0 {
+         n := len(s.points)
+         if n > s.batch {
+             n = s.batch
+         }
+         if err := s.put(s.points[:n]); err != nil {
+             return err
+         }
+         s.points = s.points[n:]
+     }
+     s.points = nil
+     return nil
+}
+
+type opentsdbPutResponse struct {
+     Failed int `json:"failed"`
+     Errors []struct {
+         Error string `json:"error"`
+     } `json:"errors"`
+}
+
+// send a request, retried with backoff on connection errors and 5xx
+func (s *opentsdbSink) put(points []*opentsdbPoint) error {
+     body, err := json.Marshal(points)
+     if err != nil {
+         return err
+     }
+
+     backoff := time.Second
+     for i := 0; ; i++ {
+         if i != 0 {
+             time.Sleep(backoff)
+             backoff *= 2
+         }
+         resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(body))
+         if err != nil {
+             if i == opentsdbMaxRetries {
+                 return err
+             }
+             continue
+         }
+         msg, _ := ioutil.ReadAll(resp.Body)
+         resp.Body.Close()
+
+         switch {
+         case resp.StatusCode >= 500:
+             if i == opentsdbMaxRetries {
+                 return fmt.Errorf("opentsdb: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+             }
+             continue
+         case resp.StatusCode == http.StatusBadRequest:
+             // bad data points, sending them again would not help
+             var r opentsdbPutResponse
+             json.Unmarshal(msg, &r)
+             if len(r.Errors) != 0 {
+                 telemetry_log.Errorf("opentsdb: %d data points failed, %s\n", r.Failed, r.Errors[0].Error)
+             } else {
+                 telemetry_log.Errorf("opentsdb: %s: %s\n", resp.Status, strings.TrimSpace(string(msg)))
+             }
+             return nil
+         case resp.StatusCode >= 300:
+             return fmt.Errorf("opentsdb: %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+         }
+         return nil
+     }
+}
+
+func (s *opentsdbSink) flushLoop(interval time.Duration) {
+     t := time.NewTicker(interval)
+     defer t.Stop()
+     for {
+         select {
+         case <-s.done:
+             return
+         case <-t.C:
+             s.Lock()
+             if err := s.flush(); err != nil {
+                 telemetry_log.Errorln("Failed to write rows:", err)
+             }
+             s.Unlock()
+         }
+     }
+}
+
+func (s *opentsdbSink) close() error {
+     close(s.done)
+     s.Lock()
+     defer s.Unlock()
+     return s.flush()
+}
@@ -0,0 +1,117 @@
+package telemetry_decode
+
+import (
+       "os"
+       "fmt"
+       "bytes"
+       "strings"
+       "path/filepath"
+       "text/template"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////     T E M P L A T E D   O U T P U T   F I L E S         ///////
+///////////////////////////////////////////////////////////////////////
+// If out file has {{ }}, it is a template expanded for every session,
+//   /data/{{.Router}}/{{.Subscription}}-{{.Date}}.json
+// Template is expanded again as time goes by, when the name changes
+// current file is closed and the new one is opened, so {{.Date}} rotates
+// files daily and {{.Date}}-{{.Hour}} hourly. Files are appended to and
+// directories are created as needed.
+//   .Router        router the session is from
+//   .Subscription  subscription name, dialin only
+//   .Date          2006-01-02
+//   .Hour          15
+//   .Time          current time, for other layouts, {{.Time.Format "2006-01"}}
+
+type mdtOutFileVars struct {
+     Router       string
+     Subscription string
+     Date         string
+     Hour         string
+     Time         time.Time
+}
+
+var pathReplacer = strings.NewReplacer("/", "_", string(os.PathSeparator), "_")
+
+func mdtIsOutTemplate(outFile string) bool {
+     return strings.Contains(outFile, "{{")
+}
+
+func (o *MdtOut)mdtParseOutTemplate() error {
+     t, err := template.New("out").Parse(o.OutFile)
+     if err != nil {
+         return fmt.Errorf("out file template %s: %v", o.OutFile, err)
+     }
+     o.outTmpl = t
+     _, err = o.mdtExpandOutTemplate(time.Now())
+     return err
+}
+
+func (o *MdtOut)mdtExpandOutTemplate(now time.Time) (string, error) {
+     var b bytes.Buffer
+
+     err := o.outTmpl.Execute(&b, &mdtOutFileVars{
+                                     Router:       pathReplacer.Replace(o.Router),
+                                     Subscription: pathReplacer.Replace(o.Subscription),
+                                     Date:         now.Format("2006-01-02"),
+                                     Hour:         now.Format("15"),
+                                     Time:         now,
+                                  })
+     if err != nil {
+         return "", err
+     }
+     return b.String() + mdtCompressSuffix(o.OutCompress) + mdtEncryptSuffix(), nil
+}
+
+// open the file the template currently expands to, checked at most once
+// a second
+func (o *MdtOut)mdtRotateOut() error {
+     now := time.Now()
+     if now.Unix() == o.outChecked {
+         return nil
+     }
+     o.outChecked = now.Unix()
+
+     name, err := o.mdtExpandOutTemplate(now)
+     if err != nil {
+         return err
+     }
+     if o.oFile != nil && name == o.oFile.Name() {
+         return nil
+     }
+
+     o.mdtCloseOut()
+     if dir := filepath.Dir(name); dir != "" {
+         if err = os.MkdirAll(dir, 0755); err != nil {
+             return err
+         }
+     }
+     o.oFile, err = os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+     if err != nil {
+         return err
+     }
+     telemetry_log.Println("Out file:", name)
+     // compressed streams can be concatenated and encrypted files can
+     // have more than one header, so appending is fine
+     o.zWriter, err = mdtNewFileWriter(o.oFile, o.OutCompress)
+     return err
+}
+
+func (o *MdtOut)mdtCloseOut() error {
+     var err error
+     if o.zWriter != nil {
+         err = o.zWriter.Close()
+         o.zWriter = nil
+     }
+     if o.oFile != nil && o.oFile != os.Stdout {
+         if cerr := o.oFile.Close(); err == nil {
+             err = cerr
+         }
+     }
+     o.oFile = nil
+     return err
+}
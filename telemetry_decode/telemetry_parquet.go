@@ -0,0 +1,220 @@
+package telemetry_decode
+
+import (
+       "os"
+       "fmt"
+       "sort"
+       "strings"
+       "net/url"
+       "path/filepath"
+       "encoding/json"
+       "time"
+
+       "github.com/xitongsys/parquet-go/writer"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                 P A R Q U E T   S I N K                 ///////
+///////////////////////////////////////////////////////////////////////
+// -out parquet:<dir>[?partition=hour|day]
+// Rows are written to a file per sensor path, partitioned by row time,
+//   <dir>/<sensor path>/date=2019-03-06/hour=10/part-<time>-<pid>.parquet
+// Schema is derived from the first row of the sensor path in a partition,
+// node_id, subscription, encoding_path, collection_id, timestamp and the
+// flattened keys and content, keys__interface_name, content__bytes_received.
+// Leafs not in the schema are dropped. File has a .tmp suffix until it is
+// complete, so readers only see complete files.
+
+func init() {
+     mdtSinkTypes["parquet"] = mdtNewParquetSink
+}
+
+type parquetSink struct {
+     dir       string
+     partition string
+     files     map[string]*parquetFile
+}
+
+type parquetFile struct {
+     name      string
+     partition string
+     file      *os.File
+     pw        *writer.JSONWriter
+     columns   []parquetColumn
+}
+
+type parquetColumn struct {
+     name  string
+     field string         // flattened field name in row
+     typ   string
+}
+
+func mdtNewParquetSink(address string, options url.Values) (mdtSink, error) {
+     if address == "" {
+         return nil, fmt.Errorf("parquet output needs a directory, parquet:<dir>")
+     }
+     partition := options.Get("partition")
+     switch partition {
+     case "":
+         partition = "hour"
+     case "hour", "day":
+     default:
+         return nil, fmt.Errorf("unsupported partition %s, Options: hour,day", partition)
+     }
+     return &parquetSink{dir: address, partition: partition, files: map[string]*parquetFile{}}, nil
+}
+
+func (p *parquetSink) partitionDir(t time.Time) string {
+     t = t.UTC()
+     if p.partition == "day" {
+         return "date=" + t.Format("2006-01-02")
+     }
+     return "date=" + t.Format("2006-01-02") + "/hour=" + t.Format("15")
+}
+
+func (p *parquetSink) writeRows(rows []*MdtRow) error {
+     for _, row := range rows {
+         fields := row.Flatten()
+         partition := p.partitionDir(time.Unix(0, int64(row.Timestamp) * int64(time.Millisecond)))
+
+         f := p.files[row.EncodingPath]
+         if f != nil && f.partition != partition {
+             delete(p.files, row.EncodingPath)
+             if err := f.close(); err != nil {
+                 return err
+             }
+             f = nil
+         }
+         if f == nil {
+             var err error
+             f, err = p.open(row.EncodingPath, partition, fields)
+             if err != nil {
+                 return err
+             }
+             p.files[row.EncodingPath] = f
+         }
+         if err := f.write(row, fields); err != nil {
+             return err
+         }
+     }
+     return nil
+}
+
+func (p *parquetSink) close() error {
+     var err error
+     for path, f := range p.files {
+         if e := f.close(); e != nil {
+             err = e
+         }
+         delete(p.files, path)
+     }
+     return err
+}
+
+func parquetType(v interface{}) string {
+     switch v.(type) {
+     case int64, uint64:
+         return "type=INT64"
+     case float64:
+         return "type=DOUBLE"
+     case bool:
+         return "type=BOOLEAN"
+     default:
+         return "type=BYTE_ARRAY, convertedtype=UTF8"
+     }
+}
+
+func (p *parquetSink) open(encodingPath string, partition string, fields map[string]interface{}) (*parquetFile, error) {
+     f := &parquetFile{partition: partition}
+
+     f.columns = []parquetColumn{
+                    {name: "node_id", typ: "type=BYTE_ARRAY, convertedtype=UTF8"},
+                    {name: "subscription", typ: "type=BYTE_ARRAY, convertedtype=UTF8"},
+                    {name: "encoding_path", typ: "type=BYTE_ARRAY, convertedtype=UTF8"},
+                    {name: "collection_id", typ: "type=INT64"},
+                    {name: "timestamp", typ: "type=INT64, convertedtype=TIMESTAMP_MILLIS"},
+                 }
+     seen := map[string]bool{}
+     for _, c := range f.columns {
+         seen[c.name] = true
+     }
+     var names []string
+     for name := range fields {
+         names = append(names, name)
+     }
+     sort.Strings(names)
+     for _, name := range names {
+         col := mdtSafeName(name)
+         if seen[col] {
+             continue
+         }
+         seen[col] = true
+         f.columns = append(f.columns, parquetColumn{name: col, field: name, typ: parquetType(fields[name])})
+     }
+
+     var schema []string
+     for _, c := range f.columns {
+         schema = append(schema, fmt.Sprintf(`{"Tag":"name=%s, %s, repetitiontype=OPTIONAL"}`, c.name, c.typ))
+     }
+     jsonSchema := `{"Tag":"name=mdt, repetitiontype=REQUIRED","Fields":[` + strings.Join(schema, ",") + `]}`
+
+     dir := filepath.Join(p.dir, mdtSafeName(encodingPath), partition)
+     if err := os.MkdirAll(dir, 0755); err != nil {
+         return nil, err
+     }
+     f.name = filepath.Join(dir, fmt.Sprintf("part-%s-%d.parquet", time.Now().UTC().Format("20060102T150405.000000000"), os.Getpid()))
+
+     var err error
+     f.file, err = os.Create(f.name + ".tmp")
+     if err != nil {
+         return nil, err
+     }
+     f.pw, err = writer.NewJSONWriterFromWriter(jsonSchema, f.file, 1)
+     if err != nil {
+         f.file.Close()
+         os.Remove(f.name + ".tmp")
+         return nil, fmt.Errorf("parquet schema for %s: %v", encodingPath, err)
+     }
+     return f, nil
+}
+
+func (f *parquetFile) write(row *MdtRow, fields map[string]interface{}) error {
+     rec := map[string]interface{}{
+                "node_id":       row.NodeId,
+                "subscription":  row.Subscription,
+                "encoding_path": row.EncodingPath,
+                "collection_id": row.CollectionId,
+                "timestamp":     row.Timestamp,
+            }
+     for _, c := range f.columns[5:] {
+         v, ok := fields[c.field]
+         if !ok {
+             continue
+         }
+         // leaf of different type than in the schema is dropped
+         if parquetType(v) != c.typ {
+             continue
+         }
+         rec[c.name] = v
+     }
+
+     b, err := json.Marshal(rec)
+     if err != nil {
+         return err
+     }
+     return f.pw.Write(string(b))
+}
+
+func (f *parquetFile) close() error {
+     err := f.pw.WriteStop()
+     if e := f.file.Close(); err == nil {
+         err = e
+     }
+     if err != nil {
+         return fmt.Errorf("parquet file %s: %v", f.name, err)
+     }
+     telemetry_log.Println("Out file:", f.name)
+     return os.Rename(f.name + ".tmp", f.name)
+}
@@ -0,0 +1,116 @@
+package telemetry_decode
+
+import (
+       "bufio"
+       "fmt"
+       "os"
+       "strings"
+)
+
+// Path map file rewrites sensor paths, and names of keys and leafs of
+// their rows, so rows of native Cisco models look like rows of the
+// OpenConfig model, or any other, to pipelines of many vendors. A line
+// maps a sensor path, the lines below it, indented, map names of its
+// keys and leafs, nested leafs joined with ".",
+//   # sensor path = new path
+//   Cisco-IOS-XR-infra-statsd-oper:infra-statistics/interfaces/interface/latest/generic-counters = openconfig-interfaces:interfaces/interface/state/counters
+//     interface-name = name
+//     bytes-received = in-octets
+//     rates.input-rate = in-rate
+// Names not in the map are left as they are. Rows are rewritten as they
+// are decoded, for outputs of rows, sinks, table, tail, restream with
+// json and gNMI.
+
+type pathMapEntry struct {
+     path   string
+     fields map[string]string
+}
+
+var mdtPathMap map[string]*pathMapEntry
+
+// load path map file, rows are rewritten from now on
+func MdtPathMapLoad(fileName string) error {
+     f, err := os.Open(fileName)
+     if err != nil {
+         return err
+     }
+     defer f.Close()
+
+     pathMap := make(map[string]*pathMapEntry)
+     var entry *pathMapEntry
+     scanner := bufio.NewScanner(f)
+     for n := 1; scanner.Scan(); n++ {
+         text := scanner.Text()
+         line := strings.TrimSpace(text)
+         if line == "" || strings.HasPrefix(line, "#") {
+             continue
+         }
+         kv := strings.SplitN(line, "=", 2)
+         if len(kv) != 2 || strings.TrimSpace(kv[0]) == "" || strings.TrimSpace(kv[1]) == "" {
+             return fmt.Errorf("%s:%d: expected name = new name", fileName, n)
+         }
+         from, to := strings.TrimSpace(kv[0]), strings.TrimSpace(kv[1])
+         if text[0] == ' ' || text[0] == '\t' {
+             if entry == nil {
+                 return fmt.Errorf("%s:%d: leaf %s is not under a sensor path", fileName, n, from)
+             }
+             entry.fields[from] = to
+             continue
+         }
+         entry = &pathMapEntry{path: to, fields: make(map[string]string)}
+         pathMap[from] = entry
+     }
+     if err = scanner.Err(); err != nil {
+         return err
+     }
+     mdtPathMap = pathMap
+     return nil
+}
+
+func mdtPathMapRows(rows []*MdtRow) {
+     for _, row := range rows {
+         entry, ok := mdtPathMap[row.EncodingPath]
+         if !ok {
+             continue
+         }
+         row.EncodingPath = entry.path
+         for from, to := range entry.fields {
+             if !pathMapMove(row.Keys, from, to) {
+                 pathMapMove(row.Content, from, to)
+             }
+         }
+     }
+}
+
+// move leaf at from to to, names with "." are nested, false if there is
+// no leaf at from
+func pathMapMove(m map[string]interface{}, from, to string) bool {
+     names := strings.Split(from, ".")
+     parent := m
+     for _, name := range names[:len(names) - 1] {
+         sub, ok := parent[name].(map[string]interface{})
+         if !ok {
+             return false
+         }
+         parent = sub
+     }
+     last := names[len(names) - 1]
+     v, ok := parent[last]
+     if !ok {
+         return false
+     }
+     delete(parent, last)
+
+     names = strings.Split(to, ".")
+     parent = m
+     for _, name := range names[:len(names) - 1] {
+         sub, ok := parent[name].(map[string]interface{})
+         if !ok {
+             sub = map[string]interface{}{}
+             parent[name] = sub
+         }
+         parent = sub
+     }
+     parent[names[len(names) - 1]] = v
+     return true
+}
@@ -0,0 +1,117 @@
+package telemetry_decode
+
+import (
+       "strconv"
+       "strings"
+
+       "google.golang.org/protobuf/encoding/protowire"
+)
+
+// Dialout of other Cisco OS families uses the same MdtDialout rpc and
+// Telemetry message, with differences in what they carry. Platform of a
+// session selects how they are decoded,
+//   xr    IOS XR
+//   xe    IOS-XE, subscription is a number, subscription_id in field 4,
+//         not subscription_id_str
+//   nxos  NX-OS, key-value rows of DME paths hold objects, class name
+//         with attributes and children, every object becomes a row, at
+//         path of the message and class, sys/intf/l1PhysIf, attributes
+//         are the content and dn the key
+
+// subscription id of IOS-XE messages
+func mdtXeSubscription(data []byte) string {
+     for len(data) > 0 {
+         num, typ, n := protowire.ConsumeTag(data)
+         if n < 0 {
+             return ""
+         }
+         data = data[n:]
+         if num == 4 && typ == protowire.VarintType {
+             v, n := protowire.ConsumeVarint(data)
+             if n < 0 {
+                 return ""
+             }
+             return strconv.FormatUint(v, 10)
+         }
+         n = protowire.ConsumeFieldValue(num, typ, data)
+         if n < 0 {
+             return ""
+         }
+         data = data[n:]
+     }
+     return ""
+}
+
+func (o *MdtOut)mdtPlatformRows(data []byte, rows []*MdtRow) []*MdtRow {
+     switch o.Platform {
+     case "xe":
+         if len(rows) != 0 && rows[0].Subscription == "" {
+             subscription := mdtXeSubscription(data)
+             for _, row := range rows {
+                 row.Subscription = subscription
+             }
+         }
+     case "nxos":
+         var out []*MdtRow
+         for _, row := range rows {
+             out = append(out, mdtNxosRows(row, row.EncodingPath, row.Content)...)
+         }
+         return out
+     }
+     return rows
+}
+
+// a row per DME object in content, content that is not made of objects,
+// as of show command paths, is left as it is
+func mdtNxosRows(row *MdtRow, path string, content map[string]interface{}) []*MdtRow {
+     var rows []*MdtRow
+     objects := false
+     for class, v := range content {
+         for _, o := range mdtNxosList(v) {
+             obj, ok := o.(map[string]interface{})
+             if !ok {
+                 continue
+             }
+             attributes, ok := obj["attributes"].(map[string]interface{})
+             if !ok {
+                 continue
+             }
+             objects = true
+             r := *row
+             r.EncodingPath = strings.TrimSuffix(path, "/") + "/" + class
+             r.Keys = map[string]interface{}{}
+             for k, v := range row.Keys {
+                 r.Keys[k] = v
+             }
+             r.Content = map[string]interface{}{}
+             for k, v := range attributes {
+                 if k == "dn" {
+                     r.Keys[k] = v
+                 } else {
+                     r.Content[k] = v
+                 }
+             }
+             rows = append(rows, &r)
+             for _, child := range mdtNxosList(obj["children"]) {
+                 if c, ok := child.(map[string]interface{}); ok {
+                     rows = append(rows, mdtNxosRows(row, r.EncodingPath, c)...)
+                 }
+             }
+         }
+     }
+     if !objects {
+         return []*MdtRow{row}
+     }
+     return rows
+}
+
+// repeated names are lists, single ones not
+func mdtNxosList(v interface{}) []interface{} {
+     if l, ok := v.([]interface{}); ok {
+         return l
+     }
+     if v == nil {
+         return nil
+     }
+     return []interface{}{v}
+}
@@ -0,0 +1,281 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sync"
+       "sort"
+       "strings"
+       "strconv"
+       "hash/fnv"
+       "net/url"
+       "database/sql"
+       "encoding/json"
+       "time"
+
+       "github.com/lib/pq"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////              P O S T G R E S   S I N K                  ///////
+///////////////////////////////////////////////////////////////////////
+// -out postgres:<user:password@host:port/database>[?batch=..&flush=..&timescale=true]
+// Rows are written with COPY to a table per sensor path, named after the
+// path without model name, created from the first row,
+//   time timestamptz, node, subscription, collection_id, a column per
+//   key, content jsonb
+// With timescale=true table is made a hypertable on time. A batch is
+// written when it has batch rows (default 10000) or every flush interval
+// (default 5s). Other options, sslmode etc, are passed to the driver.
+// Failed batches are retried with the next flush, rows are dropped if
+// more than 10 batches are pending.
+
+func init() {
+     mdtSinkTypes["postgres"] = mdtNewPostgresSink
+}
+
+type postgresTable struct {
+     name    string
+     keys    []string        // flattened key names, keys.interface-name
+     types   []string
+     columns []string
+     rows    [][]interface{}
+}
+
+type postgresSink struct {
+     sync.Mutex
+     db        *sql.DB
+     timescale bool
+     batch     int
+     pending   int
+     tables    map[string]*postgresTable
+     done      chan struct{}
+}
+
+func mdtNewPostgresSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("postgres output needs an address, postgres:<user:password@host:port/database>")
+     }
+     s := &postgresSink{batch: 10000, tables: map[string]*postgresTable{}, done: make(chan struct{})}
+
+     if b := options.Get("batch"); b != "" {
+         if s.batch, err = strconv.Atoi(b); err != nil || s.batch <= 0 {
+             return nil, fmt.Errorf("invalid batch %s", b)
+         }
+     }
+     flush := 5 * time.Second
+     if f := options.Get("flush"); f != "" {
+         if flush, err = time.ParseDuration(f); err != nil || flush <= 0 {
+             return nil, fmt.Errorf("invalid flush interval %s", f)
+         }
+     }
+     if t := options.Get("timescale"); t != "" {
+         if s.timescale, err = strconv.ParseBool(t); err != nil {
+             return nil, fmt.Errorf("invalid timescale %s", t)
+         }
+     }
+     for _, o := range []string{"batch", "flush", "timescale"} {
+         options.Del(o)
+     }
+
+     dsn := "postgres://" + address
+     if len(options) != 0 {
+         dsn += "?" + options.Encode()
+     }
+     // connects with the first batch, tables are created with their first row
+     s.db, err = sql.Open("postgres", dsn)
+     if err != nil {
+         return nil, err
+     }
+
+     go s.flushLoop(flush)
+     return s, nil
+}
+
+func postgresType(v interface{}) string {
+     switch v.(type) {
+     case int64, uint64:
+         return "bigint"
+     case float64:
+         return "double precision"
+     case bool:
+         return "boolean"
+     default:
+         return "text"
+     }
+}
+
+// postgres truncates names to 63 characters, model name is left out,
+// infra_statistics_interfaces_interface_latest_generic_counters, longer
+// names keep the end of the path and a hash of it
+func postgresTableName(encodingPath string) string {
+     name := mdtSafeName(encodingPath[strings.Index(encodingPath, ":") + 1:])
+     if len(name) > 63 {
+         h := fnv.New32a()
+         h.Write([]byte(encodingPath))
+         name = fmt.Sprintf("%s_%08x", name[len(name) - 54:], h.Sum32())
+     }
+     return name
+}
+
+// table for the sensor path, keys of first row become columns
+func (s *postgresSink) table(row *MdtRow, fields map[string]interface{}) (*postgresTable, error) {
+     if t, ok := s.tables[row.EncodingPath]; ok {
+         return t, nil
+     }
+     t := &postgresTable{
+              name:    postgresTableName(row.EncodingPath),
+              columns: []string{"time", "node", "subscription", "collection_id"},
+          }
+     for name := range fields {
+         if strings.HasPrefix(name, "keys.") {
+             t.keys = append(t.keys, name)
+         }
+     }
+     sort.Strings(t.keys)
+
+     defs := []string{"time timestamptz NOT NULL", "node text", "subscription text", "collection_id bigint"}
+     for _, k := range t.keys {
+         col := mdtSafeName(strings.TrimPrefix(k, "keys."))
+         t.columns = append(t.columns, col)
+         t.types = append(t.types, postgresType(fields[k]))
+         defs = append(defs, pq.QuoteIdentifier(col) + " " + postgresType(fields[k]))
+     }
+     t.columns = append(t.columns, "content")
+     defs = append(defs, "content jsonb")
+
+     _, err := s.db.Exec("CREATE TABLE IF NOT EXISTS " + pq.QuoteIdentifier(t.name) + " (" + strings.Join(defs, ", ") + ")")
+     if err != nil {
+         return nil, fmt.Errorf("create table %s: %v", t.name, err)
+     }
+     if s.timescale {
+         _, err = s.db.Exec("SELECT create_hypertable($1, 'time', if_not_exists => TRUE)", t.name)
+         if err != nil {
+             return nil, fmt.Errorf("create hypertable %s: %v", t.name, err)
+         }
+     }
+     s.tables[row.EncodingPath] = t
+     return t, nil
+}
+
+func (s *postgresSink) writeRows(rows []*MdtRow) error {
+     s.Lock()
+     defer s.Unlock()
+
+     for _, row := range rows {
+         fields := row.Flatten()
+         t, err := s.table(row, fields)
+         if err != nil {
+             return err
+         }
+         content, err := json.Marshal(row.Content)
+         if err != nil {
+             return err
+         }
+
+         vals := []interface{}{
+                    time.Unix(0, int64(row.Timestamp) * int64(time.Millisecond)).UTC(),
+                    row.NodeId,
+                    row.Subscription,
+                    int64(row.CollectionId),
+                }
+         for i, k := range t.keys {
+             v := fields[k]
+             if u, ok := v.(uint64); ok {
+                 v = int64(u)
+             }
+             // key of different type than the column would fail the batch
+             if postgresType(v) != t.types[i] {
+                 v = nil
+             }
+             vals = append(vals, v)
+         }
+         vals = append(vals, string(content))
+         t.rows = append(t.rows, vals)
+         s.pending++
+     }
+     if s.pending >= s.batch {
+         return s.flush()
+     }
+     return nil
+}
+
+// COPY buffered rows of every table, called with lock held
+func (s *postgresSink) flush() error {
+     var err error
+     for _, t := range s.tables {
+         if len(t.rows) == 0 {
+             continue
+         }
+         if e := s.copy(t); e != nil {
+             err = e
+             if len(t.rows) > 10 * s.batch {
+                 telemetry_log.Errorf("postgres: dropping %d rows of %s\n", len(t.rows) - 10 * s.batch, t.name)
+                 s.pending -= len(t.rows) - 10 * s.batch
+                 t.rows = t.rows[len(t.rows) - 10 * s.batch:]
+             }
+             continue
+         }
+         s.pending -= len(t.rows)
+         t.rows = nil
+     }
+     return err
+}
+
+func (s *postgresSink) copy(t *postgresTable) error {
+     txn, err := s.db.Begin()
+     if err != nil {
+         return err
+     }
+     defer txn.Rollback()
+
+     stmt, err := txn.Prepare(pq.CopyIn(t.name, t.columns...))
+     if err != nil {
+         return err
+     }
+     for _, vals := range t.rows {
+         if _, err = stmt.Exec(vals...); err != nil {
+             stmt.Close()
+             return err
+         }
+     }
+     if _, err = stmt.Exec(); err != nil {
+         stmt.Close()
+         return err
+     }
+     if err = stmt.Close(); err != nil {
+         return err
+     }
+     return txn.Commit()
+}
+
+func (s *postgresSink) flushLoop(interval time.Duration) {
+     t := time.NewTicker(interval)
+     defer t.Stop()
+     for {
+         select {
+         case <-s.done:
+             return
+         case <-t.C:
+             s.Lock()
+             if err := s.flush(); err != nil {
+                 telemetry_log.Errorln("Failed to write rows:", err)
+             }
+             s.Unlock()
+         }
+     }
+}
+
+func (s *postgresSink) close() error {
+     close(s.done)
+     s.Lock()
+     defer s.Unlock()
+     err := s.flush()
+     if e := s.db.Close(); err == nil {
+         err = e
+     }
+     return err
+}
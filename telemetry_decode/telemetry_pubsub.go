@@ -0,0 +1,200 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sync"
+       "bytes"
+       "context"
+       "strings"
+       "strconv"
+       "net/url"
+       "io/ioutil"
+       "text/template"
+       "time"
+
+       "cloud.google.com/go/pubsub"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////          G O O G L E   P U B / S U B   S I N K          ///////
+///////////////////////////////////////////////////////////////////////
+// -out pubsub:<project>[?topic=..&format=..&ordering=true&batch=..&delay=..]
+// Rows are published as json to a topic, a template, default telemetry,
+// fields are
+//   .Node          node the row is from
+//   .Subscription  subscription the row is from
+// telemetry-{{.Subscription}} gives a topic per subscription, topics must
+// exist. Messages have attributes node, subscription and encoding_path.
+// With ordering=true node and sensor path are the ordering key, so rows
+// of a router/sensor path are delivered in order. Client batches
+// messages, a batch is sent when it has batch messages (default 100) or
+// after delay (default 10ms). Credentials are found the usual way,
+// GOOGLE_APPLICATION_CREDENTIALS, and PUBSUB_EMULATOR_HOST selects the
+// emulator. Publish errors are logged, publish is not waited for.
+// Message data is json unless another row format is given, format=msgpack.
+
+func init() {
+     mdtSinkTypes["pubsub"] = mdtNewPubsubSink
+}
+
+type pubsubTopicVars struct {
+     Node         string
+     Subscription string
+}
+
+type pubsubSink struct {
+     sync.Mutex
+     client   *pubsub.Client
+     topic    *template.Template
+     topics   map[string]*pubsub.Topic
+     ordering bool
+     batch    int
+     delay    time.Duration
+     format   *mdtRowFormat
+     pending  sync.WaitGroup
+}
+
+// topic names allow letters, digits and "-_.~+%"
+func pubsubName(s string) string {
+     return strings.Map(func(r rune) rune {
+         if (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9') ||
+            strings.ContainsRune("-_.~+%", r) {
+             return r
+         }
+         return '_'
+     }, s)
+}
+
+func mdtNewPubsubSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("pubsub output needs a project, pubsub:<project>")
+     }
+     s := &pubsubSink{topics: map[string]*pubsub.Topic{}}
+
+     topic := options.Get("topic")
+     if topic == "" {
+         topic = "telemetry"
+     }
+     if s.topic, err = template.New("topic").Parse(topic); err != nil {
+         return nil, fmt.Errorf("topic template %s: %v", topic, err)
+     }
+     if err = s.topic.Execute(ioutil.Discard, &pubsubTopicVars{}); err != nil {
+         return nil, fmt.Errorf("topic template %s: %v", topic, err)
+     }
+     if o := options.Get("ordering"); o != "" {
+         if s.ordering, err = strconv.ParseBool(o); err != nil {
+             return nil, fmt.Errorf("invalid ordering %s", o)
+         }
+     }
+     if b := options.Get("batch"); b != "" {
+         if s.batch, err = strconv.Atoi(b); err != nil || s.batch <= 0 {
+             return nil, fmt.Errorf("invalid batch %s", b)
+         }
+     }
+     if d := options.Get("delay"); d != "" {
+         if s.delay, err = time.ParseDuration(d); err != nil || s.delay <= 0 {
+             return nil, fmt.Errorf("invalid delay %s", d)
+         }
+     }
+     if s.format, err = mdtGetRowFormat(options); err != nil {
+         return nil, err
+     }
+
+     ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+     defer cancel()
+     if s.client, err = pubsub.NewClient(ctx, address); err != nil {
+         return nil, err
+     }
+     return s, nil
+}
+
+// topic is checked when first used
+func (s *pubsubSink) getTopic(name string) (*pubsub.Topic, error) {
+     s.Lock()
+     defer s.Unlock()
+
+     if t, ok := s.topics[name]; ok {
+         return t, nil
+     }
+     t := s.client.Topic(name)
+     ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+     defer cancel()
+     ok, err := t.Exists(ctx)
+     if err != nil {
+         return nil, err
+     }
+     if !ok {
+         return nil, fmt.Errorf("pubsub: topic %s does not exist", name)
+     }
+     if s.batch != 0 {
+         t.PublishSettings.CountThreshold = s.batch
+     }
+     if s.delay != 0 {
+         t.PublishSettings.DelayThreshold = s.delay
+     }
+     t.EnableMessageOrdering = s.ordering
+     s.topics[name] = t
+     return t, nil
+}
+
+func (s *pubsubSink) writeRows(rows []*MdtRow) error {
+     for _, row := range rows {
+         var name bytes.Buffer
+         err := s.topic.Execute(&name, &pubsubTopicVars{
+                                            Node:         pubsubName(row.NodeId),
+                                            Subscription: pubsubName(row.Subscription),
+                                        })
+         if err != nil {
+             return err
+         }
+         t, err := s.getTopic(name.String())
+         if err != nil {
+             return err
+         }
+         data, err := s.format.marshal(row)
+         if err != nil {
+             return err
+         }
+
+         msg := &pubsub.Message{
+                    Data: data,
+                    Attributes: map[string]string{
+                                    "node":          row.NodeId,
+                                    "subscription":  row.Subscription,
+                                    "encoding_path": row.EncodingPath,
+                                },
+                }
+         if s.ordering {
+             msg.OrderingKey = row.NodeId + "/" + row.EncodingPath
+         }
+         r := t.Publish(context.Background(), msg)
+
+         s.pending.Add(1)
+         go func(key string) {
+             defer s.pending.Done()
+             if _, err := r.Get(context.Background()); err != nil {
+                 telemetry_log.Errorln("pubsub: publish failed,", err)
+                 // ordered publishing stops for the key after a failure
+                 if key != "" {
+                     t.ResumePublish(key)
+                 }
+             }
+         }(msg.OrderingKey)
+     }
+     return nil
+}
+
+func (s *pubsubSink) close() error {
+     s.Lock()
+     for _, t := range s.topics {
+         // sends batched messages
+         t.Stop()
+     }
+     s.Unlock()
+     s.pending.Wait()
+     return s.client.Close()
+}
@@ -0,0 +1,165 @@
+package telemetry_decode
+
+import (
+       "encoding/json"
+       "fmt"
+       "io/ioutil"
+       "os"
+       "path/filepath"
+       "sync"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                  Q U A R A N T I N E                    ///////
+///////////////////////////////////////////////////////////////////////
+// -quarantine_dir <dir>
+// Messages that fail to decode, and bytes of dialout tcp streams skipped
+// for a bad header or discarded for an unsupported encap, are written to dir as received, with what is known
+// about them next to them, for reproducing decode bugs later,
+//   <dir>/mdt-20190306T100002.123Z-<pid>-<n>.dat    message
+//   <dir>/mdt-20190306T100002.123Z-<pid>-<n>.json   session, router, encoding, error
+// The message is then skipped as before. A panic decoding a message is
+// recovered and the message quarantined, the session goes on. Files are
+// readable by the collector user only, with -encrypt_key .dat is encrypted,
+// .dat.enc, and messages have leafs as received, so -redact is refused. A
+// .dat file decodes again with
+//   telemetry_dialin_collector decode -encoding <encoding> <dir>/mdt-...dat
+// At most quarantineMax messages are kept per run, later ones are only
+// counted as errors.
+
+const quarantineMax = 1000
+
+var mdtQuarantineState = struct {
+    sync.Mutex
+    dir   string
+    n     int
+    full  bool
+}{}
+
+// what is known about a quarantined message
+type mdtQuarantineContext struct {
+     Time         string `json:"time"`
+     Session      string `json:"session"`
+     Router       string `json:"router,omitempty"`
+     Source       string `json:"source,omitempty"`
+     Transport    string `json:"transport,omitempty"`
+     Subscription string `json:"subscription,omitempty"`
+     Encoding     string `json:"encoding,omitempty"`
+     Error        string `json:"error"`
+     Bytes        int    `json:"bytes"`
+}
+
+// messages failing to decode are written to dir from now on, dir is
+// created if missing
+func MdtQuarantineSetup(dir string) error {
+     if MdtRedacting() {
+         return fmt.Errorf("messages are kept as received, not redacted, can't go with -redact")
+     }
+     if err := os.MkdirAll(dir, 0700); err != nil {
+         return err
+     }
+     f, err := ioutil.TempFile(dir, ".mdt-check-*")
+     if err != nil {
+         return err
+     }
+     f.Close()
+     os.Remove(f.Name())
+     mdtQuarantineState.Lock()
+     mdtQuarantineState.dir = dir
+     mdtQuarantineState.Unlock()
+     return nil
+}
+
+// true if messages are quarantined
+func MdtQuarantining() bool {
+     mdtQuarantineState.Lock()
+     defer mdtQuarantineState.Unlock()
+     return mdtQuarantineState.dir != ""
+}
+
+// bytes of a session that failed, session and source name it in the context
+func MdtQuarantine(session, source, transport string, data []byte, err error) {
+     mdtQuarantineWrite(&mdtQuarantineContext{
+                            Session:   session,
+                            Source:    source,
+                            Transport: transport,
+                        }, data, err)
+}
+
+// message of o that failed to decode
+func (o *MdtOut) mdtQuarantine(data []byte, err error) {
+     sub := o.Subscription
+     if sub == "" {
+         sub = o.mdtMessageSubscription(data)
+     }
+     mdtQuarantineWrite(&mdtQuarantineContext{
+                            Session:      o.Name,
+                            Router:       o.Router,
+                            Source:       o.Source,
+                            Transport:    o.Transport,
+                            Subscription: sub,
+                            Encoding:     o.Encoding,
+                        }, data, err)
+}
+
+func mdtQuarantineWrite(c *mdtQuarantineContext, data []byte, err error) {
+     s := &mdtQuarantineState
+     s.Lock()
+     if s.dir == "" {
+         s.Unlock()
+         return
+     }
+     if s.n >= quarantineMax {
+         if !s.full {
+             s.full = true
+             telemetry_log.Errorf("Quarantine: %d messages kept in %s, no more are written this run\n", quarantineMax, s.dir)
+         }
+         s.Unlock()
+         return
+     }
+     s.n++
+     now := time.Now().UTC()
+     base := filepath.Join(s.dir, fmt.Sprintf("mdt-%s-%d-%d", now.Format("20060102T150405.000Z"), os.Getpid(), s.n))
+     s.Unlock()
+
+     c.Time = now.Format(time.RFC3339Nano)
+     c.Error = err.Error()
+     c.Bytes = len(data)
+     j, _ := json.MarshalIndent(c, "", "  ")
+     dat := base + ".dat" + mdtEncryptSuffix()
+     if werr := mdtQuarantineFile(dat, data); werr != nil {
+         telemetry_log.Errorf("Quarantine: %v\n", werr)
+         return
+     }
+     if werr := ioutil.WriteFile(base + ".json", append(j, '\n'), 0600); werr != nil {
+         telemetry_log.Errorf("Quarantine: %v\n", werr)
+         return
+     }
+     telemetry_log.Printf("Quarantine: %s: message of %d bytes kept in %s\n", c.Session, len(data), dat)
+}
+
+// message readable by the collector user only, encrypted with -encrypt_key
+func mdtQuarantineFile(name string, data []byte) error {
+     f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+     if err != nil {
+         return err
+     }
+     w, err := mdtNewFileWriter(f, "")
+     if err == nil && w != nil {
+         if _, err = w.Write(data); err == nil {
+             err = w.Close()
+         }
+     } else if err == nil {
+         _, err = f.Write(data)
+     }
+     if cerr := f.Close(); err == nil {
+         err = cerr
+     }
+     if err != nil {
+         os.Remove(name)
+     }
+     return err
+}
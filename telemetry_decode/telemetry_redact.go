@@ -0,0 +1,173 @@
+package telemetry_decode
+
+import (
+       "bufio"
+       "crypto/hmac"
+       "crypto/sha256"
+       "encoding/hex"
+       "fmt"
+       "os"
+       "regexp"
+       "strings"
+)
+
+// Redact file, -redact, hides leafs of rows before they reach any output,
+// for usernames, prefixes, community strings and the like that must not
+// leave the collector. A line is an action, a leaf and optionally the
+// sensor paths it applies to, all paths if not given,
+//   # action leaf [sensor path]
+//   drop  community-name
+//   hash  neighbor-address  Cisco-IOS-XR-ipv4-bgp-oper:*
+//   mask  *password*
+//   salt  <secret>
+// Leaf is the name of a key or leaf at any depth, or nested leafs joined
+// with ".", * matches any part of a name or path. drop removes the leaf,
+// mask replaces its value with "****" and hash with the first 16 hex
+// digits of its HMAC-SHA256 keyed by salt, so the same value has the same
+// hash and rows can still be joined on it. hash rules need a salt of at
+// least redactMinSalt bytes, values hashed without a secret are found
+// again by hashing guesses. Rows are redacted after all
+// the transforms, so every output of rows, sinks, table, tail, live view,
+// restream of json and gNMI, sees them redacted. Outputs of messages as
+// received or dumped as they are, files written by -out without a sink,
+// relay and capture, cannot be redacted and are refused.
+
+type redactRule struct {
+     action string
+     leaf   *regexp.Regexp
+     nested bool
+     path   *regexp.Regexp
+}
+
+type mdtRedactRules struct {
+     rules []redactRule
+     salt  []byte
+}
+
+var mdtRedact *mdtRedactRules
+
+const redactMinSalt = 16
+
+// pattern with * matching anything
+func redactGlob(pattern string) *regexp.Regexp {
+     return regexp.MustCompile("^" + strings.Replace(regexp.QuoteMeta(pattern), `\*`, ".*", -1) + "$")
+}
+
+// load redact file, rows are redacted from now on
+func MdtRedactLoad(fileName string) error {
+     f, err := os.Open(fileName)
+     if err != nil {
+         return err
+     }
+     defer f.Close()
+
+     r := &mdtRedactRules{}
+     scanner := bufio.NewScanner(f)
+     for n := 1; scanner.Scan(); n++ {
+         fields := strings.Fields(scanner.Text())
+         if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+             continue
+         }
+         if fields[0] == "salt" {
+             if len(fields) != 2 {
+                 return fmt.Errorf("%s:%d: expected salt <secret>", fileName, n)
+             }
+             r.salt = []byte(fields[1])
+             continue
+         }
+         if len(fields) < 2 || len(fields) > 3 {
+             return fmt.Errorf("%s:%d: expected action leaf [sensor path]", fileName, n)
+         }
+         switch fields[0] {
+         case "drop", "hash", "mask":
+         default:
+             return fmt.Errorf("%s:%d: unknown action %s, Options: drop,hash,mask", fileName, n, fields[0])
+         }
+         rule := redactRule{action: fields[0], leaf: redactGlob(fields[1]), nested: strings.Contains(fields[1], ".")}
+         if len(fields) == 3 {
+             rule.path = redactGlob(fields[2])
+         }
+         r.rules = append(r.rules, rule)
+     }
+     if err = scanner.Err(); err != nil {
+         return err
+     }
+     if len(r.rules) == 0 {
+         return fmt.Errorf("%s: no rules", fileName)
+     }
+     for _, rule := range r.rules {
+         if rule.action == "hash" && len(r.salt) < redactMinSalt {
+             return fmt.Errorf("%s: hash rules need a salt of at least %d bytes, such as made with openssl rand -hex 16", fileName, redactMinSalt)
+         }
+     }
+     mdtRedact = r
+     return nil
+}
+
+// true if rows are redacted, messages as received are not given out then
+func MdtRedacting() bool {
+     return mdtRedact != nil
+}
+
+// true if rows of outputs of o are redacted, false if o writes messages
+func (o *MdtOut)mdtRedacted() bool {
+     if o.sink != nil {
+         rs, ok := o.sink.sink.(mdtRawSink)
+         return !ok || !rs.raw()
+     }
+     return o.OutFormat == "table" || (o.OutFile == "" && mdtTui != nil)
+}
+
+func mdtRedactRows(rows []*MdtRow) {
+     for _, row := range rows {
+         for i := range mdtRedact.rules {
+             rule := &mdtRedact.rules[i]
+             if rule.path != nil && !rule.path.MatchString(row.EncodingPath) {
+                 continue
+             }
+             mdtRedact.walk(row.Keys, "", rule)
+             mdtRedact.walk(row.Content, "", rule)
+         }
+     }
+}
+
+// apply rule to leafs of m, prefix is the name of m joined with "."
+func (r *mdtRedactRules) walk(m map[string]interface{}, prefix string, rule *redactRule) {
+     for name, v := range m {
+         full := name
+         if prefix != "" {
+             full = prefix + "." + name
+         }
+         match := rule.leaf.MatchString(name)
+         if rule.nested {
+             match = rule.leaf.MatchString(full)
+         }
+         if match {
+             switch rule.action {
+             case "drop":
+                 delete(m, name)
+             case "mask":
+                 m[name] = "****"
+             case "hash":
+                 m[name] = r.hash(v)
+             }
+             continue
+         }
+         switch c := v.(type) {
+         case map[string]interface{}:
+             r.walk(c, full, rule)
+         case []interface{}:
+             for _, e := range c {
+                 if em, ok := e.(map[string]interface{}); ok {
+                     r.walk(em, full, rule)
+                 }
+             }
+         }
+     }
+}
+
+func (r *mdtRedactRules) hash(v interface{}) string {
+     h := hmac.New(sha256.New, r.salt)
+     fmt.Fprint(h, v)
+     return hex.EncodeToString(h.Sum(nil)[:8])
+}
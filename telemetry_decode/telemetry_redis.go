@@ -0,0 +1,152 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "bytes"
+       "context"
+       "strings"
+       "strconv"
+       "net/url"
+       "io/ioutil"
+       "crypto/tls"
+       "encoding/json"
+       "text/template"
+       "time"
+
+       "github.com/redis/go-redis/v9"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////           R E D I S   S T R E A M S   S I N K           ///////
+///////////////////////////////////////////////////////////////////////
+// -out redis:<host:port>[?stream=..&maxlen=..&db=..&user=..&password=..&tls=true&ca=..]
+// Rows are appended with XADD to a stream, a template, default
+// telemetry:{{.Path}}, fields are
+//   .Node          node the row is from
+//   .Model         model name, Cisco-IOS-XR-infra-statsd-oper
+//   .Path          sensor path without model name
+//   .Subscription  subscription the row is from
+// Entry fields are node, subscription, encoding_path, collection_id,
+// timestamp, and keys and content as json. Streams are trimmed to about
+// maxlen entries (default 100000, 0 is no trimming). Rows of a message are
+// sent in one pipeline.
+
+func init() {
+     mdtSinkTypes["redis"] = mdtNewRedisSink
+}
+
+type redisStreamVars struct {
+     Node         string
+     Model        string
+     Path         string
+     Subscription string
+}
+
+type redisSink struct {
+     client *redis.Client
+     stream *template.Template
+     maxlen int64
+}
+
+func mdtNewRedisSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("redis output needs an address, redis:<host:port>")
+     }
+     s := &redisSink{maxlen: 100000}
+
+     stream := options.Get("stream")
+     if stream == "" {
+         stream = "telemetry:{{.Path}}"
+     }
+     if s.stream, err = template.New("stream").Parse(stream); err != nil {
+         return nil, fmt.Errorf("stream template %s: %v", stream, err)
+     }
+     if err = s.stream.Execute(ioutil.Discard, &redisStreamVars{}); err != nil {
+         return nil, fmt.Errorf("stream template %s: %v", stream, err)
+     }
+     if m := options.Get("maxlen"); m != "" {
+         if s.maxlen, err = strconv.ParseInt(m, 10, 64); err != nil || s.maxlen < 0 {
+             return nil, fmt.Errorf("invalid maxlen %s", m)
+         }
+     }
+
+     if s.client, err = mdtRedisClient(address, options); err != nil {
+         return nil, err
+     }
+     return s, nil
+}
+
+// client, db, user, password, tls and ca from options
+func mdtRedisClient(address string, options url.Values) (*redis.Client, error) {
+     var err error
+     opts := &redis.Options{
+                 Addr:     address,
+                 Username: options.Get("user"),
+                 Password: options.Get("password"),
+             }
+     if d := options.Get("db"); d != "" {
+         if opts.DB, err = strconv.Atoi(d); err != nil {
+             return nil, fmt.Errorf("invalid db %s", d)
+         }
+     }
+     if options.Get("tls") == "true" || options.Get("ca") != "" {
+         opts.TLSConfig = &tls.Config{}
+         if ca := options.Get("ca"); ca != "" {
+             if opts.TLSConfig, err = telemetry_tls.NewClientConfig(ca, "", 0); err != nil {
+                 return nil, err
+             }
+         }
+     }
+
+     // connects with the first command
+     return redis.NewClient(opts), nil
+}
+
+func (s *redisSink) writeRows(rows []*MdtRow) error {
+     ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+     defer cancel()
+
+     pipe := s.client.Pipeline()
+     for _, row := range rows {
+         vars := redisStreamVars{Node: row.NodeId, Path: row.EncodingPath, Subscription: row.Subscription}
+         if i := strings.Index(row.EncodingPath, ":"); i >= 0 {
+             vars.Model, vars.Path = row.EncodingPath[:i], row.EncodingPath[i+1:]
+         }
+         var stream bytes.Buffer
+         if err := s.stream.Execute(&stream, &vars); err != nil {
+             return err
+         }
+         keys, err := json.Marshal(row.Keys)
+         if err != nil {
+             return err
+         }
+         content, err := json.Marshal(row.Content)
+         if err != nil {
+             return err
+         }
+         pipe.XAdd(ctx, &redis.XAddArgs{
+                             Stream: stream.String(),
+                             MaxLen: s.maxlen,
+                             Approx: true,
+                             Values: []interface{}{
+                                         "node", row.NodeId,
+                                         "subscription", row.Subscription,
+                                         "encoding_path", row.EncodingPath,
+                                         "collection_id", row.CollectionId,
+                                         "timestamp", row.Timestamp,
+                                         "keys", keys,
+                                         "content", content,
+                                     },
+                         })
+     }
+     _, err := pipe.Exec(ctx)
+     return err
+}
+
+func (s *redisSink) close() error {
+     return s.client.Close()
+}
@@ -0,0 +1,306 @@
+package telemetry_decode
+
+import (
+       "context"
+       "crypto/tls"
+       "encoding/binary"
+       "fmt"
+       "net"
+       "net/url"
+       "strconv"
+       "strings"
+       "sync"
+       "sync/atomic"
+       "time"
+
+       "google.golang.org/grpc"
+       "google.golang.org/grpc/credentials"
+
+       "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialout"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                  R E L A Y   S I N K                    ///////
+///////////////////////////////////////////////////////////////////////
+// -out relay:<host:port>[?transport=..&buffer=..&tls=true&cert=..&server_name=..
+//                          &client_cert=..&client_key=..]
+// Messages are forwarded as received, not decoded, to another collector,
+// as a router doing dialout would send them, for edge collectors close to
+// the routers passing messages on to core collectors that decode and
+// store them. transport is grpc (default), the MdtDialout rpc, or tcp,
+// messages with the 12 byte tcp dialout header. Every session gets its
+// own connection. With tls=true, or cert, the CA cert of the collector,
+// the connection uses TLS with either transport, the certificate of the
+// collector is verified against cert, system CAs if not given, with
+// server_name, the host of the address if not given. client_cert and
+// client_key are presented to collectors asking for them. Cert files are
+// reloaded when modified, checked every -tls_reload, sessions with the same
+// files share their TLS config and its reloading. Messages
+// are queued while the collector is not reachable, up to buffer messages
+// (default 10000), connection is retried every 5s.
+
+func init() {
+     mdtSinkTypes["relay"] = mdtNewRelaySink
+}
+
+const relayRetry = 5 * time.Second
+
+// tcp dialout header values
+const (
+      relayTcpHdrLen   = 12
+      relayTcpMsgData  = 1
+      relayTcpEncapGPB = 1
+      relayTcpEncapJSON = 2
+)
+
+type relayMessage struct {
+     data     []byte
+     encoding string
+}
+
+type relaySink struct {
+     address   string
+     transport string
+     grpcOpts  []grpc.DialOption
+     tlsConfig *tls.Config
+     queue     chan relayMessage
+     dropped   uint64
+     sent      uint64
+     closing   chan struct{}
+     stopped   chan struct{}
+     jtiSkipped sync.Once
+
+     // connection, used by send loop only
+     send      func(m relayMessage) error
+     closeConn func()
+}
+
+func mdtNewRelaySink(address string, options url.Values) (mdtSink, error) {
+     if address == "" {
+         return nil, fmt.Errorf("relay output needs an address, relay:<host:port>")
+     }
+     if _, _, err := net.SplitHostPort(address); err != nil {
+         return nil, err
+     }
+     s := &relaySink{
+              address:   address,
+              transport: "grpc",
+              closing:   make(chan struct{}),
+              stopped:   make(chan struct{}),
+          }
+     if t := options.Get("transport"); t != "" {
+         if t != "grpc" && t != "tcp" {
+             return nil, fmt.Errorf("invalid transport %s, Options: grpc,tcp", t)
+         }
+         s.transport = t
+     }
+     buffer := 10000
+     if b := options.Get("buffer"); b != "" {
+         var err error
+         if buffer, err = strconv.Atoi(b); err != nil || buffer <= 0 {
+             return nil, fmt.Errorf("invalid buffer %s", b)
+         }
+     }
+     s.queue = make(chan relayMessage, buffer)
+     s.grpcOpts = []grpc.DialOption{grpc.WithInsecure()}
+     ca, clientCert, clientKey := options.Get("cert"), options.Get("client_cert"), options.Get("client_key")
+     if (clientCert == "") != (clientKey == "") {
+         return nil, fmt.Errorf("client certificate needs both client_cert and client_key")
+     }
+     if options.Get("tls") == "true" || ca != "" || clientCert != "" {
+         var err error
+         s.tlsConfig, err = mdtRelayTLSConfig(clientCert, clientKey, ca, options.Get("server_name"))
+         if err != nil {
+             return nil, err
+         }
+         s.grpcOpts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(s.tlsConfig))}
+     }
+     go s.sendLoop()
+     return s, nil
+}
+
+// TLS configs of relay sinks by their files and server name, made once,
+// a cert watcher per session would never stop reloading
+var mdtRelayTLS = struct {
+    sync.Mutex
+    reload  time.Duration
+    configs map[string]*tls.Config
+}{configs: make(map[string]*tls.Config)}
+
+// interval of checking relay cert files for changes, -tls_reload, 0 to
+// disable
+func MdtSetTLSReload(reload time.Duration) {
+     mdtRelayTLS.Lock()
+     mdtRelayTLS.reload = reload
+     mdtRelayTLS.Unlock()
+}
+
+func mdtRelayTLSConfig(clientCert, clientKey, ca, serverName string) (*tls.Config, error) {
+     mdtRelayTLS.Lock()
+     defer mdtRelayTLS.Unlock()
+     key := strings.Join([]string{clientCert, clientKey, ca, serverName}, "\x00")
+     if c, ok := mdtRelayTLS.configs[key]; ok {
+         return c, nil
+     }
+     var c *tls.Config
+     var err error
+     if clientCert != "" {
+         c, err = telemetry_tls.NewMutualClientConfig(clientCert, clientKey, ca, serverName, mdtRelayTLS.reload)
+     } else {
+         c, err = telemetry_tls.NewClientConfig(ca, serverName, mdtRelayTLS.reload)
+     }
+     if err != nil {
+         return nil, err
+     }
+     mdtRelayTLS.configs[key] = c
+     return c, nil
+}
+
+func (s *relaySink) raw() bool {
+     return true
+}
+
+// queue message for the send loop, dropped if the queue is full
+func (s *relaySink) writeRaw(data []byte, encoding string) error {
+     if encoding == "jti" {
+         // no dialout encap to send them with
+         s.jtiSkipped.Do(func() {
+             telemetry_log.Errorf("relay: %s: jti messages are not relayed\n", s.address)
+         })
+         return nil
+     }
+     select {
+     case s.queue <- relayMessage{data: data, encoding: encoding}:
+     default:
+         if atomic.AddUint64(&s.dropped, 1) % 1000 == 1 {
+             telemetry_log.Errorf("relay: %s not keeping up, %d messages dropped\n", s.address, atomic.LoadUint64(&s.dropped))
+         }
+     }
+     return nil
+}
+
+func (s *relaySink) writeRows(rows []*MdtRow) error {
+     return fmt.Errorf("relay forwards messages as received")
+}
+
+func (s *relaySink) connect() error {
+     if s.transport == "tcp" {
+         var conn net.Conn
+         var err error
+         if s.tlsConfig != nil {
+             conn, err = tls.DialWithDialer(&net.Dialer{Timeout: 10 * time.Second}, "tcp", s.address, s.tlsConfig)
+         } else {
+             conn, err = net.DialTimeout("tcp", s.address, 10 * time.Second)
+         }
+         if err != nil {
+             return err
+         }
+         s.send = func(m relayMessage) error {
+             encap := uint16(relayTcpEncapGPB)
+             if m.encoding == "json" {
+                 encap = relayTcpEncapJSON
+             }
+             buf := make([]byte, relayTcpHdrLen + len(m.data))
+             binary.BigEndian.PutUint16(buf[0:], relayTcpMsgData)
+             binary.BigEndian.PutUint16(buf[2:], encap)
+             binary.BigEndian.PutUint16(buf[4:], 1)
+             binary.BigEndian.PutUint32(buf[8:], uint32(len(m.data)))
+             copy(buf[relayTcpHdrLen:], m.data)
+             conn.SetWriteDeadline(time.Now().Add(30 * time.Second))
+             _, err := conn.Write(buf)
+             return err
+         }
+         s.closeConn = func() { conn.Close() }
+         return nil
+     }
+
+     ctx, cancel := context.WithTimeout(context.Background(), 10 * time.Second)
+     defer cancel()
+     conn, err := grpc.DialContext(ctx, s.address, append(s.grpcOpts, grpc.WithBlock(), grpc.FailOnNonTempDialError(true))...)
+     if err != nil {
+         return err
+     }
+     streamCtx, streamCancel := context.WithCancel(context.Background())
+     stream, err := mdt_dialout.NewGRPCMdtDialoutClient(conn).MdtDialout(streamCtx)
+     if err != nil {
+         streamCancel()
+         conn.Close()
+         return err
+     }
+     // read acks of collectors replying to messages, so that their
+     // replies don't hold up the stream
+     go func() {
+         for {
+             if _, err := stream.Recv(); err != nil {
+                 return
+             }
+         }
+     }()
+     var reqId int64
+     s.send = func(m relayMessage) error {
+         reqId++
+         return stream.Send(&mdt_dialout.MdtDialoutArgs{ReqId: reqId, Data: m.data})
+     }
+     s.closeConn = func() {
+         stream.CloseSend()
+         streamCancel()
+         conn.Close()
+     }
+     return nil
+}
+
+// send queued messages till the sink is closed, reconnecting as needed
+func (s *relaySink) sendLoop() {
+     defer close(s.stopped)
+     defer func() {
+         if s.closeConn != nil {
+             s.closeConn()
+         }
+     }()
+     connected := false
+     for m := range s.queue {
+         for {
+             if !connected {
+                 if err := s.connect(); err != nil {
+                     telemetry_log.Errorf("relay: %s: %v, retrying in %v\n", s.address, err, relayRetry)
+                     select {
+                     case <-s.closing:
+                         return
+                     case <-time.After(relayRetry):
+                     }
+                     continue
+                 }
+                 connected = true
+                 telemetry_log.Println("relay: connected to", s.address)
+             }
+             err := s.send(m)
+             if err == nil {
+                 atomic.AddUint64(&s.sent, 1)
+                 break
+             }
+             // message is sent again on the new connection
+             telemetry_log.Errorf("relay: %s: %v\n", s.address, err)
+             s.closeConn()
+             s.closeConn, connected = nil, false
+         }
+     }
+}
+
+// send what is queued, giving up after 10s if the collector is not
+// reachable
+func (s *relaySink) close() error {
+     close(s.queue)
+     select {
+     case <-s.stopped:
+     case <-time.After(10 * time.Second):
+         close(s.closing)
+         <-s.stopped
+     }
+     left := len(s.queue)
+     if dropped := atomic.LoadUint64(&s.dropped) + uint64(left); dropped != 0 {
+         return fmt.Errorf("relay: %s: %d messages sent, %d dropped", s.address, atomic.LoadUint64(&s.sent), dropped)
+     }
+     return nil
+}
@@ -0,0 +1,141 @@
+package telemetry_decode
+
+import (
+       "encoding/json"
+       "sync"
+       "sync/atomic"
+
+       "github.com/golang/protobuf/proto"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////            M E S S A G E   W A T C H E R S              ///////
+///////////////////////////////////////////////////////////////////////
+// Received messages of every session, as they arrive, for serving them
+// again to downstream consumers. A watcher gets the message as received
+// or, if started with rows, decoded to rows. As for the live tail, a slow
+// watcher loses messages and the sessions are not held up.
+
+type MdtMessage struct {
+     Session      string
+     Router       string
+     // subscription of the session, taken from the message if the session
+     // has none, as for dialout
+     Subscription string
+     Encoding     string
+     Data         []byte
+     // decoded rows, only for watchers started with rows
+     Rows         []*MdtRow
+}
+
+type MdtWatcher struct {
+     C       chan *MdtMessage
+     rows    bool
+     dropped uint64
+}
+
+var mdtWatchers = struct {
+    sync.RWMutex
+    watchers map[*MdtWatcher]bool
+    n        int32
+}{watchers: make(map[*MdtWatcher]bool)}
+
+// start watching messages, decoded to rows if rows is set. Up to buffer
+// messages are queued on C.
+func MdtWatchStart(rows bool, buffer int) *MdtWatcher {
+     w := &MdtWatcher{C: make(chan *MdtMessage, buffer), rows: rows}
+     mdtWatchers.Lock()
+     mdtWatchers.watchers[w] = true
+     atomic.StoreInt32(&mdtWatchers.n, int32(len(mdtWatchers.watchers)))
+     mdtWatchers.Unlock()
+     return w
+}
+
+// stop watching, C is not closed
+func (w *MdtWatcher) Stop() {
+     mdtWatchers.Lock()
+     delete(mdtWatchers.watchers, w)
+     atomic.StoreInt32(&mdtWatchers.n, int32(len(mdtWatchers.watchers)))
+     mdtWatchers.Unlock()
+}
+
+// messages lost as C was full
+func (w *MdtWatcher) Dropped() uint64 {
+     return atomic.LoadUint64(&w.dropped)
+}
+
+func mdtWatchActive() bool {
+     return atomic.LoadInt32(&mdtWatchers.n) > 0
+}
+
+// subscription id from the header of a message
+func (o *MdtOut)mdtMessageSubscription(data []byte) string {
+     if o.Encoding == "json" {
+         var hdr struct {
+             Subscription string `json:"subscription_id_str"`
+         }
+         json.Unmarshal(data, &hdr)
+         return hdr.Subscription
+     }
+     if o.Encoding == "jti" {
+         m, err := jtiParseHeader(data)
+         if err != nil {
+             return ""
+         }
+         return m.SensorName
+     }
+     telem := &telemetry.Telemetry{}
+     if proto.Unmarshal(data, telem) != nil {
+         return ""
+     }
+     if telem.GetSubscriptionIdStr() == "" && o.Platform == "xe" {
+         return mdtXeSubscription(data)
+     }
+     return telem.GetSubscriptionIdStr()
+}
+
+// pass message to the watchers, rows are decoded once for all watchers
+// that want them
+func (o *MdtOut)mdtWatchMessage(data []byte) {
+     m := &MdtMessage{
+               Session:      o.Name,
+               Router:       o.Router,
+               Subscription: o.Subscription,
+               Encoding:     o.Encoding,
+               Data:         data,
+          }
+     if m.Subscription == "" {
+         m.Subscription = o.mdtMessageSubscription(data)
+     }
+     var decoded *MdtMessage
+
+     mdtWatchers.RLock()
+     defer mdtWatchers.RUnlock()
+     for w := range mdtWatchers.watchers {
+         if !w.rows && mdtRedact != nil {
+             // only redacted rows leave the collector
+             continue
+         }
+         msg := m
+         if w.rows {
+             if decoded == nil {
+                 rows, err := o.mdtDecodeRows(data)
+                 if err != nil {
+                     atomic.AddUint64(&w.dropped, 1)
+                     continue
+                 }
+                 d := *m
+                 d.Rows = rows
+                 decoded = &d
+             }
+             msg = decoded
+         }
+         select {
+         case w.C <- msg:
+         default:
+             atomic.AddUint64(&w.dropped, 1)
+         }
+     }
+}
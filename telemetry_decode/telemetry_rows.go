@@ -0,0 +1,383 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "bytes"
+       "strconv"
+       "encoding/json"
+
+       "github.com/golang/protobuf/proto"
+       "google.golang.org/protobuf/reflect/protoreflect"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////               D E C O D E D   R O W S                   ///////
+///////////////////////////////////////////////////////////////////////
+// Sinks that store data, instead of dumping messages, get the message
+// decoded into rows, one per row in the message with header fields
+// copied in. Keys and content are nested maps as in the yang model,
+// leaf values are int64, uint64, float64, bool or string.
+// Works for json, self-describing-gpb and gpb with plugin, protoc decode
+// is not supported with sinks. Sinks publishing messages send rows as json.
+
+type MdtRow struct {
+     NodeId       string                  `json:"node_id"`
+     Subscription string                  `json:"subscription"`
+     EncodingPath string                  `json:"encoding_path"`
+     CollectionId uint64                  `json:"collection_id"`
+     Timestamp    uint64                  `json:"timestamp"`    // milliseconds since epoch
+     Keys         map[string]interface{}  `json:"keys"`
+     Content      map[string]interface{}  `json:"content"`
+     Units        map[string]string       `json:"units,omitempty"` // with -yang_models
+}
+
+// rows of a message, as outputs of rows get them, the loop need not run
+func (o *MdtOut) MdtDecodeRows(data []byte) ([]*MdtRow, error) {
+     return o.mdtDecodeRows(data)
+}
+
+func (o *MdtOut)mdtDecodeRows(data []byte) ([]*MdtRow, error) {
+     rows, err := o.mdtDecodeMessageRows(data)
+     if err == nil && mdtYang != nil {
+         mdtYangRows(rows)
+     }
+     if err == nil && mdtPathMap != nil {
+         mdtPathMapRows(rows)
+     }
+     if err == nil && mdtWasmTransform != nil {
+         rows = mdtWasmTransform.rows(rows)
+     }
+     if err == nil && mdtScriptTransform != nil {
+         rows = mdtScriptRows(rows)
+     }
+     if err == nil && mdtRedact != nil {
+         mdtRedactRows(rows)
+     }
+     return rows, err
+}
+
+func (o *MdtOut)mdtDecodeMessageRows(data []byte) ([]*MdtRow, error) {
+     if o.Encoding == "json" {
+         return mdtDecodeJsonRows(data)
+     }
+     if o.Encoding == "jti" {
+         return mdtDecodeJtiRows(data)
+     }
+
+     telem := &telemetry.Telemetry{}
+     err := proto.Unmarshal(data, telem)
+     if err != nil {
+         return nil, err
+     }
+     if telem.GetDataGpb() != nil {
+         rows, err := o.mdtDecodeGPBRows(telem)
+         if err != nil {
+             return nil, err
+         }
+         return o.mdtPlatformRows(data, rows), nil
+     }
+     return o.mdtPlatformRows(data, mdtDecodeKVGPBRows(telem)), nil
+}
+
+func mdtRowHeader(telem *telemetry.Telemetry, timestamp uint64) *MdtRow {
+     if timestamp == 0 {
+         timestamp = telem.GetMsgTimestamp()
+     }
+     return &MdtRow{
+                NodeId:       telem.GetNodeIdStr(),
+                Subscription: telem.GetSubscriptionIdStr(),
+                EncodingPath: telem.GetEncodingPath(),
+                CollectionId: telem.GetCollectionId(),
+                Timestamp:    timestamp,
+                Keys:         map[string]interface{}{},
+                Content:      map[string]interface{}{},
+            }
+}
+
+// json message, data_json has the rows
+func mdtDecodeJsonRows(data []byte) ([]*MdtRow, error) {
+     var m struct {
+         NodeId       string            `json:"node_id_str"`
+         Subscription string            `json:"subscription_id_str"`
+         EncodingPath string            `json:"encoding_path"`
+         CollectionId json.Number       `json:"collection_id"`
+         MsgTimestamp json.Number       `json:"msg_timestamp"`
+         DataJson     []struct {
+             Timestamp json.Number      `json:"timestamp"`
+             Keys      interface{}      `json:"keys"`
+             Content   interface{}      `json:"content"`
+         }                              `json:"data_json"`
+     }
+
+     d := json.NewDecoder(bytes.NewReader(data))
+     d.UseNumber()
+     if err := d.Decode(&m); err != nil {
+         return nil, err
+     }
+
+     collectionId, _ := strconv.ParseUint(m.CollectionId.String(), 10, 64)
+     msgTimestamp, _ := strconv.ParseUint(m.MsgTimestamp.String(), 10, 64)
+
+     var rows []*MdtRow
+     for _, r := range m.DataJson {
+         timestamp, _ := strconv.ParseUint(r.Timestamp.String(), 10, 64)
+         if timestamp == 0 {
+             timestamp = msgTimestamp
+         }
+         rows = append(rows, &MdtRow{
+                                NodeId:       m.NodeId,
+                                Subscription: m.Subscription,
+                                EncodingPath: m.EncodingPath,
+                                CollectionId: collectionId,
+                                Timestamp:    timestamp,
+                                Keys:         mdtJsonObject(r.Keys),
+                                Content:      mdtJsonObject(r.Content),
+                            })
+     }
+     return rows, nil
+}
+
+// keys are an object or a list of objects depending on release
+func mdtJsonObject(v interface{}) map[string]interface{} {
+     m := map[string]interface{}{}
+     switch v := mdtJsonValue(v).(type) {
+     case map[string]interface{}:
+         m = v
+     case []interface{}:
+         for _, e := range v {
+             if o, ok := e.(map[string]interface{}); ok {
+                 for k, val := range o {
+                     m[k] = val
+                 }
+             }
+         }
+     }
+     return m
+}
+
+// numbers in json are int64 if they fit, float64 otherwise
+func mdtJsonValue(v interface{}) interface{} {
+     switch v := v.(type) {
+     case json.Number:
+         if i, err := v.Int64(); err == nil {
+             return i
+         }
+         if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+             return u
+         }
+         f, _ := v.Float64()
+         return f
+     case map[string]interface{}:
+         for k, e := range v {
+             v[k] = mdtJsonValue(e)
+         }
+     case []interface{}:
+         for i, e := range v {
+             v[i] = mdtJsonValue(e)
+         }
+     }
+     return v
+}
+
+// self describing gpb, every row has keys and content fields
+func mdtDecodeKVGPBRows(telem *telemetry.Telemetry) []*MdtRow {
+     var rows []*MdtRow
+
+     for _, field := range telem.GetDataGpbkv() {
+         row := mdtRowHeader(telem, field.GetTimestamp())
+         for _, f := range field.GetFields() {
+             switch f.GetName() {
+             case "keys":
+                 row.Keys = mdtKVGPBFields(f.GetFields())
+             case "content":
+                 row.Content = mdtKVGPBFields(f.GetFields())
+             }
+         }
+         rows = append(rows, row)
+     }
+     return rows
+}
+
+// nested fields become maps, repeated names become lists
+func mdtKVGPBFields(fields []*telemetry.TelemetryField) map[string]interface{} {
+     m := map[string]interface{}{}
+
+     for _, f := range fields {
+         var v interface{}
+         if len(f.GetFields()) != 0 {
+             v = mdtKVGPBFields(f.GetFields())
+         } else {
+             v = mdtKVGPBValue(f)
+         }
+
+         name := f.GetName()
+         if old, ok := m[name]; ok {
+             if l, ok := old.([]interface{}); ok {
+                 m[name] = append(l, v)
+             } else {
+                 m[name] = []interface{}{old, v}
+             }
+         } else {
+             m[name] = v
+         }
+     }
+     return m
+}
+
+func mdtKVGPBValue(f *telemetry.TelemetryField) interface{} {
+     switch v := f.GetValueByType().(type) {
+     case *telemetry.TelemetryField_BytesValue:
+         return string(v.BytesValue)
+     case *telemetry.TelemetryField_StringValue:
+         return v.StringValue
+     case *telemetry.TelemetryField_BoolValue:
+         return v.BoolValue
+     case *telemetry.TelemetryField_Uint32Value:
+         return int64(v.Uint32Value)
+     case *telemetry.TelemetryField_Uint64Value:
+         return v.Uint64Value
+     case *telemetry.TelemetryField_Sint32Value:
+         return int64(v.Sint32Value)
+     case *telemetry.TelemetryField_Sint64Value:
+         return v.Sint64Value
+     case *telemetry.TelemetryField_DoubleValue:
+         return v.DoubleValue
+     case *telemetry.TelemetryField_FloatValue:
+         return float64(v.FloatValue)
+     }
+     return nil
+}
+
+// compact gpb, needs plugin for the encoding path
+func (o *MdtOut)mdtDecodeGPBRows(telem *telemetry.Telemetry) ([]*MdtRow, error) {
+     gpbPlugin := o.mdtGpbPlugin(telem.GetEncodingPath())
+     if gpbPlugin == nil {
+         return nil, fmt.Errorf("no plugin to decode %s", telem.GetEncodingPath())
+     }
+
+     var rows []*MdtRow
+     for _, r := range telem.GetDataGpb().GetRow() {
+         row := mdtRowHeader(telem, r.GetTimestamp())
+
+         if gpbPlugin.decoder != nil {
+             keys, content, err := mdtDecoderRow(gpbPlugin.decoder, r.Keys, r.Content)
+             if err != nil {
+                 return nil, err
+             }
+             if row.Keys, err = mdtJsonMap(string(keys)); err != nil {
+                 return nil, err
+             }
+             if row.Content, err = mdtJsonMap(string(content)); err != nil {
+                 return nil, err
+             }
+             rows = append(rows, row)
+             continue
+         }
+         decodedKeys, decodedContent := gpbPlugin.messages()
+         if decodedKeys == nil {
+             return nil, fmt.Errorf("plugin has no keys and content messages of %s", telem.GetEncodingPath())
+         }
+         if err := proto.Unmarshal(r.Keys, decodedKeys); err != nil {
+             return nil, err
+         }
+         if err := proto.Unmarshal(r.Content, decodedContent); err != nil {
+             return nil, err
+         }
+         row.Keys = mdtProtoMap(proto.MessageReflect(decodedKeys))
+         row.Content = mdtProtoMap(proto.MessageReflect(decodedContent))
+         rows = append(rows, row)
+     }
+     return rows, nil
+}
+
+// leafs of a message decoded with a plugin or descriptor, values typed as
+// those of self-describing gpb, 64 bit counters stay numbers
+func mdtProtoMap(m protoreflect.Message) map[string]interface{} {
+     v := map[string]interface{}{}
+     m.Range(func(fd protoreflect.FieldDescriptor, val protoreflect.Value) bool {
+         name := string(fd.Name())
+         switch {
+         case fd.IsList():
+             l := val.List()
+             list := make([]interface{}, 0, l.Len())
+             for i := 0; i < l.Len(); i++ {
+                 list = append(list, mdtProtoValue(fd, l.Get(i)))
+             }
+             v[name] = list
+         case fd.IsMap():
+             entries := map[string]interface{}{}
+             val.Map().Range(func(k protoreflect.MapKey, e protoreflect.Value) bool {
+                 entries[k.String()] = mdtProtoValue(fd.MapValue(), e)
+                 return true
+             })
+             v[name] = entries
+         default:
+             v[name] = mdtProtoValue(fd, val)
+         }
+         return true
+     })
+     return v
+}
+
+func mdtProtoValue(fd protoreflect.FieldDescriptor, v protoreflect.Value) interface{} {
+     switch fd.Kind() {
+     case protoreflect.MessageKind, protoreflect.GroupKind:
+         return mdtProtoMap(v.Message())
+     case protoreflect.EnumKind:
+         if e := fd.Enum().Values().ByNumber(v.Enum()); e != nil {
+             return string(e.Name())
+         }
+         return int64(v.Enum())
+     case protoreflect.BoolKind:
+         return v.Bool()
+     case protoreflect.StringKind:
+         return v.String()
+     case protoreflect.BytesKind:
+         return string(v.Bytes())
+     case protoreflect.Uint64Kind, protoreflect.Fixed64Kind:
+         return v.Uint()
+     case protoreflect.Uint32Kind, protoreflect.Fixed32Kind:
+         return int64(v.Uint())
+     case protoreflect.FloatKind, protoreflect.DoubleKind:
+         return v.Float()
+     }
+     // int32, int64, sint and sfixed
+     return v.Int()
+}
+
+func mdtJsonMap(s string) (map[string]interface{}, error) {
+     var v interface{}
+
+     d := json.NewDecoder(bytes.NewReader([]byte(s)))
+     d.UseNumber()
+     if err := d.Decode(&v); err != nil {
+         return nil, err
+     }
+     return mdtJsonObject(v), nil
+}
+
+// flatten nested keys and content to a single level, names of nested
+// leafs are joined with ".", keys.interface-name, content.bytes-received.
+// Lists are kept as json strings.
+func (r *MdtRow)Flatten() map[string]interface{} {
+     m := map[string]interface{}{}
+     mdtFlatten(m, "keys.", r.Keys)
+     mdtFlatten(m, "content.", r.Content)
+     return m
+}
+
+func mdtFlatten(m map[string]interface{}, prefix string, v map[string]interface{}) {
+     for k, e := range v {
+         switch e := e.(type) {
+         case map[string]interface{}:
+             mdtFlatten(m, prefix + k + ".", e)
+         case []interface{}:
+             b, _ := json.Marshal(e)
+             m[prefix + k] = string(b)
+         default:
+             m[prefix + k] = e
+         }
+     }
+}
@@ -0,0 +1,341 @@
+package telemetry_decode
+
+import (
+       "os"
+       "fmt"
+       "sync"
+       "bytes"
+       "context"
+       "strings"
+       "strconv"
+       "net/url"
+       "encoding/binary"
+       "time"
+
+       "github.com/aws/aws-sdk-go-v2/aws"
+       "github.com/aws/aws-sdk-go-v2/config"
+       "github.com/aws/aws-sdk-go-v2/service/s3"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                    S 3   S I N K                        ///////
+///////////////////////////////////////////////////////////////////////
+// -out s3:<bucket>[/<prefix>][?format=..&compress=..&size=..&interval=..&partition=..&raw=true&region=..&endpoint=..&path_style=true]
+// Rows are collected as json lines into an object, uploaded when it has
+// size bytes (default 64MB, before compression), is interval old
+// (default 5m) or its time partition ends, object names are
+//   <prefix>/2019/03/06/10/mdt-20190306T100002Z-<host>-<pid>-<n>.json.gz
+// partition is hour or day. With raw=true messages are stored as
+// received, each with a 4 byte big endian length in front, .bin objects.
+// compress is gzip (default), zstd or none. Objects failing to upload are
+// retried every interval, oldest are dropped if more than 10 are
+// waiting. endpoint and path_style=true are for S3 compatible stores,
+// minio etc. Credentials and region are found the usual way, AWS_REGION,
+// ~/.aws/config, instance role.
+// format=msgpack stores rows as a msgpack stream in .msgpack objects.
+
+func init() {
+     mdtSinkTypes["s3"] = mdtNewS3Sink
+}
+
+type s3Object struct {
+     key  string
+     data []byte
+}
+
+type s3Sink struct {
+     sync.Mutex
+     client    *s3.Client
+     bucket    string
+     prefix    string
+     compress  string
+     size      int
+     interval  time.Duration
+     partition string
+     rawMode   bool
+     format    *mdtRowFormat
+     host      string
+     seq       int
+
+     buf       *bytes.Buffer           // object being filled
+     zw        mdtCompressWriter
+     written   int
+     opened    time.Time
+     key       string
+     pending   []s3Object              // sealed, waiting for upload
+
+     done      chan struct{}
+     stopped   chan struct{}
+}
+
+const s3MaxPending = 10
+
+func mdtNewS3Sink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("s3 output needs a bucket, s3:<bucket>[/<prefix>]")
+     }
+     bp := strings.SplitN(address, "/", 2)
+     s := &s3Sink{
+              bucket:    bp[0],
+              compress:  "gzip",
+              size:      64 << 20,
+              interval:  5 * time.Minute,
+              partition: "hour",
+              done:      make(chan struct{}),
+              stopped:   make(chan struct{}),
+          }
+     if len(bp) == 2 {
+         s.prefix = strings.Trim(bp[1], "/")
+     }
+     if s.host, err = os.Hostname(); err != nil {
+         s.host = "collector"
+     }
+
+     if c := options.Get("compress"); c != "" {
+         s.compress = c
+     }
+     switch s.compress {
+     case "none":
+         s.compress = ""
+     case "gzip", "zstd":
+     default:
+         return nil, fmt.Errorf("unsupported compress %s, Options: gzip,zstd,none", s.compress)
+     }
+     if sz := options.Get("size"); sz != "" {
+         if s.size, err = strconv.Atoi(sz); err != nil || s.size <= 0 {
+             return nil, fmt.Errorf("invalid size %s", sz)
+         }
+     }
+     if i := options.Get("interval"); i != "" {
+         if s.interval, err = time.ParseDuration(i); err != nil || s.interval <= 0 {
+             return nil, fmt.Errorf("invalid interval %s", i)
+         }
+     }
+     if p := options.Get("partition"); p != "" {
+         if p != "hour" && p != "day" {
+             return nil, fmt.Errorf("unsupported partition %s, Options: hour,day", p)
+         }
+         s.partition = p
+     }
+     if r := options.Get("raw"); r != "" {
+         if s.rawMode, err = strconv.ParseBool(r); err != nil {
+             return nil, fmt.Errorf("invalid raw %s", r)
+         }
+     }
+     if s.format, err = mdtGetRowFormat(options); err != nil {
+         return nil, err
+     }
+
+     ctx, cancel := context.WithTimeout(context.Background(), 30 * time.Second)
+     defer cancel()
+     var opts []func(*config.LoadOptions) error
+     if r := options.Get("region"); r != "" {
+         opts = append(opts, config.WithRegion(r))
+     }
+     cfg, err := config.LoadDefaultConfig(ctx, opts...)
+     if err != nil {
+         return nil, err
+     }
+     endpoint := options.Get("endpoint")
+     pathStyle := options.Get("path_style") == "true"
+     s.client = s3.NewFromConfig(cfg, func(o *s3.Options) {
+         if endpoint != "" {
+             o.BaseEndpoint = aws.String(endpoint)
+         }
+         o.UsePathStyle = pathStyle
+     })
+
+     go s.flushLoop()
+     return s, nil
+}
+
+// time partition of object, objects do not span partitions
+func (s *s3Sink) partitionOf(t time.Time) string {
+     if s.partition == "day" {
+         return t.UTC().Format("2006/01/02")
+     }
+     return t.UTC().Format("2006/01/02/15")
+}
+
+func (s *s3Sink) open() error {
+     now := time.Now()
+     s.seq++
+     name := fmt.Sprintf("mdt-%s-%s-%d-%d", now.UTC().Format("20060102T150405Z"), s.host, os.Getpid(), s.seq)
+     if s.rawMode {
+         name += ".bin"
+     } else {
+         name += s.format.suffix
+     }
+     name += mdtCompressSuffix(s.compress)
+
+     s.key = s.partitionOf(now) + "/" + name
+     if s.prefix != "" {
+         s.key = s.prefix + "/" + s.key
+     }
+     s.buf = &bytes.Buffer{}
+     s.zw = nil
+     if s.compress != "" {
+         var err error
+         if s.zw, err = mdtNewCompressWriter(s.buf, s.compress); err != nil {
+             return err
+         }
+     }
+     s.written = 0
+     s.opened = now
+     return nil
+}
+
+// append to current object, sealed when full, called with lock held
+func (s *s3Sink) write(b []byte) error {
+     if s.buf == nil {
+         if err := s.open(); err != nil {
+             return err
+         }
+     }
+     var err error
+     if s.zw != nil {
+         _, err = s.zw.Write(b)
+     } else {
+         _, err = s.buf.Write(b)
+     }
+     if err != nil {
+         return err
+     }
+     s.written += len(b)
+     if s.written >= s.size {
+         return s.seal()
+     }
+     return nil
+}
+
+// current object is complete, queued for upload
+func (s *s3Sink) seal() error {
+     if s.buf == nil {
+         return nil
+     }
+     if s.zw != nil {
+         if err := s.zw.Close(); err != nil {
+             return err
+         }
+     }
+     s.pending = append(s.pending, s3Object{key: s.key, data: s.buf.Bytes()})
+     if len(s.pending) > s3MaxPending {
+         telemetry_log.Errorf("s3: dropping %d objects\n", len(s.pending) - s3MaxPending)
+         s.pending = s.pending[len(s.pending) - s3MaxPending:]
+     }
+     s.buf, s.zw = nil, nil
+     return nil
+}
+
+func (s *s3Sink) raw() bool {
+     return s.rawMode
+}
+
+func (s *s3Sink) writeRaw(data []byte, encoding string) error {
+     s.Lock()
+     defer s.Unlock()
+
+     b := make([]byte, 4, 4 + len(data))
+     binary.BigEndian.PutUint32(b, uint32(len(data)))
+     return s.write(append(b, data...))
+}
+
+func (s *s3Sink) writeRows(rows []*MdtRow) error {
+     s.Lock()
+     defer s.Unlock()
+
+     for _, row := range rows {
+         b, err := s.format.marshal(row)
+         if err != nil {
+             return err
+         }
+         if err = s.write(append(b, s.format.separator...)); err != nil {
+             return err
+         }
+     }
+     return nil
+}
+
+// upload pending objects, writes continue while uploading
+func (s *s3Sink) upload() error {
+     s.Lock()
+     objects := s.pending
+     s.Unlock()
+
+     var n int
+     var err error
+     for _, o := range objects {
+         ctx, cancel := context.WithTimeout(context.Background(), 5 * time.Minute)
+         _, err = s.client.PutObject(ctx, &s3.PutObjectInput{
+                                              Bucket: aws.String(s.bucket),
+                                              Key:    aws.String(o.key),
+                                              Body:   bytes.NewReader(o.data),
+                                          })
+         cancel()
+         if err != nil {
+             err = fmt.Errorf("s3: upload %s: %v", o.key, err)
+             break
+         }
+         telemetry_log.Printf("Out file: s3://%s/%s\n", s.bucket, o.key)
+         n++
+     }
+
+     s.Lock()
+     // objects may have been dropped meanwhile
+     for n > 0 && len(s.pending) > 0 && s.pending[0].key == objects[0].key {
+         s.pending, objects = s.pending[1:], objects[1:]
+         n--
+     }
+     s.Unlock()
+     return err
+}
+
+func (s *s3Sink) flushLoop() {
+     defer close(s.stopped)
+
+     t := time.NewTicker(time.Second)
+     defer t.Stop()
+     var failed time.Time
+     for {
+         select {
+         case <-s.done:
+             return
+         case now := <-t.C:
+             s.Lock()
+             if s.buf != nil && (now.Sub(s.opened) >= s.interval || s.partitionOf(now) != s.partitionOf(s.opened)) {
+                 if err := s.seal(); err != nil {
+                     telemetry_log.Errorln("Failed to write rows:", err)
+                 }
+             }
+             pending := len(s.pending)
+             s.Unlock()
+
+             // failed uploads are retried every interval
+             if pending == 0 || (!failed.IsZero() && now.Sub(failed) < s.interval) {
+                 continue
+             }
+             failed = time.Time{}
+             if err := s.upload(); err != nil {
+                 telemetry_log.Errorln("Failed to write rows:", err)
+                 failed = now
+             }
+         }
+     }
+}
+
+func (s *s3Sink) close() error {
+     close(s.done)
+     <-s.stopped
+
+     s.Lock()
+     err := s.seal()
+     s.Unlock()
+     if err != nil {
+         return err
+     }
+     return s.upload()
+}
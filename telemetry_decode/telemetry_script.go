@@ -0,0 +1,203 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sort"
+
+       "go.starlark.net/starlark"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// Script is a Starlark file with a transform function, called for every
+// decoded row, after path map,
+//   def transform(row):
+//       if row["keys"]["interface-name"].startswith("Mgmt"):
+//           return None
+//       row["content"]["bits-received"] = row["content"]["bytes-received"] * 8
+//       return row
+// row is a dict of node_id, subscription, encoding_path, collection_id,
+// timestamp, keys and content. transform returns the row, changed or
+// not, None to drop it, or a list of rows. A row the script fails on
+// goes on unchanged, error is logged.
+
+var mdtScriptTransform *starlark.Function
+
+// load script, rows are transformed from now on
+func MdtScriptLoad(fileName string) error {
+     thread := &starlark.Thread{Name: "load", Print: mdtScriptPrint}
+     globals, err := starlark.ExecFile(thread, fileName, nil, nil)
+     if err != nil {
+         return err
+     }
+     fn, ok := globals["transform"].(*starlark.Function)
+     if !ok {
+         return fmt.Errorf("%s: no transform function", fileName)
+     }
+     // globals are frozen, calls from many sessions share them
+     globals.Freeze()
+     mdtScriptTransform = fn
+     return nil
+}
+
+func mdtScriptPrint(_ *starlark.Thread, msg string) {
+     telemetry_log.Println("script:", msg)
+}
+
+func mdtScriptRows(rows []*MdtRow) []*MdtRow {
+     var out []*MdtRow
+     thread := &starlark.Thread{Name: "transform", Print: mdtScriptPrint}
+     for _, row := range rows {
+         v, err := starlark.Call(thread, mdtScriptTransform, starlark.Tuple{scriptRow(row)}, nil)
+         if err != nil {
+             telemetry_log.Errorln("Script:", err)
+             out = append(out, row)
+             continue
+         }
+         switch v := v.(type) {
+         case starlark.NoneType:
+         case *starlark.Dict:
+             out = append(out, scriptToRow(v, row))
+         case *starlark.List:
+             for i := 0; i < v.Len(); i++ {
+                 if d, ok := v.Index(i).(*starlark.Dict); ok {
+                     out = append(out, scriptToRow(d, row))
+                 }
+             }
+         default:
+             telemetry_log.Errorf("Script: transform returned %s, not a row\n", v.Type())
+             out = append(out, row)
+         }
+     }
+     return out
+}
+
+func scriptRow(row *MdtRow) *starlark.Dict {
+     d := starlark.NewDict(7)
+     d.SetKey(starlark.String("node_id"), starlark.String(row.NodeId))
+     d.SetKey(starlark.String("subscription"), starlark.String(row.Subscription))
+     d.SetKey(starlark.String("encoding_path"), starlark.String(row.EncodingPath))
+     d.SetKey(starlark.String("collection_id"), starlark.MakeUint64(row.CollectionId))
+     d.SetKey(starlark.String("timestamp"), starlark.MakeUint64(row.Timestamp))
+     d.SetKey(starlark.String("keys"), scriptValue(row.Keys))
+     d.SetKey(starlark.String("content"), scriptValue(row.Content))
+     return d
+}
+
+// header fields missing in the dict are those of the row transformed
+func scriptToRow(d *starlark.Dict, from *MdtRow) *MdtRow {
+     row := *from
+     m, _ := goValue(d).(map[string]interface{})
+     if s, ok := m["node_id"].(string); ok {
+         row.NodeId = s
+     }
+     if s, ok := m["subscription"].(string); ok {
+         row.Subscription = s
+     }
+     if s, ok := m["encoding_path"].(string); ok {
+         row.EncodingPath = s
+     }
+     if n, ok := scriptUint(m["collection_id"]); ok {
+         row.CollectionId = n
+     }
+     if n, ok := scriptUint(m["timestamp"]); ok {
+         row.Timestamp = n
+     }
+     row.Keys, _ = m["keys"].(map[string]interface{})
+     if row.Keys == nil {
+         row.Keys = map[string]interface{}{}
+     }
+     row.Content, _ = m["content"].(map[string]interface{})
+     if row.Content == nil {
+         row.Content = map[string]interface{}{}
+     }
+     return &row
+}
+
+func scriptUint(v interface{}) (uint64, bool) {
+     switch v := v.(type) {
+     case int64:
+         return uint64(v), v >= 0
+     case uint64:
+         return v, true
+     }
+     return 0, false
+}
+
+func scriptValue(v interface{}) starlark.Value {
+     switch v := v.(type) {
+     case nil:
+         return starlark.None
+     case bool:
+         return starlark.Bool(v)
+     case string:
+         return starlark.String(v)
+     case int64:
+         return starlark.MakeInt64(v)
+     case uint64:
+         return starlark.MakeUint64(v)
+     case int:
+         return starlark.MakeInt(v)
+     case uint32:
+         return starlark.MakeUint64(uint64(v))
+     case float64:
+         return starlark.Float(v)
+     case map[string]interface{}:
+         keys := make([]string, 0, len(v))
+         for k := range v {
+             keys = append(keys, k)
+         }
+         sort.Strings(keys)
+         d := starlark.NewDict(len(v))
+         for _, k := range keys {
+             d.SetKey(starlark.String(k), scriptValue(v[k]))
+         }
+         return d
+     case []interface{}:
+         l := make([]starlark.Value, len(v))
+         for i, e := range v {
+             l[i] = scriptValue(e)
+         }
+         return starlark.NewList(l)
+     }
+     return starlark.String(fmt.Sprint(v))
+}
+
+// leaf values as rows have them, int64, uint64, float64, bool or string
+func goValue(v starlark.Value) interface{} {
+     switch v := v.(type) {
+     case starlark.NoneType:
+         return nil
+     case starlark.Bool:
+         return bool(v)
+     case starlark.String:
+         return string(v)
+     case starlark.Int:
+         if i, ok := v.Int64(); ok {
+             return i
+         }
+         if u, ok := v.Uint64(); ok {
+             return u
+         }
+         return v.String()
+     case starlark.Float:
+         return float64(v)
+     case *starlark.Dict:
+         m := make(map[string]interface{}, v.Len())
+         for _, item := range v.Items() {
+             k, ok := starlark.AsString(item[0])
+             if !ok {
+                 k = item[0].String()
+             }
+             m[k] = goValue(item[1])
+         }
+         return m
+     case starlark.Indexable:
+         l := make([]interface{}, v.Len())
+         for i := range l {
+             l[i] = goValue(v.Index(i))
+         }
+         return l
+     }
+     return v.String()
+}
@@ -0,0 +1,222 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sort"
+       "strconv"
+       "strings"
+       "sync"
+       "time"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                R A T E   S H A P I N G                  ///////
+///////////////////////////////////////////////////////////////////////
+// Processing of messages is shaped by token buckets, messages and bytes
+// per second, set with -rate_limit and changed at runtime from the admin
+// api, for emulating a slow collector in the lab,
+//   -rate_limit msgs=1000,bytes=10000000
+//   -rate_limit "intf-counters:msgs=10;bgp:bytes=100000,burst=5s"
+// A limit without subscription applies to all the messages together, one
+// with a subscription to the messages of that subscription from all the
+// routers, a message waits for both. A bucket holds burst of its rate,
+// default 1s, messages are let through without waiting while it is not
+// empty. A message larger than the bucket goes through once the bucket is
+// full and leaves it owing. Messages wait in the output loop, they queue
+// up in the data channel and eventually the router is flow controlled.
+
+type MdtRateLimit struct {
+     // all the messages if not set
+     Subscription string  `json:"subscription,omitempty"`
+     // messages and bytes per second, 0 for no limit
+     Msgs         float64 `json:"msgs,omitempty"`
+     Bytes        float64 `json:"bytes,omitempty"`
+     // seconds of rate a bucket holds
+     Burst        float64 `json:"burst"`
+}
+
+type mdtTokenBucket struct {
+     rate   float64
+     size   float64
+     tokens float64
+     last   time.Time
+}
+
+func newTokenBucket(rate, burst float64) *mdtTokenBucket {
+     if rate <= 0 {
+         return nil
+     }
+     size := rate * burst
+     if size < 1 {
+         size = 1
+     }
+     return &mdtTokenBucket{rate: rate, size: size, tokens: size, last: time.Now()}
+}
+
+// take n tokens, how long to wait till they are there
+func (b *mdtTokenBucket) take(n float64, now time.Time) time.Duration {
+     if b == nil {
+         return 0
+     }
+     b.tokens += now.Sub(b.last).Seconds() * b.rate
+     if b.tokens > b.size {
+         b.tokens = b.size
+     }
+     b.last = now
+     b.tokens -= n
+     if b.tokens >= 0 {
+         return 0
+     }
+     return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+type mdtShaper struct {
+     limit MdtRateLimit
+     msgs  *mdtTokenBucket
+     bytes *mdtTokenBucket
+}
+
+// shapers by subscription, "" for all the messages
+var mdtShape = struct {
+    sync.Mutex
+    shapers map[string]*mdtShaper
+    // true if any shaper is per subscription
+    perSub  bool
+}{shapers: make(map[string]*mdtShaper)}
+
+// limits of -rate_limit, ";" separated [subscription:]msgs=..,bytes=..,burst=..
+func MdtRateLimitParse(spec string) ([]MdtRateLimit, error) {
+     var limits []MdtRateLimit
+     for _, s := range strings.Split(spec, ";") {
+         if s = strings.TrimSpace(s); s == "" {
+             continue
+         }
+         l := MdtRateLimit{Burst: 1}
+         if i := strings.Index(s, ":"); i >= 0 {
+             l.Subscription, s = s[:i], s[i+1:]
+         }
+         for _, kv := range strings.Split(s, ",") {
+             i := strings.Index(kv, "=")
+             if i < 0 {
+                 return nil, fmt.Errorf("invalid rate limit %s, expected [subscription:]msgs=<n>,bytes=<n>,burst=<duration>", kv)
+             }
+             k, v := strings.TrimSpace(kv[:i]), strings.TrimSpace(kv[i+1:])
+             var err error
+             switch k {
+             case "msgs":
+                 l.Msgs, err = strconv.ParseFloat(v, 64)
+             case "bytes":
+                 l.Bytes, err = strconv.ParseFloat(v, 64)
+             case "burst":
+                 var d time.Duration
+                 if d, err = time.ParseDuration(v); err == nil && d <= 0 {
+                     err = fmt.Errorf("not positive")
+                 }
+                 l.Burst = d.Seconds()
+             default:
+                 return nil, fmt.Errorf("unknown rate limit %s, Options: msgs,bytes,burst", k)
+             }
+             if err != nil || l.Msgs < 0 || l.Bytes < 0 {
+                 return nil, fmt.Errorf("invalid rate limit %s", kv)
+             }
+         }
+         limits = append(limits, l)
+     }
+     return limits, nil
+}
+
+// set limit of its subscription, replacing the previous one, removed if
+// both msgs and bytes are 0
+func MdtSetRateLimit(l MdtRateLimit) {
+     if l.Burst <= 0 {
+         l.Burst = 1
+     }
+     mdtShape.Lock()
+     defer mdtShape.Unlock()
+     if l.Msgs == 0 && l.Bytes == 0 {
+         delete(mdtShape.shapers, l.Subscription)
+     } else {
+         mdtShape.shapers[l.Subscription] = &mdtShaper{
+                                               limit: l,
+                                               msgs:  newTokenBucket(l.Msgs, l.Burst),
+                                               bytes: newTokenBucket(l.Bytes, l.Burst),
+                                           }
+     }
+     mdtShape.perSub = false
+     for sub := range mdtShape.shapers {
+         if sub != "" {
+             mdtShape.perSub = true
+         }
+     }
+}
+
+// limits set, sorted by subscription
+func MdtRateLimits() []MdtRateLimit {
+     mdtShape.Lock()
+     defer mdtShape.Unlock()
+     limits := []MdtRateLimit{}
+     for _, s := range mdtShape.shapers {
+         limits = append(limits, s.limit)
+     }
+     sort.Slice(limits, func(i, j int) bool { return limits[i].Subscription < limits[j].Subscription })
+     return limits
+}
+
+// limit of subscription, "" for all the messages, zero limit if not set
+func MdtRateLimitOf(subscription string) MdtRateLimit {
+     mdtShape.Lock()
+     defer mdtShape.Unlock()
+     if s := mdtShape.shapers[subscription]; s != nil {
+         return s.limit
+     }
+     return MdtRateLimit{Subscription: subscription, Burst: 1}
+}
+
+// message rate limit of all the messages, 0 if none
+func MdtOutRate() float64 {
+     mdtShape.Lock()
+     defer mdtShape.Unlock()
+     if s := mdtShape.shapers[""]; s != nil {
+         return s.limit.Msgs
+     }
+     return 0
+}
+
+// how long message data of o waits for the buckets of all the messages and
+// of its subscription
+func (o *MdtOut) mdtShapeDelay(data []byte) time.Duration {
+     mdtShape.Lock()
+     if len(mdtShape.shapers) == 0 {
+         mdtShape.Unlock()
+         return 0
+     }
+     perSub := mdtShape.perSub
+     mdtShape.Unlock()
+
+     // dialout sessions carry the subscription in the messages
+     sub := o.Subscription
+     if perSub && sub == "" {
+         sub = o.mdtMessageSubscription(data)
+     }
+
+     var delay time.Duration
+     now := time.Now()
+     mdtShape.Lock()
+     defer mdtShape.Unlock()
+     names := []string{""}
+     if sub != "" {
+         names = append(names, sub)
+     }
+     for _, name := range names {
+         s := mdtShape.shapers[name]
+         if s == nil {
+             continue
+         }
+         for _, d := range []time.Duration{s.msgs.take(1, now), s.bytes.take(float64(len(data)), now)} {
+             if d > delay {
+                 delay = d
+             }
+         }
+     }
+     return delay
+}
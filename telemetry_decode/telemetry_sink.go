@@ -0,0 +1,211 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sync"
+       "strings"
+       "strconv"
+       "net/url"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                      S I N K S                          ///////
+///////////////////////////////////////////////////////////////////////
+// Sinks store decoded rows, selected with -out <sink>:<address>, options
+// are given as query, parquet:/data/mdt?partition=day. Every output loop
+// opens its own sink. Sinks buffer rows, MdtOutClose must be called
+// before exiting so that buffered rows are written out.
+
+type mdtSink interface {
+     writeRows(rows []*MdtRow) error
+     close() error
+}
+
+// sinks that can store messages as received, raw returns true if the
+// sink was asked to, messages are then not decoded into rows. encoding is
+// the encoding of the session, gpb, self-describing-gpb or json.
+type mdtRawSink interface {
+     raw() bool
+     writeRaw(data []byte, encoding string) error
+}
+
+// sink constructors by name, address is -out without sink name and options
+var mdtSinkTypes = map[string]func(address string, options url.Values) (mdtSink, error){}
+
+// sink of another package, such as the memory sink of telemetry_harness
+type MdtSink interface {
+     WriteRows(rows []*MdtRow) error
+     Close() error
+}
+
+type mdtPackageSink struct {
+     s MdtSink
+}
+
+func (p mdtPackageSink) writeRows(rows []*MdtRow) error {
+     return p.s.WriteRows(rows)
+}
+
+func (p mdtPackageSink) close() error {
+     return p.s.Close()
+}
+
+// -out name:<address> opens a sink with open from now on, to be called
+// from init
+func MdtRegisterSink(name string, open func(address string, options url.Values) (MdtSink, error)) {
+     mdtSinkTypes[name] = func(address string, options url.Values) (mdtSink, error) {
+         s, err := open(address, options)
+         if err != nil {
+             return nil, err
+         }
+         return mdtPackageSink{s}, nil
+     }
+}
+
+// open sinks, closed on exit
+var mdtSinkRegistry = struct {
+    sync.Mutex
+    sinks  map[*mdtLockedSink]bool
+    closed bool
+}{sinks: make(map[*mdtLockedSink]bool)}
+
+// sink is closed from MdtOutClose while output loop may be writing to it
+type mdtLockedSink struct {
+     sync.Mutex
+     sink   mdtSink
+     closed bool
+}
+
+// true if out selects a sink
+func mdtIsSink(out string) bool {
+     _, ok := mdtSinkTypes[strings.SplitN(out, ":", 2)[0]]
+     return ok
+}
+
+// sink name, address and options of out
+func mdtParseSink(out string) (string, string, url.Values, error) {
+     outN := strings.SplitN(out, ":", 2)
+     if len(outN) != 2 {
+         return outN[0], "", nil, fmt.Errorf("expected %s:<address>", outN[0])
+     }
+     address, options := outN[1], url.Values{}
+     if i := strings.LastIndex(address, "?"); i >= 0 {
+         var err error
+         if options, err = url.ParseQuery(address[i+1:]); err != nil {
+             return outN[0], "", nil, fmt.Errorf("options %s: %v", address[i+1:], err)
+         }
+         address = address[:i]
+     }
+     return outN[0], address, options, nil
+}
+
+func mdtOpenSink(out string) (*mdtLockedSink, error) {
+     name, address, options, err := mdtParseSink(out)
+     if err != nil {
+         return nil, err
+     }
+
+     s, err := mdtSinkTypes[name](address, options)
+     if err != nil {
+         return nil, err
+     }
+     ls := &mdtLockedSink{sink: s}
+
+     mdtSinkRegistry.Lock()
+     defer mdtSinkRegistry.Unlock()
+     if mdtSinkRegistry.closed {
+         s.close()
+         return nil, fmt.Errorf("collector is exiting")
+     }
+     mdtSinkRegistry.sinks[ls] = true
+     return ls, nil
+}
+
+func (ls *mdtLockedSink) writeRows(rows []*MdtRow) error {
+     ls.Lock()
+     defer ls.Unlock()
+     if ls.closed {
+         return fmt.Errorf("sink is closed")
+     }
+     return ls.sink.writeRows(rows)
+}
+
+// false if sink does not store raw messages
+func (ls *mdtLockedSink) writeRaw(data []byte, encoding string) (bool, error) {
+     ls.Lock()
+     defer ls.Unlock()
+     rs, ok := ls.sink.(mdtRawSink)
+     if !ok || !rs.raw() {
+         return false, nil
+     }
+     if ls.closed {
+         return true, fmt.Errorf("sink is closed")
+     }
+     return true, rs.writeRaw(data, encoding)
+}
+
+func (ls *mdtLockedSink) close() error {
+     mdtSinkRegistry.Lock()
+     delete(mdtSinkRegistry.sinks, ls)
+     mdtSinkRegistry.Unlock()
+
+     ls.Lock()
+     defer ls.Unlock()
+     if ls.closed {
+         return nil
+     }
+     ls.closed = true
+     return ls.sink.close()
+}
+
+// close all the open sinks, writing out buffered rows, called on exit
+func MdtOutClose() {
+     mdtSinkRegistry.Lock()
+     mdtSinkRegistry.closed = true
+     var sinks []*mdtLockedSink
+     for ls := range mdtSinkRegistry.sinks {
+         sinks = append(sinks, ls)
+     }
+     mdtSinkRegistry.Unlock()
+
+     for _, ls := range sinks {
+         if err := ls.close(); err != nil {
+             telemetry_log.Errorln("Failed to close output:", err)
+         }
+     }
+}
+
+// name usable as table or column name in any store, lower case letters,
+// digits and "_", nested names joined with "__"
+func mdtSafeName(s string) string {
+     return strings.Map(func(r rune) rune {
+         if (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9') || r == '_' {
+             return r
+         }
+         if r >= 'A' && r <= 'Z' {
+             return r + 'a' - 'A'
+         }
+         return '_'
+     }, strings.Replace(s, ".", "__", -1))
+}
+
+// numeric value of a leaf as text for metric outputs, booleans are 0/1,
+// false if leaf is not numeric
+func mdtMetricValue(v interface{}) (string, bool) {
+     switch v := v.(type) {
+     case int64:
+         return strconv.FormatInt(v, 10), true
+     case uint64:
+         return strconv.FormatUint(v, 10), true
+     case float64:
+         return strconv.FormatFloat(v, 'g', -1, 64), true
+     case bool:
+         if v {
+             return "1", true
+         }
+         return "0", true
+     }
+     return "", false
+}
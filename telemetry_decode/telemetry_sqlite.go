@@ -0,0 +1,109 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "net/url"
+       "database/sql"
+       "encoding/json"
+
+       _ "github.com/mattn/go-sqlite3"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                  S Q L I T E   S I N K                  ///////
+///////////////////////////////////////////////////////////////////////
+// -out sqlite:<file>
+// Rows are inserted into a table per sensor path, created as needed,
+//   time, node, subscription, collection_id, keys, content
+// time is milliseconds since epoch, keys and content are json, e.g.
+//   select datetime(time/1000, 'unixepoch'), json_extract(keys, '$.interface-name'),
+//          json_extract(content, '$.bytes-received') from <table>
+// Sessions can share the database file.
+
+func init() {
+     mdtSinkTypes["sqlite"] = mdtNewSqliteSink
+}
+
+type sqliteSink struct {
+     db     *sql.DB
+     tables map[string]string
+}
+
+func mdtNewSqliteSink(address string, options url.Values) (mdtSink, error) {
+     if address == "" {
+         return nil, fmt.Errorf("sqlite output needs a database file, sqlite:<file>")
+     }
+     // sessions writing to same file wait for each other
+     db, err := sql.Open("sqlite3", "file:" + address + "?_busy_timeout=10000&_journal_mode=WAL")
+     if err != nil {
+         return nil, err
+     }
+     if err = db.Ping(); err != nil {
+         db.Close()
+         return nil, err
+     }
+     telemetry_log.Println("Out file:", address)
+     return &sqliteSink{db: db, tables: map[string]string{}}, nil
+}
+
+// table for sensor path, Cisco-IOS-XR-infra-statsd-oper:infra-statistics/interfaces/...
+// becomes cisco_ios_xr_infra_statsd_oper_infra_statistics_interfaces_...
+func (s *sqliteSink) table(encodingPath string) (string, error) {
+     if t, ok := s.tables[encodingPath]; ok {
+         return t, nil
+     }
+     t := mdtSafeName(encodingPath)
+     _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS "` + t + `" (
+                            time          INTEGER,
+                            node          TEXT,
+                            subscription  TEXT,
+                            collection_id INTEGER,
+                            keys          TEXT,
+                            content       TEXT)`)
+     if err != nil {
+         return "", err
+     }
+     s.tables[encodingPath] = t
+     return t, nil
+}
+
+// rows of a message are inserted in one transaction
+func (s *sqliteSink) writeRows(rows []*MdtRow) error {
+     // tables are created before transaction is started
+     for _, row := range rows {
+         if _, err := s.table(row.EncodingPath); err != nil {
+             return err
+         }
+     }
+
+     tx, err := s.db.Begin()
+     if err != nil {
+         return err
+     }
+     defer tx.Rollback()
+
+     for _, row := range rows {
+         t := s.tables[row.EncodingPath]
+         keys, err := json.Marshal(row.Keys)
+         if err != nil {
+             return err
+         }
+         content, err := json.Marshal(row.Content)
+         if err != nil {
+             return err
+         }
+         _, err = tx.Exec(`INSERT INTO "` + t + `" VALUES (?, ?, ?, ?, ?, ?)`,
+                          int64(row.Timestamp), row.NodeId, row.Subscription,
+                          int64(row.CollectionId), string(keys), string(content))
+         if err != nil {
+             return err
+         }
+     }
+     return tx.Commit()
+}
+
+func (s *sqliteSink) close() error {
+     return s.db.Close()
+}
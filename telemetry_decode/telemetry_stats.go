@@ -0,0 +1,207 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sort"
+       "sync"
+       "sync/atomic"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////     O U T P U T   S T A T S   A N D   C O N T R O L     ///////
+///////////////////////////////////////////////////////////////////////
+// Every output loop registers its counters while it is running, these are
+// reported by the admin api. Pause applies to all the output loops,
+// messages queue up in data channel and eventually the router is flow
+// controlled, useful for checking router behaviour with slow collector,
+// as are the rate limits of telemetry_shape.go.
+// A bounded run stops all the output loops after a number of messages or
+// a duration, each writing out and closing its output, and the collector
+// exits with a summary.
+
+type mdtOutCounters struct {
+     name        string
+     reqId       int64
+     start       time.Time
+     messages    uint64
+     bytes       uint64
+     errors      uint64
+     lastMessage int64
+}
+
+// stats of an output loop, as reported by admin api
+type MdtOutStat struct {
+     Name        string    `json:"name"`
+     // dialin subscription request id
+     ReqId       int64     `json:"req_id,omitempty"`
+     Start       time.Time `json:"start"`
+     Messages    uint64    `json:"messages"`
+     Bytes       uint64    `json:"bytes"`
+     Errors      uint64    `json:"errors"`
+     LastMessage time.Time `json:"last_message,omitempty"`
+}
+
+var mdtOutRegistry = struct {
+    sync.Mutex
+    counters map[*mdtOutCounters]bool
+}{counters: make(map[*mdtOutCounters]bool)}
+
+// all the messages since start, of loops running or done
+var mdtOutTotal = mdtOutCounters{name: "total", start: time.Now()}
+
+var mdtOutBound = struct {
+    maxMessages uint64
+    counted     uint64
+    stop        func()
+    once        sync.Once
+    stopped     chan struct{}
+}{stopped: make(chan struct{})}
+
+var mdtOutControl = struct {
+    sync.Mutex
+    cond   *sync.Cond
+    paused bool
+}{}
+
+func init() {
+     mdtOutControl.cond = sync.NewCond(&mdtOutControl)
+}
+
+func mdtOutRegister(name string, reqId int64) *mdtOutCounters {
+     c := &mdtOutCounters{name: name, reqId: reqId, start: time.Now()}
+     mdtOutRegistry.Lock()
+     mdtOutRegistry.counters[c] = true
+     mdtOutRegistry.Unlock()
+     return c
+}
+
+func mdtOutUnregister(c *mdtOutCounters) {
+     mdtOutRegistry.Lock()
+     delete(mdtOutRegistry.counters, c)
+     mdtOutRegistry.Unlock()
+}
+
+func (c *mdtOutCounters) message(n int) {
+     if c != &mdtOutTotal {
+         mdtOutTotal.message(n)
+     }
+     atomic.AddUint64(&c.messages, 1)
+     atomic.AddUint64(&c.bytes, uint64(n))
+     atomic.StoreInt64(&c.lastMessage, time.Now().UnixNano())
+}
+
+func (c *mdtOutCounters) error() {
+     if c != &mdtOutTotal {
+         mdtOutTotal.error()
+     }
+     atomic.AddUint64(&c.errors, 1)
+}
+
+// stats of all the running output loops, sorted by name
+func MdtOutStats() []MdtOutStat {
+     var stats []MdtOutStat
+
+     mdtOutRegistry.Lock()
+     for c := range mdtOutRegistry.counters {
+         s := MdtOutStat{
+                  Name:     c.name,
+                  ReqId:    c.reqId,
+                  Start:    c.start,
+                  Messages: atomic.LoadUint64(&c.messages),
+                  Bytes:    atomic.LoadUint64(&c.bytes),
+                  Errors:   atomic.LoadUint64(&c.errors),
+              }
+         if t := atomic.LoadInt64(&c.lastMessage); t != 0 {
+             s.LastMessage = time.Unix(0, t)
+         }
+         stats = append(stats, s)
+     }
+     mdtOutRegistry.Unlock()
+
+     sort.Slice(stats, func(i, j int) bool { return stats[i].Name < stats[j].Name })
+     return stats
+}
+
+// pause or resume processing of messages
+func MdtOutPause(pause bool) {
+     mdtOutControl.Lock()
+     mdtOutControl.paused = pause
+     mdtOutControl.Unlock()
+     mdtOutControl.cond.Broadcast()
+}
+
+func MdtOutPaused() bool {
+     mdtOutControl.Lock()
+     defer mdtOutControl.Unlock()
+     return mdtOutControl.paused
+}
+
+// called before processing every message, blocks while paused and till
+// rate limits let data through
+func (o *MdtOut) mdtOutWait(data []byte) {
+     mdtOutControl.Lock()
+     for mdtOutControl.paused {
+         mdtOutControl.cond.Wait()
+     }
+     mdtOutControl.Unlock()
+
+     if delay := o.mdtShapeDelay(data); delay > 0 {
+         time.Sleep(delay)
+     }
+}
+
+// bound the run to maxMessages messages across all output loops and to
+// maxDuration, 0 for no bound. Output loops are stopped when either is
+// reached, then stop is called, it is expected to exit.
+func MdtOutSetBound(maxMessages uint64, maxDuration time.Duration, stop func()) {
+     mdtOutBound.maxMessages = maxMessages
+     mdtOutBound.stop = stop
+     if maxDuration > 0 {
+         time.AfterFunc(maxDuration, func() {
+             mdtOutStop(fmt.Sprintf("-max_duration %v reached", maxDuration))
+         })
+     }
+}
+
+// false once max messages are processed, message is not processed
+func mdtOutCount() bool {
+     if mdtOutBound.maxMessages == 0 {
+         return true
+     }
+     n := atomic.AddUint64(&mdtOutBound.counted, 1)
+     if n > mdtOutBound.maxMessages {
+         return false
+     }
+     if n == mdtOutBound.maxMessages {
+         go mdtOutStop(fmt.Sprintf("-max_messages %d reached", mdtOutBound.maxMessages))
+     }
+     return true
+}
+
+// stop output loops, wait for them to write out their outputs, at most
+// 10s in case one is paused, print summary and call stop
+func mdtOutStop(reason string) {
+     mdtOutBound.once.Do(func() {
+         telemetry_log.Printf("Stopping, %s\n", reason)
+         close(mdtOutBound.stopped)
+         deadline := time.Now().Add(10 * time.Second)
+         for time.Now().Before(deadline) {
+             mdtOutRegistry.Lock()
+             running := len(mdtOutRegistry.counters)
+             mdtOutRegistry.Unlock()
+             if running == 0 {
+                 break
+             }
+             time.Sleep(10 * time.Millisecond)
+         }
+         telemetry_log.Printf("Processed %d messages, %d bytes, %d errors in %v\n",
+                              atomic.LoadUint64(&mdtOutTotal.messages), atomic.LoadUint64(&mdtOutTotal.bytes),
+                              atomic.LoadUint64(&mdtOutTotal.errors), time.Since(mdtOutTotal.start).Round(time.Millisecond))
+         if mdtOutBound.stop != nil {
+             mdtOutBound.stop()
+         }
+     })
+}
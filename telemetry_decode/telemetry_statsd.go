@@ -0,0 +1,190 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "net"
+       "sort"
+       "bytes"
+       "strings"
+       "strconv"
+       "net/url"
+       "io/ioutil"
+       "text/template"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                 S T A T S D   S I N K                   ///////
+///////////////////////////////////////////////////////////////////////
+// -out statsd:<host:port>[?metric=..&fields=..&counters=..&packet=..]
+// Numeric leafs of the content are sent over UDP as gauges. Metric name
+// is a template, default {{.Node}}.{{.Path}}.{{.Keys}}.{{.Leaf}}, fields
+//   .Node          node the row is from
+//   .Model         model name, Cisco-IOS-XR-infra-statsd-oper
+//   .Path          sensor path without model name, "/" replaced by "."
+//   .Keys          key values ordered by key name, joined with "."
+//   .Leaf          leaf name, nested leafs joined with "."
+// fields=<leaf>,.. selects the leafs to send, default all numeric leafs.
+// Leafs in counters=<leaf>,.. are sent as counters, increment since the
+// previous message, router counters are totals. Metrics are packed into
+// datagrams of up to packet bytes (default 1432).
+
+func init() {
+     mdtSinkTypes["statsd"] = mdtNewStatsdSink
+}
+
+type statsdMetricVars struct {
+     Node  string
+     Model string
+     Path  string
+     Keys  string
+     Leaf  string
+}
+
+type statsdSink struct {
+     conn     net.Conn
+     metric   *template.Template
+     fields   map[string]bool
+     counters map[string]bool
+     last     map[string]float64   // previous value of counters
+     packet   int
+}
+
+var statsdReplacer = strings.NewReplacer(":", "_", "|", "_", "@", "_", " ", "_", "/", "_", "\n", "_")
+
+func mdtNewStatsdSink(address string, options url.Values) (mdtSink, error) {
+     var err error
+
+     if address == "" {
+         return nil, fmt.Errorf("statsd output needs an address, statsd:<host:port>")
+     }
+     s := &statsdSink{
+              fields:   map[string]bool{},
+              counters: map[string]bool{},
+              last:     map[string]float64{},
+              packet:   1432,
+          }
+
+     metric := options.Get("metric")
+     if metric == "" {
+         metric = "{{.Node}}.{{.Path}}.{{.Keys}}.{{.Leaf}}"
+     }
+     if s.metric, err = template.New("metric").Parse(metric); err != nil {
+         return nil, fmt.Errorf("metric template %s: %v", metric, err)
+     }
+     if err = s.metric.Execute(ioutil.Discard, &statsdMetricVars{}); err != nil {
+         return nil, fmt.Errorf("metric template %s: %v", metric, err)
+     }
+     if f := options.Get("fields"); f != "" {
+         for _, leaf := range strings.Split(f, ",") {
+             s.fields[leaf] = true
+         }
+     }
+     if c := options.Get("counters"); c != "" {
+         for _, leaf := range strings.Split(c, ",") {
+             s.counters[leaf] = true
+         }
+     }
+     if p := options.Get("packet"); p != "" {
+         if s.packet, err = strconv.Atoi(p); err != nil || s.packet <= 0 {
+             return nil, fmt.Errorf("invalid packet %s", p)
+         }
+     }
+
+     if s.conn, err = net.Dial("udp", address); err != nil {
+         return nil, err
+     }
+     return s, nil
+}
+
+// metric name part, "." is kept as separator
+func statsdName(s string) string {
+     return statsdReplacer.Replace(s)
+}
+
+func (s *statsdSink) writeRows(rows []*MdtRow) error {
+     var metrics []string
+
+     for _, row := range rows {
+         vars := statsdMetricVars{Node: statsdName(row.NodeId), Path: row.EncodingPath}
+         if i := strings.Index(row.EncodingPath, ":"); i >= 0 {
+             vars.Model, vars.Path = row.EncodingPath[:i], row.EncodingPath[i+1:]
+         }
+         vars.Path = statsdName(strings.Replace(vars.Path, "/", ".", -1))
+
+         keys := map[string]interface{}{}
+         mdtFlatten(keys, "", row.Keys)
+         var names, values []string
+         for k := range keys {
+             names = append(names, k)
+         }
+         sort.Strings(names)
+         for _, k := range names {
+             values = append(values, statsdName(strings.Replace(fmt.Sprint(keys[k]), ".", "_", -1)))
+         }
+         vars.Keys = strings.Join(values, ".")
+
+         fields := map[string]interface{}{}
+         mdtFlatten(fields, "", row.Content)
+         for leaf, v := range fields {
+             if len(s.fields) != 0 && !s.fields[leaf] && !s.counters[leaf] {
+                 continue
+             }
+             value, ok := mdtMetricValue(v)
+             if !ok {
+                 continue
+             }
+             vars.Leaf = statsdName(leaf)
+             var b bytes.Buffer
+             if err := s.metric.Execute(&b, &vars); err != nil {
+                 return err
+             }
+             // no empty nodes if template fields are empty, key-less rows
+             name := strings.Trim(strings.Replace(b.String(), "..", ".", -1), ".")
+
+             if s.counters[leaf] {
+                 f, _ := strconv.ParseFloat(value, 64)
+                 prev, ok := s.last[name]
+                 s.last[name] = f
+                 // first value and counter resets have no increment
+                 if !ok || f < prev {
+                     continue
+                 }
+                 metrics = append(metrics, name + ":" + strconv.FormatFloat(f - prev, 'g', -1, 64) + "|c")
+                 continue
+             }
+             // negative value changes a gauge, it is set to 0 first
+             if strings.HasPrefix(value, "-") {
+                 metrics = append(metrics, name + ":0|g")
+             }
+             metrics = append(metrics, name + ":" + value + "|g")
+         }
+     }
+     return s.send(metrics)
+}
+
+// send metrics, as many as fit in a datagram
+func (s *statsdSink) send(metrics []string) error {
+     var b bytes.Buffer
+     for _, m := range metrics {
+         if b.Len() != 0 && b.Len() + 1 + len(m) > s.packet {
+             if _, err := s.conn.Write(b.Bytes()); err != nil {
+                 return err
+             }
+             b.Reset()
+         }
+         if b.Len() != 0 {
+             b.WriteByte('\n')
+         }
+         b.WriteString(m)
+     }
+     if b.Len() != 0 {
+         if _, err := s.conn.Write(b.Bytes()); err != nil {
+             return err
+         }
+     }
+     return nil
+}
+
+func (s *statsdSink) close() error {
+     return s.conn.Close()
+}
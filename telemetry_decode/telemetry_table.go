@@ -0,0 +1,109 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "sort"
+       "bytes"
+       "strings"
+       "strconv"
+       "text/tabwriter"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                 T A B L E   O U T P U T                 ///////
+///////////////////////////////////////////////////////////////////////
+// -format table writes rows of every message as aligned columns, for
+// watching a few counters interactively,
+//   TIME          NODE  PATH                         interface-name  packets-received
+//   10:00:02.092  r1    infra-statistics/interfa...  Gi0/0/0/0       100
+// Columns are time, node, sensor path without model name, the keys and
+// the leafs in -fields, nested leafs joined with ".", rates.input-rate.
+// Without -fields all leafs of the message are shown. Every message gets
+// its own header, rows of a message are aligned.
+
+const tablePathWidth = 48
+
+func tableValue(v interface{}) string {
+     switch v := v.(type) {
+     case nil:
+         return "-"
+     case float64:
+         return strconv.FormatFloat(v, 'f', -1, 64)
+     default:
+         return fmt.Sprint(v)
+     }
+}
+
+// long sensor paths are cut in the middle, end of the path tells most
+func tablePath(path string) string {
+     path = path[strings.Index(path, ":") + 1:]
+     if len(path) <= tablePathWidth {
+         return path
+     }
+     return path[:tablePathWidth / 2 - 2] + "..." + path[len(path) - tablePathWidth / 2 + 1:]
+}
+
+func (o *MdtOut)mdtDumpTableMessage(data []byte) {
+     rows, err := o.mdtDecodeRows(data)
+     if err != nil {
+         o.counters.error()
+         telemetry_log.Errorln("Failed to decode rows:", err)
+         o.mdtQuarantine(data, err)
+         return
+     }
+     if len(rows) == 0 {
+         return
+     }
+
+     var keys, fields []string
+     seenKeys, seenFields := map[string]bool{}, map[string]bool{}
+     flat := make([]map[string]interface{}, len(rows))
+     for i, row := range rows {
+         flat[i] = row.Flatten()
+         for name := range flat[i] {
+             if strings.HasPrefix(name, "keys.") {
+                 if k := strings.TrimPrefix(name, "keys."); !seenKeys[k] {
+                     seenKeys[k] = true
+                     keys = append(keys, k)
+                 }
+             } else if f := strings.TrimPrefix(name, "content."); len(o.tableFields) == 0 && !seenFields[f] {
+                 seenFields[f] = true
+                 fields = append(fields, f)
+             }
+         }
+     }
+     sort.Strings(keys)
+     if len(o.tableFields) != 0 {
+         fields = o.tableFields
+     } else {
+         sort.Strings(fields)
+     }
+
+     var b bytes.Buffer
+     w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+     header := append([]string{"TIME", "NODE", "PATH"}, keys...)
+     fmt.Fprintln(w, strings.Join(append(header, fields...), "\t"))
+     for i, row := range rows {
+         line := []string{
+                     time.Unix(0, int64(row.Timestamp) * int64(time.Millisecond)).Format("15:04:05.000"),
+                     row.NodeId,
+                     tablePath(row.EncodingPath),
+                 }
+         for _, k := range keys {
+             line = append(line, tableValue(flat[i]["keys." + k]))
+         }
+         for _, f := range fields {
+             line = append(line, tableValue(flat[i]["content." + f]))
+         }
+         fmt.Fprintln(w, strings.Join(line, "\t"))
+     }
+     w.Flush()
+     b.WriteString("\n")
+
+     if err = o.mdtWriteOut(b.String()); err != nil {
+         telemetry_log.Errorln(err)
+     }
+}
@@ -0,0 +1,86 @@
+package telemetry_decode
+
+import (
+       "strings"
+       "sync"
+       "sync/atomic"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                   L I V E   T A I L                     ///////
+///////////////////////////////////////////////////////////////////////
+// Decoded rows of every session, for watching the feed from a browser.
+// Rows are decoded only while someone is watching, a slow watcher loses
+// rows instead of holding up the sessions. Rows can be limited to sensor
+// paths starting with a prefix, with or without the model name,
+//   Cisco-IOS-XR-infra-statsd-oper:infra-statistics/interfaces
+//   infra-statistics/interfaces
+
+type MdtTail struct {
+     C       chan *MdtRow
+     path    string
+     dropped uint64
+}
+
+var mdtTails = struct {
+    sync.RWMutex
+    tails map[*MdtTail]bool
+    n     int32
+}{tails: make(map[*MdtTail]bool)}
+
+// start watching rows of sensor paths starting with path, all rows if
+// path is empty. Up to buffer rows are queued on C.
+func MdtTailStart(path string, buffer int) *MdtTail {
+     t := &MdtTail{C: make(chan *MdtRow, buffer), path: path}
+     mdtTails.Lock()
+     mdtTails.tails[t] = true
+     atomic.StoreInt32(&mdtTails.n, int32(len(mdtTails.tails)))
+     mdtTails.Unlock()
+     return t
+}
+
+// stop watching, C is not closed
+func (t *MdtTail) Stop() {
+     mdtTails.Lock()
+     delete(mdtTails.tails, t)
+     atomic.StoreInt32(&mdtTails.n, int32(len(mdtTails.tails)))
+     mdtTails.Unlock()
+}
+
+// rows lost as C was full
+func (t *MdtTail) Dropped() uint64 {
+     return atomic.LoadUint64(&t.dropped)
+}
+
+func (t *MdtTail) match(path string) bool {
+     if t.path == "" || strings.HasPrefix(path, t.path) {
+         return true
+     }
+     return strings.HasPrefix(path[strings.Index(path, ":") + 1:], t.path)
+}
+
+func mdtTailActive() bool {
+     return atomic.LoadInt32(&mdtTails.n) > 0
+}
+
+// decode message and pass rows to the watchers
+func (o *MdtOut)mdtTailMessage(data []byte) {
+     rows, err := o.mdtDecodeRows(data)
+     if err != nil {
+         return
+     }
+     mdtTails.RLock()
+     defer mdtTails.RUnlock()
+     for t := range mdtTails.tails {
+         for _, row := range rows {
+             if !t.match(row.EncodingPath) {
+                 continue
+             }
+             select {
+             case t.C <- row:
+             default:
+                 atomic.AddUint64(&t.dropped, 1)
+             }
+         }
+     }
+}
@@ -0,0 +1,84 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "bytes"
+       "strings"
+
+       "github.com/golang/protobuf/proto"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////           P R O T O   T E X T   O U T P U T             ///////
+///////////////////////////////////////////////////////////////////////
+// -format text writes messages in protobuf text format instead of json.
+// self-describing-gpb messages are the Telemetry message as is, gpb
+// messages have keys and content of the rows decoded with the plugin of
+// the sensor path, in place of the bytes,
+//   data_gpb: <
+//     row: <
+//       timestamp: 1551866407092
+//       keys: <
+//         interface_name: "GigabitEthernet0/0/0/0"
+//       >
+//       content: <
+//         ...
+// Rows without plugin are written with escaped bytes, as protoc
+// --decode=Telemetry would. Fields are in proto order, so consecutive
+// messages diff cleanly.
+
+// indent every line of text
+func textIndent(s string, indent string) string {
+     var b strings.Builder
+     for _, line := range strings.SplitAfter(s, "\n") {
+         if line != "" {
+             b.WriteString(indent)
+             b.WriteString(line)
+         }
+     }
+     return b.String()
+}
+
+func (o *MdtOut)mdtDumpTextMessage(copy *telemetry.Telemetry) {
+     var gpbPlugin *gpbPluginInfo
+     if copy.GetDataGpb() != nil {
+         gpbPlugin = o.mdtGpbPlugin(copy.EncodingPath)
+     }
+     var decodedKeys, decodedContent proto.Message
+     if gpbPlugin != nil {
+         decodedKeys, decodedContent = gpbPlugin.messages()
+     }
+     if decodedKeys == nil {
+         if err := o.mdtWriteOut(proto.MarshalTextString(copy)); err != nil {
+             telemetry_log.Errorln("Error writing the output", err)
+         }
+         return
+     }
+
+     var rows bytes.Buffer
+     for _, row := range copy.GetDataGpb().GetRow() {
+         if err := proto.Unmarshal(row.Keys, decodedKeys); err != nil {
+             telemetry_log.Errorln("plugin unmarshal failed", err)
+             return
+         }
+         if err := proto.Unmarshal(row.Content, decodedContent); err != nil {
+             telemetry_log.Errorln("plugin unmarshal failed", err)
+             return
+         }
+         fmt.Fprintf(&rows, "  row: <\n    timestamp: %d\n", row.Timestamp)
+         rows.WriteString("    keys: <\n")
+         rows.WriteString(textIndent(proto.MarshalTextString(decodedKeys), "      "))
+         rows.WriteString("    >\n    content: <\n")
+         rows.WriteString(textIndent(proto.MarshalTextString(decodedContent), "      "))
+         rows.WriteString("    >\n  >\n")
+     }
+
+     copy.DataGpb = nil
+     out := proto.MarshalTextString(copy) + "data_gpb: <\n" + rows.String() + ">\n"
+     if err := o.mdtWriteOut(out); err != nil {
+         telemetry_log.Errorln("Error writing the output", err)
+     }
+}
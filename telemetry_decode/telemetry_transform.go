@@ -0,0 +1,258 @@
+package telemetry_decode
+
+import (
+       "bufio"
+       "bytes"
+       "context"
+       "encoding/json"
+       "fmt"
+       "io"
+       "io/ioutil"
+       "sync"
+       "time"
+
+       "github.com/tetratelabs/wazero"
+       "github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// WebAssembly transforms and decoders are WASI modules, written in any
+// language, run in the collector by the embedded wazero runtime, no
+// runtime to install. A request is a json line written to the stdin of
+// the module, it answers with a json line on stdout. A transform gets rows
+// of every message as a json array and answers with the rows to keep,
+// changed, dropped or added. A decoder gets keys or content of a gpb row
+// no plugin decodes,
+//   {"encoding_path": "<path>", "part": "keys", "data": "<base64>"}
+// and answers with the decoded value, or an error,
+//   {"value": {...}}   {"error": "<reason>"}
+// Lines it writes to stderr are logged. A module that exits or does not
+// take a request or answer in time is stopped, rows go on unchanged and
+// rows left to a decoder fail to decode.
+
+const wasmTimeout = 5 * time.Second
+
+type mdtWasm struct {
+     name    string
+     mu      sync.Mutex
+     // ends the module, its runtime is closed on it
+     cancel  context.CancelFunc
+     in      *io.PipeWriter
+     out     chan []byte
+     stopped bool
+}
+
+var mdtWasmTransform *mdtWasm
+
+var mdtWasmDecoder *mdtWasm
+
+// start module, rows are transformed from now on
+func MdtWasmStart(module string) error {
+     w, err := mdtWasmRun("transform", module)
+     if err != nil {
+         return err
+     }
+     mdtWasmTransform = w
+     return nil
+}
+
+// start module, gpb rows without plugin are decoded by it from now on
+func MdtWasmDecoderStart(module string) error {
+     w, err := mdtWasmRun("decoder", module)
+     if err != nil {
+         return err
+     }
+     mdtWasmDecoder = w
+     return nil
+}
+
+func mdtWasmRun(name, module string) (*mdtWasm, error) {
+     b, err := ioutil.ReadFile(module)
+     if err != nil {
+         return nil, err
+     }
+     ctx, cancel := context.WithCancel(context.Background())
+     runtime := wazero.NewRuntimeWithConfig(ctx, wazero.NewRuntimeConfig().WithCloseOnContextDone(true))
+     wasi_snapshot_preview1.MustInstantiate(ctx, runtime)
+     compiled, err := runtime.CompileModule(ctx, b)
+     if err != nil {
+         runtime.Close(ctx)
+         cancel()
+         return nil, fmt.Errorf("%s: %v", module, err)
+     }
+
+     inR, inW := io.Pipe()
+     outR, outW := io.Pipe()
+     errR, errW := io.Pipe()
+     config := wazero.NewModuleConfig().
+                      WithName(name).
+                      WithArgs(module).
+                      WithStdin(inR).
+                      WithStdout(outW).
+                      WithStderr(errW)
+     w := &mdtWasm{name: name, cancel: cancel, in: inW, out: make(chan []byte, 1)}
+     go func() {
+         r := bufio.NewReaderSize(outR, 1024*1024)
+         for {
+             line, err := r.ReadBytes('\n')
+             if err != nil {
+                 close(w.out)
+                 return
+             }
+             w.out <- line
+         }
+     }()
+     go func() {
+         s := bufio.NewScanner(errR)
+         for s.Scan() {
+             telemetry_log.Errorln("wasm:", s.Text())
+         }
+     }()
+     go func() {
+         // runs _start of the module till it exits or is stopped
+         _, err := runtime.InstantiateModule(ctx, compiled, config)
+         telemetry_log.Errorf("WebAssembly %s %s exited: %v\n", name, module, err)
+         inR.Close()
+         outW.Close()
+         errW.Close()
+         runtime.Close(context.Background())
+     }()
+     telemetry_log.Printf("WebAssembly %s %s started\n", name, module)
+     return w, nil
+}
+
+// write request and read the answer, both within wasmTimeout, module is
+// stopped if it fails to take the request or to answer
+func (w *mdtWasm) call(req []byte) ([]byte, error) {
+     w.mu.Lock()
+     defer w.mu.Unlock()
+     if w.stopped {
+         return nil, fmt.Errorf("WebAssembly %s is stopped", w.name)
+     }
+     timeout := time.NewTimer(wasmTimeout)
+     defer timeout.Stop()
+
+     // a module not reading its stdin blocks the write, stop ends it
+     written := make(chan error, 1)
+     go func() {
+         _, err := w.in.Write(append(req, '\n'))
+         written <- err
+     }()
+     select {
+     case err := <-written:
+         if err != nil {
+             return nil, w.stop(fmt.Sprintf("write failed, %v", err))
+         }
+     case <-timeout.C:
+         return nil, w.stop(fmt.Sprintf("request not taken in %v", wasmTimeout))
+     }
+     select {
+     case line, ok := <-w.out:
+         if !ok {
+             return nil, w.stop("output closed")
+         }
+         return line, nil
+     case <-timeout.C:
+         return nil, w.stop(fmt.Sprintf("no answer in %v", wasmTimeout))
+     }
+}
+
+func (w *mdtWasm) rows(rows []*MdtRow) []*MdtRow {
+     b, err := json.Marshal(rows)
+     if err != nil {
+         return rows
+     }
+     line, err := w.call(b)
+     if err != nil {
+         return rows
+     }
+
+     var out []struct {
+         MdtRow
+         Keys    interface{} `json:"keys"`
+         Content interface{} `json:"content"`
+     }
+     d := json.NewDecoder(bytes.NewReader(line))
+     d.UseNumber()
+     if err = d.Decode(&out); err != nil {
+         telemetry_log.Errorln("WebAssembly transform, bad rows:", err)
+         return rows
+     }
+     transformed := make([]*MdtRow, 0, len(out))
+     for i := range out {
+         row := out[i].MdtRow
+         row.Keys = mdtJsonObject(out[i].Keys)
+         row.Content = mdtJsonObject(out[i].Content)
+         transformed = append(transformed, &row)
+     }
+     return transformed
+}
+
+// module is not called any more, error of the call that stopped it
+func (w *mdtWasm) stop(reason string) error {
+     telemetry_log.Errorf("WebAssembly %s stopped, %s\n", w.name, reason)
+     w.stopped = true
+     w.in.Close()
+     w.cancel()
+     return fmt.Errorf("WebAssembly %s stopped, %s", w.name, reason)
+}
+
+// decoder of gpb rows of a sensor path by -wasm_decoder
+type mdtWasmPathDecoder struct {
+     w    *mdtWasm
+     path string
+}
+
+func (d *mdtWasmPathDecoder) Match(encodingPath string) bool {
+     return encodingPath == d.path
+}
+
+func (d *mdtWasmPathDecoder) DecodeKeys(data []byte) (interface{}, error) {
+     return d.decode("keys", data)
+}
+
+func (d *mdtWasmPathDecoder) DecodeContent(data []byte) (interface{}, error) {
+     return d.decode("content", data)
+}
+
+func (d *mdtWasmPathDecoder) decode(part string, data []byte) (interface{}, error) {
+     req, err := json.Marshal(struct {
+                                  EncodingPath string `json:"encoding_path"`
+                                  Part         string `json:"part"`
+                                  Data         []byte `json:"data"`
+                              }{d.path, part, data})
+     if err != nil {
+         return nil, err
+     }
+     line, err := d.w.call(req)
+     if err != nil {
+         return nil, err
+     }
+     var answer struct {
+         Value interface{} `json:"value"`
+         Error string      `json:"error"`
+     }
+     dec := json.NewDecoder(bytes.NewReader(line))
+     dec.UseNumber()
+     if err = dec.Decode(&answer); err != nil {
+         return nil, fmt.Errorf("WebAssembly decoder, bad answer: %v", err)
+     }
+     if answer.Error != "" {
+         return nil, fmt.Errorf("WebAssembly decoder: %s", answer.Error)
+     }
+     return answer.Value, nil
+}
+
+// module is readable and compiles, without starting it
+func MdtWasmCheck(module string) error {
+     b, err := ioutil.ReadFile(module)
+     if err != nil {
+         return err
+     }
+     ctx := context.Background()
+     runtime := wazero.NewRuntime(ctx)
+     defer runtime.Close(ctx)
+     _, err = runtime.CompileModule(ctx, b)
+     return err
+}
@@ -0,0 +1,334 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "os"
+       "sort"
+       "strings"
+       "sync"
+       "time"
+
+       "golang.org/x/term"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                  L I V E   V I E W                      ///////
+///////////////////////////////////////////////////////////////////////
+// -tui takes over the terminal and redraws every second,
+//   - sessions, subscriptions for dialin, with message rate and errors
+//   - last value of the leafs pinned with -fields, a line per node, path
+//     and keys, most recently updated first
+//   - rows as they arrive, first row of every message
+//   - collector messages and errors
+// Output given with -out is written as usual, messages for stdout are
+// dropped. Keys: q quits, p pauses and resumes processing of messages,
+// as pause from admin api. Needs a terminal on stdin and stdout.
+
+const (
+      tuiMaxPinned = 200
+      tuiMaxRows   = 200
+      tuiMaxLog    = 50
+)
+
+type tuiPinned struct {
+     node    string
+     path    string
+     keys    string
+     values  []string
+     updated time.Time
+}
+
+type mdtTuiView struct {
+     sync.Mutex
+     fields  []string
+     pinned  map[string]*tuiPinned
+     rows    []string
+     log     []string
+     partial string
+     // messages per session at previous redraw, for rates
+     prev    map[string]uint64
+     prevAt  time.Time
+     quit    func()
+     restore func()
+     stop    chan struct{}
+     stopped sync.Once
+}
+
+var mdtTui *mdtTuiView
+
+// start live view, quit is called when q is pressed. fields are the leafs
+// to pin, comma separated, as -fields.
+func MdtTuiStart(fields string, quit func()) error {
+     if !term.IsTerminal(int(os.Stdout.Fd())) || !term.IsTerminal(int(os.Stdin.Fd())) {
+         return fmt.Errorf("-tui needs a terminal")
+     }
+     t := &mdtTuiView{
+              pinned: make(map[string]*tuiPinned),
+              prev:   make(map[string]uint64),
+              prevAt: time.Now(),
+              quit:   quit,
+              stop:   make(chan struct{}),
+          }
+     if fields != "" {
+         t.fields = strings.Split(fields, ",")
+     }
+
+     // keys are read as pressed, output needs \r\n while in raw mode
+     state, err := term.MakeRaw(int(os.Stdin.Fd()))
+     if err != nil {
+         return err
+     }
+     t.restore = func() { term.Restore(int(os.Stdin.Fd()), state) }
+     // alternate screen, cursor hidden
+     fmt.Print("\033[?1049h\033[?25l")
+
+     telemetry_log.SetOutput(t)
+     mdtTui = t
+     go t.keys()
+     go t.redrawLoop()
+     return nil
+}
+
+// leave live view and give the terminal back
+func MdtTuiStop() {
+     if t := mdtTui; t != nil {
+         t.stopped.Do(func() {
+             close(t.stop)
+             t.Lock()
+             fmt.Print("\033[?25h\033[?1049l")
+             t.restore()
+             telemetry_log.SetOutput(os.Stdout)
+             t.Unlock()
+         })
+     }
+}
+
+// collector messages printed while live view is on
+func (t *mdtTuiView) Write(p []byte) (int, error) {
+     t.Lock()
+     defer t.Unlock()
+     lines := strings.Split(t.partial + string(p), "\n")
+     t.partial = lines[len(lines) - 1]
+     for _, line := range lines[:len(lines) - 1] {
+         if line = strings.TrimSpace(line); line != "" {
+             t.log = append(t.log, time.Now().Format("15:04:05 ") + line)
+         }
+     }
+     if len(t.log) > tuiMaxLog {
+         t.log = t.log[len(t.log) - tuiMaxLog:]
+     }
+     return len(p), nil
+}
+
+func (t *mdtTuiView) keys() {
+     buf := make([]byte, 1)
+     for {
+         if _, err := os.Stdin.Read(buf); err != nil {
+             return
+         }
+         switch buf[0] {
+         case 'q', 'Q', 3:
+             // 3 is ctrl-c, no signal is sent in raw mode
+             MdtTuiStop()
+             t.quit()
+             return
+         case 'p', 'P':
+             MdtOutPause(!MdtOutPaused())
+             t.redraw()
+         }
+     }
+}
+
+func (t *mdtTuiView) redrawLoop() {
+     ticker := time.NewTicker(time.Second)
+     defer ticker.Stop()
+     for {
+         t.redraw()
+         select {
+         case <-t.stop:
+             return
+         case <-ticker.C:
+         }
+     }
+}
+
+// rows of a message for the live view
+func (o *MdtOut)mdtTuiMessage(data []byte) {
+     rows, err := o.mdtDecodeRows(data)
+     if err != nil || len(rows) == 0 {
+         return
+     }
+     t := mdtTui
+     t.Lock()
+     defer t.Unlock()
+
+     for i, row := range rows {
+         flat := row.Flatten()
+         var keys, content []string
+         for name, v := range flat {
+             if strings.HasPrefix(name, "keys.") {
+                 keys = append(keys, strings.TrimPrefix(name, "keys.") + "=" + tableValue(v))
+             } else if i == 0 {
+                 content = append(content, strings.TrimPrefix(name, "content.") + "=" + tableValue(v))
+             }
+         }
+         sort.Strings(keys)
+         if i == 0 {
+             sort.Strings(content)
+             ts := time.Unix(0, int64(row.Timestamp) * int64(time.Millisecond)).Format("15:04:05.000")
+             t.rows = append(t.rows, strings.Join(append([]string{ts, row.NodeId, tablePath(row.EncodingPath), strings.Join(keys, " ")}, content...), " "))
+         }
+         if len(t.fields) == 0 {
+             continue
+         }
+
+         id := row.NodeId + "\x00" + row.EncodingPath + "\x00" + strings.Join(keys, " ")
+         p, ok := t.pinned[id]
+         if !ok {
+             if len(t.pinned) >= tuiMaxPinned {
+                 continue
+             }
+             p = &tuiPinned{node: row.NodeId, path: tablePath(row.EncodingPath), keys: strings.Join(keys, " ")}
+             t.pinned[id] = p
+         }
+         found := false
+         values := make([]string, len(t.fields))
+         for j, f := range t.fields {
+             if v, ok := flat["content." + f]; ok {
+                 values[j] = tableValue(v)
+                 found = true
+             } else if j < len(p.values) {
+                 values[j] = p.values[j]
+             } else {
+                 values[j] = "-"
+             }
+         }
+         if found {
+             p.values, p.updated = values, time.Now()
+         } else if !ok {
+             // row has none of the pinned leafs
+             delete(t.pinned, id)
+         }
+     }
+     if len(t.rows) > tuiMaxRows {
+         t.rows = t.rows[len(t.rows) - tuiMaxRows:]
+     }
+}
+
+// cut line to the screen width
+func tuiLine(s string, width int) string {
+     if len(s) > width {
+         return s[:width]
+     }
+     return s
+}
+
+// values in columns as wide as the pinned leaf names
+func tuiColumns(values []string, fields []string) string {
+     var b strings.Builder
+     for i, v := range values {
+         fmt.Fprintf(&b, " %*s", len(fields[i]), v)
+     }
+     return b.String()
+}
+
+func (t *mdtTuiView) redraw() {
+     width, height, err := term.GetSize(int(os.Stdout.Fd()))
+     if err != nil {
+         width, height = 80, 24
+     }
+     stats := MdtOutStats()
+
+     t.Lock()
+     defer t.Unlock()
+     select {
+     case <-t.stop:
+         return
+     default:
+     }
+
+     now := time.Now()
+     elapsed := now.Sub(t.prevAt).Seconds()
+     var lines []string
+     var total float64
+     sessions := []string{fmt.Sprintf("%-48s %10s %12s %8s  %s", "SESSION", "MSG/S", "MESSAGES", "ERRORS", "LAST")}
+     prev := make(map[string]uint64)
+     for _, s := range stats {
+         rate := 0.0
+         if n, ok := t.prev[s.Name]; ok && elapsed > 0 {
+             rate = float64(s.Messages - n) / elapsed
+         }
+         prev[s.Name] = s.Messages
+         total += rate
+         last := "-"
+         if !s.LastMessage.IsZero() {
+             last = now.Sub(s.LastMessage).Round(time.Second).String() + " ago"
+         }
+         sessions = append(sessions, fmt.Sprintf("%-48s %10.1f %12d %8d  %s", tuiLine(s.Name, 48), rate, s.Messages, s.Errors, last))
+     }
+     t.prev, t.prevAt = prev, now
+
+     status := ""
+     if MdtOutPaused() {
+         status = "  PAUSED"
+     }
+     lines = append(lines, fmt.Sprintf("%s  %s  %d sessions  %.1f msg/s%s  (q quit, p pause)",
+                                       now.Format("15:04:05"), os.Args[0], len(stats), total, status), "")
+     lines = append(lines, sessions...)
+
+     if len(t.fields) != 0 {
+         var pinned []*tuiPinned
+         for _, p := range t.pinned {
+             pinned = append(pinned, p)
+         }
+         sort.Slice(pinned, func(i, j int) bool {
+             if !pinned[i].updated.Equal(pinned[j].updated) {
+                 return pinned[i].updated.After(pinned[j].updated)
+             }
+             return pinned[i].keys < pinned[j].keys
+         })
+         max := height / 3
+         if len(pinned) > max {
+             pinned = pinned[:max]
+         }
+         lines = append(lines, "", fmt.Sprintf("%-12s %-48s %-30s%s", "NODE", "PATH", "KEYS", tuiColumns(t.fields, t.fields)))
+         for _, p := range pinned {
+             lines = append(lines, fmt.Sprintf("%-12s %-48s %-30s%s", p.node, p.path, tuiLine(p.keys, 30), tuiColumns(p.values, t.fields)))
+         }
+     }
+
+     logLines := t.log
+     if len(logLines) > 3 {
+         logLines = logLines[len(logLines) - 3:]
+     }
+     lines = append(lines, "", "ROWS")
+     if n := height - len(lines) - len(logLines) - 2; n > 0 {
+         rows := t.rows
+         if len(rows) > n {
+             rows = rows[len(rows) - n:]
+         }
+         lines = append(lines, rows...)
+         for i := len(rows); i < n; i++ {
+             lines = append(lines, "")
+         }
+     }
+     lines = append(lines, "", "LOG")
+     lines = append(lines, logLines...)
+     if len(lines) > height {
+         lines = lines[:height]
+     }
+
+     var b strings.Builder
+     b.WriteString("\033[H")
+     for i, line := range lines {
+         b.WriteString(tuiLine(line, width))
+         b.WriteString("\033[K")
+         if i < len(lines) - 1 {
+             b.WriteString("\r\n")
+         }
+     }
+     b.WriteString("\033[J")
+     os.Stdout.WriteString(b.String())
+}
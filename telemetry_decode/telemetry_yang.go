@@ -0,0 +1,561 @@
+package telemetry_decode
+
+import (
+       "fmt"
+       "io/ioutil"
+       "path/filepath"
+       "strconv"
+       "strings"
+       "sync"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////               Y A N G   M O D E L S                     ///////
+///////////////////////////////////////////////////////////////////////
+// Yang models loaded from a directory, the .yang files of the models
+// streamed and of the models they import, give rows what gpb decode
+// alone does not know, leaf values of their yang type, enum names in
+// place of numbers, strings of 64 bit numbers as numbers, and units of
+// leafs. Keys of rows are checked to be keys of the list in the model.
+// Only the statements describing data are read, containers, lists,
+// leafs, groupings, typedefs, choices and augments, the rest is skipped.
+// Groupings and typedefs are of the module they are in, a prefixed name is
+// found through the imports of the module using it, so modules may use
+// the same names.
+
+type yangLeaf struct {
+     typ   string            // built-in type, typedefs resolved
+     units string
+     enums map[int64]string
+}
+
+type yangModels struct {
+     leafs map[string]*yangLeaf // by schema path, module:a/b/c
+     keys  map[string][]string  // keys of lists, by schema path
+}
+
+var mdtYang *yangModels
+
+// yang statement, keyword, argument and substatements
+type yangStmt struct {
+     keyword string
+     arg     string
+     subs    []*yangStmt
+}
+
+func (s *yangStmt) sub(keyword string) *yangStmt {
+     for _, sub := range s.subs {
+         if sub.keyword == keyword {
+             return sub
+         }
+     }
+     return nil
+}
+
+func (s *yangStmt) subArg(keyword string) string {
+     if sub := s.sub(keyword); sub != nil {
+         return sub.arg
+     }
+     return ""
+}
+
+// load .yang files of directory
+func MdtYangLoad(dir string) error {
+     files, err := filepath.Glob(filepath.Join(dir, "*.yang"))
+     if err != nil {
+         return err
+     }
+     if len(files) == 0 {
+         return fmt.Errorf("%s: no .yang files", dir)
+     }
+     var modules []*yangStmt
+     for _, file := range files {
+         b, err := ioutil.ReadFile(file)
+         if err != nil {
+             return err
+         }
+         stmts, err := yangParse(string(b))
+         if err != nil {
+             return fmt.Errorf("%s: %v", file, err)
+         }
+         for _, s := range stmts {
+             if s.keyword == "module" || s.keyword == "submodule" {
+                 modules = append(modules, s)
+             }
+         }
+     }
+
+     y := &yangBuilder{
+              groupings: map[string]*yangDef{},
+              typedefs:  map[string]*yangDef{},
+              prefixes:  map[string]string{},
+              models:    &yangModels{
+                             leafs: map[string]*yangLeaf{},
+                             keys:  map[string][]string{},
+                         },
+          }
+     for _, m := range modules {
+         if m.keyword == "module" {
+             y.prefixes[m.subArg("prefix")] = m.arg
+         }
+         y.collect(m, m)
+     }
+     for _, m := range modules {
+         y.module, y.moduleName = m, yangModuleName(m)
+         y.data(m.subs, y.moduleName + ":", 0)
+         for _, s := range m.subs {
+             if s.keyword == "augment" {
+                 if path := y.augmentPath(s.arg); path != "" {
+                     y.data(s.subs, path + "/", 0)
+                 }
+             }
+         }
+     }
+     mdtYang = y.models
+     telemetry_log.Printf("Loaded yang models from %s, %d leafs\n", dir, len(y.models.leafs))
+     return nil
+}
+
+type yangBuilder struct {
+     groupings  map[string]*yangDef // by module:name
+     typedefs   map[string]*yangDef // by module:name
+     prefixes   map[string]string // prefix of module to module name
+     module     *yangStmt         // module or submodule names are resolved in
+     moduleName string
+     models     *yangModels
+}
+
+// grouping or typedef and the module or submodule it is in
+type yangDef struct {
+     stmt   *yangStmt
+     module *yangStmt
+}
+
+// name of module, of the module a submodule belongs to
+func yangModuleName(m *yangStmt) string {
+     if m.keyword == "submodule" {
+         return m.subArg("belongs-to")
+     }
+     return m.arg
+}
+
+// groupings and typedefs of module m, anywhere in it
+func (y *yangBuilder) collect(m, s *yangStmt) {
+     for _, sub := range s.subs {
+         switch sub.keyword {
+         case "grouping":
+             y.groupings[yangModuleName(m) + ":" + sub.arg] = &yangDef{sub, m}
+         case "typedef":
+             y.typedefs[yangModuleName(m) + ":" + sub.arg] = &yangDef{sub, m}
+         }
+         y.collect(m, sub)
+     }
+}
+
+// module:name of a name used in the current module, prefix:name is of
+// the module imported with prefix
+func (y *yangBuilder) qualify(name string) string {
+     if i := strings.Index(name, ":"); i >= 0 {
+         if module := y.importOf(name[:i]); module != "" {
+             return module + ":" + name[i+1:]
+         }
+         return name
+     }
+     return y.moduleName + ":" + name
+}
+
+// names are resolved in the module of def till the returned func is called
+func (y *yangBuilder) enter(def *yangDef) func() {
+     module, moduleName := y.module, y.moduleName
+     y.module, y.moduleName = def.module, yangModuleName(def.module)
+     return func() {
+         y.module, y.moduleName = module, moduleName
+     }
+}
+
+func yangName(name string) string {
+     if i := strings.Index(name, ":"); i >= 0 {
+         return name[i+1:]
+     }
+     return name
+}
+
+// schema path of absolute augment target, /if:interfaces/if:interface
+func (y *yangBuilder) augmentPath(target string) string {
+     elems := strings.Split(strings.Trim(target, "/"), "/")
+     module := y.moduleName
+     if i := strings.Index(elems[0], ":"); i >= 0 {
+         prefix := elems[0][:i]
+         if imp := y.importOf(prefix); imp != "" {
+             module = imp
+         }
+     }
+     for i := range elems {
+         elems[i] = yangName(elems[i])
+     }
+     return module + ":" + strings.Join(elems, "/")
+}
+
+func (y *yangBuilder) importOf(prefix string) string {
+     for _, imp := range y.module.subs {
+         if imp.keyword == "import" && imp.subArg("prefix") == prefix {
+             return imp.arg
+         }
+     }
+     if prefix == y.module.subArg("prefix") {
+         return y.moduleName
+     }
+     if b := y.module.sub("belongs-to"); b != nil && prefix == b.subArg("prefix") {
+         return y.moduleName
+     }
+     return y.prefixes[prefix]
+}
+
+// data nodes under path, choices and cases are not in paths
+func (y *yangBuilder) data(stmts []*yangStmt, path string, depth int) {
+     if depth > 64 {
+         return
+     }
+     for _, s := range stmts {
+         switch s.keyword {
+         case "container":
+             y.data(s.subs, path + s.arg + "/", depth + 1)
+         case "list":
+             y.models.keys[path + s.arg] = strings.Fields(s.subArg("key"))
+             y.data(s.subs, path + s.arg + "/", depth + 1)
+         case "choice", "case":
+             y.data(s.subs, path, depth + 1)
+         case "uses":
+             if g, ok := y.groupings[y.qualify(s.arg)]; ok {
+                 leave := y.enter(g)
+                 y.data(g.stmt.subs, path, depth + 1)
+                 leave()
+             }
+         case "leaf", "leaf-list":
+             leaf := &yangLeaf{units: s.subArg("units")}
+             if t := s.sub("type"); t != nil {
+                 y.leafType(leaf, t, 0)
+             }
+             y.models.leafs[path + s.arg] = leaf
+         }
+     }
+}
+
+// built-in type of leaf, through typedefs, with enum names
+func (y *yangBuilder) leafType(leaf *yangLeaf, t *yangStmt, depth int) {
+     name := yangName(t.arg)
+     if td, ok := y.typedefs[y.qualify(t.arg)]; ok && !yangBuiltin[t.arg] && depth < 16 {
+         if leaf.units == "" {
+             leaf.units = td.stmt.subArg("units")
+         }
+         if sub := td.stmt.sub("type"); sub != nil {
+             leave := y.enter(td)
+             y.leafType(leaf, sub, depth + 1)
+             leave()
+             return
+         }
+     }
+     leaf.typ = name
+     if name != "enumeration" {
+         return
+     }
+     leaf.enums = map[int64]string{}
+     next := int64(0)
+     for _, e := range t.subs {
+         if e.keyword != "enum" {
+             continue
+         }
+         if v, err := strconv.ParseInt(e.subArg("value"), 10, 64); err == nil {
+             next = v
+         }
+         leaf.enums[next] = e.arg
+         next++
+     }
+}
+
+var yangBuiltin = map[string]bool{
+    "int8": true, "int16": true, "int32": true, "int64": true,
+    "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+    "decimal64": true, "string": true, "boolean": true, "enumeration": true,
+    "bits": true, "binary": true, "leafref": true, "identityref": true,
+    "empty": true, "union": true, "instance-identifier": true,
+}
+
+///////////////////////////////////////////////////////////////////////
+// Statements of yang text, RFC 7950 section 6, strings quoted with " or
+// ' and joined with +, comments // and /* */.
+
+func yangParse(text string) ([]*yangStmt, error) {
+     tokens, err := yangTokens(text)
+     if err != nil {
+         return nil, err
+     }
+     stmts, rest, err := yangStmts(tokens)
+     if err != nil {
+         return nil, err
+     }
+     if len(rest) != 0 {
+         return nil, fmt.Errorf("unexpected %s", rest[0])
+     }
+     return stmts, nil
+}
+
+func yangStmts(tokens []string) ([]*yangStmt, []string, error) {
+     var stmts []*yangStmt
+     for len(tokens) > 0 && tokens[0] != "}" {
+         s := &yangStmt{keyword: tokens[0]}
+         tokens = tokens[1:]
+         if len(tokens) > 0 && tokens[0] != ";" && tokens[0] != "{" {
+             s.arg = strings.TrimPrefix(tokens[0], "\x00")
+             tokens = tokens[1:]
+         }
+         if len(tokens) == 0 {
+             return nil, nil, fmt.Errorf("statement %s not terminated", s.keyword)
+         }
+         switch tokens[0] {
+         case ";":
+             tokens = tokens[1:]
+         case "{":
+             subs, rest, err := yangStmts(tokens[1:])
+             if err != nil {
+                 return nil, nil, err
+             }
+             if len(rest) == 0 {
+                 return nil, nil, fmt.Errorf("statement %s %s not closed", s.keyword, s.arg)
+             }
+             s.subs, tokens = subs, rest[1:]
+         default:
+             return nil, nil, fmt.Errorf("statement %s %s: unexpected %s", s.keyword, s.arg, tokens[0])
+         }
+         stmts = append(stmts, s)
+     }
+     return stmts, tokens, nil
+}
+
+// quoted strings are marked with a leading \x00, so they are not taken
+// for ; { or }
+func yangTokens(text string) ([]string, error) {
+     var tokens []string
+     joining := false
+     for i := 0; i < len(text); {
+         c := text[i]
+         switch {
+         case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+             i++
+         case strings.HasPrefix(text[i:], "//"):
+             for i < len(text) && text[i] != '\n' {
+                 i++
+             }
+         case strings.HasPrefix(text[i:], "/*"):
+             end := strings.Index(text[i+2:], "*/")
+             if end < 0 {
+                 return nil, fmt.Errorf("comment not closed")
+             }
+             i += end + 4
+         case c == ';' || c == '{' || c == '}':
+             tokens = append(tokens, string(c))
+             i++
+         case c == '"' || c == '\'':
+             var b strings.Builder
+             j := i + 1
+             for ; j < len(text) && text[j] != c; j++ {
+                 if c == '"' && text[j] == '\\' && j + 1 < len(text) {
+                     j++
+                     switch text[j] {
+                     case 'n':
+                         b.WriteByte('\n')
+                     case 't':
+                         b.WriteByte('\t')
+                     default:
+                         b.WriteByte(text[j])
+                     }
+                     continue
+                 }
+                 b.WriteByte(text[j])
+             }
+             if j == len(text) {
+                 return nil, fmt.Errorf("string not closed")
+             }
+             i = j + 1
+             if joining && len(tokens) > 0 {
+                 tokens[len(tokens)-1] += b.String()
+                 joining = false
+             } else {
+                 tokens = append(tokens, "\x00" + b.String())
+             }
+         case c == '+' && len(tokens) > 0 && strings.HasPrefix(tokens[len(tokens)-1], "\x00"):
+             joining = true
+             i++
+         default:
+             j := i
+             for j < len(text) && !strings.ContainsRune(" \t\r\n;{}", rune(text[j])) {
+                 j++
+             }
+             tokens = append(tokens, text[i:j])
+             i = j
+         }
+     }
+     return tokens, nil
+}
+
+///////////////////////////////////////////////////////////////////////
+// rows typed with the models
+
+var yangKeyWarned sync.Map
+
+func mdtYangRows(rows []*MdtRow) {
+     for _, row := range rows {
+         path := row.EncodingPath
+         list, keys := yangList(path)
+         if list != "" {
+             for k := range row.Keys {
+                 if !yangIsKey(keys, k) {
+                     if _, warned := yangKeyWarned.LoadOrStore(list + "/" + k, true); !warned {
+                         telemetry_log.Errorf("Key %s of rows at %s is not a key of list %s in yang models\n", k, path, list)
+                     }
+                 }
+             }
+             mdtYangValues(row, row.Keys, list + "/", "")
+         }
+         mdtYangValues(row, row.Content, path + "/", "")
+     }
+}
+
+// keys of rows are keys of the list at path or the nearest one above it
+func yangList(path string) (string, []string) {
+     for {
+         if keys, ok := mdtYang.keys[path]; ok {
+             return path, keys
+         }
+         i := strings.LastIndex(path, "/")
+         if i < 0 {
+             return "", nil
+         }
+         path = path[:i]
+     }
+}
+
+func yangIsKey(keys []string, k string) bool {
+     for _, key := range keys {
+         if key == k {
+             return true
+         }
+     }
+     return false
+}
+
+// leafs of m, at schema path, are typed, units of leafs go to the row,
+// named as path map names nested leafs
+func mdtYangValues(row *MdtRow, m map[string]interface{}, path, name string) {
+     for k, v := range m {
+         switch sub := v.(type) {
+         case map[string]interface{}:
+             mdtYangValues(row, sub, path + k + "/", name + k + ".")
+             continue
+         case []interface{}:
+             leaf := mdtYang.leafs[path + k]
+             for i, e := range sub {
+                 if em, ok := e.(map[string]interface{}); ok {
+                     mdtYangValues(row, em, path + k + "/", name + k + ".")
+                 } else if leaf != nil {
+                     sub[i] = leaf.value(e)
+                 }
+             }
+             if leaf != nil {
+                 row.unit(name + k, leaf.units)
+             }
+             continue
+         }
+         if leaf, ok := mdtYang.leafs[path + k]; ok {
+             m[k] = leaf.value(v)
+             row.unit(name + k, leaf.units)
+         }
+     }
+}
+
+func (row *MdtRow) unit(name, units string) {
+     if units == "" {
+         return
+     }
+     if row.Units == nil {
+         row.Units = map[string]string{}
+     }
+     row.Units[name] = units
+}
+
+// value of leaf type, values that do not parse are left as they are
+func (leaf *yangLeaf) value(v interface{}) interface{} {
+     switch leaf.typ {
+     case "enumeration":
+         var n int64
+         switch x := v.(type) {
+         case int64:
+             n = x
+         case uint64:
+             n = int64(x)
+         case float64:
+             n = int64(x)
+         case string:
+             var err error
+             if n, err = strconv.ParseInt(x, 10, 64); err != nil {
+                 return v
+             }
+         default:
+             return v
+         }
+         if e, ok := leaf.enums[n]; ok {
+             return e
+         }
+     case "int8", "int16", "int32", "int64":
+         switch x := v.(type) {
+         case string:
+             if n, err := strconv.ParseInt(x, 10, 64); err == nil {
+                 return n
+             }
+         case float64:
+             return int64(x)
+         case uint64:
+             return int64(x)
+         }
+     case "uint8", "uint16", "uint32", "uint64":
+         switch x := v.(type) {
+         case string:
+             if n, err := strconv.ParseUint(x, 10, 64); err == nil {
+                 return n
+             }
+         case float64:
+             return uint64(x)
+         case int64:
+             if x >= 0 {
+                 return uint64(x)
+             }
+         }
+     case "decimal64":
+         switch x := v.(type) {
+         case string:
+             if f, err := strconv.ParseFloat(x, 64); err == nil {
+                 return f
+             }
+         case int64:
+             return float64(x)
+         case uint64:
+             return float64(x)
+         }
+     case "boolean":
+         if x, ok := v.(string); ok {
+             if b, err := strconv.ParseBool(x); err == nil {
+                 return b
+             }
+         }
+     case "string":
+         switch x := v.(type) {
+         case int64:
+             return strconv.FormatInt(x, 10)
+         case uint64:
+             return strconv.FormatUint(x, 10)
+         }
+     }
+     return v
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+        "fmt"
+        "net"
+        "os"
+        "strings"
+        "time"
+
+        "golang.org/x/net/context"
+
+        "github.com/ios-xr/telemetry-go-collector/telemetry_admin"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+)
+
+// With -check_config options of subscribe are checked and the collector
+// exits without subscribing. Files given in options are loaded, outputs
+// are checked without being opened, with -check_reachability the server,
+// through -proxy if set, and output hosts are connected to.
+
+func mdtCheckConfig() int {
+     checks := []telemetry_admin.Check{
+         {Name: "options", Run: mdtCheckFlags},
+         {Name: "server", Run: func() error {
+             if len(*discover) > 0 {
+                 return nil
+             }
+             if *serverAddr == "" {
+                 return fmt.Errorf("no -server or -discover")
+             }
+             _, _, err := mdtServerTarget(*serverAddr)
+             return err
+         }},
+         {Name: "subscription", Run: func() error {
+             if *subIds == "" && *adminListen == "" && *configFile == "" {
+                 return fmt.Errorf("no -subscription")
+             }
+             return nil
+         }},
+         {Name: "credentials", Run: func() error {
+             if *credentialsFile != "" {
+                 if _, _, err := mdtReadCredentialsFile(*credentialsFile); err != nil {
+                     return err
+                 }
+             }
+             if *tokenFile != "" {
+                 if _, err := mdtNewTokenCredential("", *tokenFile, 0); err != nil {
+                     return err
+                 }
+             }
+             return nil
+         }},
+         {Name: "output", Run: func() error {
+             o := &telemetry_decode.MdtOut{
+                                OutFile:     mdtOutFile(*subIds),
+                                OutCompress: *outCompress,
+                                OutFormat:   *outFormat,
+                                Encoding:    *encoding,
+                                Decode_raw:  *decode_raw,
+                                ProtoFile:   *protoFile,
+             }
+             return o.MdtOutCheck()
+         }},
+     }
+     if strings.HasPrefix(*discover, "file:") {
+         checks = append(checks, telemetry_admin.Check{Name: "inventory", Run: func() error {
+             targets, err := mdtReadInventory(strings.TrimPrefix(*discover, "file:"))
+             for i := 0; err == nil && i < len(targets); i++ {
+                 if t := &targets[i]; t.own() {
+                     _, err = mdtTargetDialOptions(t)
+                 }
+             }
+             return err
+         }})
+     }
+     if *leaderLock != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "leader_lock", Run: func() error {
+             l, err := mdtNewLeaderLock(*leaderLock)
+             if err == nil && *checkReachability {
+                 err = l.call("GET", "/v1/status/leader", nil, nil)
+             }
+             return err
+         }})
+     }
+     if *certFile != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "tls", Run: func() error {
+             _, err := telemetry_tls.NewClientConfig(*certFile, *serverHostOverride, 0)
+             return err
+         }})
+     }
+     if *proxyUrl != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "proxy", Run: func() error {
+             _, err := mdtProxyDialer(*proxyUrl)
+             return err
+         }})
+     }
+     if *yangModels != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "yang_models", Run: func() error {
+             return telemetry_decode.MdtYangLoad(*yangModels)
+         }})
+     }
+     if *scriptFile != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "script", Run: func() error {
+             return telemetry_decode.MdtScriptLoad(*scriptFile)
+         }})
+     }
+     if *wasmTransform != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "wasm_transform", Run: func() error {
+             return telemetry_decode.MdtWasmCheck(*wasmTransform)
+         }})
+     }
+     if *wasmDecoder != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "wasm_decoder", Run: func() error {
+             return telemetry_decode.MdtWasmCheck(*wasmDecoder)
+         }})
+     }
+     if *pathMap != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "path_map", Run: func() error {
+             return telemetry_decode.MdtPathMapLoad(*pathMap)
+         }})
+     }
+     if *dedup != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "dedup", Run: func() error {
+             return telemetry_decode.MdtDedupSetup(*dedup, *dedupWindow)
+         }})
+     }
+     if *redactFile != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "redact", Run: func() error {
+             return telemetry_decode.MdtRedactLoad(*redactFile)
+         }})
+     }
+     if *encryptKey != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "encrypt key", Run: func() error {
+             return telemetry_decode.MdtEncryptSetup(*encryptKey)
+         }})
+     }
+     if *rateLimit != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "rate limit", Run: func() error {
+             _, err := telemetry_decode.MdtRateLimitParse(*rateLimit)
+             return err
+         }})
+     }
+     if *chaos != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "chaos", Run: func() error {
+             return telemetry_decode.MdtChaosSetup(*chaos)
+         }})
+     }
+     if *quarantineDir != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "quarantine_dir", Run: func() error {
+             return telemetry_decode.MdtQuarantineSetup(*quarantineDir)
+         }})
+     }
+     if *controlAllow != "" || *controlTokenFile != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "control access", Run: func() error {
+             return telemetry_admin.ControlAccessSetup(*controlAllow, *controlTokenFile)
+         }})
+     }
+     if *adminListen != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "admin", Run: func() error {
+             if _, err := telemetry_admin.NewAdminServer(*adminTokenFile); err != nil {
+                 return err
+             }
+             return telemetry_admin.CheckCertKey(*adminCert, *adminKey)
+         }})
+     }
+     if *restreamListen != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "restream", Run: func() error {
+             return telemetry_admin.CheckCertKey(*restreamCert, *restreamKey)
+         }})
+     }
+     if *gnmiListen != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "gnmi", Run: func() error {
+             return telemetry_admin.CheckCertKey(*gnmiCert, *gnmiKey)
+         }})
+     }
+     if *checkReachability {
+         // grpc targets with a scheme are resolved by grpc, not checked
+         if len(*discover) == 0 && *serverAddr != "" && !strings.Contains(*serverAddr, "://") {
+             checks = append(checks, telemetry_admin.Check{Name: "server reachable", Run: mdtCheckServer})
+         }
+         checks = append(checks, telemetry_admin.Check{Name: "output reachable", Run: func() error {
+             return telemetry_decode.MdtOutReachable(*outFile, 5 * time.Second)
+         }})
+     }
+     return telemetry_admin.RunChecks(os.Stdout, checks)
+}
+
+// tcp connection to the server, through the proxy if set
+func mdtCheckServer() error {
+     timeout := *dialTimeout
+     if timeout == 0 {
+         timeout = 5 * time.Second
+     }
+     ctx, cancel := context.WithTimeout(context.Background(), timeout)
+     defer cancel()
+
+     var d net.Dialer
+     dial := func(ctx context.Context, addr string) (net.Conn, error) {
+         return d.DialContext(ctx, "tcp", addr)
+     }
+     if *proxyUrl != "" {
+         var err error
+         if dial, err = mdtProxyDialer(*proxyUrl); err != nil {
+             return err
+         }
+     }
+     conn, err := dial(ctx, *serverAddr)
+     if err != nil {
+         return err
+     }
+     return conn.Close()
+}
@@ -1,21 +1,35 @@
 package main
 
 import (
+       "errors"
        "flag"
        "fmt"
        "io"
+       "io/ioutil"
        "log"
+       "net"
        "os"
        "os/signal"
+       "syscall"
+       "sync/atomic"
        "strings"
+       "time"
        "path/filepath"
 
        "golang.org/x/net/context"
        "google.golang.org/grpc"
        "google.golang.org/grpc/credentials"
+       "google.golang.org/grpc/encoding/gzip"
+       "google.golang.org/grpc/status"
+       "google.golang.org/grpc/codes"
+       "google.golang.org/grpc/keepalive"
 
        MdtDialin "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialin"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_admin"
        "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_restream"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_gnmi"
 )
 
 const tmpFileName   = "telemetry-msg-*.dat"
@@ -27,140 +41,624 @@ var telemetryEncoding = map[string]int64{
     "json":                4,
 }
 
-var usage = func() {
-    fmt.Fprintf(os.Stderr, "Usage: %s [options]\n", os.Args[0])
+var reqId = int64(os.Getpid())
 
+var usage = func() {
+    fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Commands:\n")
+    for _, c := range mdtCommands {
+        fmt.Fprintf(os.Stderr, "  %-10s %s\n", c.name, c.summary)
+    }
+    fmt.Fprintf(os.Stderr, "Options of a command: %s <command> -h\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Without a command, all options are accepted and -oper selects subscribe or get-proto:\n")
     flag.PrintDefaults()
     fmt.Fprintf(os.Stderr, "Examples:\n")
-    fmt.Fprintf(os.Stderr, "Subscribe                       : %s -server <ip:port> -subscription <> -encoding self-describing-gpb -username <> -password <>\n", os.Args[0])
-    fmt.Fprintf(os.Stderr, "Get proto for yang path         : %s -server <ip:port> -oper get-proto -yang <yang model or xpath> -out <filename> -username <> -password <>\n", os.Args[0])
-    fmt.Fprintf(os.Stderr, "Subscribe, using TLS            : %s -server <ip:port> -subscription <> -encoding self-describing-gpb -username <> -password <> -cert <>\n", os.Args[0])
-    fmt.Fprintf(os.Stderr, "Subscribe, use protoc to decode : %s -server <ip:port> -subscription <> -encoding gpb -username <> -password <> -proto cdp_neighbor.proto\n", os.Args[0])
-    fmt.Fprintf(os.Stderr, "Subscribe, use protoc to decode without proto: %s %s -server <ip:port> -subscription <> -encoding gpb -decode_raw\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe                       : %s subscribe -server <ip:port> -subscription <> -encoding self-describing-gpb -username <> -password <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe, IPv6 link-local      : %s subscribe -server [fe80::1%%eth0]:<port> -subscription <> -username <> -password <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe, servers from dns srv : %s subscribe -discover srv:_mdt._tcp.<domain> -subscription <> -username <> -password <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe, servers from a file  : %s subscribe -discover file:<inventory> -subscription <> -username <> -password <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe, options from config  : %s subscribe -config <file>, kill -HUP <pid> to reload\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Config file of all the options  : %s config init -server <ip:port> -subscription <> > collector.conf\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Get proto for yang path         : %s get-proto -server <ip:port> -yang_path <yang model or xpath> -out <filename> -username <> -password <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Get protos for many yang paths  : %s get-proto -server <ip:port> -yang_path_file <file of paths> -out <filename> -username <> -password <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Get protos, a file per message  : %s get-proto -server <ip:port> -yang_path <yang model or xpath> -out_dir <dir> -username <> -password <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "List subscriptions on router    : %s list -server <ip:port> -username <> -password <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe, credentials from env : MDT_USERNAME=<> MDT_PASSWORD=<> %s subscribe -server <ip:port> -subscription <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe, token authentication : %s subscribe -server <ip:port> -subscription <> -token_file <> -token_refresh 5m -cert <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe, using TLS            : %s subscribe -server <ip:port> -subscription <> -encoding self-describing-gpb -username <> -password <> -cert <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe, use protoc to decode : %s subscribe -server <ip:port> -subscription <> -encoding gpb -username <> -password <> -proto cdp_neighbor.proto\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe, through socks5 proxy    : %s subscribe -server <ip:port> -subscription <> -username <> -password <> -proxy socks5://<ip:port>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Subscribe, use protoc to decode without proto: %s subscribe -server <ip:port> -subscription <> -encoding gpb -decode_raw\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Replay a captured tcp dialout session   : %s replay -out csv:<file> <capture>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Search captures, indexed first          : %s index -index <file> <capture>..., %s search -index <file> -path <regexp> -from 10:00 -to 10:15\n", os.Args[0], os.Args[0])
+    fmt.Fprintf(os.Stderr, "Try an output with generated messages   : %s generate -routers 10 -keys 100 -rate 5 -out <out>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "Load test a dialout collector           : %s loadgen -dest <ip:port> -sessions 10 -rate 100\n", os.Args[0])
 }
 
 var (
-        serverAddr   = flag.String("server", "", "The server address, host:port")
-        operation    = flag.String("oper", "subscribe", "Operation: subscribe, get-proto")
+        configFile   = flag.String("config", "", "Config file with an option per line, option = value, reloaded on SIGHUP")
+        serverAddr   = flag.String("server", "", "The server address, host:port, IPv6 address in brackets [addr%zone]:port, or a grpc target, dns:///host:port")
+        operation    = flag.String("oper", "subscribe", "Operation: subscribe, get-proto, used when run without a command")
         subIds       = flag.String("subscription", "", "Subscription name to subscribe to")
         encoding     = flag.String("encoding", "json",
                                    "encoding to use, Options: json,self-describing-gpb,gpb")
         qos          = flag.Uint("qos", NotConfigured, "Qos to use for the session")
-        yangPath     = flag.String("yang_path", "", "Yang path for get-proto")
-        outFile      = flag.String("out", "", "output file to write to")
+        yangPath     = flag.String("yang_path", "", "Yang path for get-proto, comma separated for more than one")
+        yangPathFile = flag.String("yang_path_file", "", "File of yang paths for get-proto, one per line")
+        outDir       = flag.String("out_dir", "", "Directory to write protos of get-proto to, a .proto file per message, at the path of its package, instead of -out")
+        outFile      = flag.String("out", "", "output file to write to, can be a template, /data/{{.Router}}/{{.Subscription}}-{{.Date}}.json, or a sink, elasticsearch:<host:port>, opensearch:<host:port>, parquet:<dir>, csv:<file>, sqlite:<file>, clickhouse:<host:port>, postgres:<user:password@host:port/db>, graphite:<host:port>, opentsdb:<host:port>, statsd:<host:port>, nats:<host:port>, mqtt:<host:port>, redis:<host:port>, pubsub:<project>, kinesis:<stream>, s3:<bucket>/<prefix>, fluentd:<host:port>, gelf:<host:port>, loki:<host:port>, avro:<dir>, msgpack:<file>, cbor:<file>, relay:<host:port>, capture:<dir>")
+        outCompress  = flag.String("out_compress", "", "compress output file, Options: gzip,zstd")
+        outFormat    = flag.String("format", "json", "format of decoded messages in output file, Options: json,text,table, text is protobuf text format, gpb encodings only, table shows rows as aligned columns")
+        tableFields  = flag.String("fields", "", "Leafs to show with -format table or to pin with -tui, comma separated, nested leafs joined with \".\", rates.input-rate, all leafs if not set")
+        outPerSub    = flag.Bool("out_per_subscription", false, "Write each subscription to its own file, subscription name is added to -out, dump_*.txt becomes dump_<subscription>-*.txt")
         username     = flag.String("username", "",
                                    "Username for the client connection")
         password     = flag.String("password", "",
                                    "Password for the client connection")
+        credentialsFile = flag.String("credentials_file", "",
+                                   "File with username=<> and password=<> lines for the client connection, must be chmod 600")
+        token        = flag.String("token", "", "Bearer token to send in authorization header, instead of username and password, needs -cert")
+        tokenFile    = flag.String("token_file", "", "File to read bearer token from")
+        tokenRefresh = flag.Duration("token_refresh", 0, "Interval for re-reading token from token_file, e.g. 5m")
         decode_raw   = flag.Bool("decode_raw", false, "Use protoc --decode_raw")
         protoFile    = flag.String("proto", "", "proto file to use for decode")
+        yangModels   = flag.String("yang_models", "", "Directory of .yang files of streamed models, rows get leaf values of their yang type, enum names and units")
+        pathMap      = flag.String("path_map", "", "File mapping sensor paths and leaf names to new ones, e.g. OpenConfig paths, for rows written to sinks")
+        descriptorCache = flag.String("descriptor_cache", "", "Directory to cache descriptors of protos fetched from the router in, gpb rows without plugin are decoded with them, needs protoc")
+        wasmTransform = flag.String("wasm_transform", "", "WebAssembly module, WASI, transforming rows of every message, json array of rows on stdin, rows to keep on stdout")
+        wasmDecoder  = flag.String("wasm_decoder", "", "WebAssembly module, WASI, decoding keys and content of gpb rows without plugin, a row part on stdin, its json on stdout")
+        scriptFile   = flag.String("script", "", "Starlark file with a transform(row) function called for every row, returns the row, changed or not, None to drop it, or a list of rows")
+        dedup        = flag.String("dedup", "", "Drop rows written to sinks that were already written, same node, sensor path, keys and timestamp, seen rows kept in memory or redis:<host:port> shared by collectors")
+        dedupWindow  = flag.Duration("dedup_window", 10 * time.Minute, "How long rows are remembered for -dedup")
+        redactFile   = flag.String("redact", "", "File of rules dropping, hashing or masking leafs of rows before any output, usernames, prefixes, community strings")
+        encryptKey   = flag.String("encrypt_key", "", "File with a 32 byte key, raw or hex, output files and capture segments are encrypted with, AES-GCM, replay and decode read files encrypted with it")
         pluginDir    = flag.String("plugin_dir", "", "absolute path to directory for proto plugins")
         pluginFile    = flag.String("plugin", "", "plugin file, used to lookup gpb symbol for decode")
         dontClean    = flag.Bool("dont_clean", false, "Don't remove tmp files on exit")
         certFile     = flag.String("cert","","TLS cert file")
+        tlsReload    = flag.Duration("tls_reload", time.Minute, "Interval for checking TLS cert file for changes, changed cert is used for new sessions, 0 to disable")
+        grpcCompress = flag.Bool("grpc_compress", false, "Use gzip compression on the grpc session, router must support it")
+        maxRecvMsgSize = flag.Int("max_recv_msg_size", 0, "Max size in bytes of a message that can be received, default is grpc default of 4MB")
+        dialTimeout  = flag.Duration("dial_timeout", 0, "Timeout for connecting to the server, e.g. 10s, waits forever if not set")
+        rpcDeadline  = flag.Duration("rpc_deadline", 0, "Deadline for the subscribe or get-proto rpc, e.g. 1h, session is closed when deadline is reached")
+        keepaliveTime = flag.Duration("keepalive_time", 0, "Send keepalive ping after this much idle time on the session, e.g. 30s, disabled if not set")
+        keepaliveTimeout = flag.Duration("keepalive_timeout", 20 * time.Second, "Close the session if keepalive ping is not acked within this time")
+        keepalivePermitWithoutStream = flag.Bool("keepalive_permit_without_stream", false, "Send keepalive pings even when there is no active rpc")
+        discover     = flag.String("discover", "", "Discover servers to subscribe to, srv:<dns name>, consul:<consul agent ip:port>/<service> or file:<inventory file>")
+        leaderLock   = flag.String("leader_lock", "", "Run as leader or standby, only the collector holding the lock keeps sessions, consul:<consul agent ip:port>/<key>")
+        shardIndex   = flag.Int("shard_index", 0, "Shard of this collector, 0 to shard_count - 1, with -shard_count")
+        shardCount   = flag.Int("shard_count", 0, "Number of collectors sharing the discovered servers, each subscribes only to the servers of its -shard_index")
+        discoverInterval = flag.Duration("discover_interval", time.Minute, "Interval for refreshing the discovered servers")
+        proxyUrl     = flag.String("proxy", "", "Proxy to use for connecting to the server, socks5://[user:pass@]host:port or http://[user:pass@]host:port")
+        adminListen  = flag.String("admin_listen", "", "Address to serve admin api on, ip:port, disabled if not set")
+        adminTokenFile = flag.String("admin_token_file", "", "File with token for admin api, required for admin api")
+        adminCert    = flag.String("admin_cert", "", "TLS cert file for admin api")
+        adminKey     = flag.String("admin_key", "", "TLS key file for admin api")
+        healthListen = flag.String("health_listen", "", "Address to serve /healthz and /readyz probes on, ip:port, disabled if not set")
+        readyWindow  = flag.Duration("ready_window", time.Minute, "/readyz fails if no message was received within this duration")
+        restreamListen = flag.String("restream_listen", "", "Address to serve received messages again to downstream consumers on, ip:port, over the dialin CreateSubs rpc, disabled if not set")
+        restreamCert = flag.String("restream_cert", "", "TLS cert file for restream")
+        restreamKey  = flag.String("restream_key", "", "TLS key file for restream")
+        gnmiListen   = flag.String("gnmi_listen", "", "Address to serve received rows on to gNMI clients, ip:port, Subscribe and Get, disabled if not set")
+        gnmiCert     = flag.String("gnmi_cert", "", "TLS cert file for gNMI server")
+        gnmiKey      = flag.String("gnmi_key", "", "TLS key file for gNMI server")
+        dashboardListen = flag.String("dashboard_listen", "", "Address to serve web dashboard on, e.g. 127.0.0.1:8080, disabled if not set")
+        debugListen  = flag.String("debug_listen", "", "Address to serve pprof and expvar on, e.g. 127.0.0.1:6060, disabled if not set")
+        controlAllow = flag.String("control_allow", "", "Addresses or prefixes, comma separated, that may connect to the admin api, debug endpoint and dashboard, any if not set")
+        controlTokenFile = flag.String("control_token_file", "", "File with token required by the debug endpoint and dashboard, as for the admin api")
+        daemon       = flag.Bool("daemon", false, "Run as systemd service, write pidfile, notify systemd when first subscription is up and send watchdog heartbeats while subscriptions are up")
+        pidFile      = flag.String("pidfile", "/run/telemetry_dialin_collector.pid", "Pidfile to write with -daemon")
+        quiet        = flag.Bool("quiet", false, "Print errors only")
+        verbose      = flag.Bool("v", false, "Print a line for every received message")
+        debug        = flag.Bool("vv", false, "Print transport details of every message, implies -v")
+        colorMode    = flag.String("color", "auto", "Highlight sensor paths, errors and timestamps, Options: auto,always,never, auto colors if stdout is a terminal")
+        tui          = flag.Bool("tui", false, "Live view of sessions, message rates, leafs pinned with -fields and incoming rows, q to quit")
+        mode         = flag.String("mode", "stream", "Collection mode, Options: stream,once,poll, once ends after a collection of every sensor path, poll does once every -poll_interval")
+        pollInterval = flag.Duration("poll_interval", time.Minute, "Interval of collections with -mode poll")
+        silenceTimeout = flag.Duration("silence_timeout", 0, "Subscribe again if a subscription gets no data for this long, e.g. 5m, longer than its sample interval, not watched if not set")
+        connectLimit = flag.Int("connect_limit", 0, "Subscriptions being set up at a time across all the servers, rest wait, no limit if not set")
+        connectJitter = flag.Duration("connect_jitter", 0, "Wait a random time up to this before setting up every subscription, e.g. 5s")
+        retryInterval = flag.Duration("retry_interval", 0, "Subscribe again this long after a subscription failed, e.g. 30s, a failed subscription is not retried if not set")
+        checkConfig  = flag.Bool("check_config", false, "Check options, credentials, TLS files, outputs and loaded files, print a report and exit without subscribing, non-zero if a check failed")
+        checkReachability = flag.Bool("check_reachability", false, "With -check_config, also connect to the server and to output hosts")
+        maxMessages  = flag.Uint64("max_messages", 0, "Stop after this many messages across all sessions, writing out outputs and printing a summary, no limit if not set")
+        maxDuration  = flag.Duration("max_duration", 0, "Stop after running this long, e.g. 10m, writing out outputs and printing a summary, no limit if not set")
+        rateLimit    = flag.String("rate_limit", "", "Rate limits of processing messages, [subscription:]msgs=<n>,bytes=<n>,burst=<duration>, ; separated, all the messages if no subscription, changed from admin api")
+        chaos        = flag.String("chaos", "", "Inject faults for testing, chance of a message being delayed, dropped, failing to decode or closing its stream, delay=0.1:500ms,drop=0.01,fail=0.01,disconnect=0.001,seed=1, never for production")
+        quarantineDir = flag.String("quarantine_dir", "", "Directory messages that fail to decode are written to, as received, with session, router and error next to them, not kept if not set")
         serverHostOverride = flag.String("server_host_override", "ems.cisco.com",
                            "The server name to verify the hostname returned during TLS handshake")
 )
 
 func main() {
-     flag.Usage = usage
-     flag.Parse()
+     cmd := mdtParseCommand()
+     if *configFile != "" {
+         if err := mdtLoadConfig(*configFile); err != nil {
+             log.Fatalf("Failed to load config: %v", err)
+         }
+         go mdtConfigReloader(*configFile)
+     }
+     telemetry_log.Setup(telemetry_log.FlagLevel(*quiet, *verbose, *debug), *colorMode)
+     if *checkConfig {
+         os.Exit(mdtCheckConfig())
+     }
+
+     // install signal handler for cleaning up tmp files and pidfile and
+     // for writing out buffered rows, systemd stops the collector with SIGTERM
+     sigs := make(chan os.Signal, 1)
+     signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+     go func() {
+         <- sigs
+         mdtExit()
+     }()
+
+     if *yangModels != "" {
+         if err := telemetry_decode.MdtYangLoad(*yangModels); err != nil {
+             log.Fatalf("Failed to load yang models: %v", err)
+         }
+     }
+     if *scriptFile != "" {
+         if err := telemetry_decode.MdtScriptLoad(*scriptFile); err != nil {
+             log.Fatalf("Failed to load script: %v", err)
+         }
+     }
+     if *wasmTransform != "" {
+         if err := telemetry_decode.MdtWasmStart(*wasmTransform); err != nil {
+             log.Fatalf("Failed to start WebAssembly transform: %v", err)
+         }
+     }
+     if *wasmDecoder != "" {
+         if err := telemetry_decode.MdtWasmDecoderStart(*wasmDecoder); err != nil {
+             log.Fatalf("Failed to start WebAssembly decoder: %v", err)
+         }
+     }
+     if *pathMap != "" {
+         if err := telemetry_decode.MdtPathMapLoad(*pathMap); err != nil {
+             log.Fatalf("Failed to load path map: %v", err)
+         }
+     }
+     if *dedup != "" {
+         if err := telemetry_decode.MdtDedupSetup(*dedup, *dedupWindow); err != nil {
+             log.Fatalf("Failed to set up dedup: %v", err)
+         }
+     }
+     if *redactFile != "" {
+         if err := telemetry_decode.MdtRedactLoad(*redactFile); err != nil {
+             log.Fatalf("Failed to load redact rules: %v", err)
+         }
+     }
+     if *encryptKey != "" {
+         if err := telemetry_decode.MdtEncryptSetup(*encryptKey); err != nil {
+             log.Fatalf("Failed to load -encrypt_key: %v", err)
+         }
+     }
+
+     if *tui {
+         if err := telemetry_decode.MdtTuiStart(*tableFields, mdtExit); err != nil {
+             log.Fatalf("Failed to start live view: %v", err)
+         }
+         defer telemetry_decode.MdtTuiStop()
+     }
+
+     cmd.run()
+}
+
+// grpc dial options from the connection flags, credentials, TLS, keepalive
+// and proxy
+func mdtDialOptions() []grpc.DialOption {
+     if err := mdtResolveCredentials(); err != nil {
+         log.Fatalf("Failed to get credentials: %v", err)
+     }
+     opts, err := mdtTargetDialOptions(&mdtTarget{})
+     if err != nil {
+         log.Fatal(err)
+     }
+     return opts
+}
+
+// dial options of a server, settings of the target in place of the options
+func mdtTargetDialOptions(t *mdtTarget) ([]grpc.DialOption, error) {
      var opts []grpc.DialOption
-     var cred passCredential
+     cred := passCredential{username: *username, password: *password}
+     if t.username != "" {
+         cred.username = t.username
+     }
+     if t.password != "" {
+         cred.password = t.password
+     }
+     cert, serverName := *certFile, *serverHostOverride
+     if t.cert != "" {
+         cert = t.cert
+     }
+     if t.serverHostOverride != "" {
+         serverName = t.serverHostOverride
+     }
+     tok, tokFile := *token, *tokenFile
+     if t.tokenFile != "" {
+         tok, tokFile = "", t.tokenFile
+     }
 
-     if !*dontClean {
-         // install signal handler for cleaning up tmp files
-         sigs := make(chan os.Signal, 1)
-         signal.Notify(sigs, os.Interrupt)
+     if (cert != "") {
+         tlsConfig, err := mdtTargetTLS(cert, serverName)
+         if err != nil {
+             return nil, fmt.Errorf("Failed to load TLS cert: %v", err)
+         }
+         opts = append(opts, grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig)))
+     } else {
+         opts = append(opts, grpc.WithInsecure())
+     }
+     if tok == "" && tokFile == "" {
+         opts = append(opts, grpc.WithPerRPCCredentials(cred))
+     } else {
+         // token is sent instead of username and password, only over TLS
+         if cert == "" {
+             return nil, fmt.Errorf("Token needs TLS, -cert is not set")
+         }
+         tc, err := mdtTargetToken(tok, tokFile)
+         if err != nil {
+             return nil, fmt.Errorf("Failed to get token: %v", err)
+         }
+         opts = append(opts, grpc.WithPerRPCCredentials(tc))
+     }
+     if *grpcCompress {
+         // requests are sent compressed, router replies using the same
+         // compressor if it supports it
+         opts = append(opts, grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)))
+     }
+     if *keepaliveTime > 0 {
+         // dead session is detected and stream Recv returns error instead
+         // of waiting forever, router should permit pings at this rate
+         opts = append(opts, grpc.WithKeepaliveParams(keepalive.ClientParameters{
+                                Time:                *keepaliveTime,
+                                Timeout:             *keepaliveTimeout,
+                                PermitWithoutStream: *keepalivePermitWithoutStream,
+                             }))
+     }
+     if *proxyUrl != "" {
+         dialer, err := mdtProxyDialer(*proxyUrl)
+         if err != nil {
+             return nil, fmt.Errorf("Invalid proxy: %v", err)
+         }
+         opts = append(opts, grpc.WithContextDialer(dialer))
+     }
+     if *maxRecvMsgSize > 0 {
+         opts = append(opts, grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(*maxRecvMsgSize)))
+     }
+
+     return opts, nil
+}
+
+// subscribe to -subscription on -server, or on the discovered servers
+func mdtSubscribeCmd() {
+     opts := mdtDialOptions()
+     if err := mdtCheckFlags(); err != nil {
+        log.Fatal(err)
+     }
+
+     if *descriptorCache != "" {
+         if err := telemetry_decode.MdtDescriptorCacheSetup(*descriptorCache); err != nil {
+             log.Fatalf("Failed to set up descriptor cache: %v", err)
+         }
+     }
+
+     if *daemon {
+         if err := telemetry_admin.WritePidFile(*pidFile); err != nil {
+             log.Fatalf("Failed to write pidfile: %v", err)
+         }
+         defer telemetry_admin.RemovePidFile(*pidFile)
+         go telemetry_admin.SdWatchdog(mdtStreamsUp)
+     }
+
+     mdtRampSetup(*connectLimit)
+
+     if *rateLimit != "" {
+         limits, err := telemetry_decode.MdtRateLimitParse(*rateLimit)
+         if err != nil {
+             log.Fatalf("Invalid -rate_limit: %v", err)
+         }
+         for _, l := range limits {
+             telemetry_decode.MdtSetRateLimit(l)
+         }
+     }
+
+     telemetry_decode.MdtSetTLSReload(*tlsReload)
+
+     if *chaos != "" {
+         if err := telemetry_decode.MdtChaosSetup(*chaos); err != nil {
+             log.Fatalf("Invalid -chaos: %v", err)
+         }
+         log.Printf("Chaos mode, injecting faults: %s", *chaos)
+     }
+
+     if *quarantineDir != "" {
+         if err := telemetry_decode.MdtQuarantineSetup(*quarantineDir); err != nil {
+             log.Fatalf("Invalid -quarantine_dir: %v", err)
+         }
+     }
+
+     if *maxMessages > 0 || *maxDuration > 0 {
+         telemetry_decode.MdtOutSetBound(*maxMessages, *maxDuration, mdtExit)
+     }
+
+     if err := telemetry_admin.ControlAccessSetup(*controlAllow, *controlTokenFile); err != nil {
+         log.Fatalf("Control access: %v", err)
+     }
+
+     if *adminListen != "" {
+         admin, err := telemetry_admin.NewAdminServer(*adminTokenFile)
+         if err != nil {
+             log.Fatalf("Failed to start admin api: %v", err)
+         }
+         admin.Shutdown = mdtExit
+         admin.HandleFunc("/subscriptions", mdtAdminSubscriptions)
          go func() {
-             <- sigs
-             //cleanup()
-             files, _ := filepath.Glob("/tmp/" + tmpFileName)
-             for _, f := range files {
-                 if err := os.Remove(f); err != nil {
-                     fmt.Printf("Failed to remove tmp file %s\n",f)
-                 }
-             }
-             os.Exit(0)
+             err := admin.ListenAndServe(*adminListen, *adminCert, *adminKey, *tlsReload)
+             log.Fatalf("Admin api: %v", err)
+         }()
+     }
+
+     if *debugListen != "" {
+         go func() {
+             err := telemetry_admin.ServeDebug(*debugListen)
+             log.Fatalf("Debug endpoint: %v", err)
+         }()
+     }
+
+     if *healthListen != "" {
+         go func() {
+             err := telemetry_admin.ServeHealth(*healthListen, *readyWindow)
+             log.Fatalf("Health probes: %v", err)
+         }()
+     }
+
+     if *restreamListen != "" {
+         go func() {
+             err := telemetry_restream.Serve(*restreamListen, *restreamCert, *restreamKey, *tlsReload)
+             log.Fatalf("Restream: %v", err)
+         }()
+     }
+
+     if *gnmiListen != "" {
+         go func() {
+             err := telemetry_gnmi.Serve(*gnmiListen, *gnmiCert, *gnmiKey, *tlsReload)
+             log.Fatalf("gNMI server: %v", err)
+         }()
+     }
+
+     if *dashboardListen != "" {
+         go func() {
+             err := telemetry_admin.ServeDashboard(*dashboardListen)
+             log.Fatalf("Dashboard: %v", err)
          }()
      }
 
-     if (*certFile != "") {
-         var tc credentials.TransportCredentials
-         tc, _ = credentials.NewClientTLSFromFile(*certFile, *serverHostOverride)
-         opts = append(opts, grpc.WithTransportCredentials(tc))
+     run := func(ctx context.Context) {
+         if len(*discover) > 0 {
+            // servers to subscribe to are discovered, runs till ctx is done
+            mdtDiscoverLoop(ctx, *discover, *discoverInterval, opts)
+         } else {
+            err := mdtDialinServer(ctx, mdtTarget{addr: *serverAddr}, opts)
+            if err != nil {
+               log.Fatal(err)
+            }
+         }
+     }
+     if *leaderLock != "" {
+         l, err := mdtNewLeaderLock(*leaderLock)
+         if err != nil {
+             log.Fatalf("Invalid leader lock: %v", err)
+         }
+         mdtLeaderLoop(l, run)
      } else {
-         opts = append(opts, grpc.WithInsecure())
+         run(context.Background())
      }
-     opts = append(opts, grpc.WithPerRPCCredentials(cred))
+}
+
+// subscribe options that are not supported
+func mdtCheckFlags() error {
+     if _, ok := telemetryEncoding[*encoding]; !ok {
+        return fmt.Errorf("Not supported encoding: %s", *encoding)
+     }
+     switch *mode {
+     case "stream", "once", "poll":
+     default:
+        return fmt.Errorf("Invalid mode %s, Options: stream,once,poll", *mode)
+     }
+     if *shardCount > 1 && len(*discover) == 0 {
+        return fmt.Errorf("-shard_count needs -discover")
+     }
+     if *shardCount > 1 && (*shardIndex < 0 || *shardIndex >= *shardCount) {
+        return fmt.Errorf("-shard_index %d out of range, 0 to %d", *shardIndex, *shardCount - 1)
+     }
+     if *descriptorCache != "" && (*encoding != "gpb" || *decode_raw || *protoFile != "") {
+        return fmt.Errorf("-descriptor_cache needs gpb encoding, without -decode_raw or -proto")
+     }
+     return nil
+}
 
-     conn, err := grpc.Dial(*serverAddr, opts...)
+// get proto for -yang_path, written to -out, -yang_path can be a comma
+// separated list and -yang_path_file a file of paths, one per line, protos
+// of all the paths are written one after the other
+func mdtGetProtoCmd() {
+     paths, err := mdtYangPaths(*yangPath, *yangPathFile)
+     if err != nil {
+        log.Fatalf("Failed to read yang paths: %v", err)
+     }
+     if len(paths) == 0 {
+        telemetry_log.Errorln("No yang path specified!")
+        return
+     }
+     conn, err := mdtDial(context.Background(), *serverAddr, mdtDialOptions())
      if err != nil {
         log.Fatalf("fail to dial: %v", err)
      }
      defer conn.Close()
 
+     if *outDir != "" && len(*outFile) != 0 {
+        log.Fatal("-out and -out_dir can not be used together")
+     }
+     oFile := os.Stdout
+     if len(*outFile) != 0 {
+        oFile, err = os.Create(*outFile)
+        if err != nil {
+           log.Fatalf("GetProto: %v", err)
+        }
+        defer oFile.Close()
+     }
+
      configOperClient := MdtDialin.NewGRPCConfigOperClient(conn)
+     failed := 0
+     for i, path := range paths {
+         getProtoArgs := MdtDialin.GetProtoFileArgs{ReqId: reqId + int64(i), YangPath: path}
+         if *outDir != "" {
+            err = mdtGetProtoDir(configOperClient, &getProtoArgs, *outDir)
+         } else {
+            err = mdtGetProto(configOperClient, &getProtoArgs, oFile)
+         }
+         if err != nil {
+            // rest of the paths are still fetched
+            telemetry_log.Errorf("GetProto: %s, %v\n", path, err)
+            failed++
+         }
+     }
+     if failed != 0 {
+        oFile.Close()
+        log.Fatalf("GetProto: failed for %d of %d yang paths", failed, len(paths))
+     }
+}
+
+// yang paths of the comma separated list and of the file, blank lines and
+// lines starting with # are skipped
+func mdtYangPaths(list, fileName string) ([]string, error) {
+     var paths []string
+     for _, path := range strings.Split(list, ",") {
+         if path = strings.TrimSpace(path); path != "" {
+             paths = append(paths, path)
+         }
+     }
+     if fileName != "" {
+         b, err := ioutil.ReadFile(fileName)
+         if err != nil {
+             return nil, err
+         }
+         for _, line := range strings.Split(string(b), "\n") {
+             if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+                 paths = append(paths, line)
+             }
+         }
+     }
+     return paths, nil
+}
+
+// cleanup tmp files and exit
+func mdtExit() {
+     telemetry_decode.MdtTuiStop()
+     if mdtLeaderLock != nil {
+         // standby takes over without waiting for the TTL
+         mdtLeaderLock.release()
+     }
+     // write out rows buffered in sinks
+     telemetry_decode.MdtOutClose()
+     mdtCheckpointExit()
+     if *daemon {
+         telemetry_admin.RemovePidFile(*pidFile)
+     }
+     if !*dontClean {
+         files, _ := filepath.Glob("/tmp/" + tmpFileName)
+         for _, f := range files {
+             if err := os.Remove(f); err != nil {
+                 telemetry_log.Errorf("Failed to remove tmp file %s\n",f)
+             }
+         }
+     }
+     os.Exit(0)
+}
 
-     reqId := int64(os.Getpid())
-     telemetryEncode, ok := telemetryEncoding[*encoding]
-     if !ok {
-        log.Fatalf("Not supported encoding: %s", *encoding)
+// dial the server, blocks till the connection is up if dial timeout is set
+func mdtDial(ctx context.Context, addr string, opts []grpc.DialOption) (*grpc.ClientConn, error) {
+     target, authority, err := mdtServerTarget(addr)
+     if err != nil {
+         return nil, err
+     }
+     dialOpts := append([]grpc.DialOption{}, opts...)
+     if authority != "" {
+         dialOpts = append(dialOpts, grpc.WithAuthority(authority))
      }
-     telemetrySubIdstr := *subIds
-     telemetryQos := (uint32)(*qos)
 
-     if strings.EqualFold(*operation, "subscribe") {
-        subidstrings := strings.Split(telemetrySubIdstr, "#")
+     if *dialTimeout > 0 {
+         // block till connection is up, so that dial fails after timeout
+         var cancel context.CancelFunc
+         ctx, cancel = context.WithTimeout(ctx, *dialTimeout)
+         defer cancel()
+         dialOpts = append(dialOpts, grpc.WithBlock())
+     }
 
-        var marking *MdtDialin.QOSMarking
-        if telemetryQos != NotConfigured {
-           marking = &MdtDialin.QOSMarking{Marking: telemetryQos}
-        }
+     return grpc.DialContext(ctx, target, dialOpts...)
+}
 
-        //createSubsArgs := MdtDialin.CreateSubsArgs{
-        //                  ReqId:         reqId,
-        //                  Encode:        telemetryEncode,
-        //                  Subscriptions: subidstrings,
-        //                  Qos:           marking}
-        //mdtSubscribe(configOperClient, &createSubsArgs)
-
-        // let's do a session per subscription instead of
-        // 1 session for all subscriptions, which above code does
-        for _, subid := range subidstrings {
-            createSubsArgs := MdtDialin.CreateSubsArgs{
-                              ReqId:         reqId,
-                              Encode:        telemetryEncode,
-                              Subidstr:      subid,
-                              Qos:           marking}
-
-            go mdtSubscribe(configOperClient, &createSubsArgs)
-        }
-        select { }
-     } else if strings.EqualFold(*operation, "get-proto") {
-        if len(*yangPath) > 0 {
-           getProtoArgs := MdtDialin.GetProtoFileArgs{ReqId: reqId, YangPath: *yangPath}
-           mdtGetProto(configOperClient, &getProtoArgs)
-        } else {
-           fmt.Println("No yang path specified!")
-        }
-     } else {
-        fmt.Println("Unsupported operation!")
+// dial the server and subscribe to all the subscriptions, a session per
+// subscription. Returns once all the sessions are done or ctx is cancelled.
+// A failed session is logged and rest of the sessions continue, error is
+// returned at the end if any failed. With admin api or config file,
+// connection is kept till ctx is cancelled, as subscriptions can be added
+// from the api or on config reload, unless -mode is once.
+func mdtDialinServer(ctx context.Context, t mdtTarget, opts []grpc.DialOption) error {
+     conn, err := mdtDial(ctx, t.addr, opts)
+     if err != nil {
+         return fmt.Errorf("fail to dial: %v", err)
+     }
+     defer conn.Close()
+
+     s := mdtNewSession(ctx, t.addr, t.encoding, MdtDialin.NewGRPCConfigOperClient(conn))
+     defer s.unregister()
+
+     //createSubsArgs := MdtDialin.CreateSubsArgs{
+     //                  ReqId:         reqId,
+     //                  Encode:        telemetryEncode,
+     //                  Subscriptions: subidstrings,
+     //                  Qos:           marking}
+     //mdtSubscribe(configOperClient, &createSubsArgs)
+
+     // let's do a session per subscription instead of
+     // 1 session for all subscriptions, which above code does
+     mdtConfigMu.RLock()
+     subs := mdtSplitSubscriptions(*subIds)
+     mdtConfigMu.RUnlock()
+     for subid := range subs {
+         s.subscribe(subid)
+     }
+     if (*adminListen != "" || *configFile != "") && *mode != "once" {
+         s.wg.Add(1)
+         go func() {
+             <-ctx.Done()
+             s.wg.Done()
+         }()
      }
+     // wait for all the sessions to end
+     s.wg.Wait()
+     return s.err()
 }
 
 // createSubs rpc to subscribe
-func mdtSubscribe(client MdtDialin.GRPCConfigOperClient, args *MdtDialin.CreateSubsArgs) {
-     fmt.Printf("mdtSubscribe: Dialin Reqid %d subscription %s\n", args.ReqId, args.Subidstr)
+func mdtSubscribe(parent context.Context, addr, encoding string, client MdtDialin.GRPCConfigOperClient, args *MdtDialin.CreateSubsArgs) error {
+     telemetry_log.Printf("mdtSubscribe: Dialin Reqid %d subscription %s\n", args.ReqId, args.Subidstr)
 
      dataChan := make(chan []byte, 10000)
      //dataChan := make(chan *MdtDialin.CreateSubsReply, 10000)
-     defer close(dataChan)
+     outDone := make(chan struct{})
      //go mdtOutLoop(dataChan, args.Encode)
 
+     mdtConfigMu.RLock()
      o := &telemetry_decode.MdtOut{
-                        OutFile:     *outFile,
-                        Encoding:    *encoding,
+                        Name:        addr + " " + args.Subidstr,
+                        ReqId:       args.ReqId,
+                        Router:      addr,
+                        Subscription: args.Subidstr,
+                        OutFile:     mdtOutFile(args.Subidstr),
+                        OutCompress: *outCompress,
+                        OutFormat:   *outFormat,
+                        TableFields: *tableFields,
+                        Encoding:    encoding,
                         Decode_raw:  *decode_raw,
                         DontClean:   *dontClean,
                         ProtoFile:   *protoFile,
@@ -168,50 +666,188 @@ func mdtSubscribe(client MdtDialin.GRPCConfigOperClient, args *MdtDialin.CreateS
                         PluginFile:  *pluginFile,
                         DataChan:     dataChan,
      }
+     mdtConfigMu.RUnlock()
+     if *descriptorCache != "" && encoding == "gpb" {
+         o.ProtoSource = &mdtProtoSource{addr: addr, client: client}
+     }
+     // output unreachable, e.g. database down, is retried without
+     // subscribing, waiting twice as long every time up to mdtOpenBackoffMax
+     backoff := *retryInterval
+     for {
+         err := o.MdtOutOpen()
+         if err == nil {
+             break
+         }
+         if *retryInterval == 0 || parent.Err() != nil {
+             return fmt.Errorf("%s: %v", o.Name, err)
+         }
+         telemetry_log.Errorf("%s: %v, trying again in %v\n", o.Name, err, backoff)
+         select {
+         case <-parent.Done():
+             return nil
+         case <-time.After(backoff):
+         }
+         if backoff *= 2; backoff > mdtOpenBackoffMax {
+             backoff = mdtOpenBackoffMax
+         }
+     }
+     defer func() {
+         // let output loop drain the channel before returning
+         close(dataChan)
+         <-outDone
+     }()
      // handler for decoding the data, reads data from dataChan
-     go o.MdtOutLoop()
+     go func() {
+         o.MdtOutLoop()
+         close(outDone)
+     }()
+
+     for {
+         start := time.Now()
+         next := start.Add(*pollInterval)
+         err := mdtCreateSubs(parent, client, args, encoding, dataChan)
+         if err == mdtErrSilent {
+             telemetry_log.Errorf("%s: ReqId %d, subscription %s got no data for %v, subscribing again\n", addr, args.ReqId, args.Subidstr, *silenceTimeout)
+             continue
+         }
+         if err != nil {
+             // stream is done, output is kept for the retry
+             if *retryInterval == 0 || parent.Err() != nil {
+                 return err
+             }
+             telemetry_log.Errorf("%s: %v, subscribing again in %v\n", addr, err, *retryInterval)
+             next = time.Now().Add(*retryInterval)
+         } else if *mode != "poll" {
+             return nil
+         }
+         select {
+         case <-parent.Done():
+             return nil
+         case <-time.After(time.Until(next)):
+         }
+     }
+}
+
+// longest wait between tries of opening an output
+const mdtOpenBackoffMax = 5 * time.Minute
 
-     stream, err := client.CreateSubs(context.Background(), args)
+// subscription ended by -silence_timeout, router side of it is likely gone
+// while the stream is still up
+var mdtErrSilent = errors.New("no data")
+
+// createSubs rpc, received messages are queued to dataChan till the stream
+// ends, or with -mode once or poll till a collection is received
+func mdtCreateSubs(parent context.Context, client MdtDialin.GRPCConfigOperClient, args *MdtDialin.CreateSubsArgs, encoding string, dataChan chan<- []byte) error {
+     ctx, cancel := mdtRpcContext(parent)
+     defer cancel()
+     release, err := mdtRampWait(ctx)
+     if err != nil {
+         // cancelled before it was set up
+         return nil
+     }
+     defer release()
+     var snap *mdtSnapshot
+     if *mode != "stream" {
+         snap = mdtNewSnapshot(cancel, encoding)
+     }
+     var silent int32
+     var watchdog *time.Timer
+     if *silenceTimeout > 0 {
+         watchdog = time.AfterFunc(*silenceTimeout, func() {
+             atomic.StoreInt32(&silent, 1)
+             cancel()
+         })
+         defer watchdog.Stop()
+     }
+     stream, err := client.CreateSubs(ctx, args)
      if err != nil {
-        log.Fatalf("mdtSubscribe: ReqId %d, %v", args.ReqId, err)
+        return fmt.Errorf("mdtSubscribe: ReqId %d, %v", args.ReqId, err)
      }
 
+     streaming := false
+     defer func() {
+         if streaming {
+             mdtStreamDown()
+         }
+     }()
+
      for {
          reply, err := stream.Recv()
+         release()
+         if snap != nil && snap.complete() {
+            telemetry_log.Printf("Subscribe: ReqId %d, subscription %s collected\n", args.ReqId, args.Subidstr)
+            break
+         }
+         if atomic.LoadInt32(&silent) != 0 {
+            return mdtErrSilent
+         }
+         if watchdog != nil && err == nil {
+            watchdog.Reset(*silenceTimeout)
+         }
+         if err == nil && !streaming {
+            streaming = true
+            mdtStreamUp()
+         }
          if err == io.EOF {
-            fmt.Printf("Subscribe: Got EOF\n\n")
+            telemetry_log.Printf("Subscribe: Got EOF\n\n")
+            break
+         }
+         if parent.Err() != nil {
+            // session is no longer needed
+            telemetry_log.Printf("Subscribe: ReqId %d, subscription %s cancelled\n", args.ReqId, args.Subidstr)
+            break
+         }
+         if status.Code(err) == codes.DeadlineExceeded {
+            telemetry_log.Printf("Subscribe: ReqId %d, rpc deadline %v reached\n", args.ReqId, *rpcDeadline)
             break
          }
          if err != nil {
-            log.Fatalf("Subscribe: ReqId %d, %v", args.ReqId, err)
+            return fmt.Errorf("Subscribe: ReqId %d, %v", args.ReqId, err)
          }
 
          if len(reply.Data) == 0 {
             if len(reply.Errors) != 0 {
-               fmt.Printf("Subscribe: Received ReqId %d, error:\n%s\n", args.ReqId, reply.Errors)
-               break
+               return fmt.Errorf("Subscribe: Received ReqId %d, subscription %s error:\n%s", args.ReqId, args.Subidstr, reply.Errors)
             }
          } else {
+            telemetry_log.Debugf("Subscribe: ReqId %d, subscription %s received message len: %v\n", args.ReqId, args.Subidstr, len(reply.Data))
+            if snap != nil && !snap.message(reply.Data) {
+               continue
+            }
             dataChan <- reply.Data
+            if telemetry_decode.MdtChaosDisconnect() {
+               return fmt.Errorf("Subscribe: ReqId %d, chaos: stream disconnected", args.ReqId)
+            }
          }
      }
 
+     return nil
 }
 
-// Get Proto request
-func mdtGetProto(client MdtDialin.GRPCConfigOperClient, args *MdtDialin.GetProtoFileArgs) int64 {
-     var oFile *os.File
-
-     stream, err := client.GetProtoFile(context.Background(), args)
-     if err != nil {
-        log.Fatalf("GetProto: ReqId %d, %v", args.ReqId, err)
-        return 0
+// output file for the subscription, all subscriptions share -out unless
+// out_per_subscription is set
+func mdtOutFile(subid string) string {
+     if !*outPerSub || len(*outFile) == 0 || strings.HasPrefix(*outFile, "elasticsearch:") ||
+        strings.HasPrefix(*outFile, "opensearch:") ||
+        strings.Contains(*outFile, "{{") {
+         // template has {{.Subscription}} for this
+         return *outFile
+     }
+     sub := strings.NewReplacer("/", "_", string(os.PathSeparator), "_").Replace(subid)
+     if i := strings.LastIndex(*outFile, "*"); i >= 0 {
+         return (*outFile)[:i] + sub + "-" + (*outFile)[i:]
      }
+     ext := filepath.Ext(*outFile)
+     return strings.TrimSuffix(*outFile, ext) + "_" + sub + ext
+}
 
-     oFile = os.Stdout
-     if len(*outFile) != 0 {
-        oFile, err = os.Create(*outFile)
-        defer oFile.Close()
+// Get Proto request, proto is written to oFile
+func mdtGetProto(client MdtDialin.GRPCConfigOperClient, args *MdtDialin.GetProtoFileArgs, oFile io.Writer) error {
+     ctx, cancel := mdtRpcContext(context.Background())
+     defer cancel()
+     stream, err := client.GetProtoFile(ctx, args)
+     if err != nil {
+        return fmt.Errorf("ReqId %d, %v", args.ReqId, err)
      }
 
      for {
@@ -220,41 +856,73 @@ func mdtGetProto(client MdtDialin.GRPCConfigOperClient, args *MdtDialin.GetProto
             break
          }
          if err != nil {
-            log.Fatalf("GetProto: ReqId %d, %v", args.ReqId, err)
-            return 0
+            return fmt.Errorf("ReqId %d, %v", args.ReqId, err)
          }
 
          if len(reply.Errors) != 0 {
-            fmt.Printf("GetProto: ReqId %d, received error: %s\n", args.ReqId, reply.Errors)
-            return 0
+            return fmt.Errorf("ReqId %d, received error: %s", args.ReqId, reply.Errors)
          } else if reply.ReqId != args.ReqId {
-            fmt.Printf("GetProto: mismatch sent ReqID %d, Received ReqId %d\n",
-                                         args.ReqId, reply.ReqId)
-            return 0
+            return fmt.Errorf("mismatch sent ReqID %d, Received ReqId %d", args.ReqId, reply.ReqId)
          } else {
             if len(reply.ProtoContent) == 0 {
-               fmt.Printf("GetProto: Received ReqId %d \n", reply.ReqId)
+               telemetry_log.Printf("GetProto: Received ReqId %d \n", reply.ReqId)
             } else {
-               _, err := oFile.WriteString(reply.ProtoContent)
+               _, err := io.WriteString(oFile, reply.ProtoContent)
                if err != nil {
-                  fmt.Println(err)
+                  telemetry_log.Errorln(err)
                }
             }
          }
      }
 
-     return 0
+     return nil
+}
+
+
+// grpc target for the server address, the address itself, host:port or a
+// target with a scheme, dns:///r1:57400, unix:///path. IPv6 address is
+// expected in brackets and may have a zone, e.g. [fe80::1%eth0]:57400.
+// Zone is not valid in a grpc target or in :authority, so it is escaped in
+// a passthrough target and dropped from the authority.
+func mdtServerTarget(addr string) (string, string, error) {
+     if strings.Contains(addr, "://") || !strings.Contains(addr, "%") {
+         return addr, "", nil
+     }
+     host, port, err := net.SplitHostPort(addr)
+     if err != nil {
+         return "", "", err
+     }
+     i := strings.LastIndex(host, "%")
+     if i < 0 {
+         return addr, "", nil
+     }
+     if ip := net.ParseIP(host[:i]); ip == nil || ip.To4() != nil {
+         return "", "", fmt.Errorf("zone is valid only with IPv6 address: %s", addr)
+     }
+     target := "passthrough:///" + strings.Replace(net.JoinHostPort(host, port), "%", "%25", 1)
+     return target, net.JoinHostPort(host[:i], port), nil
+}
+
+// context for the rpc, with deadline if configured
+func mdtRpcContext(parent context.Context) (context.Context, context.CancelFunc) {
+     if *rpcDeadline > 0 {
+         return context.WithTimeout(parent, *rpcDeadline)
+     }
+     return context.WithCancel(parent)
 }
 
+type passCredential struct {
+     username string
+     password string
+}
 
-type passCredential int
-func (passCredential) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+func (c passCredential) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
      return map[string]string{
-                "username": *username,
-                "password": *password,
+                "username": c.username,
+                "password": c.password,
             }, nil
 }
 
-func (passCredential) RequireTransportSecurity() bool {
+func (c passCredential) RequireTransportSecurity() bool {
      return false
 }
@@ -0,0 +1,253 @@
+package main
+
+import (
+       "flag"
+       "fmt"
+       "log"
+       "os"
+       "path/filepath"
+       "runtime"
+       "strings"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_admin"
+)
+
+// Collector is run as <command> [options], each command has only the
+// options it uses,
+//   subscribe   subscribe to subscriptions on a router and decode the stream
+//   get-proto   get proto file for a yang path from a router
+//   list        list subscriptions and sensor paths configured on a router
+//   replay      decode messages recorded from a tcp dialout session
+//   decode      decode messages saved one per file, or check them with -golden
+//   index       index captures by router, sensor path and time
+//   search      decode messages of captures by router, sensor path and time
+//   decrypt     print files encrypted with -encrypt_key
+//   generate    decode generated messages to -out
+//   loadgen     send generated messages to a dialout collector
+//   config init print a config file of the subscribe options
+//   version     print version
+// Options shared by commands are the same flags, so config file and admin
+// api see the same values. Running without a command, options first, is
+// still supported and runs -oper, subscribe or get-proto.
+
+type mdtCommand struct {
+     name    string
+     summary string
+     flags   *flag.FlagSet
+     // sub commands, first argument
+     sub     []string
+     // options shared with other commands
+     shared  []string
+     run     func()
+}
+
+// set with -ldflags "-X main.version=<version>" at build time
+var version = "dev"
+
+var (
+     connectionOptions = []string{
+         "server", "username", "password", "credentials_file", "token", "token_file", "token_refresh",
+         "cert", "tls_reload", "server_host_override", "grpc_compress", "max_recv_msg_size",
+         "dial_timeout", "rpc_deadline", "keepalive_time", "keepalive_timeout",
+         "keepalive_permit_without_stream", "proxy",
+     }
+     decodeOptions = []string{
+         "encoding", "out", "out_compress", "format", "fields", "decode_raw", "proto",
+         "plugin_dir", "plugin", "dont_clean", "yang_models", "path_map", "wasm_transform", "wasm_decoder", "script",
+         "dedup", "dedup_window", "redact", "encrypt_key",
+     }
+     logOptions = []string{"quiet", "v", "vv", "color"}
+     // subscribe options that can be in the config file
+     mdtSubscribeOptions = []string{
+         "subscription", "qos", "out_per_subscription",
+         "discover", "discover_interval", "shard_index", "shard_count", "leader_lock",
+         "admin_listen", "admin_token_file",
+         "admin_cert", "admin_key", "health_listen", "ready_window",
+         "debug_listen", "dashboard_listen", "control_allow", "control_token_file", "restream_listen",
+         "restream_cert", "restream_key", "gnmi_listen", "gnmi_cert", "gnmi_key", "descriptor_cache",
+         "daemon", "pidfile", "tui", "max_messages", "max_duration", "rate_limit", "chaos", "quarantine_dir", "mode", "poll_interval",
+         "retry_interval", "silence_timeout", "connect_limit", "connect_jitter",
+     }
+)
+
+var mdtCommands = []*mdtCommand{
+    {
+        name:    "subscribe",
+        summary: "subscribe to subscriptions on a router and decode the stream",
+        shared:  mdtOptions([]string{"config"}, mdtSubscribeOptions,
+                            []string{"check_config", "check_reachability"},
+                            connectionOptions, decodeOptions, logOptions),
+        run:     mdtSubscribeCmd,
+    },
+    {
+        name:    "get-proto",
+        summary: "get proto file for a yang path from a router",
+        shared:  mdtOptions([]string{"yang_path", "yang_path_file", "out", "out_dir"}, connectionOptions, logOptions),
+        run:     mdtGetProtoCmd,
+    },
+    {
+        name:    "list",
+        summary: "list subscriptions, their sensor groups and sensor paths configured on a router",
+        shared:  mdtOptions(connectionOptions, logOptions),
+        run:     mdtListCmd,
+    },
+    {
+        name:    "replay",
+        summary: "decode messages recorded from a tcp dialout session, files or - for stdin",
+        flags:   replayFlags,
+        shared:  mdtOptions(decodeOptions, logOptions),
+        run:     mdtReplayCmd,
+    },
+    {
+        name:    "decode",
+        summary: "decode messages saved one per file, in -encoding, or check them against expected rows with -golden",
+        flags:   decodeFlags,
+        shared:  mdtOptions(decodeOptions, logOptions),
+        run:     mdtDecodeCmd,
+    },
+    {
+        name:    "index",
+        summary: "index captures of tcp dialout sessions by router, sensor path and time, for search",
+        flags:   indexFlags,
+        shared:  mdtOptions([]string{"encrypt_key"}, logOptions),
+        run:     mdtIndexCmd,
+    },
+    {
+        name:    "search",
+        summary: "decode messages of captures by router, sensor path and time, captures read are picked with -index",
+        flags:   searchFlags,
+        shared:  mdtOptions(decodeOptions, logOptions),
+        run:     mdtSearchCmd,
+    },
+    {
+        name:    "decrypt",
+        summary: "print files encrypted with -encrypt_key, decrypted and decompressed",
+        shared:  mdtOptions([]string{"encrypt_key"}, logOptions),
+        run:     mdtDecryptCmd,
+    },
+    {
+        name:    "generate",
+        summary: "decode generated messages to -out, for trying outputs without a router",
+        flags:   generateFlags,
+        shared:  mdtOptions(decodeOptions, logOptions),
+        run:     mdtGenerateCmd,
+    },
+    {
+        name:    "loadgen",
+        summary: "send generated messages to a dialout collector, for load testing",
+        flags:   loadgenFlags,
+        shared:  mdtOptions([]string{"cert", "server_host_override"}, logOptions),
+        run:     mdtLoadgenCmd,
+    },
+    {
+        name:    "config",
+        summary: "config init, print a config file of all the subscribe options, commented, with values given as options",
+        sub:     []string{"init"},
+        shared:  mdtOptions([]string{"config"}, mdtSubscribeOptions, connectionOptions, decodeOptions, logOptions),
+        run:     mdtConfigCmd,
+    },
+    {
+        name:    "version",
+        summary: "print version",
+        run:     mdtVersionCmd,
+    },
+}
+
+func mdtOptions(lists ...[]string) []string {
+     var options []string
+     for _, l := range lists {
+         options = append(options, l...)
+     }
+     return options
+}
+
+func mdtLookupCommand(name string) *mdtCommand {
+     for _, c := range mdtCommands {
+         if c.name == name {
+             return c
+         }
+     }
+     return nil
+}
+
+// parse command line, returns the command to run
+func mdtParseCommand() *mdtCommand {
+     if len(os.Args) < 2 || strings.HasPrefix(os.Args[1], "-") {
+         // options only, -oper selects the command
+         flag.Usage = usage
+         flag.Parse()
+         mdtFlagsFromEnv(flag.CommandLine)
+         oper := strings.ToLower(*operation)
+         if oper != "subscribe" && oper != "get-proto" {
+             log.Fatalf("Unsupported operation %s, Options: subscribe,get-proto", *operation)
+         }
+         return mdtLookupCommand(oper)
+     }
+
+     c := mdtLookupCommand(os.Args[1])
+     if c == nil {
+         fmt.Fprintf(os.Stderr, "Unknown command %s\n", os.Args[1])
+         usage()
+         os.Exit(2)
+     }
+     fs := c.flags
+     if fs == nil {
+         fs = flag.NewFlagSet(c.name, flag.ExitOnError)
+     }
+     shared := make(map[string]bool)
+     for _, name := range c.shared {
+         f := flag.Lookup(name)
+         fs.Var(f.Value, f.Name, f.Usage)
+         shared[name] = true
+     }
+     args := os.Args[2:]
+     if len(c.sub) != 0 {
+         for _, sub := range c.sub {
+             if len(args) > 0 && args[0] == sub {
+                 mdtSubCommand = sub
+             }
+         }
+         if mdtSubCommand == "" {
+             fmt.Fprintf(os.Stderr, "Usage: %s %s %s [options]\n", os.Args[0], c.name, strings.Join(c.sub, "|"))
+             os.Exit(2)
+         }
+         args = args[1:]
+     }
+     fs.Usage = func() {
+         fmt.Fprintf(os.Stderr, "Usage: %s %s [options]\n  %s\n", os.Args[0], strings.TrimSpace(c.name + " " + mdtSubCommand), c.summary)
+         fs.PrintDefaults()
+     }
+     fs.Parse(args)
+     mdtCommandArgs = fs.Args()
+     mdtFlagsFromEnv(fs)
+
+     // mark options as given on the command line, so that config file
+     // does not override them
+     fs.Visit(func(f *flag.Flag) {
+         if shared[f.Name] {
+             flag.Set(f.Name, f.Value.String())
+         }
+     })
+     return c
+}
+
+// options of fs not on the command line from MDT_ environment variables,
+// and values of @file options from files
+func mdtFlagsFromEnv(fs *flag.FlagSet) {
+     if err := telemetry_admin.FlagsFromEnv(fs, "MDT_"); err != nil {
+         log.Fatal(err)
+     }
+     if err := telemetry_admin.FlagFiles(fs); err != nil {
+         log.Fatal(err)
+     }
+}
+
+// arguments after the options of the command
+var mdtCommandArgs []string
+
+// sub command given, of commands that have them
+var mdtSubCommand string
+
+func mdtVersionCmd() {
+     fmt.Printf("%s %s %s %s/%s\n", filepath.Base(os.Args[0]), version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+}
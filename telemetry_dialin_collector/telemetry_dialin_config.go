@@ -0,0 +1,250 @@
+package main
+
+import (
+       "bufio"
+       "flag"
+       "fmt"
+       "log"
+       "os"
+       "os/signal"
+       "path/filepath"
+       "strings"
+       "sync"
+       "syscall"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_admin"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// Config file has an option per line, same name as the command line
+// option without the '-', and its value,
+//   # comment
+//   server = 192.168.122.157:57500
+//   subscription = cdp-neighbor#intf-counters
+//   encoding = self-describing-gpb
+// Options given on the command line or in MDT_ environment variables
+// override the config file, values can be @file.
+
+// options that are applied to running sessions when config is reloaded,
+// changing any other option needs a restart
+var mdtReloadOutputOptions = []string{
+    "encoding", "qos", "out", "out_compress", "out_per_subscription", "decode_raw", "proto", "plugin_dir", "plugin",
+}
+
+// held setting the options of mdtReloadOutputOptions and subscription on
+// reload, and reading them starting a subscription
+var mdtConfigMu sync.RWMutex
+
+// options set on command line
+var mdtCmdlineOptions = make(map[string]bool)
+
+func mdtReadConfig(fileName string) (map[string]string, error) {
+     f, err := os.Open(fileName)
+     if err != nil {
+         return nil, err
+     }
+     defer f.Close()
+
+     config := make(map[string]string)
+     scanner := bufio.NewScanner(f)
+     for n := 1; scanner.Scan(); n++ {
+         line := strings.TrimSpace(scanner.Text())
+         if line == "" || strings.HasPrefix(line, "#") {
+             continue
+         }
+         kv := strings.SplitN(line, "=", 2)
+         if len(kv) != 2 {
+             return nil, fmt.Errorf("%s:%d: expected option = value", fileName, n)
+         }
+         name := strings.TrimSpace(kv[0])
+         if flag.Lookup(name) == nil || name == "config" {
+             return nil, fmt.Errorf("%s:%d: unknown option %s", fileName, n, name)
+         }
+         config[name] = strings.TrimSpace(kv[1])
+     }
+     return config, scanner.Err()
+}
+
+// set options from config at startup, options not in config are set back
+// to default unless given on the command line
+func mdtApplyConfig(config map[string]string) error {
+     var err error
+     flag.VisitAll(func(f *flag.Flag) {
+         if err != nil || mdtCmdlineOptions[f.Name] || f.Name == "config" {
+             return
+         }
+         value, ok := config[f.Name]
+         if !ok {
+             value = f.DefValue
+         }
+         if e := f.Value.Set(value); e != nil {
+             err = fmt.Errorf("invalid value %q for option %s: %v", value, f.Name, e)
+         }
+     })
+     if err != nil {
+         return err
+     }
+     return telemetry_admin.FlagFiles(flag.CommandLine)
+}
+
+// load config file at startup
+func mdtLoadConfig(fileName string) error {
+     flag.Visit(func(f *flag.Flag) {
+         mdtCmdlineOptions[f.Name] = true
+     })
+     config, err := mdtReadConfig(fileName)
+     if err != nil {
+         return err
+     }
+     return mdtApplyConfig(config)
+}
+
+// reload config file on SIGHUP and apply changes to running sessions,
+//   - new subscriptions are started, removed ones are cancelled
+//   - if output or encoding options changed, subscriptions are restarted
+//   - rest of the subscriptions are not touched
+func mdtConfigReloader(fileName string) {
+     hup := make(chan os.Signal, 1)
+     signal.Notify(hup, syscall.SIGHUP)
+
+     for range hup {
+         telemetry_log.Printf("Config: reloading %s\n", fileName)
+         if err := mdtReloadConfig(fileName); err != nil {
+             log.Printf("Config: reload failed, keeping current config: %v", err)
+         }
+     }
+}
+
+func mdtReloadConfig(fileName string) error {
+     config, err := mdtReadConfig(fileName)
+     if err != nil {
+         return err
+     }
+     // value an option gets from config, default if not in it
+     value := func(f *flag.Flag) (string, error) {
+         v, ok := config[f.Name]
+         if !ok {
+             return f.DefValue, nil
+         }
+         return telemetry_admin.FileValue(v)
+     }
+
+     // only subscriptions and output options are set, running sessions read
+     // them under mdtConfigMu, rest is left as it is and only logged
+     reload := append([]string{"subscription"}, mdtReloadOutputOptions...)
+     old := make(map[string]string)
+     mdtConfigMu.Lock()
+     for _, name := range reload {
+         f := flag.Lookup(name)
+         old[name] = f.Value.String()
+         if mdtCmdlineOptions[name] {
+             continue
+         }
+         v, e := value(f)
+         if e == nil {
+             e = f.Value.Set(v)
+         }
+         if e != nil {
+             // put back the old values
+             for name, v := range old {
+                 flag.Lookup(name).Value.Set(v)
+             }
+             mdtConfigMu.Unlock()
+             return fmt.Errorf("invalid value for option %s: %v", name, e)
+         }
+     }
+     restart := false
+     for _, name := range mdtReloadOutputOptions {
+         if old[name] != flag.Lookup(name).Value.String() {
+             telemetry_log.Printf("Config: %s changed, restarting subscriptions\n", name)
+             restart = true
+         }
+     }
+     oldSubs := mdtSplitSubscriptions(old["subscription"])
+     newSubs := mdtSplitSubscriptions(*subIds)
+     mdtConfigMu.Unlock()
+
+     flag.VisitAll(func(f *flag.Flag) {
+         if _, ok := old[f.Name]; ok || mdtCmdlineOptions[f.Name] || f.Name == "config" {
+             return
+         }
+         if v, e := value(f); e == nil && v != f.Value.String() {
+             log.Printf("Config: change to %s is applied after restart", f.Name)
+         }
+     })
+
+     mdtSessions.Lock()
+     defer mdtSessions.Unlock()
+     for _, s := range mdtSessions.m {
+         for subid := range oldSubs {
+             if !newSubs[subid] || restart {
+                 if err := s.unsubscribe(subid); err == nil {
+                     telemetry_log.Printf("Config: cancelled subscription %s on %s\n", subid, s.addr)
+                 }
+             }
+         }
+         for subid := range newSubs {
+             if !oldSubs[subid] || restart {
+                 telemetry_log.Printf("Config: subscribe to %s on %s\n", subid, s.addr)
+                 if err := s.subscribe(subid); err != nil {
+                     log.Printf("Config: %v", err)
+                 }
+             }
+         }
+     }
+     return nil
+}
+
+func mdtSplitSubscriptions(subs string) map[string]bool {
+     m := make(map[string]bool)
+     for _, subid := range strings.Split(subs, "#") {
+         if subid != "" {
+             m[subid] = true
+         }
+     }
+     return m
+}
+
+// config init, config file of the subscribe options on stdout, options
+// with values other than default, given as options or in -config, are set,
+// rest are commented out with their default
+func mdtConfigCmd() {
+     w := bufio.NewWriter(os.Stdout)
+     defer w.Flush()
+     fmt.Fprintf(w, "# %s subscribe -config <file>\n", filepath.Base(os.Args[0]))
+     fmt.Fprintf(w, "# option = value, options given on command line or in MDT_ environment\n")
+     fmt.Fprintf(w, "# variables override these, values can be @file, reloaded on SIGHUP\n")
+
+     for _, name := range mdtOptions(connectionOptions, mdtSubscribeOptions, decodeOptions, logOptions) {
+         f := flag.Lookup(name)
+         fmt.Fprintln(w)
+         for _, line := range mdtWrap(f.Usage, 74) {
+             fmt.Fprintf(w, "# %s\n", line)
+         }
+         line := strings.TrimSpace(name + " = " + f.Value.String())
+         if f.Value.String() == f.DefValue {
+             line = "# " + line
+         }
+         fmt.Fprintln(w, line)
+     }
+}
+
+// text as lines of at most width, words are not broken
+func mdtWrap(text string, width int) []string {
+     var lines []string
+     line := ""
+     for _, word := range strings.Fields(text) {
+         if line != "" && len(line) + 1 + len(word) > width {
+             lines = append(lines, line)
+             line = ""
+         }
+         if line != "" {
+             line += " "
+         }
+         line += word
+     }
+     if line != "" {
+         lines = append(lines, line)
+     }
+     return lines
+}
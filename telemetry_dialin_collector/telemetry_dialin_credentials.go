@@ -0,0 +1,155 @@
+package main
+
+import (
+       "bufio"
+       "fmt"
+       "io/ioutil"
+       "log"
+       "os"
+       "strings"
+       "sync"
+       "time"
+
+       "golang.org/x/net/context"
+       "golang.org/x/term"
+)
+
+// Username and password for the session are picked from, in order,
+//   1) -username/-password options
+//   2) MDT_USERNAME/MDT_PASSWORD environment variables, MDT_TOKEN for token
+//   3) credentials file, lines of username=<> and password=<>, file must
+//      not be accessible to group or others
+//   4) prompt, if username is known but password is not and stdin is a
+//      terminal
+func mdtResolveCredentials() error {
+     if *username == "" {
+         *username = os.Getenv("MDT_USERNAME")
+     }
+     if *password == "" {
+         *password = os.Getenv("MDT_PASSWORD")
+     }
+     if *token == "" {
+         *token = os.Getenv("MDT_TOKEN")
+     }
+
+     if *credentialsFile != "" && (*username == "" || *password == "") {
+         user, pass, err := mdtReadCredentialsFile(*credentialsFile)
+         if err != nil {
+             return err
+         }
+         if *username == "" {
+             *username = user
+         }
+         if *password == "" {
+             *password = pass
+         }
+     }
+
+     if *username != "" && *password == "" && term.IsTerminal(int(os.Stdin.Fd())) {
+         fmt.Fprintf(os.Stderr, "Password for %s: ", *username)
+         pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+         fmt.Fprintln(os.Stderr)
+         if err != nil {
+             return err
+         }
+         *password = string(pass)
+     }
+     return nil
+}
+
+func mdtReadCredentialsFile(fileName string) (string, string, error) {
+     var user, pass string
+
+     f, err := os.Open(fileName)
+     if err != nil {
+         return "", "", err
+     }
+     defer f.Close()
+
+     fi, err := f.Stat()
+     if err != nil {
+         return "", "", err
+     }
+     if fi.Mode().Perm() & 0077 != 0 {
+         return "", "", fmt.Errorf("credentials file %s is accessible to group or others (%v), chmod 600 it",
+                                   fileName, fi.Mode().Perm())
+     }
+
+     scanner := bufio.NewScanner(f)
+     for scanner.Scan() {
+         line := strings.TrimSpace(scanner.Text())
+         if line == "" || strings.HasPrefix(line, "#") {
+             continue
+         }
+         kv := strings.SplitN(line, "=", 2)
+         if len(kv) != 2 {
+             return "", "", fmt.Errorf("credentials file %s: expected key=value, got %q", fileName, line)
+         }
+         switch strings.TrimSpace(kv[0]) {
+         case "username":
+             user = strings.TrimSpace(kv[1])
+         case "password":
+             pass = strings.TrimSpace(kv[1])
+         default:
+             return "", "", fmt.Errorf("credentials file %s: unknown key %s", fileName, kv[0])
+         }
+     }
+     return user, pass, scanner.Err()
+}
+
+// bearer token sent in authorization header of every rpc, token read from
+// file is re-read every refresh interval so that it can be rotated
+type tokenCredential struct {
+     mu    sync.RWMutex
+     token string
+}
+
+func mdtNewTokenCredential(token string, tokenFile string, refresh time.Duration) (*tokenCredential, error) {
+     c := &tokenCredential{token: token}
+     if tokenFile == "" {
+         return c, nil
+     }
+
+     if err := c.load(tokenFile); err != nil {
+         return nil, err
+     }
+     if refresh > 0 {
+         go func() {
+             for range time.Tick(refresh) {
+                 if err := c.load(tokenFile); err != nil {
+                     log.Printf("Failed to refresh token from %s: %v", tokenFile, err)
+                 }
+             }
+         }()
+     }
+     return c, nil
+}
+
+func (c *tokenCredential) load(tokenFile string) error {
+     b, err := ioutil.ReadFile(tokenFile)
+     if err != nil {
+         return err
+     }
+     token := strings.TrimSpace(string(b))
+     if token == "" {
+         return fmt.Errorf("token file %s is empty", tokenFile)
+     }
+
+     c.mu.Lock()
+     c.token = token
+     c.mu.Unlock()
+     return nil
+}
+
+func (c *tokenCredential) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+     c.mu.RLock()
+     defer c.mu.RUnlock()
+     return map[string]string{
+                "authorization": "Bearer " + c.token,
+            }, nil
+}
+
+// token is never sent in clear
+func (c *tokenCredential) RequireTransportSecurity() bool {
+     return true
+}
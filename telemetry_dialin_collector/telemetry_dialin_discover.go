@@ -0,0 +1,200 @@
+package main
+
+import (
+       "fmt"
+       "log"
+       "net"
+       "net/http"
+       "net/url"
+       "os"
+       "strconv"
+       "strings"
+       "time"
+       "encoding/json"
+
+       "golang.org/x/net/context"
+       "google.golang.org/grpc"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// discovered server and its session
+type mdtDiscoveredServer struct {
+     target mdtTarget
+     cancel context.CancelFunc
+     done   chan struct{}
+}
+
+// Discover servers periodically and keep a session to each of them.
+// Session is started when a server shows up, cancelled when it goes away
+// and restarted on next refresh if it ended on its own or its settings
+// changed. Runs till ctx is cancelled, then all the sessions are closed.
+func mdtDiscoverLoop(parent context.Context, discover string, interval time.Duration, opts []grpc.DialOption) {
+     servers := make(map[string]*mdtDiscoveredServer)
+     if *shardCount > 1 {
+         telemetry_log.Printf("Discover: servers of shard %d of 0 to %d\n", *shardIndex, *shardCount - 1)
+     }
+
+     for {
+         targets, err := mdtDiscoverServers(discover)
+         if err != nil {
+             // keep the existing sessions, try again on next refresh
+             log.Printf("Discover: %s, %v", discover, err)
+         } else {
+             found := make(map[string]bool)
+             for _, t := range targets {
+                 addr := t.addr
+                 found[addr] = true
+                 if s, ok := servers[addr]; ok {
+                     if s.target != t {
+                         telemetry_log.Printf("Discover: settings of %s changed, restarting session\n", addr)
+                         s.cancel()
+                         <-s.done
+                     } else {
+                         select {
+                         case <-s.done:
+                             telemetry_log.Printf("Discover: restarting session to %s\n", addr)
+                         default:
+                             continue
+                         }
+                     }
+                 } else {
+                     telemetry_log.Printf("Discover: found %s\n", addr)
+                 }
+
+                 topts := opts
+                 if t.own() {
+                     if topts, err = mdtTargetDialOptions(&t); err != nil {
+                         log.Printf("Discover: %s: %v", addr, err)
+                         delete(servers, addr)
+                         continue
+                     }
+                 }
+                 ctx, cancel := context.WithCancel(parent)
+                 s := &mdtDiscoveredServer{target: t, cancel: cancel, done: make(chan struct{})}
+                 servers[addr] = s
+                 go func(t mdtTarget) {
+                     defer close(s.done)
+                     err := mdtDialinServer(ctx, t, topts)
+                     if err != nil {
+                         log.Printf("Discover: %s: %v", t.addr, err)
+                     }
+                 }(t)
+             }
+
+             for addr, s := range servers {
+                 if !found[addr] {
+                     telemetry_log.Printf("Discover: %s is gone, closing session\n", addr)
+                     s.cancel()
+                     delete(servers, addr)
+                 }
+             }
+         }
+         select {
+         case <-parent.Done():
+             for _, s := range servers {
+                 <-s.done
+             }
+             return
+         case <-time.After(interval):
+         }
+     }
+}
+
+// get list of servers, host:port, from
+//   srv:<name>                          DNS SRV records
+//   consul:<agent ip:port>/<service>    healthy instances of consul service
+//   file:<file>                         inventory file, with settings per server
+func mdtDiscoverServers(discover string) ([]mdtTarget, error) {
+     d := strings.SplitN(discover, ":", 2)
+     if len(d) != 2 {
+         return nil, fmt.Errorf("expected srv:<name>, consul:<ip:port>/<service> or file:<file>")
+     }
+
+     var addrs []string
+     var err error
+     switch d[0] {
+     case "srv":
+         addrs, err = mdtDiscoverSrv(d[1])
+     case "consul":
+         addrs, err = mdtDiscoverConsul(d[1])
+     case "file":
+         targets, err := mdtReadInventory(d[1])
+         return mdtShardTargets(targets), err
+     default:
+         return nil, fmt.Errorf("unsupported discovery %s, Options: srv,consul,file", d[0])
+     }
+     var targets []mdtTarget
+     for _, addr := range addrs {
+         targets = append(targets, mdtTarget{addr: addr})
+     }
+     return mdtShardTargets(targets), err
+}
+
+func mdtDiscoverSrv(name string) ([]string, error) {
+     _, srvs, err := net.LookupSRV("", "", name)
+     if err != nil {
+         return nil, err
+     }
+
+     var addrs []string
+     for _, srv := range srvs {
+         host := strings.TrimSuffix(srv.Target, ".")
+         addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(int(srv.Port))))
+     }
+     return addrs, nil
+}
+
+// consul health api entry, only fields used for the address
+type consulServiceEntry struct {
+     Node struct {
+          Address string
+     }
+     Service struct {
+          Address string
+          Port    int
+     }
+}
+
+// CONSUL_HTTP_TOKEN from environment is used for the acl token, same as
+// consul cli
+func mdtDiscoverConsul(agentService string) ([]string, error) {
+     i := strings.Index(agentService, "/")
+     if i < 0 {
+         return nil, fmt.Errorf("expected consul:<ip:port>/<service>")
+     }
+     u := "http://" + agentService[:i] + "/v1/health/service/" +
+          url.PathEscape(agentService[i+1:]) + "?passing"
+
+     req, err := http.NewRequest("GET", u, nil)
+     if err != nil {
+         return nil, err
+     }
+     if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+         req.Header.Set("X-Consul-Token", token)
+     }
+     client := http.Client{Timeout: 10 * time.Second}
+     res, err := client.Do(req)
+     if err != nil {
+         return nil, err
+     }
+     defer res.Body.Close()
+     if res.StatusCode != http.StatusOK {
+         return nil, fmt.Errorf("consul %s", res.Status)
+     }
+
+     var entries []consulServiceEntry
+     if err := json.NewDecoder(res.Body).Decode(&entries); err != nil {
+         return nil, err
+     }
+
+     var addrs []string
+     for _, e := range entries {
+         host := e.Service.Address
+         if host == "" {
+             host = e.Node.Address
+         }
+         addrs = append(addrs, net.JoinHostPort(host, strconv.Itoa(e.Service.Port)))
+     }
+     return addrs, nil
+}
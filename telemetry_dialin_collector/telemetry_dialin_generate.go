@@ -0,0 +1,103 @@
+package main
+
+import (
+        "flag"
+        "fmt"
+        "log"
+        "strings"
+        "sync"
+        "sync/atomic"
+        "time"
+
+        "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// generate makes up messages and decodes them to -out as if they were
+// received, for trying outputs and their options without a router. Every
+// router, -routers of them, sends a message of each of -paths in turn, at
+// -rate messages a second, with -keys rows, interfaces, of -counters
+// counters going up with every message, in -encoding json or
+// self-describing-gpb,
+//   telemetry_dialin_collector generate -routers 10 -keys 1000 -counters 20 -rate 5 -duration 1m -out "clickhouse:127.0.0.1:8123"
+// Messages are from generate-1, generate-2 and so on, with subscription
+// generate.
+
+var (
+     generateFlags    = flag.NewFlagSet("generate", flag.ExitOnError)
+     generatePaths    = generateFlags.String("paths", loadgenPath, "Sensor paths of messages, comma separated")
+     generateRouters  = generateFlags.Int("routers", 1, "Number of routers, each one a session")
+     generateKeys     = generateFlags.Int("keys", 10, "Rows, interfaces, per message")
+     generateCounters = generateFlags.Int("counters", 4, "Counters per row")
+     generateRate     = generateFlags.Float64("rate", 10, "Messages per second per router, 0 for as fast as possible")
+     generateCount    = generateFlags.Int("count", 0, "Messages per router, no limit if not set")
+     generateDuration = generateFlags.Duration("duration", 0, "Stop after this duration, e.g. 5m, runs till interrupted or -count if not set")
+)
+
+func mdtGenerateCmd() {
+     if *encoding != "self-describing-gpb" && *encoding != "json" {
+         log.Fatalf("generate: not supported encoding: %s, Options: self-describing-gpb,json", *encoding)
+     }
+     var paths []string
+     for _, p := range strings.Split(*generatePaths, ",") {
+         if p = strings.TrimSpace(p); p != "" {
+             paths = append(paths, p)
+         }
+     }
+     if len(paths) == 0 || *generateRouters <= 0 || *generateKeys <= 0 || *generateCounters <= 0 {
+         log.Fatal("generate: -paths, -routers, -keys and -counters must be given")
+     }
+
+     done := make(chan struct{})
+     if *generateDuration > 0 {
+         time.AfterFunc(*generateDuration, func() { close(done) })
+     }
+
+     start := time.Now()
+     var sent, bytes uint64
+     var wg sync.WaitGroup
+     for i := 0; i < *generateRouters; i++ {
+         node := fmt.Sprintf("generate-%d", i + 1)
+         _, dataChan, outDone := mdtNewOut("generate " + node)
+         wg.Add(1)
+         go func() {
+             defer wg.Done()
+             defer func() {
+                 close(dataChan)
+                 <-outDone
+             }()
+             var tick <-chan time.Time
+             if *generateRate > 0 {
+                 ticker := time.NewTicker(time.Duration(float64(time.Second) / *generateRate))
+                 defer ticker.Stop()
+                 tick = ticker.C
+             }
+             for n := 0; *generateCount == 0 || n < *generateCount; n++ {
+                 // collection id goes up once all the paths are sent
+                 path := paths[n % len(paths)]
+                 data, err := telemetry_decode.MdtGenerateMessage(*encoding, node, "generate", path, uint64(n / len(paths) + 1), *generateKeys, *generateCounters)
+                 if err != nil {
+                     telemetry_log.Errorf("generate: %s: %v\n", node, err)
+                     return
+                 }
+                 select {
+                 case dataChan <- data:
+                 case <-done:
+                     return
+                 }
+                 atomic.AddUint64(&sent, 1)
+                 atomic.AddUint64(&bytes, uint64(len(data)))
+                 if tick != nil {
+                     select {
+                     case <-tick:
+                     case <-done:
+                         return
+                     }
+                 }
+             }
+         }()
+     }
+     wg.Wait()
+     telemetry_decode.MdtOutClose()
+     telemetry_log.Printf("generate: %d messages, %d bytes in %v\n", sent, bytes, time.Since(start).Round(time.Millisecond))
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "flag"
+        "fmt"
+        "io/ioutil"
+        "log"
+        "os"
+        "path/filepath"
+        "sort"
+        "strings"
+
+        "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// decode -golden <dir> checks the decoder against a corpus of messages
+// from routers. Every file of dir is a message, in -encoding, and
+// <message>.golden.json next to it the rows it is expected to decode to,
+// or the error it is expected to fail with. Rows that differ are printed
+// as a diff and decode exits 1. -update writes the golden files from what
+// is decoded now, for new messages and for intended changes, check them
+// in with the corpus,
+//   telemetry_dialin_collector decode -encoding gpb -plugin_dir ~/plugins -golden testdata/xr-7.3 -update
+//   telemetry_dialin_collector decode -encoding gpb -plugin_dir ~/plugins -golden testdata/xr-7.3
+// -yang_models, -path_map and the other transforms apply, as they do to
+// outputs of rows.
+
+var (
+     decodeFlags  = flag.NewFlagSet("decode", flag.ExitOnError)
+     decodeGolden = decodeFlags.String("golden", "", "Directory of messages and their expected rows, <message>.golden.json, the messages are checked against instead of decoded to -out")
+     decodeUpdate = decodeFlags.Bool("update", false, "With -golden, write the expected rows of the messages from what they decode to now")
+)
+
+const goldenSuffix = ".golden.json"
+
+// what a message decodes to, as kept in its golden file
+type mdtGoldenResult struct {
+     Error string                     `json:"error,omitempty"`
+     Rows  []*telemetry_decode.MdtRow `json:"rows"`
+}
+
+func mdtGoldenDecode(o *telemetry_decode.MdtOut, name string) ([]byte, error) {
+     f, err := mdtOpenInput(name)
+     if err != nil {
+         return nil, err
+     }
+     data, err := ioutil.ReadAll(f)
+     f.Close()
+     if err != nil {
+         return nil, err
+     }
+     var r mdtGoldenResult
+     if r.Rows, err = o.MdtDecodeRows(data); err != nil {
+         r.Error, r.Rows = err.Error(), nil
+     }
+     if r.Rows == nil {
+         r.Rows = []*telemetry_decode.MdtRow{}
+     }
+     b, err := json.MarshalIndent(&r, "", "  ")
+     return append(b, '\n'), err
+}
+
+// golden file as decoded output would be written, so that hand edits and
+// formatting don't show up as differences. Numbers are kept as written,
+// 64 bit counters don't go through float64.
+func mdtGoldenRead(name string) ([]byte, error) {
+     b, err := ioutil.ReadFile(name)
+     if err != nil {
+         return nil, err
+     }
+     var r mdtGoldenResult
+     d := json.NewDecoder(bytes.NewReader(b))
+     d.UseNumber()
+     if err = d.Decode(&r); err != nil {
+         return nil, fmt.Errorf("%s: %v", name, err)
+     }
+     if r.Rows == nil {
+         r.Rows = []*telemetry_decode.MdtRow{}
+     }
+     b, err = json.MarshalIndent(&r, "", "  ")
+     return append(b, '\n'), err
+}
+
+// lines of a, expected, and b, got, that differ, - for a and + for b,
+// with a line around them
+func mdtGoldenDiff(a, b string) string {
+     al := strings.Split(strings.TrimSuffix(a, "\n"), "\n")
+     bl := strings.Split(strings.TrimSuffix(b, "\n"), "\n")
+     if len(al) * len(bl) > 16 << 20 {
+         // too big for a diff, first line that differs
+         for i := 0; i < len(al) && i < len(bl); i++ {
+             if al[i] != bl[i] {
+                 return fmt.Sprintf("  line %d\n- %s\n+ %s\n", i + 1, al[i], bl[i])
+             }
+         }
+         return fmt.Sprintf("  %d lines expected, %d decoded\n", len(al), len(bl))
+     }
+     // longest common subsequence of lines, from the end
+     lcs := make([][]int, len(al) + 1)
+     for i := range lcs {
+         lcs[i] = make([]int, len(bl) + 1)
+     }
+     for i := len(al) - 1; i >= 0; i-- {
+         for j := len(bl) - 1; j >= 0; j-- {
+             if al[i] == bl[j] {
+                 lcs[i][j] = lcs[i + 1][j + 1] + 1
+             } else if lcs[i + 1][j] >= lcs[i][j + 1] {
+                 lcs[i][j] = lcs[i + 1][j]
+             } else {
+                 lcs[i][j] = lcs[i][j + 1]
+             }
+         }
+     }
+     type line struct {
+          op   byte
+          text string
+     }
+     var lines []line
+     i, j := 0, 0
+     for i < len(al) || j < len(bl) {
+         switch {
+         case i < len(al) && j < len(bl) && al[i] == bl[j]:
+             lines = append(lines, line{' ', al[i]})
+             i++
+             j++
+         case i < len(al) && (j == len(bl) || lcs[i + 1][j] >= lcs[i][j + 1]):
+             lines = append(lines, line{'-', al[i]})
+             i++
+         default:
+             lines = append(lines, line{'+', bl[j]})
+             j++
+         }
+     }
+     var sb strings.Builder
+     skipped := false
+     for k, l := range lines {
+         near := l.op != ' ' || (k > 0 && lines[k - 1].op != ' ') || (k + 1 < len(lines) && lines[k + 1].op != ' ')
+         if near {
+             fmt.Fprintf(&sb, "%c %s\n", l.op, l.text)
+             skipped = false
+         } else if !skipped {
+             sb.WriteString("  ...\n")
+             skipped = true
+         }
+     }
+     return sb.String()
+}
+
+func mdtGoldenCmd() {
+     entries, err := ioutil.ReadDir(*decodeGolden)
+     if err != nil {
+         log.Fatalf("decode: %v", err)
+     }
+     var messages []string
+     for _, e := range entries {
+         if e.Mode().IsRegular() && !strings.HasSuffix(e.Name(), goldenSuffix) {
+             messages = append(messages, e.Name())
+         }
+     }
+     sort.Strings(messages)
+     if len(messages) == 0 {
+         log.Fatalf("decode: no messages in %s", *decodeGolden)
+     }
+
+     o := &telemetry_decode.MdtOut{
+                        Name:        "golden",
+                        Encoding:    *encoding,
+                        ProtoFile:   *protoFile,
+                        PluginDir:   *pluginDir,
+                        PluginFile:  *pluginFile,
+     }
+     var failed, updated int
+     for _, m := range messages {
+         name := filepath.Join(*decodeGolden, m)
+         got, err := mdtGoldenDecode(o, name)
+         if err != nil {
+             log.Fatalf("decode: %s: %v", name, err)
+         }
+         golden := name + goldenSuffix
+         if *decodeUpdate {
+             if old, err := mdtGoldenRead(golden); err == nil && string(old) == string(got) {
+                 continue
+             }
+             if err = ioutil.WriteFile(golden, got, 0644); err != nil {
+                 log.Fatalf("decode: %v", err)
+             }
+             telemetry_log.Printf("updated %s\n", golden)
+             updated++
+             continue
+         }
+         want, err := mdtGoldenRead(golden)
+         if os.IsNotExist(err) {
+             fmt.Printf("FAIL %s: no %s, write it with -update\n", m, filepath.Base(golden))
+             failed++
+             continue
+         }
+         if err != nil {
+             log.Fatalf("decode: %v", err)
+         }
+         if string(want) != string(got) {
+             fmt.Printf("FAIL %s\n%s", m, mdtGoldenDiff(string(want), string(got)))
+             failed++
+             continue
+         }
+         telemetry_log.Debugf("ok   %s\n", m)
+     }
+     if *decodeUpdate {
+         telemetry_log.Printf("decode: %d messages, %d golden files updated\n", len(messages), updated)
+         return
+     }
+     telemetry_log.Printf("decode: %d messages, %d ok, %d failed\n", len(messages), len(messages) - failed, failed)
+     if failed != 0 {
+         os.Exit(1)
+     }
+}
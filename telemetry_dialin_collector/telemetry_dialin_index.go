@@ -0,0 +1,344 @@
+package main
+
+import (
+        "encoding/json"
+        "flag"
+        "fmt"
+        "io"
+        "io/ioutil"
+        "log"
+        "os"
+        "path/filepath"
+        "regexp"
+        "sort"
+        "strings"
+        "time"
+
+        "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// index reads captures, as replayed, and keeps what is in each of them,
+// message count and time range, in all and per router and sensor path, in
+// an index file. Captures indexed before are read again only if they
+// changed. search writes the messages of captures matching -router and
+// -path regexps and -from/-to to -out, reading only the captures the
+// index says have them,
+//   telemetry_dialin_collector index -index /archive/mdt.idx /archive/*.bin
+//   telemetry_dialin_collector search -index /archive/mdt.idx -path bgp.*neighbor -from 10:00 -to 10:15 -out bgp.json
+// search without -index reads the captures given. Times are message
+// timestamps, as 2006-01-02T15:04:05Z07:00, "2006-01-02 15:04[:05]" or
+// 15:04[:05] of today, local time unless a zone is given.
+
+var (
+     indexFlags    = flag.NewFlagSet("index", flag.ExitOnError)
+     indexFile     = indexFlags.String("index", "mdt.idx", "Index file, updated with the captures given")
+
+     searchFlags   = flag.NewFlagSet("search", flag.ExitOnError)
+     searchIndex   = searchFlags.String("index", "", "Index file of the captures, all of them are searched if no captures are given")
+     searchRouter  = searchFlags.String("router", "", "Regexp of node id of messages, all routers if not set")
+     searchPath    = searchFlags.String("path", "", "Regexp of sensor path of messages, all paths if not set")
+     searchFrom    = searchFlags.String("from", "", "Messages from this time on")
+     searchTo      = searchFlags.String("to", "", "Messages up to this time")
+     searchList    = searchFlags.Bool("list", false, "List captures having matching messages, instead of writing the messages")
+)
+
+// messages of a capture, a router or a sensor path
+type mdtIndexRange struct {
+     Messages int       `json:"messages"`
+     First    time.Time `json:"first"`
+     Last     time.Time `json:"last"`
+}
+
+type mdtCaptureIndex struct {
+     File     string                    `json:"file"`
+     Size     int64                     `json:"size"`
+     ModTime  time.Time                 `json:"mod_time"`
+     Encoding string                    `json:"encoding"`
+     mdtIndexRange
+     Routers  map[string]*mdtIndexRange `json:"routers"`
+     Paths    map[string]*mdtIndexRange `json:"paths"`
+}
+
+func (r *mdtIndexRange) add(t time.Time) {
+     if r.Messages == 0 || t.Before(r.First) {
+         r.First = t
+     }
+     if r.Messages == 0 || t.After(r.Last) {
+         r.Last = t
+     }
+     r.Messages++
+}
+
+func (r *mdtIndexRange) overlaps(from, to time.Time) bool {
+     return r.Messages != 0 && (from.IsZero() || !r.Last.Before(from)) && (to.IsZero() || !r.First.After(to))
+}
+
+// messages of a capture, fn is called with every data message and its
+// header, messages that fail to decode are skipped
+func mdtScanCapture(name string, fn func(encoding string, data []byte, node, path string, t time.Time) error) error {
+     f, err := mdtOpenInput(name)
+     if err != nil {
+         return err
+     }
+     defer f.Close()
+     for n := 1; ; n++ {
+         msgType, encap, buf, err := mdtReadTcpMessage(f)
+         if err == io.EOF {
+             return nil
+         }
+         if err != nil {
+             return fmt.Errorf("%s: message %d: %v", name, n, err)
+         }
+         if msgType != tcpMsgTypeData {
+             continue
+         }
+         encoding := mdtTcpEncoding(encap)
+         node, path, timestamp, _, err := telemetry_decode.MdtMessageHeader(encoding, buf)
+         if err != nil {
+             telemetry_log.Debugf("%s: message %d: %v\n", name, n, err)
+             continue
+         }
+         t := time.Unix(0, int64(timestamp) * int64(time.Millisecond))
+         if err := fn(encoding, buf, node, path, t); err != nil {
+             return err
+         }
+     }
+}
+
+func mdtIndexCapture(name string, fi os.FileInfo) (*mdtCaptureIndex, error) {
+     c := &mdtCaptureIndex{
+              File:    name,
+              Size:    fi.Size(),
+              ModTime: fi.ModTime(),
+              Routers: make(map[string]*mdtIndexRange),
+              Paths:   make(map[string]*mdtIndexRange),
+     }
+     err := mdtScanCapture(name, func(encoding string, data []byte, node, path string, t time.Time) error {
+              c.Encoding = encoding
+              c.add(t)
+              if c.Routers[node] == nil {
+                  c.Routers[node] = &mdtIndexRange{}
+              }
+              c.Routers[node].add(t)
+              if c.Paths[path] == nil {
+                  c.Paths[path] = &mdtIndexRange{}
+              }
+              c.Paths[path].add(t)
+              return nil
+          })
+     return c, err
+}
+
+func mdtReadIndex(fileName string) (map[string]*mdtCaptureIndex, error) {
+     index := make(map[string]*mdtCaptureIndex)
+     data, err := ioutil.ReadFile(fileName)
+     if err != nil {
+         return index, err
+     }
+     var captures []*mdtCaptureIndex
+     if err = json.Unmarshal(data, &captures); err != nil {
+         return index, fmt.Errorf("%s: %v", fileName, err)
+     }
+     for _, c := range captures {
+         index[c.File] = c
+     }
+     return index, nil
+}
+
+func mdtWriteIndex(fileName string, index map[string]*mdtCaptureIndex) error {
+     var captures []*mdtCaptureIndex
+     for _, c := range index {
+         captures = append(captures, c)
+     }
+     sort.Slice(captures, func(i, j int) bool { return captures[i].File < captures[j].File })
+     data, err := json.MarshalIndent(captures, "", "  ")
+     if err != nil {
+         return err
+     }
+     tmp := fileName + ".tmp"
+     if err = ioutil.WriteFile(tmp, append(data, '\n'), 0644); err != nil {
+         return err
+     }
+     return os.Rename(tmp, fileName)
+}
+
+func mdtIndexCmd() {
+     if len(mdtCommandArgs) == 0 {
+         log.Fatal("index: no captures given")
+     }
+     index, err := mdtReadIndex(*indexFile)
+     if err != nil && !os.IsNotExist(err) {
+         log.Fatalf("index: %v", err)
+     }
+     for _, name := range mdtCommandArgs {
+         // captures are kept by absolute path, index can be used from
+         // anywhere
+         if abs, err := filepath.Abs(name); err == nil {
+             name = abs
+         }
+         fi, err := os.Stat(name)
+         if err != nil {
+             log.Fatalf("index: %v", err)
+         }
+         if c := index[name]; c != nil && c.Size == fi.Size() && c.ModTime.Equal(fi.ModTime()) {
+             telemetry_log.Debugf("index: %s: not changed\n", name)
+             continue
+         }
+         c, err := mdtIndexCapture(name, fi)
+         if err != nil {
+             // indexed up to the error, a capture cut short by the end of
+             // the session is still searchable
+             telemetry_log.Errorf("index: %v\n", err)
+         }
+         index[name] = c
+         telemetry_log.Printf("index: %s: %d messages, %d routers, %d paths, %s - %s\n", name, c.Messages,
+                              len(c.Routers), len(c.Paths), telemetry_log.Time(c.First), telemetry_log.Time(c.Last))
+     }
+     if err := mdtWriteIndex(*indexFile, index); err != nil {
+         log.Fatalf("index: %v", err)
+     }
+}
+
+// time of -from or -to, zero if not set. -to of a minute, 10:15, or of a
+// day is up to the end of it.
+func mdtParseSearchTime(value string, end bool) (time.Time, error) {
+     if value == "" {
+         return time.Time{}, nil
+     }
+     if t, err := time.Parse(time.RFC3339, value); err == nil {
+         return t, nil
+     }
+     layouts := []struct {
+          layout string
+          span   time.Duration
+     }{
+          {"2006-01-02 15:04:05", time.Second},
+          {"2006-01-02 15:04", time.Minute},
+          {"2006-01-02", 24 * time.Hour},
+          {"15:04:05", time.Second},
+          {"15:04", time.Minute},
+     }
+     for _, l := range layouts {
+         t, err := time.ParseInLocation(l.layout, value, time.Local)
+         if err != nil {
+             continue
+         }
+         if !strings.HasPrefix(l.layout, "2006") {
+             y, m, d := time.Now().Date()
+             t = time.Date(y, m, d, t.Hour(), t.Minute(), t.Second(), 0, time.Local)
+         }
+         if end {
+             t = t.Add(l.span - time.Millisecond)
+         }
+         return t, nil
+     }
+     return time.Time{}, fmt.Errorf("unsupported time %s, expected 2006-01-02T15:04:05Z07:00, \"2006-01-02 15:04[:05]\" or 15:04[:05]", value)
+}
+
+// true if any of the names matching re has messages within from and to
+func mdtIndexMatch(ranges map[string]*mdtIndexRange, re *regexp.Regexp, from, to time.Time) bool {
+     for name, r := range ranges {
+         if (re == nil || re.MatchString(name)) && r.overlaps(from, to) {
+             return true
+         }
+     }
+     return false
+}
+
+func mdtSearchCmd() {
+     from, err := mdtParseSearchTime(*searchFrom, false)
+     if err != nil {
+         log.Fatalf("search: -from: %v", err)
+     }
+     to, err := mdtParseSearchTime(*searchTo, true)
+     if err != nil {
+         log.Fatalf("search: -to: %v", err)
+     }
+     var routerRe, pathRe *regexp.Regexp
+     if *searchRouter != "" {
+         if routerRe, err = regexp.Compile(*searchRouter); err != nil {
+             log.Fatalf("search: -router: %v", err)
+         }
+     }
+     if *searchPath != "" {
+         if pathRe, err = regexp.Compile(*searchPath); err != nil {
+             log.Fatalf("search: -path: %v", err)
+         }
+     }
+
+     captures := mdtCommandArgs
+     if *searchIndex != "" {
+         index, err := mdtReadIndex(*searchIndex)
+         if err != nil {
+             log.Fatalf("search: %v", err)
+         }
+         if len(captures) == 0 {
+             for name := range index {
+                 captures = append(captures, name)
+             }
+             sort.Strings(captures)
+         }
+         var matching []string
+         for _, name := range captures {
+             if abs, err := filepath.Abs(name); err == nil {
+                 name = abs
+             }
+             c := index[name]
+             if c == nil {
+                 telemetry_log.Errorf("search: %s is not in the index, run index first\n", name)
+                 continue
+             }
+             if c.overlaps(from, to) && mdtIndexMatch(c.Routers, routerRe, from, to) && mdtIndexMatch(c.Paths, pathRe, from, to) {
+                 matching = append(matching, name)
+             }
+         }
+         telemetry_log.Debugf("search: %d of %d captures to read\n", len(matching), len(captures))
+         captures = matching
+     } else if len(captures) == 0 {
+         log.Fatal("search: no captures or -index given")
+     }
+
+     // an output per encoding, captures of a collector have the same one
+     type searchOut struct {
+          dataChan chan []byte
+          done     chan struct{}
+     }
+     outs := make(map[string]*searchOut)
+     total := 0
+     for _, name := range captures {
+         n := 0
+         err := mdtScanCapture(name, func(enc string, data []byte, node, path string, t time.Time) error {
+                  if (routerRe != nil && !routerRe.MatchString(node)) || (pathRe != nil && !pathRe.MatchString(path)) ||
+                     (!from.IsZero() && t.Before(from)) || (!to.IsZero() && t.After(to)) {
+                      return nil
+                  }
+                  n++
+                  if *searchList {
+                      return nil
+                  }
+                  out := outs[enc]
+                  if out == nil {
+                      *encoding = enc
+                      out = &searchOut{}
+                      _, out.dataChan, out.done = mdtNewOut("search " + enc)
+                      outs[enc] = out
+                  }
+                  out.dataChan <- data
+                  return nil
+              })
+         if err != nil {
+             telemetry_log.Errorf("search: %v\n", err)
+         }
+         if *searchList && n > 0 {
+             fmt.Printf("%s %d\n", name, n)
+         }
+         total += n
+     }
+     for _, out := range outs {
+         close(out.dataChan)
+         <-out.done
+     }
+     telemetry_decode.MdtOutClose()
+     telemetry_log.Printf("search: %d messages in %d captures\n", total, len(captures))
+}
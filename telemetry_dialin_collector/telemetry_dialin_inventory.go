@@ -0,0 +1,138 @@
+package main
+
+import (
+        "bufio"
+        "crypto/tls"
+        "fmt"
+        "os"
+        "strings"
+        "sync"
+
+        "github.com/ios-xr/telemetry-go-collector/telemetry_admin"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+)
+
+// Inventory file, -discover file:<file>, has a server per line and the
+// settings it does not share with the rest, those not set are taken from
+// the options,
+//   # server [option=value ...]
+//   192.168.122.157:57500 username=root password=@/run/secrets/r1
+//   10.1.1.1:57400 cert=ems-r2.pem server_host_override=r2.lab encoding=gpb
+//   10.1.1.2:57400 token_file=/run/secrets/r3-token
+// Values can be @file. File is read again every -discover_interval, a
+// session whose settings changed is restarted.
+
+// server to subscribe to, settings not set are those of the options
+type mdtTarget struct {
+     addr               string
+     username           string
+     password           string
+     tokenFile          string
+     cert               string
+     serverHostOverride string
+     encoding           string
+}
+
+func mdtReadInventory(fileName string) ([]mdtTarget, error) {
+     f, err := os.Open(fileName)
+     if err != nil {
+         return nil, err
+     }
+     defer f.Close()
+
+     var targets []mdtTarget
+     seen := make(map[string]bool)
+     scanner := bufio.NewScanner(f)
+     for n := 1; scanner.Scan(); n++ {
+         fields := strings.Fields(scanner.Text())
+         if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+             continue
+         }
+         t := mdtTarget{addr: fields[0]}
+         if _, _, err := mdtServerTarget(t.addr); err != nil {
+             return nil, fmt.Errorf("%s:%d: %v", fileName, n, err)
+         }
+         if seen[t.addr] {
+             return nil, fmt.Errorf("%s:%d: %s is already in the inventory", fileName, n, t.addr)
+         }
+         seen[t.addr] = true
+         for _, field := range fields[1:] {
+             kv := strings.SplitN(field, "=", 2)
+             if len(kv) != 2 {
+                 return nil, fmt.Errorf("%s:%d: expected option=value, got %q", fileName, n, field)
+             }
+             value, err := telemetry_admin.FileValue(kv[1])
+             if err != nil {
+                 return nil, fmt.Errorf("%s:%d: %s: %v", fileName, n, kv[0], err)
+             }
+             switch kv[0] {
+             case "username":
+                 t.username = value
+             case "password":
+                 t.password = value
+             case "token_file":
+                 t.tokenFile = value
+             case "cert":
+                 t.cert = value
+             case "server_host_override":
+                 t.serverHostOverride = value
+             case "encoding":
+                 if _, ok := telemetryEncoding[value]; !ok {
+                     return nil, fmt.Errorf("%s:%d: not supported encoding %s", fileName, n, value)
+                 }
+                 t.encoding = value
+             default:
+                 return nil, fmt.Errorf("%s:%d: unknown option %s, Options: username,password,token_file,cert,server_host_override,encoding",
+                                        fileName, n, kv[0])
+             }
+         }
+         targets = append(targets, t)
+     }
+     return targets, scanner.Err()
+}
+
+// true if target has settings of its own
+func (t *mdtTarget) own() bool {
+     return *t != mdtTarget{addr: t.addr}
+}
+
+// TLS configs and token credentials of targets, shared by the servers
+// using the same files and kept across session restarts, as both reload
+// their files for as long as the collector runs
+var mdtTargetCreds = struct {
+    sync.Mutex
+    tls    map[string]*tls.Config
+    tokens map[string]*tokenCredential
+}{tls: make(map[string]*tls.Config), tokens: make(map[string]*tokenCredential)}
+
+func mdtTargetTLS(certFile, serverName string) (*tls.Config, error) {
+     mdtTargetCreds.Lock()
+     defer mdtTargetCreds.Unlock()
+     key := certFile + " " + serverName
+     if c, ok := mdtTargetCreds.tls[key]; ok {
+         return c, nil
+     }
+     c, err := telemetry_tls.NewClientConfig(certFile, serverName, *tlsReload)
+     if err != nil {
+         return nil, err
+     }
+     mdtTargetCreds.tls[key] = c
+     return c, nil
+}
+
+func mdtTargetToken(token, tokenFile string) (*tokenCredential, error) {
+     if tokenFile == "" {
+         return mdtNewTokenCredential(token, "", 0)
+     }
+     mdtTargetCreds.Lock()
+     defer mdtTargetCreds.Unlock()
+     if c, ok := mdtTargetCreds.tokens[tokenFile]; ok {
+         return c, nil
+     }
+     c, err := mdtNewTokenCredential("", tokenFile, *tokenRefresh)
+     if err != nil {
+         return nil, err
+     }
+     mdtTargetCreds.tokens[tokenFile] = c
+     return c, nil
+}
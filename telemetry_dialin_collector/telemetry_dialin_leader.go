@@ -0,0 +1,237 @@
+package main
+
+import (
+        "bytes"
+        "encoding/json"
+        "fmt"
+        "io"
+        "io/ioutil"
+        "net/http"
+        "os"
+        "strings"
+        "sync"
+        "time"
+
+        "golang.org/x/net/context"
+
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// With -leader_lock, collectors run with the same options and only the one
+// holding the lock, the leader, keeps sessions to the servers, the rest
+// stand by and one of them takes over when the leader goes away. Lock is a
+// key in Consul,
+//   -leader_lock consul:<agent ip:port>/<key>
+// held by a Consul session with a TTL that the leader renews. A leader that
+// cannot renew it within the TTL steps down, so two collectors are not
+// both leader for long when Consul is unreachable. CONSUL_HTTP_TOKEN from
+// environment is used for the acl token, same as consul cli.
+
+const mdtLeaderTTL = 15 * time.Second
+
+type mdtConsulLock struct {
+     agent   string
+     key     string
+
+     mu      sync.Mutex
+     session string
+}
+
+// lock of this collector, released on exit
+var mdtLeaderLock *mdtConsulLock
+
+func mdtNewLeaderLock(spec string) (*mdtConsulLock, error) {
+     d := strings.SplitN(spec, ":", 2)
+     if len(d) != 2 {
+         return nil, fmt.Errorf("expected consul:<ip:port>/<key>")
+     }
+     if d[0] != "consul" {
+         return nil, fmt.Errorf("unsupported lock %s, Options: consul", d[0])
+     }
+     i := strings.Index(d[1], "/")
+     if i <= 0 || i == len(d[1]) - 1 {
+         return nil, fmt.Errorf("expected consul:<ip:port>/<key>")
+     }
+     return &mdtConsulLock{agent: d[1][:i], key: d[1][i+1:]}, nil
+}
+
+// consul http api request, reply is decoded into v if not nil
+func (l *mdtConsulLock) call(method, path string, body []byte, v interface{}) error {
+     req, err := http.NewRequest(method, "http://" + l.agent + path, bytes.NewReader(body))
+     if err != nil {
+         return err
+     }
+     if token := os.Getenv("CONSUL_HTTP_TOKEN"); token != "" {
+         req.Header.Set("X-Consul-Token", token)
+     }
+     client := http.Client{Timeout: 5 * time.Second}
+     res, err := client.Do(req)
+     if err != nil {
+         return err
+     }
+     defer res.Body.Close()
+     if res.StatusCode != http.StatusOK {
+         msg, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+         return fmt.Errorf("consul %s %s: %s %s", method, path, res.Status, strings.TrimSpace(string(msg)))
+     }
+     if v == nil {
+         return nil
+     }
+     return json.NewDecoder(res.Body).Decode(v)
+}
+
+// take the lock if it is free, true if held
+func (l *mdtConsulLock) acquire() (bool, error) {
+     l.mu.Lock()
+     defer l.mu.Unlock()
+     host, _ := os.Hostname()
+     if l.session == "" {
+         b, _ := json.Marshal(map[string]string{
+                                  "Name":      "telemetry-go-collector " + host,
+                                  "TTL":       mdtLeaderTTL.String(),
+                                  "Behavior":  "release",
+                                  "LockDelay": "1s",
+                              })
+         var s struct {
+             ID string
+         }
+         if err := l.call("PUT", "/v1/session/create", b, &s); err != nil {
+             return false, err
+         }
+         l.session = s.ID
+     }
+     var held bool
+     err := l.call("PUT", "/v1/kv/" + l.key + "?acquire=" + l.session, []byte(host), &held)
+     if err != nil && mdtConsulInvalidSession(err) {
+         // session expired or was destroyed, a new one is created next time
+         l.session = ""
+     }
+     return held, err
+}
+
+// consul reply to a session id it does not know
+func mdtConsulInvalidSession(err error) bool {
+     msg := strings.ToLower(err.Error())
+     return strings.Contains(msg, "404") || strings.Contains(msg, "invalid session") ||
+            strings.Contains(msg, "session not found")
+}
+
+// renew the session and check the lock is still held by it
+func (l *mdtConsulLock) renew() (bool, error) {
+     l.mu.Lock()
+     defer l.mu.Unlock()
+     if l.session == "" {
+         return false, nil
+     }
+     if err := l.call("PUT", "/v1/session/renew/" + l.session, nil, nil); err != nil {
+         if mdtConsulInvalidSession(err) {
+             // session expired, lock is released
+             l.session = ""
+             return false, nil
+         }
+         return false, err
+     }
+     var kv []struct {
+         Session string
+     }
+     if err := l.call("GET", "/v1/kv/" + l.key, nil, &kv); err != nil {
+         return false, err
+     }
+     return len(kv) == 1 && kv[0].Session == l.session, nil
+}
+
+// forget a session that can't be renewed, destroyed if consul is reachable,
+// so acquire creates a new one
+func (l *mdtConsulLock) drop() {
+     l.mu.Lock()
+     defer l.mu.Unlock()
+     if l.session == "" {
+         return
+     }
+     if err := l.call("PUT", "/v1/session/destroy/" + l.session, nil, nil); err != nil {
+         telemetry_log.Debugf("Leader: %v\n", err)
+     }
+     l.session = ""
+}
+
+// release the lock and destroy the session, next leader takes over
+func (l *mdtConsulLock) release() {
+     l.mu.Lock()
+     defer l.mu.Unlock()
+     if l.session == "" {
+         return
+     }
+     if err := l.call("PUT", "/v1/kv/" + l.key + "?release=" + l.session, nil, nil); err != nil {
+         telemetry_log.Errorf("Leader: %v\n", err)
+     }
+     if err := l.call("PUT", "/v1/session/destroy/" + l.session, nil, nil); err != nil {
+         telemetry_log.Errorf("Leader: %v\n", err)
+     }
+     l.session = ""
+}
+
+// run while leader, run is cancelled when the lock is lost and run again
+// once it is taken back. Returns when run ends on its own.
+func mdtLeaderLoop(l *mdtConsulLock, run func(ctx context.Context)) {
+     mdtLeaderLock = l
+     standby := false
+     for {
+         held, err := l.acquire()
+         if err != nil {
+             telemetry_log.Errorf("Leader: %v\n", err)
+         }
+         if !held {
+             if err == nil && !standby {
+                 telemetry_log.Printf("Leader: lock %s is held by another collector, standing by\n", l.key)
+                 standby = true
+             }
+             time.Sleep(mdtLeaderTTL / 3)
+             continue
+         }
+         standby = false
+         telemetry_log.Printf("Leader: took lock %s, starting sessions\n", l.key)
+
+         ctx, cancel := context.WithCancel(context.Background())
+         done := make(chan struct{})
+         go func() {
+             run(ctx)
+             close(done)
+         }()
+         if l.keep(done) {
+             cancel()
+             l.release()
+             return
+         }
+         telemetry_log.Errorf("Leader: lost lock %s, stopping sessions\n", l.key)
+         cancel()
+         <-done
+     }
+}
+
+// renew the lock till done is closed, true, or the lock is lost, false
+func (l *mdtConsulLock) keep(done <-chan struct{}) bool {
+     renewed := time.Now()
+     t := time.NewTicker(mdtLeaderTTL / 3)
+     defer t.Stop()
+     for {
+         select {
+         case <-done:
+             return true
+         case <-t.C:
+         }
+         held, err := l.renew()
+         if err != nil {
+             telemetry_log.Errorf("Leader: %v\n", err)
+             if time.Since(renewed) > mdtLeaderTTL {
+                 // session has likely expired, other collector may lead
+                 l.drop()
+                 return false
+             }
+             continue
+         }
+         if !held {
+             return false
+         }
+         renewed = time.Now()
+     }
+}
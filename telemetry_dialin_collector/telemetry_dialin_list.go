@@ -0,0 +1,226 @@
+package main
+
+import (
+        "encoding/json"
+        "fmt"
+        "io"
+        "log"
+        "os"
+        "sort"
+        "strings"
+
+        "golang.org/x/net/context"
+
+        MdtDialin "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialin"
+)
+
+// list command prints the subscriptions configured on the router, with
+// their sensor groups, sample intervals and sensor paths, and the state
+// of every subscription, from the telemetry model driven config and oper
+// models, so what to subscribe to is known without console access.
+
+const (
+      mdtCfgModel  = "Cisco-IOS-XR-telemetry-model-driven-cfg:telemetry-model-driven"
+      mdtOperModel = "Cisco-IOS-XR-telemetry-model-driven-oper:telemetry-model-driven"
+)
+
+type mdtListSubscription struct {
+     name     string
+     state    string
+     profiles []mdtListProfile
+}
+
+type mdtListProfile struct {
+     group    string
+     interval float64
+}
+
+func mdtListCmd() {
+     conn, err := mdtDial(context.Background(), *serverAddr, mdtDialOptions())
+     if err != nil {
+        log.Fatalf("fail to dial: %v", err)
+     }
+     defer conn.Close()
+     client := MdtDialin.NewGRPCConfigOperClient(conn)
+
+     cfg, err := mdtGetConfig(client, `{"` + mdtCfgModel + `": [null]}`)
+     if err != nil {
+        log.Fatalf("List: %v", err)
+     }
+     telemetry := mdtJsonData(cfg, mdtCfgModel)
+
+     // state is informational, config is listed without it
+     var states map[string]string
+     if oper, err := mdtGetOper(client, `{"` + mdtOperModel + `": {"subscriptions": [null]}}`); err == nil {
+        states = mdtListStates(mdtJsonData(oper, mdtOperModel))
+     }
+
+     groups := map[string][]string{}
+     for _, g := range mdtJsonList(mdtJsonPath(telemetry, "sensor-groups", "sensor-group")) {
+         var paths []string
+         for _, p := range mdtJsonList(mdtJsonPath(g, "sensor-paths", "sensor-path")) {
+             if path, ok := p["telemetry-sensor-path"].(string); ok {
+                 paths = append(paths, path)
+             }
+         }
+         if name, ok := g["sensor-group-identifier"].(string); ok {
+             groups[name] = paths
+         }
+     }
+
+     var subs []mdtListSubscription
+     for _, s := range mdtJsonList(mdtJsonPath(telemetry, "subscriptions", "subscription")) {
+         name, _ := s["subscription-identifier"].(string)
+         sub := mdtListSubscription{name: name, state: states[name]}
+         for _, p := range mdtJsonList(mdtJsonPath(s, "sensor-profiles", "sensor-profile")) {
+             group, _ := p["sensorgroupid"].(string)
+             interval, _ := p["sample-interval"].(float64)
+             sub.profiles = append(sub.profiles, mdtListProfile{group: group, interval: interval})
+         }
+         subs = append(subs, sub)
+     }
+     mdtListPrint(os.Stdout, subs, groups)
+}
+
+func mdtListPrint(w io.Writer, subs []mdtListSubscription, groups map[string][]string) {
+     used := map[string]bool{}
+     sort.Slice(subs, func(i, j int) bool { return subs[i].name < subs[j].name })
+     for _, s := range subs {
+         state := ""
+         if s.state != "" {
+             state = " (" + s.state + ")"
+         }
+         fmt.Fprintf(w, "subscription %s%s\n", s.name, state)
+         for _, p := range s.profiles {
+             used[p.group] = true
+             if p.interval > 0 {
+                 fmt.Fprintf(w, "  sensor-group %s, sample interval %gms\n", p.group, p.interval)
+             } else {
+                 fmt.Fprintf(w, "  sensor-group %s, event driven\n", p.group)
+             }
+             for _, path := range groups[p.group] {
+                 fmt.Fprintf(w, "    %s\n", path)
+             }
+         }
+     }
+
+     // groups no subscription uses yet
+     var names []string
+     for name := range groups {
+         if !used[name] {
+             names = append(names, name)
+         }
+     }
+     sort.Strings(names)
+     for _, name := range names {
+         fmt.Fprintf(w, "sensor-group %s, not in a subscription\n", name)
+         for _, path := range groups[name] {
+             fmt.Fprintf(w, "  %s\n", path)
+         }
+     }
+     if len(subs) == 0 && len(groups) == 0 {
+         fmt.Fprintf(w, "No model driven telemetry configured\n")
+     }
+}
+
+// state of subscriptions, by name
+func mdtListStates(telemetry map[string]interface{}) map[string]string {
+     states := map[string]string{}
+     for _, s := range mdtJsonList(mdtJsonPath(telemetry, "subscriptions", "subscription")) {
+         name, _ := s["subscription-id"].(string)
+         state, ok := mdtJsonPath(s, "subscription", "state").(string)
+         if !ok {
+             state, _ = s["state"].(string)
+         }
+         if name != "" {
+             states[name] = strings.TrimPrefix(state, "subscription-state-")
+         }
+     }
+     return states
+}
+
+func mdtGetConfig(client MdtDialin.GRPCConfigOperClient, path string) (string, error) {
+     ctx, cancel := mdtRpcContext(context.Background())
+     defer cancel()
+     stream, err := client.GetConfig(ctx, &MdtDialin.ConfigGetArgs{ReqId: reqId, Yangpathjson: path})
+     if err != nil {
+        return "", fmt.Errorf("GetConfig: ReqId %d, %v", reqId, err)
+     }
+     var b strings.Builder
+     for {
+         reply, err := stream.Recv()
+         if err == io.EOF {
+            return b.String(), nil
+         }
+         if err != nil {
+            return "", fmt.Errorf("GetConfig: ReqId %d, %v", reqId, err)
+         }
+         if len(reply.Errors) != 0 {
+            return "", fmt.Errorf("GetConfig: ReqId %d, received error: %s", reqId, reply.Errors)
+         }
+         b.WriteString(reply.Yangjson)
+     }
+}
+
+func mdtGetOper(client MdtDialin.GRPCConfigOperClient, path string) (string, error) {
+     ctx, cancel := mdtRpcContext(context.Background())
+     defer cancel()
+     stream, err := client.GetOper(ctx, &MdtDialin.GetOperArgs{ReqId: reqId, Yangpathjson: path})
+     if err != nil {
+        return "", fmt.Errorf("GetOper: ReqId %d, %v", reqId, err)
+     }
+     var b strings.Builder
+     for {
+         reply, err := stream.Recv()
+         if err == io.EOF {
+            return b.String(), nil
+         }
+         if err != nil {
+            return "", fmt.Errorf("GetOper: ReqId %d, %v", reqId, err)
+         }
+         if len(reply.Errors) != 0 {
+            return "", fmt.Errorf("GetOper: ReqId %d, received error: %s", reqId, reply.Errors)
+         }
+         b.WriteString(reply.Yangjson)
+     }
+}
+
+// model of a reply, with or without the "data" around it
+func mdtJsonData(reply, model string) map[string]interface{} {
+     var v map[string]interface{}
+     if err := json.Unmarshal([]byte(reply), &v); err != nil {
+         return nil
+     }
+     if data, ok := v["data"].(map[string]interface{}); ok {
+         v = data
+     }
+     m, _ := v[model].(map[string]interface{})
+     return m
+}
+
+func mdtJsonPath(v interface{}, names ...string) interface{} {
+     for _, name := range names {
+         m, ok := v.(map[string]interface{})
+         if !ok {
+             return nil
+         }
+         v = m[name]
+     }
+     return v
+}
+
+// list of objects, a single object is a list of one
+func mdtJsonList(v interface{}) []map[string]interface{} {
+     var l []map[string]interface{}
+     switch v := v.(type) {
+     case []interface{}:
+         for _, e := range v {
+             if m, ok := e.(map[string]interface{}); ok {
+                 l = append(l, m)
+             }
+         }
+     case map[string]interface{}:
+         l = append(l, v)
+     }
+     return l
+}
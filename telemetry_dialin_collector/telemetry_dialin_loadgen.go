@@ -0,0 +1,193 @@
+package main
+
+import (
+       "encoding/binary"
+       "flag"
+       "fmt"
+       "log"
+       "net"
+       "sync"
+       "sync/atomic"
+       "time"
+
+       "golang.org/x/net/context"
+       "google.golang.org/grpc"
+       "google.golang.org/grpc/credentials"
+
+       "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialout"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+)
+
+// loadgen plays routers doing dialout, for sizing a collector and its
+// output before pointing real routers at it. Every session sends interface
+// counters, -rows interfaces per message, at -rate messages a second,
+// counters go up with every message.
+//   telemetry_dialin_collector loadgen -dest 127.0.0.1:57400 -sessions 20 -rate 50 -duration 5m
+// Sent messages and bytes are printed every 10s and at the end.
+
+var (
+     loadgenFlags    = flag.NewFlagSet("loadgen", flag.ExitOnError)
+     loadgenDest     = loadgenFlags.String("dest", "127.0.0.1:57400", "Dialout collector to send to, host:port")
+     loadgenTransport = loadgenFlags.String("transport", "grpc", "transport to use, grpc or tcp")
+     loadgenEncoding = loadgenFlags.String("encoding", "self-describing-gpb", "encoding of generated messages, Options: self-describing-gpb,json")
+     loadgenSessions = loadgenFlags.Int("sessions", 1, "Number of sessions, each one a router")
+     loadgenRate     = loadgenFlags.Float64("rate", 10, "Messages per second per session, 0 for as fast as possible")
+     loadgenRows     = loadgenFlags.Int("rows", 10, "Rows, interfaces, per message")
+     loadgenDuration = loadgenFlags.Duration("duration", 0, "Stop after this duration, e.g. 5m, runs till interrupted if not set")
+)
+
+const loadgenPath = "Cisco-IOS-XR-infra-statsd-oper:infra-statistics/interfaces/interface/latest/generic-counters"
+
+var loadgenStats struct {
+    messages uint64
+    bytes    uint64
+}
+
+func mdtLoadgenCmd() {
+     if *loadgenEncoding != "self-describing-gpb" && *loadgenEncoding != "json" {
+         log.Fatalf("Not supported encoding: %s", *loadgenEncoding)
+     }
+     if *loadgenTransport != "grpc" && *loadgenTransport != "tcp" {
+         log.Fatalf("Not supported transport: %s", *loadgenTransport)
+     }
+
+     ctx := context.Background()
+     if *loadgenDuration > 0 {
+         var cancel context.CancelFunc
+         ctx, cancel = context.WithTimeout(ctx, *loadgenDuration)
+         defer cancel()
+     }
+
+     start := time.Now()
+     go func() {
+         for range time.Tick(10 * time.Second) {
+             mdtLoadgenPrintStats(start)
+         }
+     }()
+
+     var wg sync.WaitGroup
+     for i := 0; i < *loadgenSessions; i++ {
+         wg.Add(1)
+         go func(node string) {
+             defer wg.Done()
+             if err := mdtLoadgenSession(ctx, node); err != nil {
+                 telemetry_log.Errorf("loadgen: %s: %v\n", node, err)
+             }
+         }(fmt.Sprintf("loadgen-%d", i + 1))
+     }
+     wg.Wait()
+     mdtLoadgenPrintStats(start)
+}
+
+func mdtLoadgenPrintStats(start time.Time) {
+     d := time.Since(start)
+     n := atomic.LoadUint64(&loadgenStats.messages)
+     telemetry_log.Printf("loadgen: sent %d messages, %d bytes in %v, %.1f messages/s\n",
+                          n, atomic.LoadUint64(&loadgenStats.bytes), d.Round(time.Second), float64(n) / d.Seconds())
+}
+
+// send messages for a router till ctx is done
+func mdtLoadgenSession(ctx context.Context, node string) error {
+     send, closeSession, err := mdtLoadgenConnect(ctx)
+     if err != nil {
+         return err
+     }
+     defer closeSession()
+     telemetry_log.Printf("loadgen: %s connected to %s\n", node, *loadgenDest)
+
+     var tick <-chan time.Time
+     if *loadgenRate > 0 {
+         ticker := time.NewTicker(time.Duration(float64(time.Second) / *loadgenRate))
+         defer ticker.Stop()
+         tick = ticker.C
+     }
+     for id := uint64(1); ; id++ {
+         data, err := mdtLoadgenMessage(node, id)
+         if err != nil {
+             return err
+         }
+         if err = send(id, data); err != nil {
+             if ctx.Err() != nil {
+                 return nil
+             }
+             return err
+         }
+         atomic.AddUint64(&loadgenStats.messages, 1)
+         atomic.AddUint64(&loadgenStats.bytes, uint64(len(data)))
+         telemetry_log.Debugf("loadgen: %s sent message %d len: %d\n", node, id, len(data))
+
+         if tick != nil {
+             select {
+             case <-ctx.Done():
+                 return nil
+             case <-tick:
+             }
+         } else if ctx.Err() != nil {
+             return nil
+         }
+     }
+}
+
+// connect to -dest, returns function to send a message and to close the
+// session
+func mdtLoadgenConnect(ctx context.Context) (func(uint64, []byte) error, func(), error) {
+     if *loadgenTransport == "tcp" {
+         var d net.Dialer
+         conn, err := d.DialContext(ctx, "tcp", *loadgenDest)
+         if err != nil {
+             return nil, nil, err
+         }
+         encap := uint16(tcpEncapGPB)
+         if *loadgenEncoding == "json" {
+             encap = tcpEncapJSON
+         }
+         send := func(id uint64, data []byte) error {
+             buf := make([]byte, tcpHdrLen + len(data))
+             binary.BigEndian.PutUint16(buf[0:], tcpMsgTypeData)
+             binary.BigEndian.PutUint16(buf[2:], encap)
+             binary.BigEndian.PutUint16(buf[4:], 1)
+             binary.BigEndian.PutUint32(buf[8:], uint32(len(data)))
+             copy(buf[tcpHdrLen:], data)
+             _, err := conn.Write(buf)
+             return err
+         }
+         return send, func() { conn.Close() }, nil
+     }
+
+     opts := []grpc.DialOption{grpc.WithInsecure()}
+     if *certFile != "" {
+         tlsConfig, err := telemetry_tls.NewClientConfig(*certFile, *serverHostOverride, 0)
+         if err != nil {
+             return nil, nil, err
+         }
+         opts = []grpc.DialOption{grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))}
+     }
+     conn, err := grpc.DialContext(ctx, *loadgenDest, opts...)
+     if err != nil {
+         return nil, nil, err
+     }
+     stream, err := mdt_dialout.NewGRPCMdtDialoutClient(conn).MdtDialout(ctx)
+     if err != nil {
+         conn.Close()
+         return nil, nil, err
+     }
+     // acks of a collector replying to messages are read and dropped
+     go func() {
+         for {
+             if _, err := stream.Recv(); err != nil {
+                 return
+             }
+         }
+     }()
+     send := func(id uint64, data []byte) error {
+         return stream.Send(&mdt_dialout.MdtDialoutArgs{ReqId: int64(id), Data: data})
+     }
+     return send, func() { stream.CloseSend(); conn.Close() }, nil
+}
+
+// interface counters of a router, counters of message id
+func mdtLoadgenMessage(node string, id uint64) ([]byte, error) {
+     return telemetry_decode.MdtGenerateMessage(*loadgenEncoding, node, "loadgen", loadgenPath, id, *loadgenRows, 4)
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+        "sync"
+        "time"
+
+        "golang.org/x/net/context"
+
+        "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+)
+
+// With -mode once, a subscription is cancelled once a collection of every
+// sensor path of it is received, and the collector exits when all the
+// subscriptions are done. With -mode poll, the subscription is made again
+// every -poll_interval, into the same output. A collection is done when a
+// message of it has the collection end time set, a subscription is taken
+// to have no more sensor paths once all the collections seen are done and
+// nothing came for mdtQuietTime. Message of the next collection of a
+// sensor path also ends the subscription, so routers that do not set the
+// end time are collected over one sample interval.
+
+const mdtQuietTime = 2 * time.Second
+
+type mdtPathCollection struct {
+     id    uint64
+     ended bool
+}
+
+// collections of a subscription, cancel ends its rpc
+type mdtSnapshot struct {
+     mu     sync.Mutex
+     cancel context.CancelFunc
+     encoding string
+     paths  map[string]*mdtPathCollection
+     quiet  *time.Timer
+     done   bool
+}
+
+func mdtNewSnapshot(cancel context.CancelFunc, encoding string) *mdtSnapshot {
+     return &mdtSnapshot{cancel: cancel, encoding: encoding, paths: make(map[string]*mdtPathCollection)}
+}
+
+// false if message is not part of the snapshot
+func (s *mdtSnapshot) message(data []byte) bool {
+     path, id, end, err := telemetry_decode.MdtCollection(data, s.encoding)
+     if err != nil {
+         // passed on, decoding reports it
+         return true
+     }
+
+     s.mu.Lock()
+     defer s.mu.Unlock()
+     if s.done {
+         return false
+     }
+     c, ok := s.paths[path]
+     if ok && c.id != id {
+         // next collection
+         s.finish()
+         return false
+     }
+     if !ok {
+         c = &mdtPathCollection{id: id}
+         s.paths[path] = c
+     }
+     c.ended = c.ended || end
+
+     if s.quiet != nil {
+         s.quiet.Stop()
+         s.quiet = nil
+     }
+     for _, c := range s.paths {
+         if !c.ended {
+             return true
+         }
+     }
+     s.quiet = time.AfterFunc(mdtQuietTime, func() {
+         s.mu.Lock()
+         s.finish()
+         s.mu.Unlock()
+     })
+     return true
+}
+
+func (s *mdtSnapshot) finish() {
+     s.done = true
+     s.cancel()
+}
+
+func (s *mdtSnapshot) complete() bool {
+     s.mu.Lock()
+     defer s.mu.Unlock()
+     return s.done
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+        "bytes"
+        "fmt"
+        "io/ioutil"
+        "os"
+        "path/filepath"
+        "regexp"
+        "strings"
+
+        MdtDialin "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialin"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// With -out_dir, protos of get-proto are written each to a file of its
+// own instead of one after the other. A yang path, a model or a wildcard,
+// can give many protos, each starting with its syntax line. Proto is
+// written at the path of its package, name of its message,
+//   cisco_ios_xr_cdp_oper/cdp/nodes/node/neighbors/details/detail/cdp_neighbor_entry.proto
+// as in the proto archives of IOS XR releases, so imports and plugins
+// built from them find it.
+
+var (
+     protoSyntaxRe  = regexp.MustCompile(`(?m)^\s*syntax\s*=`)
+     protoPackageRe = regexp.MustCompile(`(?m)^\s*package\s+([\w.]+)\s*;`)
+     protoMessageRe = regexp.MustCompile(`(?m)^\s*message\s+(\w+)`)
+)
+
+func mdtGetProtoDir(client MdtDialin.GRPCConfigOperClient, args *MdtDialin.GetProtoFileArgs, dir string) error {
+     var buf bytes.Buffer
+     if err := mdtGetProto(client, args, &buf); err != nil {
+         return err
+     }
+     for _, proto := range mdtSplitProtos(buf.String()) {
+         name, err := mdtProtoFileName(proto)
+         if err != nil {
+             return err
+         }
+         file := filepath.Join(dir, name)
+         if err = os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+             return err
+         }
+         if err = ioutil.WriteFile(file, []byte(proto), 0644); err != nil {
+             return err
+         }
+         telemetry_log.Printf("GetProto: %s written to %s\n", args.YangPath, file)
+     }
+     return nil
+}
+
+// protos of content, split at their syntax lines
+func mdtSplitProtos(content string) []string {
+     var protos []string
+     starts := protoSyntaxRe.FindAllStringIndex(content, -1)
+     if len(starts) == 0 || strings.TrimSpace(content[:starts[0][0]]) != "" {
+         // no syntax line at the start, it is one proto
+         starts = append([][]int{{0, 0}}, starts...)
+     }
+     for i, start := range starts {
+         end := len(content)
+         if i + 1 < len(starts) {
+             end = starts[i+1][0]
+         }
+         if proto := strings.TrimSpace(content[start[0]:end]); proto != "" {
+             protos = append(protos, proto + "\n")
+         }
+     }
+     return protos
+}
+
+// package as directories, first message as file name, _KEYS message of
+// a row is named after its row
+func mdtProtoFileName(proto string) (string, error) {
+     pkg := protoPackageRe.FindStringSubmatch(proto)
+     msg := protoMessageRe.FindStringSubmatch(proto)
+     if pkg == nil && msg == nil {
+         return "", fmt.Errorf("proto without package or message")
+     }
+     var elems []string
+     if pkg != nil {
+         elems = strings.Split(pkg[1], ".")
+     }
+     if msg == nil {
+         // named after the last element of its package
+         return filepath.Join(elems...) + ".proto", nil
+     }
+     name := strings.TrimSuffix(msg[1], "_KEYS") + ".proto"
+     return filepath.Join(append(elems, name)...), nil
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+        "bytes"
+        "sync"
+
+        MdtDialin "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialin"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// With -descriptor_cache, protos of sensor paths of gpb subscriptions are
+// fetched from the router of the session, with GetProtoFile. Version of
+// the router, from the install oper model, keys the cache, routers of
+// the same version share descriptors.
+
+const mdtVersionModel = "Cisco-IOS-XR-spirit-install-instmgr-oper:software-install"
+
+type mdtProtoSource struct {
+     addr    string
+     client  MdtDialin.GRPCConfigOperClient
+     once    sync.Once
+     version string
+}
+
+func (s *mdtProtoSource) Version() string {
+     s.once.Do(func() {
+         s.version = "unknown"
+         oper, err := mdtGetOper(s.client, `{"` + mdtVersionModel + `": {"version": [null]}}`)
+         if err != nil {
+             telemetry_log.Errorf("%s: failed to get version, descriptors are cached as unknown: %v\n", s.addr, err)
+             return
+         }
+         if v := mdtJsonString(mdtJsonPath(mdtJsonData(oper, mdtVersionModel), "version"), "label", "version"); v != "" {
+             s.version = v
+         }
+         telemetry_log.Printf("%s: version %s\n", s.addr, s.version)
+     })
+     return s.version
+}
+
+func (s *mdtProtoSource) GetProto(yangPath string) (string, error) {
+     var buf bytes.Buffer
+     err := mdtGetProto(s.client, &MdtDialin.GetProtoFileArgs{ReqId: mdtNextReqId(), YangPath: yangPath}, &buf)
+     return buf.String(), err
+}
+
+// first string value of names, searched depth first
+func mdtJsonString(v interface{}, names ...string) string {
+     switch v := v.(type) {
+     case map[string]interface{}:
+         for _, name := range names {
+             if s, ok := v[name].(string); ok && s != "" {
+                 return s
+             }
+         }
+         for _, e := range v {
+             if s := mdtJsonString(e, names...); s != "" {
+                 return s
+             }
+         }
+     case []interface{}:
+         for _, e := range v {
+             if s := mdtJsonString(e, names...); s != "" {
+                 return s
+             }
+         }
+     }
+     return ""
+}
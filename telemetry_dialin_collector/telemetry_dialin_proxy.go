@@ -0,0 +1,99 @@
+package main
+
+import (
+       "bufio"
+       "fmt"
+       "net"
+       "net/http"
+       "net/url"
+       "time"
+
+       "golang.org/x/net/context"
+       "golang.org/x/net/proxy"
+)
+
+// dialer used by grpc to connect to the router through a proxy.
+// Supported proxy urls,
+//   socks5://[user:password@]host:port
+//   http://[user:password@]host:port    uses HTTP CONNECT
+func mdtProxyDialer(proxyUrl string) (func(context.Context, string) (net.Conn, error), error) {
+     u, err := url.Parse(proxyUrl)
+     if err != nil {
+         return nil, err
+     }
+
+     switch u.Scheme {
+     case "socks5", "socks5h":
+         d, err := proxy.FromURL(u, proxy.Direct)
+         if err != nil {
+             return nil, err
+         }
+         return func(ctx context.Context, addr string) (net.Conn, error) {
+             if cd, ok := d.(proxy.ContextDialer); ok {
+                 return cd.DialContext(ctx, "tcp", addr)
+             }
+             return d.Dial("tcp", addr)
+         }, nil
+     case "http":
+         return func(ctx context.Context, addr string) (net.Conn, error) {
+             return mdtHttpConnect(ctx, u, addr)
+         }, nil
+     default:
+         return nil, fmt.Errorf("unsupported proxy %s, Options: socks5://host:port, http://host:port", proxyUrl)
+     }
+}
+
+// open tunnel to addr using HTTP CONNECT through the proxy
+func mdtHttpConnect(ctx context.Context, u *url.URL, addr string) (net.Conn, error) {
+     var d net.Dialer
+
+     conn, err := d.DialContext(ctx, "tcp", u.Host)
+     if err != nil {
+         return nil, err
+     }
+
+     req := &http.Request{
+                Method: http.MethodConnect,
+                URL:    &url.URL{Opaque: addr},
+                Host:   addr,
+                Header: make(http.Header),
+            }
+     if u.User != nil {
+         password, _ := u.User.Password()
+         req.SetBasicAuth(u.User.Username(), password)
+         req.Header.Set("Proxy-Authorization", req.Header.Get("Authorization"))
+         req.Header.Del("Authorization")
+     }
+     if deadline, ok := ctx.Deadline(); ok {
+         conn.SetDeadline(deadline)
+         defer conn.SetDeadline(time.Time{})
+     }
+     if err = req.Write(conn); err != nil {
+         conn.Close()
+         return nil, err
+     }
+
+     r := bufio.NewReader(conn)
+     resp, err := http.ReadResponse(r, req)
+     if err != nil {
+         conn.Close()
+         return nil, err
+     }
+     resp.Body.Close()
+     if resp.StatusCode != http.StatusOK {
+         conn.Close()
+         return nil, fmt.Errorf("proxy %s CONNECT %s failed: %s", u.Host, addr, resp.Status)
+     }
+
+     // router may have sent data already, it could be buffered in reader
+     return &proxyConn{Conn: conn, r: r}, nil
+}
+
+type proxyConn struct {
+     net.Conn
+     r *bufio.Reader
+}
+
+func (c *proxyConn) Read(b []byte) (int, error) {
+     return c.r.Read(b)
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+        "math/rand"
+        "sync"
+        "time"
+
+        "golang.org/x/net/context"
+)
+
+// Subscriptions to many servers are set up gradually. With -connect_jitter
+// every CreateSubs rpc, first or again on retry or poll, waits a random time
+// up to the jitter, with -connect_limit at most that many are being set up
+// at a time across all the servers. A subscription is set up once its first
+// reply, message or error, comes or after mdtRampHold, as the first message
+// of a subscription can take a sample interval.
+
+const mdtRampHold = 10 * time.Second
+
+var mdtRampSlots chan struct{}
+
+func mdtRampSetup(limit int) {
+     if limit > 0 {
+         mdtRampSlots = make(chan struct{}, limit)
+     }
+}
+
+// wait for jitter and a free slot, release frees the slot, more calls of
+// it do nothing
+func mdtRampWait(ctx context.Context) (release func(), err error) {
+     if *connectJitter > 0 {
+         select {
+         case <-ctx.Done():
+             return nil, ctx.Err()
+         case <-time.After(time.Duration(rand.Int63n(int64(*connectJitter)))):
+         }
+     }
+     if mdtRampSlots == nil {
+         return func() {}, nil
+     }
+     select {
+     case <-ctx.Done():
+         return nil, ctx.Err()
+     case mdtRampSlots <- struct{}{}:
+     }
+     var once sync.Once
+     free := func() {
+         once.Do(func() { <-mdtRampSlots })
+     }
+     t := time.AfterFunc(mdtRampHold, free)
+     return func() {
+         t.Stop()
+         free()
+     }, nil
+}
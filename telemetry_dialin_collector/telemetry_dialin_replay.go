@@ -0,0 +1,448 @@
+package main
+
+import (
+       "bufio"
+       "bytes"
+       "compress/gzip"
+       "encoding/binary"
+       "encoding/json"
+       "flag"
+       "fmt"
+       "io"
+       "io/ioutil"
+       "log"
+       "os"
+       "path/filepath"
+       "sync"
+       "time"
+
+       "github.com/klauspost/compress/zstd"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// replay reads messages as sent by a router on a tcp dialout session, a
+// 12 byte header, type, encap, version, flags and length, before every
+// message, so a session captured with nc -l <port> > session.bin can be
+// decoded again with other options. Encoding is taken from the header of
+// the first message, heartbeats are skipped. Every file is written to its
+// own output.
+//   telemetry_dialin_collector replay -out csv:/tmp/intf.csv session.bin
+// With -checkpoint, replay keeps in the file, for every capture, the offset
+// of the first message not yet written to the output and the count of
+// messages before it. Sinks and files buffer rows, so messages are written
+// only once the output of the capture is closed, at its end, without
+// error. Checkpoint is written then and on exit, a replay run again with
+// it skips the captures done and replays the others from their offset,
+// rows of a capture cut short are written again, none are lost. stdin is
+// read from the start. Checkpoint is removed once all are done.
+// Captures compressed with zstd or gzip, as recorded by -out capture:<dir>
+// with compress, are read as they are, by decode and search too, and
+// files encrypted with -encrypt_key are decrypted.
+// decode reads a message per file, in -encoding, such as messages kept by
+// -dont_clean or saved from a packet capture.
+
+var (
+     replayFlags    = flag.NewFlagSet("replay", flag.ExitOnError)
+     replayInterval = replayFlags.Duration("interval", 0, "Wait between messages, e.g. 100ms, as fast as possible if not set")
+     replayCheckpoint = replayFlags.String("checkpoint", "", "File replay progress is kept in, replay run again with it resumes where it left off")
+)
+
+// progress of a capture
+type mdtReplayPos struct {
+     Offset   int64 `json:"offset"`
+     Messages int   `json:"messages"`
+     Done     bool  `json:"done,omitempty"`
+}
+
+var mdtCheckpoint = struct {
+    sync.Mutex
+    file    string
+    files   map[string]*mdtReplayPos
+    // capture being replayed, ends are the offsets after the messages
+    // sent to out and not yet written
+    name    string
+    out     *telemetry_decode.MdtOut
+    handled uint64
+    ends    []int64
+}{files: make(map[string]*mdtReplayPos)}
+
+// tcp dialout header, same as in telemetry_dialout_collector
+const (
+      tcpHdrLen      = 12
+      tcpMsgTypeData = 1
+      tcpEncapGPB    = 1
+      tcpEncapJSON   = 2
+)
+
+// decode output for replay and decode commands, messages sent on the
+// returned channel are written to -out, done is closed when they are all
+// written
+func mdtNewOut(name string) (*telemetry_decode.MdtOut, chan []byte, chan struct{}) {
+     dataChan := make(chan []byte, 10000)
+     done := make(chan struct{})
+     o := &telemetry_decode.MdtOut{
+                        Name:        name,
+                        OutFile:     *outFile,
+                        OutCompress: *outCompress,
+                        OutFormat:   *outFormat,
+                        TableFields: *tableFields,
+                        Encoding:    *encoding,
+                        Decode_raw:  *decode_raw,
+                        DontClean:   *dontClean,
+                        ProtoFile:   *protoFile,
+                        PluginDir:   *pluginDir,
+                        PluginFile:  *pluginFile,
+                        DataChan:     dataChan,
+     }
+     if err := o.MdtOutOpen(); err != nil {
+         log.Fatal(err)
+     }
+     go func() {
+         o.MdtOutLoop()
+         close(done)
+     }()
+     return o, dataChan, done
+}
+
+// magic numbers of compressed input
+var (
+     zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+     gzipMagic = []byte{0x1f, 0x8b}
+)
+
+type mdtInputReader struct {
+     io.Reader
+     close func() error
+}
+
+func (r *mdtInputReader) Close() error {
+     return r.close()
+}
+
+// file or - for stdin, encrypted input is decrypted with -encrypt_key,
+// zstd and gzip input, such as compressed capture segments, is
+// decompressed. Plain files are returned as is, for seeking.
+func mdtOpenInput(name string) (io.ReadCloser, error) {
+     var f io.ReadCloser = ioutil.NopCloser(os.Stdin)
+     if name != "-" {
+         file, err := os.Open(name)
+         if err != nil {
+             return nil, err
+         }
+         f = file
+     }
+     br := bufio.NewReader(f)
+     magic, _ := br.Peek(8)
+     if telemetry_decode.MdtEncrypted(magic) {
+         d, err := telemetry_decode.MdtDecryptReader(br)
+         if err != nil {
+             f.Close()
+             return nil, fmt.Errorf("%s: %v", name, err)
+         }
+         // compressed before encrypted
+         br = bufio.NewReader(d)
+         magic, _ = br.Peek(len(zstdMagic))
+         f = &mdtInputReader{Reader: br, close: f.Close}
+     }
+     switch {
+     case bytes.HasPrefix(magic, zstdMagic):
+         d, err := zstd.NewReader(br)
+         if err != nil {
+             f.Close()
+             return nil, fmt.Errorf("%s: %v", name, err)
+         }
+         return &mdtInputReader{Reader: d, close: func() error {
+                                                      d.Close()
+                                                      return f.Close()
+                                                  }}, nil
+     case bytes.HasPrefix(magic, gzipMagic):
+         z, err := gzip.NewReader(br)
+         if err != nil {
+             f.Close()
+             return nil, fmt.Errorf("%s: %v", name, err)
+         }
+         return &mdtInputReader{Reader: z, close: f.Close}, nil
+     }
+     if file, ok := f.(*os.File); ok {
+         // magic was read by br
+         if _, err := file.Seek(0, io.SeekStart); err != nil {
+             file.Close()
+             return nil, err
+         }
+         return file, nil
+     }
+     return &mdtInputReader{Reader: br, close: f.Close}, nil
+}
+
+func mdtReplayCmd() {
+     if len(mdtCommandArgs) == 0 {
+         mdtCommandArgs = []string{"-"}
+     }
+     if *replayCheckpoint != "" {
+         if err := mdtReadCheckpoint(*replayCheckpoint); err != nil {
+             log.Fatalf("replay: %v", err)
+         }
+     }
+     complete := true
+     for _, name := range mdtCommandArgs {
+         pos := mdtCheckpoint.files[name]
+         if name == "-" {
+             // stdin is not read again
+             pos = nil
+         }
+         if pos != nil && pos.Done {
+             telemetry_log.Printf("replay: %s: done in checkpoint, skipped\n", name)
+             continue
+         }
+         f, err := mdtOpenInput(name)
+         if err != nil {
+             log.Fatalf("replay: %v", err)
+         }
+         if pos == nil {
+             pos = &mdtReplayPos{}
+         } else if pos.Offset != 0 {
+             // compressed captures are read up to the offset
+             if s, ok := f.(io.Seeker); ok {
+                 _, err = s.Seek(pos.Offset, io.SeekStart)
+             } else {
+                 _, err = io.CopyN(ioutil.Discard, f, pos.Offset)
+             }
+             if err != nil {
+                 log.Fatalf("replay: %s: %v", name, err)
+             }
+             telemetry_log.Printf("replay: %s: resuming after %d messages\n", name, pos.Messages)
+         }
+         n, err := mdtReplay(name, f, *pos)
+         f.Close()
+         if err != nil {
+             complete = false
+             telemetry_log.Errorf("replay: %s: %v, after %d messages\n", name, err, n)
+         } else {
+             telemetry_log.Printf("replay: %s: %d messages\n", name, n)
+         }
+         if !mdtCheckpointEnd(name, err == nil) {
+             complete = false
+         }
+     }
+     telemetry_decode.MdtOutClose()
+     if *replayCheckpoint != "" && complete {
+         os.Remove(*replayCheckpoint)
+     }
+}
+
+// replay messages of r, read from start, to an output of their own
+func mdtReplay(name string, r io.Reader, start mdtReplayPos) (int, error) {
+     var dataChan chan []byte
+     var done chan struct{}
+     defer func() {
+         if dataChan != nil {
+             close(dataChan)
+             <-done
+         }
+     }()
+
+     n := start.Messages
+     offset := start.Offset
+     mdtCheckpointStart(name, start)
+     for {
+         msgType, encap, buf, err := mdtReadTcpMessage(r)
+         if err != nil {
+             if err == io.EOF {
+                 return n, nil
+             }
+             return n, err
+         }
+         offset += int64(tcpHdrLen + len(buf))
+         if msgType != tcpMsgTypeData {
+             continue
+         }
+         telemetry_log.Debugf("replay: message len: %v encode %v\n", len(buf), encap)
+         // a session has one encoding, output is set up for the encoding
+         // of the first message
+         if dataChan == nil {
+             *encoding = mdtTcpEncoding(encap)
+             var o *telemetry_decode.MdtOut
+             o, dataChan, done = mdtNewOut("replay " + name)
+             mdtCheckpointOut(o)
+         } else if mdtTcpEncoding(encap) != *encoding {
+             return n, fmt.Errorf("message %d is %s, session started with %s", n + 1, mdtTcpEncoding(encap), *encoding)
+         }
+         if n > 0 && *replayInterval > 0 {
+             time.Sleep(*replayInterval)
+         }
+         mdtCheckpointSent(offset)
+         dataChan <- buf
+         n++
+     }
+}
+
+func mdtReadCheckpoint(fileName string) error {
+     mdtCheckpoint.file = fileName
+     data, err := ioutil.ReadFile(fileName)
+     if os.IsNotExist(err) {
+         return nil
+     }
+     if err != nil {
+         return err
+     }
+     if err = json.Unmarshal(data, &mdtCheckpoint.files); err != nil {
+         return fmt.Errorf("%s: %v", fileName, err)
+     }
+     return nil
+}
+
+func mdtCheckpointStart(name string, start mdtReplayPos) {
+     mdtCheckpoint.Lock()
+     defer mdtCheckpoint.Unlock()
+     mdtCheckpoint.name = name
+     mdtCheckpoint.out = nil
+     mdtCheckpoint.handled = 0
+     mdtCheckpoint.ends = nil
+     mdtCheckpoint.files[name] = &start
+}
+
+func mdtCheckpointOut(o *telemetry_decode.MdtOut) {
+     mdtCheckpoint.Lock()
+     mdtCheckpoint.out = o
+     mdtCheckpoint.Unlock()
+}
+
+// message ending at offset is being sent to the output
+func mdtCheckpointSent(offset int64) {
+     mdtCheckpoint.Lock()
+     defer mdtCheckpoint.Unlock()
+     mdtCheckpoint.ends = append(mdtCheckpoint.ends, offset)
+}
+
+// capture is replayed and its output closed, done if all of it was read
+// and written out, returns done
+func mdtCheckpointEnd(name string, done bool) bool {
+     mdtCheckpoint.Lock()
+     defer mdtCheckpoint.Unlock()
+     mdtCheckpointUpdate()
+     if o := mdtCheckpoint.out; o != nil && o.Written() != o.Handled() {
+         done = false
+     }
+     if done {
+         mdtCheckpoint.files[name].Done = true
+     }
+     mdtCheckpoint.name = ""
+     mdtCheckpointWrite()
+     return done
+}
+
+// checkpoint on exit, messages not yet written are replayed next time
+func mdtCheckpointExit() {
+     mdtCheckpoint.Lock()
+     defer mdtCheckpoint.Unlock()
+     mdtCheckpointWrite()
+}
+
+// move position of the capture being replayed past the messages written
+// out
+func mdtCheckpointUpdate() {
+     if mdtCheckpoint.name == "" || mdtCheckpoint.out == nil {
+         return
+     }
+     pos := mdtCheckpoint.files[mdtCheckpoint.name]
+     handled := mdtCheckpoint.out.Written()
+     for ; mdtCheckpoint.handled < handled && len(mdtCheckpoint.ends) > 0; mdtCheckpoint.handled++ {
+         pos.Offset = mdtCheckpoint.ends[0]
+         pos.Messages++
+         mdtCheckpoint.ends = mdtCheckpoint.ends[1:]
+     }
+}
+
+// write checkpoint to a tmp file renamed over it, a crash while writing
+// leaves the previous one
+func mdtCheckpointWrite() {
+     if mdtCheckpoint.file == "" {
+         return
+     }
+     mdtCheckpointUpdate()
+     data, _ := json.MarshalIndent(mdtCheckpoint.files, "", "  ")
+     tmp, err := ioutil.TempFile(filepath.Dir(mdtCheckpoint.file), filepath.Base(mdtCheckpoint.file) + ".*")
+     if err == nil {
+         _, err = tmp.Write(append(data, '\n'))
+         if cerr := tmp.Close(); err == nil {
+             err = cerr
+         }
+         if err == nil {
+             err = os.Rename(tmp.Name(), mdtCheckpoint.file)
+         }
+         if err != nil {
+             os.Remove(tmp.Name())
+         }
+     }
+     if err != nil {
+         telemetry_log.Errorf("replay: checkpoint: %v\n", err)
+     }
+}
+
+// next message of a tcp dialout session, io.EOF at the end
+func mdtReadTcpMessage(r io.Reader) (msgType uint16, encap uint16, buf []byte, err error) {
+     hdr := make([]byte, tcpHdrLen)
+     if _, err = io.ReadFull(r, hdr); err != nil {
+         return
+     }
+     msgType = binary.BigEndian.Uint16(hdr[0:])
+     encap = binary.BigEndian.Uint16(hdr[2:])
+     buf = make([]byte, binary.BigEndian.Uint32(hdr[8:]))
+     if _, err = io.ReadFull(r, buf); err == io.EOF {
+         err = io.ErrUnexpectedEOF
+     }
+     return
+}
+
+func mdtTcpEncoding(encap uint16) string {
+     if encap == tcpEncapJSON {
+         return "json"
+     }
+     return "gpb"
+}
+
+func mdtDecodeCmd() {
+     if *decodeGolden != "" {
+         mdtGoldenCmd()
+         return
+     }
+     if len(mdtCommandArgs) == 0 {
+         log.Fatal("decode: no files given")
+     }
+     _, dataChan, done := mdtNewOut("decode")
+     for _, name := range mdtCommandArgs {
+         f, err := mdtOpenInput(name)
+         if err != nil {
+             log.Fatalf("decode: %v", err)
+         }
+         data, err := ioutil.ReadAll(f)
+         f.Close()
+         if err != nil {
+             log.Fatalf("decode: %s: %v", name, err)
+         }
+         dataChan <- data
+     }
+     close(dataChan)
+     <-done
+     telemetry_decode.MdtOutClose()
+}
+
+// decrypt prints files, encrypted with -encrypt_key, compressed or not
+func mdtDecryptCmd() {
+     if len(mdtCommandArgs) == 0 {
+         mdtCommandArgs = []string{"-"}
+     }
+     for _, name := range mdtCommandArgs {
+         f, err := mdtOpenInput(name)
+         if err != nil {
+             log.Fatalf("decrypt: %v", err)
+         }
+         _, err = io.Copy(os.Stdout, f)
+         f.Close()
+         if err != nil {
+             log.Fatalf("decrypt: %s: %v", name, err)
+         }
+     }
+}
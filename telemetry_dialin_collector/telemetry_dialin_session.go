@@ -0,0 +1,243 @@
+package main
+
+import (
+       "fmt"
+       "log"
+       "sort"
+       "strings"
+       "sync"
+       "sync/atomic"
+       "net/http"
+
+       "golang.org/x/net/context"
+
+       MdtDialin "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialin"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_admin"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// connection to a server and the subscriptions running on it
+type mdtSession struct {
+     addr        string
+     // encoding of the server, -encoding if not set
+     encoding    string
+     ctx         context.Context
+     client      MdtDialin.GRPCConfigOperClient
+     wg          sync.WaitGroup
+
+     mu          sync.Mutex
+     subs        map[string]*mdtSubscription
+     failed      []string
+}
+
+type mdtSubscription struct {
+     reqId  int64
+     cancel context.CancelFunc
+}
+
+// sessions by server address, used by admin api
+var mdtSessions = struct {
+    sync.Mutex
+    m map[string]*mdtSession
+}{m: make(map[string]*mdtSession)}
+
+// request ids of rpcs of a subscribe run, pid + 1, pid + 2, ..., every
+// subscription has its own, in logs and stats, for matching with the
+// subscription on the server
+var mdtLastReqId = reqId
+
+func mdtNextReqId() int64 {
+     return atomic.AddInt64(&mdtLastReqId, 1)
+}
+
+func mdtNewSession(ctx context.Context, addr, encoding string, client MdtDialin.GRPCConfigOperClient) *mdtSession {
+     s := &mdtSession{
+              addr:        addr,
+              encoding:    encoding,
+              ctx:         ctx,
+              client:      client,
+              subs:        make(map[string]*mdtSubscription),
+          }
+     mdtSessions.Lock()
+     mdtSessions.m[addr] = s
+     mdtSessions.Unlock()
+     return s
+}
+
+func (s *mdtSession) unregister() {
+     mdtSessions.Lock()
+     if mdtSessions.m[s.addr] == s {
+         delete(mdtSessions.m, s.addr)
+     }
+     mdtSessions.Unlock()
+}
+
+// start a subscription, runs till the subscription ends or is cancelled.
+// A failed subscription ends alone, rest of the session goes on
+func (s *mdtSession) subscribe(subid string) error {
+     s.mu.Lock()
+     defer s.mu.Unlock()
+     if _, ok := s.subs[subid]; ok {
+         return fmt.Errorf("already subscribed to %s on %s", subid, s.addr)
+     }
+
+     mdtConfigMu.RLock()
+     var marking *MdtDialin.QOSMarking
+     if telemetryQos := (uint32)(*qos); telemetryQos != NotConfigured {
+        marking = &MdtDialin.QOSMarking{Marking: telemetryQos}
+     }
+     enc := s.encoding
+     if enc == "" {
+         enc = *encoding
+     }
+     mdtConfigMu.RUnlock()
+     createSubsArgs := MdtDialin.CreateSubsArgs{
+                       ReqId:         mdtNextReqId(),
+                       Encode:        telemetryEncoding[enc],
+                       Subidstr:      subid,
+                       Qos:           marking}
+
+     ctx, cancel := context.WithCancel(s.ctx)
+     sub := &mdtSubscription{reqId: createSubsArgs.ReqId, cancel: cancel}
+     s.subs[subid] = sub
+
+     s.wg.Add(1)
+     go func() {
+         defer s.wg.Done()
+         defer func() {
+             cancel()
+             s.mu.Lock()
+             if s.subs[subid] == sub {
+                 delete(s.subs, subid)
+             }
+             s.mu.Unlock()
+         }()
+
+         err := mdtSubscribe(ctx, s.addr, enc, s.client, &createSubsArgs)
+         if err != nil {
+             telemetry_log.Errorf("%s: %v\n", s.addr, err)
+             s.mu.Lock()
+             s.failed = append(s.failed, subid)
+             s.mu.Unlock()
+         }
+     }()
+     return nil
+}
+
+// cancel a running subscription
+func (s *mdtSession) unsubscribe(subid string) error {
+     s.mu.Lock()
+     defer s.mu.Unlock()
+     sub, ok := s.subs[subid]
+     if !ok {
+         return fmt.Errorf("not subscribed to %s on %s", subid, s.addr)
+     }
+     sub.cancel()
+     delete(s.subs, subid)
+     return nil
+}
+
+// subscriptions that failed, once the session is done
+func (s *mdtSession) err() error {
+     s.mu.Lock()
+     defer s.mu.Unlock()
+     if len(s.failed) == 0 {
+         return nil
+     }
+     sort.Strings(s.failed)
+     return fmt.Errorf("%s: subscriptions failed: %s", s.addr, strings.Join(s.failed, ", "))
+}
+
+func (s *mdtSession) subscriptions() []adminSubscription {
+     var subs []adminSubscription
+     s.mu.Lock()
+     for subid, sub := range s.subs {
+         subs = append(subs, adminSubscription{Server: s.addr, Subscription: subid, ReqId: sub.reqId})
+     }
+     s.mu.Unlock()
+     sort.Slice(subs, func(i, j int) bool { return subs[i].Subscription < subs[j].Subscription })
+     return subs
+}
+
+// number of subscriptions that have received data and are still up
+var mdtStreams int64
+var mdtReady sync.Once
+
+func mdtStreamUp() {
+     atomic.AddInt64(&mdtStreams, 1)
+     if *daemon {
+         mdtReady.Do(func() {
+             if err := telemetry_admin.SdNotify("READY=1"); err != nil {
+                 log.Printf("Failed to notify systemd: %v", err)
+             }
+         })
+     }
+}
+
+func mdtStreamDown() {
+     atomic.AddInt64(&mdtStreams, -1)
+}
+
+func mdtStreamsUp() bool {
+     return atomic.LoadInt64(&mdtStreams) > 0
+}
+
+type adminSubscription struct {
+     Server       string `json:"server"`
+     Subscription string `json:"subscription"`
+     ReqId        int64  `json:"req_id"`
+}
+
+// admin api for subscriptions,
+//   GET    /subscriptions                           list running subscriptions
+//   POST   /subscriptions?name=<sub>[&server=<ip:port>]  subscribe, on all servers if server is not given
+//   DELETE /subscriptions?name=<sub>[&server=<ip:port>]  cancel subscription
+func mdtAdminSubscriptions(w http.ResponseWriter, r *http.Request) {
+     name := r.URL.Query().Get("name")
+     server := r.URL.Query().Get("server")
+
+     var sessions []*mdtSession
+     mdtSessions.Lock()
+     for addr, s := range mdtSessions.m {
+         if server == "" || server == addr {
+             sessions = append(sessions, s)
+         }
+     }
+     mdtSessions.Unlock()
+
+     switch r.Method {
+     case http.MethodGet:
+     case http.MethodPost, http.MethodDelete:
+         if name == "" {
+             http.Error(w, "expected name=<subscription>", http.StatusBadRequest)
+             return
+         }
+         if len(sessions) == 0 {
+             http.Error(w, "no session to server " + server, http.StatusNotFound)
+             return
+         }
+         for _, s := range sessions {
+             var err error
+             if r.Method == http.MethodPost {
+                 telemetry_log.Printf("Admin api: subscribe to %s on %s\n", name, s.addr)
+                 err = s.subscribe(name)
+             } else {
+                 telemetry_log.Printf("Admin api: cancel subscription %s on %s\n", name, s.addr)
+                 err = s.unsubscribe(name)
+             }
+             if err != nil {
+                 http.Error(w, err.Error(), http.StatusConflict)
+                 return
+             }
+         }
+     default:
+         http.Error(w, "use GET, POST or DELETE", http.StatusMethodNotAllowed)
+         return
+     }
+
+     subs := []adminSubscription{}
+     for _, s := range sessions {
+         subs = append(subs, s.subscriptions()...)
+     }
+     telemetry_admin.WriteJSON(w, subs)
+}
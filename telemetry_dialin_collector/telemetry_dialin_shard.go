@@ -0,0 +1,39 @@
+package main
+
+import (
+        "hash/fnv"
+        "strconv"
+)
+
+// With -shard_count, collectors sharing an inventory, or any -discover
+// source, each subscribe only to the servers of their -shard_index. Server
+// is given to the shard with the highest hash of server and shard,
+// rendezvous hashing, so when a collector is added or removed only the
+// servers of that shard move.
+
+func mdtShard(addr string, count int) int {
+     shard := 0
+     var max uint64
+     for i := 0; i < count; i++ {
+         h := fnv.New64a()
+         h.Write([]byte(addr + "/" + strconv.Itoa(i)))
+         if sum := h.Sum64(); i == 0 || sum > max {
+             shard, max = i, sum
+         }
+     }
+     return shard
+}
+
+// targets of this collector's shard
+func mdtShardTargets(targets []mdtTarget) []mdtTarget {
+     if *shardCount <= 1 {
+         return targets
+     }
+     var mine []mdtTarget
+     for _, t := range targets {
+         if mdtShard(t.addr, *shardCount) == *shardIndex {
+             mine = append(mine, t)
+         }
+     }
+     return mine
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+        "crypto/x509"
+        "fmt"
+        "net"
+        "strings"
+        "sync"
+
+        "google.golang.org/grpc/credentials"
+        "google.golang.org/grpc/peer"
+
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// Only routers listed in -allow, addresses or prefixes, may send, with
+// any transport. Connections from other addresses are closed as they are
+// accepted, their udp datagrams dropped. With mutual TLS -allow_names
+// further limits routers to certificates with one of the names, as common
+// name or dns name. Every rejected address is logged once.
+
+type mdtAllowList struct {
+     nets   []*net.IPNet
+     names  map[string]bool
+     mu     sync.Mutex
+     logged map[string]bool
+}
+
+var allowList *mdtAllowList
+
+func mdtParseAllow(addrs, names string) (*mdtAllowList, error) {
+     a := &mdtAllowList{logged: make(map[string]bool)}
+     for _, s := range strings.Split(addrs, ",") {
+         if s = strings.TrimSpace(s); s == "" {
+             continue
+         }
+         prefix := s
+         if !strings.Contains(s, "/") {
+             if ip := net.ParseIP(s); ip != nil && ip.To4() != nil {
+                 prefix += "/32"
+             } else {
+                 prefix += "/128"
+             }
+         }
+         _, n, err := net.ParseCIDR(prefix)
+         if err != nil {
+             return nil, fmt.Errorf("invalid address %s", s)
+         }
+         a.nets = append(a.nets, n)
+     }
+     for _, s := range strings.Split(names, ",") {
+         if s = strings.TrimSpace(s); s != "" {
+             if a.names == nil {
+                 a.names = make(map[string]bool)
+             }
+             a.names[s] = true
+         }
+     }
+     return a, nil
+}
+
+// true if router at addr may send, all may if no list was given
+func (a *mdtAllowList) allowed(addr net.Addr) bool {
+     if a == nil || len(a.nets) == 0 {
+         return true
+     }
+     host, _, err := net.SplitHostPort(addr.String())
+     if err != nil {
+         host = addr.String()
+     }
+     if ip := net.ParseIP(host); ip != nil {
+         for _, n := range a.nets {
+             if n.Contains(ip) {
+                 return true
+             }
+         }
+     }
+     a.reject(host, "address not allowed")
+     return false
+}
+
+// true if certificate of a grpc session has an allowed name
+func (a *mdtAllowList) allowedPeer(p *peer.Peer) bool {
+     if a == nil || a.names == nil {
+         return true
+     }
+     var cert *x509.Certificate
+     if info, ok := p.AuthInfo.(credentials.TLSInfo); ok && len(info.State.PeerCertificates) != 0 {
+         cert = info.State.PeerCertificates[0]
+     }
+     if cert != nil {
+         if a.names[cert.Subject.CommonName] {
+             return true
+         }
+         for _, name := range cert.DNSNames {
+             if a.names[name] {
+                 return true
+             }
+         }
+     }
+     host, _, _ := net.SplitHostPort(p.Addr.String())
+     a.reject(host, "certificate name not allowed")
+     return false
+}
+
+func (a *mdtAllowList) reject(host, reason string) {
+     a.mu.Lock()
+     defer a.mu.Unlock()
+     if !a.logged[host] {
+         a.logged[host] = true
+         telemetry_log.Errorf("Rejected %s, %s\n", host, reason)
+     }
+}
+
+// listener closing connections from routers not allowed
+type allowListener struct {
+     net.Listener
+}
+
+func (l allowListener) Accept() (net.Conn, error) {
+     for {
+         conn, err := l.Listener.Accept()
+         if err != nil || allowList.allowed(conn.RemoteAddr()) {
+             return conn, err
+         }
+         conn.Close()
+     }
+}
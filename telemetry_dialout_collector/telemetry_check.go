@@ -0,0 +1,171 @@
+package main
+
+import (
+        "fmt"
+        "net"
+        "os"
+        "strconv"
+        "time"
+
+        "github.com/ios-xr/telemetry-go-collector/telemetry_admin"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+)
+
+// With -check_config options are checked and the collector exits without
+// listening. Files given in options are loaded, outputs are checked
+// without being opened, with -check_reachability the port is listened on
+// and output hosts are connected to.
+
+func mdtCheckConfig() int {
+     checks := []telemetry_admin.Check{
+         {Name: "options", Run: mdtCheckFlags},
+         {Name: "encoding", Run: func() error {
+             switch *encoding {
+             case "json", "self-describing-gpb", "gpb":
+                 return nil
+             }
+             return fmt.Errorf("unsupported encoding %s, Options: json,self-describing-gpb,gpb", *encoding)
+         }},
+         {Name: "output", Run: func() error {
+             o := &telemetry_decode.MdtOut{
+                                OutFile:     *outFileName,
+                                OutCompress: *outCompress,
+                                OutFormat:   *outFormat,
+                                Encoding:    *encoding,
+                                Decode_raw:  *decode_raw,
+                                ProtoFile:   *protoFile,
+             }
+             return o.MdtOutCheck()
+         }},
+         {Name: "allow", Run: func() error {
+             _, err := mdtParseAllow(*allow, *allowNames)
+             return err
+         }},
+     }
+     if *certFile != "" && *keyFile != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "tls", Run: func() error {
+             var err error
+             if *clientCA != "" {
+                 _, err = telemetry_tls.NewMutualServerConfig(*certFile, *keyFile, *clientCA, 0)
+             } else {
+                 _, err = telemetry_tls.NewServerConfig(*certFile, *keyFile, 0)
+             }
+             return err
+         }})
+     }
+     if *yangModels != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "yang_models", Run: func() error {
+             return telemetry_decode.MdtYangLoad(*yangModels)
+         }})
+     }
+     if *scriptFile != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "script", Run: func() error {
+             return telemetry_decode.MdtScriptLoad(*scriptFile)
+         }})
+     }
+     if *wasmTransform != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "wasm_transform", Run: func() error {
+             return telemetry_decode.MdtWasmCheck(*wasmTransform)
+         }})
+     }
+     if *wasmDecoder != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "wasm_decoder", Run: func() error {
+             return telemetry_decode.MdtWasmCheck(*wasmDecoder)
+         }})
+     }
+     if *pathMap != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "path_map", Run: func() error {
+             return telemetry_decode.MdtPathMapLoad(*pathMap)
+         }})
+     }
+     if *jtiDescriptors != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "jti_descriptors", Run: func() error {
+             return telemetry_decode.MdtJtiLoad(*jtiDescriptors)
+         }})
+     }
+     if *dedup != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "dedup", Run: func() error {
+             return telemetry_decode.MdtDedupSetup(*dedup, *dedupWindow)
+         }})
+     }
+     if *redactFile != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "redact", Run: func() error {
+             return telemetry_decode.MdtRedactLoad(*redactFile)
+         }})
+     }
+     if *encryptKey != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "encrypt key", Run: func() error {
+             return telemetry_decode.MdtEncryptSetup(*encryptKey)
+         }})
+     }
+     if *rateLimit != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "rate limit", Run: func() error {
+             _, err := telemetry_decode.MdtRateLimitParse(*rateLimit)
+             return err
+         }})
+     }
+     if *chaos != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "chaos", Run: func() error {
+             return telemetry_decode.MdtChaosSetup(*chaos)
+         }})
+     }
+     if *quarantineDir != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "quarantine_dir", Run: func() error {
+             return telemetry_decode.MdtQuarantineSetup(*quarantineDir)
+         }})
+     }
+     if *controlAllow != "" || *controlTokenFile != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "control access", Run: func() error {
+             return telemetry_admin.ControlAccessSetup(*controlAllow, *controlTokenFile)
+         }})
+     }
+     if *adminListen != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "admin", Run: func() error {
+             if _, err := telemetry_admin.NewAdminServer(*adminTokenFile); err != nil {
+                 return err
+             }
+             return telemetry_admin.CheckCertKey(*adminCert, *adminKey)
+         }})
+     }
+     if *restreamListen != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "restream", Run: func() error {
+             return telemetry_admin.CheckCertKey(*restreamCert, *restreamKey)
+         }})
+     }
+     if *gnmiListen != "" {
+         checks = append(checks, telemetry_admin.Check{Name: "gnmi", Run: func() error {
+             return telemetry_admin.CheckCertKey(*gnmiCert, *gnmiKey)
+         }})
+     }
+     if *checkReachability {
+         checks = append(checks, telemetry_admin.Check{Name: "listen", Run: func() error {
+             return mdtCheckListen(*transport, ":" + strconv.Itoa(*port))
+         }})
+         if *jtiListen != "" {
+             checks = append(checks, telemetry_admin.Check{Name: "jti_listen", Run: func() error {
+                 return mdtCheckListen("udp", *jtiListen)
+             }})
+         }
+         checks = append(checks, telemetry_admin.Check{Name: "output reachable", Run: func() error {
+             return telemetry_decode.MdtOutReachable(*outFileName, 5 * time.Second)
+         }})
+     }
+     return telemetry_admin.RunChecks(os.Stdout, checks)
+}
+
+// port is free to listen on
+func mdtCheckListen(transport, addr string) error {
+     if transport == "udp" {
+         conn, err := net.ListenPacket("udp", addr)
+         if err != nil {
+             return err
+         }
+         return conn.Close()
+     }
+     lis, err := net.Listen("tcp", addr)
+     if err != nil {
+         return err
+     }
+     return lis.Close()
+}
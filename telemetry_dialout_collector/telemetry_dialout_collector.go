@@ -3,19 +3,31 @@ package main
 import (
         "os"
         "os/signal"
+        "syscall"
         "flag"
         "fmt"
         "io"
+        "log"
         "net"
         "strconv"
         "path/filepath"
+        "time"
+        "crypto/tls"
 
         "google.golang.org/grpc"
         "google.golang.org/grpc/peer"
         "google.golang.org/grpc/credentials"
+        "google.golang.org/grpc/status"
+        "google.golang.org/grpc/codes"
+        "google.golang.org/grpc/keepalive"
 
         "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialout"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_admin"
         "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_restream"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_gnmi"
 )
 
 var usage = func() {
@@ -25,7 +37,10 @@ var usage = func() {
     fmt.Fprintf(os.Stderr, "Examples:\n")
     fmt.Fprintf(os.Stderr, "GRPC Server                            : %s -port <> -encoding gpb\n", os.Args[0])
     fmt.Fprintf(os.Stderr, "GRPC with TLS                          : %s -port <> -encoding gpb -cert <> -key <>\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "GRPC with mutual TLS                   : %s -port <> -encoding gpb -cert <> -key <> -client_ca <>\n", os.Args[0])
     fmt.Fprintf(os.Stderr, "TCP Server                             : %s -port <> -transport tcp\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "UDP Server                             : %s -port <> -transport udp -udp_read_buffer 8388608\n", os.Args[0])
+    fmt.Fprintf(os.Stderr, "GRPC and Juniper JTI Server            : %s -port <> -encoding gpb -jti_listen :50000 -jti_descriptors jti.pb\n", os.Args[0])
     fmt.Fprintf(os.Stderr, "GRPC use protoc to decode              : %s -port <> -encoding gpb -proto cdp_neighbor.proto\n", os.Args[0])
     fmt.Fprintf(os.Stderr, "GRPC use protoc to decode without proto: %s -port <> -encoding gpb -decode_raw\n", os.Args[0])
 }
@@ -35,13 +50,73 @@ var (
                                    "expected encoding, Options: json,self-describing-gpb,gpb needed only for grpc")
         decode_raw   = flag.Bool("decode_raw", false, "Use protoc --decode_raw")
         protoFile    = flag.String("proto", "", "proto file to use for decode")
+        platform     = flag.String("platform", "xr", "OS family of the routers, Options: xr,xe,nxos, xe reads numeric subscription ids, nxos makes a row of every DME object")
         transport    = flag.String("transport", "grpc", "transport to use, grpc, tcp or udp")
+        udpReassemble = flag.Bool("udp_reassemble", false, "With udp, join messages split over datagrams, a datagram shorter than the length in its header is followed by the rest of the message")
+        udpReadBuffer = flag.Int("udp_read_buffer", 0, "With udp, socket receive buffer size in bytes, system default if not set")
+        jtiListen    = flag.String("jti_listen", "", "Address to receive Juniper JTI native sensors on over udp, e.g. :50000, next to the dialout transport, disabled if not set")
+        jtiDescriptors = flag.String("jti_descriptors", "", "Descriptor set of the Juniper protos, protoc --include_imports -o, sensors are decoded with field numbers if not set")
         dontClean    = flag.Bool("dont_clean", false, "Don't remove tmp files on exit")
-        outFileName  = flag.String("out", "dump_*.txt", "output file to write to")
+        outFileName  = flag.String("out", "dump_*.txt", "output file to write to, can be a template, /data/{{.Router}}-{{.Date}}.json, or a sink, elasticsearch:<host:port>, opensearch:<host:port>, parquet:<dir>, csv:<file>, sqlite:<file>, clickhouse:<host:port>, postgres:<user:password@host:port/db>, graphite:<host:port>, opentsdb:<host:port>, statsd:<host:port>, nats:<host:port>, mqtt:<host:port>, redis:<host:port>, pubsub:<project>, kinesis:<stream>, s3:<bucket>/<prefix>, fluentd:<host:port>, gelf:<host:port>, loki:<host:port>, avro:<dir>, msgpack:<file>, cbor:<file>, relay:<host:port>, capture:<dir>")
+        outCompress  = flag.String("out_compress", "", "compress output file, Options: gzip,zstd")
+        outFormat    = flag.String("format", "json", "format of decoded messages in output file, Options: json,text,table, text is protobuf text format, gpb encodings only, table shows rows as aligned columns")
+        envelope     = flag.Bool("envelope", false, "Wrap every message in the output file with router address, transport, receive time and subscription, json format only")
+        tableFields  = flag.String("fields", "", "Leafs to show with -format table or to pin with -tui, comma separated, nested leafs joined with \".\", rates.input-rate, all leafs if not set")
+        yangModels   = flag.String("yang_models", "", "Directory of .yang files of streamed models, rows get leaf values of their yang type, enum names and units")
+        pathMap      = flag.String("path_map", "", "File mapping sensor paths and leaf names to new ones, e.g. OpenConfig paths, for rows written to sinks")
+        wasmTransform = flag.String("wasm_transform", "", "WebAssembly module, WASI, transforming rows of every message, json array of rows on stdin, rows to keep on stdout")
+        wasmDecoder  = flag.String("wasm_decoder", "", "WebAssembly module, WASI, decoding keys and content of gpb rows without plugin, a row part on stdin, its json on stdout")
+        scriptFile   = flag.String("script", "", "Starlark file with a transform(row) function called for every row, returns the row, changed or not, None to drop it, or a list of rows")
+        dedup        = flag.String("dedup", "", "Drop rows written to sinks that were already written, same node, sensor path, keys and timestamp, seen rows kept in memory or redis:<host:port> shared by collectors")
+        dedupWindow  = flag.Duration("dedup_window", 10 * time.Minute, "How long rows are remembered for -dedup")
+        redactFile   = flag.String("redact", "", "File of rules dropping, hashing or masking leafs of rows before any output, usernames, prefixes, community strings")
+        encryptKey   = flag.String("encrypt_key", "", "File with a 32 byte key, raw or hex, output files and capture segments are encrypted with, AES-GCM, replay and decode read files encrypted with it")
         pluginDir    = flag.String("plugin_dir", "", "absolute path to directory for proto plugins")
         pluginFile    = flag.String("plugin", "", "plugin file, used to lookup gpb symbol for decode")
         certFile     = flag.String("cert","","TLS cert file")
         keyFile      = flag.String("key","","TLS key file")
+        ack          = flag.Bool("ack", false, "With grpc, send the ReqId of every message back on the dialout stream once it is queued for decoding, for routers doing flow control")
+        maxRecvMsgSize = flag.Int("max_recv_msg_size", 0, "With grpc, max size in bytes of a message that can be received, default is grpc default of 4MB")
+        maxConcurrentStreams = flag.Uint("max_concurrent_streams", 0, "With grpc, max number of dialout streams on one router connection, unlimited if not set")
+        keepaliveTime = flag.Duration("keepalive_time", 0, "With grpc, ping a router after this much idle time on its connection, e.g. 1m, grpc default of 2h if not set")
+        keepaliveTimeout = flag.Duration("keepalive_timeout", 20 * time.Second, "With grpc, close the connection if keepalive ping is not acked within this time")
+        keepaliveMinTime = flag.Duration("keepalive_min_time", 0, "With grpc, least time between keepalive pings of a router, connections of routers pinging more often are closed, grpc default of 5m if not set")
+        keepalivePermitWithoutStream = flag.Bool("keepalive_permit_without_stream", false, "With grpc, allow routers to send keepalive pings when there is no active stream")
+        maxConnectionIdle = flag.Duration("max_connection_idle", 0, "With grpc, close router connections without streams for this long, e.g. 10m, never if not set")
+        clientCA     = flag.String("client_ca", "", "CA file for verifying router certificates, routers must present a certificate signed by it, mutual TLS, needs -cert and -key")
+        allow        = flag.String("allow", "", "Routers allowed to send, comma separated addresses or prefixes, 10.0.0.0/8,192.168.1.5, all if not set")
+        allowNames   = flag.String("allow_names", "", "With -client_ca, names allowed in router certificates, common name or dns name, comma separated, all signed by the CA if not set")
+        adminListen  = flag.String("admin_listen", "", "Address to serve admin api on, ip:port, disabled if not set")
+        adminTokenFile = flag.String("admin_token_file", "", "File with token for admin api, required for admin api")
+        adminCert    = flag.String("admin_cert", "", "TLS cert file for admin api")
+        adminKey     = flag.String("admin_key", "", "TLS key file for admin api")
+        healthListen = flag.String("health_listen", "", "Address to serve /healthz and /readyz probes on, ip:port, disabled if not set")
+        readyWindow  = flag.Duration("ready_window", time.Minute, "/readyz fails if no message was received within this duration")
+        restreamListen = flag.String("restream_listen", "", "Address to serve received messages again to downstream consumers on, ip:port, over the dialin CreateSubs rpc, disabled if not set")
+        restreamCert = flag.String("restream_cert", "", "TLS cert file for restream")
+        restreamKey  = flag.String("restream_key", "", "TLS key file for restream")
+        gnmiListen   = flag.String("gnmi_listen", "", "Address to serve received rows on to gNMI clients, ip:port, Subscribe and Get, disabled if not set")
+        gnmiCert     = flag.String("gnmi_cert", "", "TLS cert file for gNMI server")
+        gnmiKey      = flag.String("gnmi_key", "", "TLS key file for gNMI server")
+        dashboardListen = flag.String("dashboard_listen", "", "Address to serve web dashboard on, e.g. 127.0.0.1:8080, disabled if not set")
+        debugListen  = flag.String("debug_listen", "", "Address to serve pprof and expvar on, e.g. 127.0.0.1:6060, disabled if not set")
+        controlAllow = flag.String("control_allow", "", "Addresses or prefixes, comma separated, that may connect to the admin api, debug endpoint and dashboard, any if not set")
+        controlTokenFile = flag.String("control_token_file", "", "File with token required by the debug endpoint and dashboard, as for the admin api")
+        daemon       = flag.Bool("daemon", false, "Run as systemd service, write pidfile, notify systemd when listening and send watchdog heartbeats")
+        pidFile      = flag.String("pidfile", "/run/telemetry_dialout_collector.pid", "Pidfile to write with -daemon")
+        tlsReload    = flag.Duration("tls_reload", time.Minute, "Interval for checking TLS cert and key files for changes, changed cert is used for new sessions, 0 to disable")
+        quiet        = flag.Bool("quiet", false, "Print errors only")
+        verbose      = flag.Bool("v", false, "Print a line for every received message")
+        debug        = flag.Bool("vv", false, "Print transport details of every message, implies -v")
+        colorMode    = flag.String("color", "auto", "Highlight sensor paths, errors and timestamps, Options: auto,always,never, auto colors if stdout is a terminal")
+        tui          = flag.Bool("tui", false, "Live view of sessions, message rates, leafs pinned with -fields and incoming rows, q to quit")
+        checkConfig  = flag.Bool("check_config", false, "Check options, outputs, TLS files, allow list and loaded files, print a report and exit, non-zero if a check failed")
+        checkReachability = flag.Bool("check_reachability", false, "With -check_config, also check the port can be listened on and output hosts can be connected to")
+        maxMessages  = flag.Uint64("max_messages", 0, "Stop after this many messages across all sessions, writing out outputs and printing a summary, no limit if not set")
+        maxDuration  = flag.Duration("max_duration", 0, "Stop after running this long, e.g. 10m, writing out outputs and printing a summary, no limit if not set")
+        rateLimit    = flag.String("rate_limit", "", "Rate limits of processing messages, [subscription:]msgs=<n>,bytes=<n>,burst=<duration>, ; separated, all the messages if no subscription, changed from admin api")
+        chaos        = flag.String("chaos", "", "Inject faults for testing, chance of a message being delayed, dropped, failing to decode or closing its stream, delay=0.1:500ms,drop=0.01,fail=0.01,disconnect=0.001,seed=1, never for production")
+        quarantineDir = flag.String("quarantine_dir", "", "Directory messages that fail to decode are written to, as received, with session, router and error next to them, not kept if not set")
 )
 
 const tmpFileName                = "telemetry-msg-*.dat"
@@ -49,21 +124,177 @@ const tmpFileName                = "telemetry-msg-*.dat"
 func main() {
      flag.Usage = usage
      flag.Parse()
+     if err := telemetry_admin.FlagsFromEnv(flag.CommandLine, "MDT_"); err != nil {
+         log.Fatal(err)
+     }
+     if err := telemetry_admin.FlagFiles(flag.CommandLine); err != nil {
+         log.Fatal(err)
+     }
+     telemetry_log.Setup(telemetry_log.FlagLevel(*quiet, *verbose, *debug), *colorMode)
 
-     if !*dontClean {
-         // install signal handler for cleaning up tmp files
-         sigs := make(chan os.Signal, 1)
-         signal.Notify(sigs, os.Interrupt)
+     if *checkConfig {
+         os.Exit(mdtCheckConfig())
+     }
+     if err := mdtCheckFlags(); err != nil {
+         log.Fatal(err)
+     }
+     if *yangModels != "" {
+         if err := telemetry_decode.MdtYangLoad(*yangModels); err != nil {
+             log.Fatalf("Failed to load yang models: %v", err)
+         }
+     }
+     if *scriptFile != "" {
+         if err := telemetry_decode.MdtScriptLoad(*scriptFile); err != nil {
+             log.Fatalf("Failed to load script: %v", err)
+         }
+     }
+     if *wasmTransform != "" {
+         if err := telemetry_decode.MdtWasmStart(*wasmTransform); err != nil {
+             log.Fatalf("Failed to start WebAssembly transform: %v", err)
+         }
+     }
+     if *wasmDecoder != "" {
+         if err := telemetry_decode.MdtWasmDecoderStart(*wasmDecoder); err != nil {
+             log.Fatalf("Failed to start WebAssembly decoder: %v", err)
+         }
+     }
+     if *pathMap != "" {
+         if err := telemetry_decode.MdtPathMapLoad(*pathMap); err != nil {
+             log.Fatalf("Failed to load path map: %v", err)
+         }
+     }
+     if *dedup != "" {
+         if err := telemetry_decode.MdtDedupSetup(*dedup, *dedupWindow); err != nil {
+             log.Fatalf("Failed to set up dedup: %v", err)
+         }
+     }
+     if *redactFile != "" {
+         if err := telemetry_decode.MdtRedactLoad(*redactFile); err != nil {
+             log.Fatalf("Failed to load redact rules: %v", err)
+         }
+     }
+     if *encryptKey != "" {
+         if err := telemetry_decode.MdtEncryptSetup(*encryptKey); err != nil {
+             log.Fatalf("Failed to load -encrypt_key: %v", err)
+         }
+     }
+     if *jtiDescriptors != "" {
+         if err := telemetry_decode.MdtJtiLoad(*jtiDescriptors); err != nil {
+             log.Fatalf("-jti_descriptors: %v", err)
+         }
+     }
+     var err error
+     if allowList, err = mdtParseAllow(*allow, *allowNames); err != nil {
+         log.Fatalf("-allow: %v", err)
+     }
+
+     // install signal handler for cleaning up tmp files and pidfile and
+     // for writing out buffered rows, systemd stops the collector with SIGTERM
+     sigs := make(chan os.Signal, 1)
+     signal.Notify(sigs, os.Interrupt, syscall.SIGTERM)
+     go func() {
+         <- sigs
+         mdtExit()
+     }()
+
+     if *rateLimit != "" {
+         limits, err := telemetry_decode.MdtRateLimitParse(*rateLimit)
+         if err != nil {
+             log.Fatalf("Invalid -rate_limit: %v", err)
+         }
+         for _, l := range limits {
+             telemetry_decode.MdtSetRateLimit(l)
+         }
+     }
+
+     telemetry_decode.MdtSetTLSReload(*tlsReload)
+
+     if *chaos != "" {
+         if err := telemetry_decode.MdtChaosSetup(*chaos); err != nil {
+             log.Fatalf("Invalid -chaos: %v", err)
+         }
+         log.Printf("Chaos mode, injecting faults: %s", *chaos)
+     }
+
+     if *quarantineDir != "" {
+         if err := telemetry_decode.MdtQuarantineSetup(*quarantineDir); err != nil {
+             log.Fatalf("Invalid -quarantine_dir: %v", err)
+         }
+     }
+
+     if *maxMessages > 0 || *maxDuration > 0 {
+         telemetry_decode.MdtOutSetBound(*maxMessages, *maxDuration, mdtExit)
+     }
+
+     if *tui {
+         if err := telemetry_decode.MdtTuiStart(*tableFields, mdtExit); err != nil {
+             log.Fatalf("Failed to start live view: %v", err)
+         }
+         defer telemetry_decode.MdtTuiStop()
+     }
+
+     if err := telemetry_admin.ControlAccessSetup(*controlAllow, *controlTokenFile); err != nil {
+         log.Fatalf("Control access: %v", err)
+     }
+
+     if *adminListen != "" {
+         admin, err := telemetry_admin.NewAdminServer(*adminTokenFile)
+         if err != nil {
+             log.Fatalf("Failed to start admin api: %v", err)
+         }
+         admin.Shutdown = mdtExit
          go func() {
-             <- sigs
-             // cleanup
-             files, _ := filepath.Glob(os.TempDir() + "/" + tmpFileName)
-             for _, f := range files {
-                 if err := os.Remove(f); err != nil {
-                     fmt.Printf("Failed to remove tmp file %s\n",f)
-                 }
-             }
-             os.Exit(0)
+             err := admin.ListenAndServe(*adminListen, *adminCert, *adminKey, *tlsReload)
+             log.Fatalf("Admin api: %v", err)
+         }()
+     }
+
+     if *debugListen != "" {
+         go func() {
+             err := telemetry_admin.ServeDebug(*debugListen)
+             log.Fatalf("Debug endpoint: %v", err)
+         }()
+     }
+
+     if *healthListen != "" {
+         go func() {
+             err := telemetry_admin.ServeHealth(*healthListen, *readyWindow)
+             log.Fatalf("Health probes: %v", err)
+         }()
+     }
+
+     if *restreamListen != "" {
+         go func() {
+             err := telemetry_restream.Serve(*restreamListen, *restreamCert, *restreamKey, *tlsReload)
+             log.Fatalf("Restream: %v", err)
+         }()
+     }
+
+     if *gnmiListen != "" {
+         go func() {
+             err := telemetry_gnmi.Serve(*gnmiListen, *gnmiCert, *gnmiKey, *tlsReload)
+             log.Fatalf("gNMI server: %v", err)
+         }()
+     }
+
+     if *dashboardListen != "" {
+         go func() {
+             err := telemetry_admin.ServeDashboard(*dashboardListen)
+             log.Fatalf("Dashboard: %v", err)
+         }()
+     }
+
+     if *daemon {
+         if err := telemetry_admin.WritePidFile(*pidFile); err != nil {
+             log.Fatalf("Failed to write pidfile: %v", err)
+         }
+         defer telemetry_admin.RemovePidFile(*pidFile)
+     }
+
+     if *jtiListen != "" {
+         go func() {
+             err := mdtJtiServer(*jtiListen)
+             log.Fatalf("JTI: %v", err)
          }()
      }
 
@@ -76,6 +307,78 @@ func main() {
      }
 }
 
+// flag combinations that are not supported
+func mdtCheckFlags() error {
+     if (*certFile == "") != (*keyFile == "") {
+         return fmt.Errorf("TLS needs both -cert and -key")
+     }
+     if *clientCA != "" && *certFile == "" {
+         return fmt.Errorf("-client_ca needs -cert and -key")
+     }
+     if *certFile != "" && *transport != "grpc" {
+         return fmt.Errorf("TLS is supported with grpc transport only")
+     }
+     switch *platform {
+     case "xr", "xe", "nxos":
+     default:
+         return fmt.Errorf("Invalid platform %s, Options: xr,xe,nxos", *platform)
+     }
+     if *envelope && (*outFormat != "json" || *decode_raw || *protoFile != "") {
+         return fmt.Errorf("-envelope needs -format json, without -decode_raw or -proto")
+     }
+     if *transport != "grpc" && (*ack || *maxRecvMsgSize > 0 || *maxConcurrentStreams > 0 || *keepaliveTime > 0 ||
+                                 *keepaliveMinTime > 0 || *keepalivePermitWithoutStream || *maxConnectionIdle > 0) {
+         return fmt.Errorf("grpc tuning options are supported with grpc transport only")
+     }
+     if *jtiListen != "" && (*outFormat == "text" || *decode_raw || *protoFile != "") {
+         return fmt.Errorf("-jti_listen is not supported with -format text, -decode_raw or -proto")
+     }
+     if *allowNames != "" && *clientCA == "" {
+         return fmt.Errorf("-allow_names needs -client_ca")
+     }
+     return nil
+}
+
+// cleanup tmp files and exit
+func mdtExit() {
+     telemetry_decode.MdtTuiStop()
+     // write out rows buffered in sinks
+     telemetry_decode.MdtOutClose()
+     if *daemon {
+         telemetry_admin.RemovePidFile(*pidFile)
+     }
+     if !*dontClean {
+         files, _ := filepath.Glob(os.TempDir() + "/" + tmpFileName)
+         for _, f := range files {
+             if err := os.Remove(f); err != nil {
+                 telemetry_log.Errorf("Failed to remove tmp file %s\n",f)
+             }
+         }
+     }
+     os.Exit(0)
+}
+
+// notify systemd once server is listening, heartbeats are sent as long as
+// collector is running
+func mdtListening() {
+     if *daemon {
+         if err := telemetry_admin.SdNotify("READY=1"); err != nil {
+             log.Printf("Failed to notify systemd: %v", err)
+         }
+         go telemetry_admin.SdWatchdog(func() bool { return true })
+     }
+}
+
+// router address used in output file template, port is left out as it
+// changes with every session
+func mdtRouter(addr net.Addr) string {
+     host, _, err := net.SplitHostPort(addr.String())
+     if err != nil {
+         return addr.String()
+     }
+     return host
+}
+
 // grpc server
 func mdtGrpcServer(grpcPort string) {
      var lis net.Listener
@@ -83,14 +386,21 @@ func mdtGrpcServer(grpcPort string) {
      var opts []grpc.ServerOption
 
      if *certFile != "" && *keyFile != "" {
-         fmt.Printf("Enabled TLS, cert: %v key: %v\n", *certFile, *keyFile)
-         creds, err := credentials.NewServerTLSFromFile(*certFile, *keyFile)
+         telemetry_log.Printf("Enabled TLS, cert: %v key: %v\n", *certFile, *keyFile)
+         var tlsConfig *tls.Config
+         if *clientCA != "" {
+             telemetry_log.Printf("Enabled mutual TLS, client CA: %v\n", *clientCA)
+             tlsConfig, err = telemetry_tls.NewMutualServerConfig(*certFile, *keyFile, *clientCA, *tlsReload)
+         } else {
+             tlsConfig, err = telemetry_tls.NewServerConfig(*certFile, *keyFile, *tlsReload)
+         }
          if err != nil {
-             fmt.Printf("Failed to generate credentials %v", err)
+             telemetry_log.Errorf("Failed to generate credentials %v", err)
              return
          }
-         opts = []grpc.ServerOption{grpc.Creds(creds)}
+         opts = []grpc.ServerOption{grpc.Creds(credentials.NewTLS(tlsConfig))}
      }
+     opts = append(opts, mdtGrpcServerOptions()...)
 
      grpcServer := grpc.NewServer(opts...)
      s := gRPCMdtDialoutServer{}
@@ -98,52 +408,116 @@ func mdtGrpcServer(grpcPort string) {
 
      lis, err = net.Listen("tcp", grpcPort)
      if err != nil {
-         fmt.Printf("Failed to open listen port %v", err)
+         telemetry_log.Errorf("Failed to open listen port %v", err)
          return
      }
 
-     fmt.Println("GRPC server listening at ", grpcPort)
-     grpcServer.Serve(lis)
+     telemetry_log.Println("GRPC server listening at ", grpcPort)
+     mdtListening()
+     err = grpcServer.Serve(allowListener{lis})
      if err != nil {
-         fmt.Printf("Server stopped: %v", err)
+         telemetry_log.Errorf("Server stopped: %v", err)
+     }
+}
+
+// server options from the tuning flags, left at grpc defaults if not set.
+// Routers keepalive pinging faster than keepalive_min_time are sent a
+// GOAWAY and their connection closed, it must be at most the ping interval
+// configured on the routers.
+func mdtGrpcServerOptions() []grpc.ServerOption {
+     var opts []grpc.ServerOption
+     if *maxRecvMsgSize > 0 {
+         opts = append(opts, grpc.MaxRecvMsgSize(*maxRecvMsgSize))
+     }
+     if *maxConcurrentStreams > 0 {
+         opts = append(opts, grpc.MaxConcurrentStreams(uint32(*maxConcurrentStreams)))
      }
+     if *keepaliveMinTime > 0 || *keepalivePermitWithoutStream {
+         opts = append(opts, grpc.KeepaliveEnforcementPolicy(keepalive.EnforcementPolicy{
+                                MinTime:             *keepaliveMinTime,
+                                PermitWithoutStream: *keepalivePermitWithoutStream,
+                             }))
+     }
+     if *keepaliveTime > 0 || *maxConnectionIdle > 0 {
+         opts = append(opts, grpc.KeepaliveParams(keepalive.ServerParameters{
+                                Time:              *keepaliveTime,
+                                Timeout:           *keepaliveTimeout,
+                                MaxConnectionIdle: *maxConnectionIdle,
+                             }))
+     }
+     return opts
 }
 
 type gRPCMdtDialoutServer struct{}
 
 func (s *gRPCMdtDialoutServer) MdtDialout(stream mdt_dialout.GRPCMdtDialout_MdtDialoutServer) error {
+     var name, router, source string
      peer, ok := peer.FromContext(stream.Context())
+     if ok && !allowList.allowedPeer(peer) {
+         return status.Error(codes.PermissionDenied, "certificate name not allowed")
+     }
      if ok {
-         fmt.Printf("Session connected from %s\n", peer.Addr.String())
+         telemetry_log.Printf("Session connected from %s\n", peer.Addr.String())
+         source = peer.Addr.String()
+         name = "grpc " + source
+         router = mdtRouter(peer.Addr)
      }
 
      dataChan := make(chan []byte, 10000)
      defer close(dataChan)
      o := &telemetry_decode.MdtOut{
+                        Name:        name,
+                        Router:      router,
                         OutFile:     *outFileName,
+                        OutCompress: *outCompress,
+                        OutFormat:   *outFormat,
+                        TableFields: *tableFields,
                         Encoding:    *encoding,
                         Decode_raw:  *decode_raw,
                         DontClean:   *dontClean,
                         ProtoFile:   *protoFile,
                         PluginDir:   *pluginDir,
                         PluginFile:  *pluginFile,
+                        Source:      source,
+                        Transport:   "grpc",
+                        Envelope:    *envelope,
+                        Platform:    *platform,
                         DataChan:     dataChan,
      }
+     if err := o.MdtOutOpen(); err != nil {
+         // router reconnects and tries again
+         telemetry_log.Errorf("MdtDialout: %s: %v\n", name, err)
+         return status.Error(codes.Unavailable, err.Error())
+     }
      // handler for decoding the data, reads data from dataChan
      go o.MdtOutLoop()
 
      for {
          reply, err := stream.Recv()
          if err == io.EOF {
-             fmt.Printf("MdtDialout: Got EOF\n\n")
+             telemetry_log.Printf("MdtDialout: Got EOF\n\n")
              return err
          }
          if err != nil {
-             fmt.Printf("MdtDialout: Stream Recv got error %v", err)
+             telemetry_log.Errorf("MdtDialout: Stream Recv got error %v", err)
              return err
          }
 
+         telemetry_log.Debugf("MdtDialout: %s received message len: %v reqid %v\n", name, len(reply.Data), reply.ReqId)
          dataChan <- reply.Data
+         if telemetry_decode.MdtChaosDisconnect() {
+             telemetry_log.Printf("MdtDialout: %s: chaos: stream disconnected\n", name)
+             return status.Error(codes.Unavailable, "chaos: stream disconnected")
+         }
+         if *ack {
+             // queue is full while decoding falls behind, so acks slow
+             // down as well
+             err = stream.Send(&mdt_dialout.MdtDialoutArgs{ReqId: reply.ReqId})
+             if err != nil {
+                 telemetry_log.Errorf("MdtDialout: Stream Send got error %v", err)
+                 return err
+             }
+         }
      }
 
      return nil
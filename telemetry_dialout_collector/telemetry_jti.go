@@ -0,0 +1,60 @@
+package main
+
+import (
+        "net"
+        "time"
+
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+// Juniper routers stream native sensors over udp, every datagram a
+// TelemetryStream message, without header. They are received next to the
+// dialout transport, on -jti_listen, so Cisco and Juniper routers can send
+// to the same collector and outputs. As with udp dialout every router
+// address is a session of its own.
+
+func mdtJtiServer(addr string) error {
+     serverAddr, err := net.ResolveUDPAddr("udp", addr)
+     if err != nil {
+         return err
+     }
+     conn, err := net.ListenUDP("udp", serverAddr)
+     if err != nil {
+         return err
+     }
+     defer conn.Close()
+     if *udpReadBuffer > 0 {
+         if err = conn.SetReadBuffer(*udpReadBuffer); err != nil {
+             telemetry_log.Errorln("Failed to set read buffer:", err)
+         }
+     }
+     telemetry_log.Println("JTI server listening at ", addr)
+
+     sessions := make(map[string]*udpSession)
+     lastSweep := time.Now()
+     buf := make([]byte, 64*1024)
+     for {
+         n, peer, err := conn.ReadFromUDP(buf)
+         if err != nil {
+             telemetry_log.Errorln("Read error:", err, "from", peer)
+             continue
+         }
+         if !allowList.allowed(peer) {
+             continue
+         }
+         now := time.Now()
+         if now.Sub(lastSweep) > time.Minute {
+             mdtUdpSweep(sessions, now)
+             lastSweep = now
+         }
+         s, ok := sessions[peer.String()]
+         if !ok {
+             telemetry_log.Printf("JTI session started from %s\n", peer)
+             s = newUdpSession(peer, "jti")
+             sessions[s.peer] = s
+         }
+         s.last = now
+         telemetry_log.Debugf("From %s received jti message len: %v\n", peer, n)
+         s.message("jti", buf[:n])
+     }
+}
@@ -1,13 +1,16 @@
 package main
 
 import (
+        "bufio"
         "fmt"
         "io"
         "net"
         "bytes"
         "encoding/binary"
+        "time"
 
         "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
 )
 
 ///////////////////////////////////
@@ -28,11 +31,15 @@ const (
       ENC_ST_HDR_MSG_TYPE_HEARTBEAT
 )
 
+// gpb encaps all carry a Telemetry message, compact or key-value rows are
+// told apart by the decoder from the message itself
 type encapSTHdrMsgEncap uint16
 const (
       ENC_ST_HDR_MSG_ENCAP_UNSED encapSTHdrMsgEncap = iota
       ENC_ST_HDR_MSG_ENCAP_GPB
       ENC_ST_HDR_MSG_ENCAP_JSON
+      ENC_ST_HDR_MSG_ENCAP_GPB_COMPACT
+      ENC_ST_HDR_MSG_ENCAP_GPB_KV
 )
 
 type tcpMsgHdr struct {
@@ -47,11 +54,13 @@ type tcpSession struct {
      conn          *net.TCPConn
      // tcp msg header
      hdr           []byte
+     // bytes skipped for a bad header, kept for -quarantine_dir
+     skipped       []byte
 }
 
 func mdtGetEncodeStr(enc encapSTHdrMsgEncap) string {
      switch (enc) {
-     case ENC_ST_HDR_MSG_ENCAP_GPB:
+     case ENC_ST_HDR_MSG_ENCAP_GPB, ENC_ST_HDR_MSG_ENCAP_GPB_COMPACT, ENC_ST_HDR_MSG_ENCAP_GPB_KV:
          return "gpb"
      case ENC_ST_HDR_MSG_ENCAP_JSON:
          return "json"
@@ -60,45 +69,150 @@ func mdtGetEncodeStr(enc encapSTHdrMsgEncap) string {
      }
 }
 
+// largest message accepted, a bad header must not make us allocate
+// gigabytes
+const tcpMaxMsgLen = 64 * 1024 * 1024
+
+// header version sent by routers, the only one defined
+const tcpHdrVersion = 1
+
+// true if header has a version and encap we can decode
+func tcpHdrKnown(hdr *tcpMsgHdr) bool {
+     return hdr.MsgHdrVersion == tcpHdrVersion && mdtGetEncodeStr(hdr.MsgEncap) != "Unknown"
+}
+
+// true if header is one a router would send, a header read out of step
+// with the messages, after a corrupt length, is very unlikely to be.
+// Encap may still be one we can't decode, the message is then discarded
+// whole. Only version 1 is supported, other versions are skipped as bad
+// headers.
+func tcpHdrValid(hdr *tcpMsgHdr) bool {
+     if hdr.MsgHdrVersion != tcpHdrVersion {
+         return false
+     }
+     switch hdr.MsgType {
+     case ENC_ST_HDR_MSG_TYPE_TELEMETRY_DATA:
+         return hdr.Msglen != 0 && hdr.Msglen <= tcpMaxMsgLen
+     case ENC_ST_HDR_MSG_TYPE_HEARTBEAT:
+         return hdr.Msglen == 0
+     }
+     return false
+}
+
+// read the next valid header. A bad header is skipped a byte at a time
+// till a valid one is found, giving up after tcpMaxMsgLen bytes. Returns
+// the number of bytes skipped, kept in s.skipped if quarantining.
+func (s *tcpSession) readHeader(r *bufio.Reader, hdr *tcpMsgHdr) (int, error) {
+     if _, err := io.ReadFull(r, s.hdr); err != nil {
+         return 0, err
+     }
+     quarantine := telemetry_decode.MdtQuarantining()
+     s.skipped = s.skipped[:0]
+     skipped := 0
+     for {
+         binary.Read(bytes.NewReader(s.hdr), binary.BigEndian, hdr)
+         if tcpHdrValid(hdr) {
+             return skipped, nil
+         }
+         if skipped >= tcpMaxMsgLen {
+             return skipped, fmt.Errorf("no valid header in %d bytes", skipped)
+         }
+         b, err := r.ReadByte()
+         if err != nil {
+             return skipped, err
+         }
+         if quarantine {
+             s.skipped = append(s.skipped, s.hdr[0])
+         }
+         copy(s.hdr, s.hdr[1:])
+         s.hdr[len(s.hdr) - 1] = b
+         skipped++
+     }
+}
+
+// a session per router connection, each with its own output, sessions run
+// concurrently
 func (s *tcpSession) handleConnection() {
      var hdr tcpMsgHdr
      var buf []byte
 
+     peer := s.conn.RemoteAddr().String()
+     defer s.conn.Close()
      dataChan := make(chan []byte, 10000)
-     defer close(dataChan)
+     outDone := make(chan struct{})
      o := &telemetry_decode.MdtOut{
+                        Name:        "tcp " + peer,
+                        Router:      mdtRouter(s.conn.RemoteAddr()),
                         OutFile:     *outFileName,
+                        OutCompress: *outCompress,
+                        OutFormat:   *outFormat,
+                        TableFields: *tableFields,
                         Encoding:    *encoding,
                         Decode_raw:  *decode_raw,
                         DontClean:   *dontClean,
                         ProtoFile:   *protoFile,
                         PluginDir:   *pluginDir,
+                        PluginFile:  *pluginFile,
+                        Source:      peer,
+                        Transport:   "tcp",
+                        Envelope:    *envelope,
+                        Platform:    *platform,
                         DataChan:     dataChan,
      }
 
-     go o.MdtOutLoop()
+     if err := o.MdtOutOpen(); err != nil {
+         // router reconnects and tries again
+         telemetry_log.Errorf("Session from %s: %v\n", peer, err)
+         return
+     }
+     go func() {
+         o.MdtOutLoop()
+         close(outDone)
+     }()
+
+     messages := 0
+     defer func() {
+         // let output loop write what is queued
+         close(dataChan)
+         <-outDone
+         telemetry_log.Printf("Session from %s closed, %d messages\n", peer, messages)
+     }()
 
+     r := bufio.NewReaderSize(s.conn, 64 * 1024)
      for {
          // read header for tcp message.
-         _, err := io.ReadFull(s.conn, s.hdr)
+         skipped, err := s.readHeader(r, &hdr)
+         if skipped != 0 {
+             telemetry_log.Errorf("Session from %s: bad header, skipped %d bytes\n", peer, skipped)
+             if len(s.skipped) != 0 {
+                 telemetry_decode.MdtQuarantine(o.Name, peer, "tcp", s.skipped, fmt.Errorf("bad header, skipped %d bytes", skipped))
+             }
+         }
          if err != nil {
-             if err == io.EOF {
-                fmt.Printf(".")
-                return
-             } else {
-                fmt.Println("Read error : ", err)
-                continue       // should return? allows router to reconnect
+             if err != io.EOF {
+                telemetry_log.Errorf("Session from %s: read error: %v\n", peer, err)
              }
+             return
          }
-         hdrbuf := bytes.NewReader(s.hdr)
-         err = binary.Read(hdrbuf, binary.BigEndian, &hdr)
-         //fmt.Printf("Received message len: %v encode %v\n", hdr.Msglen, hdr.MsgEncap)
+         telemetry_log.Debugf("%s received message len: %v encode %v\n", peer, hdr.Msglen, hdr.MsgEncap)
          buf = make([]byte, hdr.Msglen)
 
          // read rest of the tcp message using length from header.
-         _, err = io.ReadFull(s.conn, buf)
+         _, err = io.ReadFull(r, buf)
          if err != nil {
-            fmt.Println(err)
+            telemetry_log.Errorf("Session from %s: read error: %v\n", peer, err)
+            return
+         }
+         if hdr.MsgType != ENC_ST_HDR_MSG_TYPE_TELEMETRY_DATA {
+            // heartbeat
+            continue
+         }
+         if !tcpHdrKnown(&hdr) {
+            reason := fmt.Errorf("encap %d not supported, discarded %d bytes", hdr.MsgEncap, hdr.Msglen)
+            telemetry_log.Errorf("Session from %s: %v\n", peer, reason)
+            if telemetry_decode.MdtQuarantining() {
+                telemetry_decode.MdtQuarantine(o.Name, peer, "tcp", append(append([]byte(nil), s.hdr...), buf...), reason)
+            }
             continue
          }
 
@@ -106,6 +220,11 @@ func (s *tcpSession) handleConnection() {
          o.MdtOutSetEncoding(mdtGetEncodeStr(hdr.MsgEncap))
          // write to the data channel
          dataChan <- buf
+         messages++
+         if telemetry_decode.MdtChaosDisconnect() {
+             telemetry_log.Printf("Session from %s: chaos: connection closed\n", peer)
+             return
+         }
      }
 }
 
@@ -125,14 +244,27 @@ func mdtTcpServer(tcpPort string) error {
      }
      defer listener.Close()
 
-     fmt.Println("TCP server listening at ", tcpPort)
+     telemetry_log.Println("TCP server listening at ", tcpPort)
+     mdtListening()
      for {
          serverConn, err := listener.AcceptTCP()
          if err != nil {
+             if ne, ok := err.(net.Error); ok && ne.Temporary() {
+                 // out of file descriptors, wait for sessions to close
+                 telemetry_log.Errorln("Accept error:", err)
+                 time.Sleep(time.Second)
+                 continue
+             }
              panic(err)
          }
-         defer serverConn.Close()
-         fmt.Printf("Session connected from %s\n", serverConn.RemoteAddr())
+         if !allowList.allowed(serverConn.RemoteAddr()) {
+             serverConn.Close()
+             continue
+         }
+         // routers gone without closing the connection are noticed
+         serverConn.SetKeepAlive(true)
+         serverConn.SetKeepAlivePeriod(time.Minute)
+         telemetry_log.Printf("Session connected from %s\n", serverConn.RemoteAddr())
 
          s := new(tcpSession)
          s.conn  = serverConn
@@ -1,13 +1,13 @@
 package main
 
 import (
-        "fmt"
-        "io"
         "net"
         "bytes"
         "encoding/binary"
+        "time"
 
         "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+        "github.com/ios-xr/telemetry-go-collector/telemetry_log"
 )
 
 ///////////////////////////////////
@@ -20,24 +20,98 @@ import (
 //|          Msg Length        |
 // ----------------------------
 ///////////////////////////////////
+// Every datagram is a message with the same header as tcp. Messages of a
+// router go to a session of its own, as with tcp, a session is closed
+// after udpIdle without messages. Some exporters split messages larger
+// than a datagram, with -udp_reassemble a datagram shorter than the
+// length in its header is joined with the datagrams that follow from the
+// same router, without header, until the length is reached. Without it
+// such messages are dropped as truncated.
 
-func mdtUdpServer(udpPort string) error {
-     var err error
-     var hdr tcpMsgHdr
+const (
+      udpHdrLen     = 12
+      udpIdle       = 10 * time.Minute
+      // parts of a message arrive within this time or it is dropped
+      udpReassembly = time.Second
+)
+
+type udpSession struct {
+     peer     string
+     o        *telemetry_decode.MdtOut
+     dataChan chan []byte
+     done     chan struct{}
+     last     time.Time
+     messages int
+     // message being reassembled
+     partial  []byte
+     want     int
+     encap    encapSTHdrMsgEncap
+     started  time.Time
+}
 
-     dataChan := make(chan []byte, 10000)
-     defer close(dataChan)
-     o := &telemetry_decode.MdtOut{
+// transport is udp, or jti for juniper sensors
+func newUdpSession(addr *net.UDPAddr, transport string) *udpSession {
+     platform := *platform
+     if transport == "jti" {
+         platform = ""
+     }
+     s := &udpSession{
+               peer:     addr.String(),
+               dataChan: make(chan []byte, 10000),
+               done:     make(chan struct{}),
+          }
+     s.o = &telemetry_decode.MdtOut{
+                        Name:        transport + " " + s.peer,
+                        Router:      mdtRouter(addr),
                         OutFile:     *outFileName,
+                        OutCompress: *outCompress,
+                        OutFormat:   *outFormat,
+                        TableFields: *tableFields,
                         Encoding:    *encoding,
                         Decode_raw:  *decode_raw,
                         DontClean:   *dontClean,
                         ProtoFile:   *protoFile,
                         PluginDir:   *pluginDir,
-                        DataChan:     dataChan,
+                        PluginFile:  *pluginFile,
+                        Source:      s.peer,
+                        Transport:   transport,
+                        Envelope:    *envelope,
+                        Platform:    platform,
+                        DataChan:     s.dataChan,
+     }
+     go func() {
+         s.o.MdtOutLoop()
+         close(s.done)
+     }()
+     return s
+}
+
+// pass a copy of the message to the session, buffer is reused for the
+// next datagram
+func (s *udpSession) message(encoding string, data []byte) {
+     s.o.MdtOutSetEncoding(encoding)
+     s.dataChan <- append([]byte(nil), data...)
+     s.messages++
+}
+
+func (s *udpSession) close() {
+     close(s.dataChan)
+     <-s.done
+     telemetry_log.Printf("Session from %s closed, %d messages\n", s.peer, s.messages)
+}
+
+// close sessions of routers that went quiet
+func mdtUdpSweep(sessions map[string]*udpSession, now time.Time) {
+     for peer, s := range sessions {
+         if now.Sub(s.last) > udpIdle {
+             delete(sessions, peer)
+             go s.close()
+         }
      }
+}
 
-     go o.MdtOutLoop()
+func mdtUdpServer(udpPort string) error {
+     var hdr tcpMsgHdr
 
      ServerAddr, err := net.ResolveUDPAddr("udp", udpPort)
      if err != nil {
@@ -50,32 +124,89 @@ func mdtUdpServer(udpPort string) error {
          panic(err)
      }
      defer ServerConn.Close()
-     fmt.Println("UDP server listening at ", udpPort)
+     if *udpReadBuffer > 0 {
+         // bursts from many routers overflow the default socket buffer
+         if err = ServerConn.SetReadBuffer(*udpReadBuffer); err != nil {
+             telemetry_log.Errorln("Failed to set read buffer:", err)
+         }
+     }
+     telemetry_log.Println("UDP server listening at ", udpPort)
+     mdtListening()
 
+     sessions := make(map[string]*udpSession)
+     lastSweep := time.Now()
      buf := make([]byte, 64*1024)
      for {
          n, addr, err := ServerConn.ReadFromUDP(buf)
-         if (err != nil) || (n == 0) {
-             if err == io.EOF {
-                fmt.Printf(".")
-                return err
-             } else {
-                fmt.Println("Read error:", err, "from", addr)
-                continue
+         if err != nil {
+             telemetry_log.Errorln("Read error:", err, "from", addr)
+             continue
+         }
+         if !allowList.allowed(addr) {
+             continue
+         }
+         now := time.Now()
+         if now.Sub(lastSweep) > time.Minute {
+             mdtUdpSweep(sessions, now)
+             lastSweep = now
+         }
+
+         s, ok := sessions[addr.String()]
+         if !ok {
+             telemetry_log.Printf("Session started from %s\n", addr)
+             s = newUdpSession(addr, "udp")
+             sessions[s.peer] = s
+         }
+         s.last = now
+
+         if s.partial != nil {
+             if now.Sub(s.started) <= udpReassembly {
+                 // rest of a message
+                 s.partial = append(s.partial, buf[:n]...)
+                 if len(s.partial) >= s.want {
+                     s.message(mdtGetEncodeStr(s.encap), s.partial[:s.want])
+                     s.partial = nil
+                 }
+                 continue
              }
+             telemetry_log.Errorf("From %s dropped message, got %d of %d bytes\n", s.peer, len(s.partial), s.want)
+             s.partial = nil
          }
 
+         if n < udpHdrLen {
+             telemetry_log.Errorf("From %s datagram of %d bytes, too short for header\n", s.peer, n)
+             continue
+         }
          // msg header is 12 bytes
-         hdrbuf := bytes.NewReader(buf[:12])
-         err = binary.Read(hdrbuf, binary.BigEndian, &hdr)
-         //fmt.Printf("From %s received message len: %v encode %v\n",
-         //           addr, hdr.Msglen, hdr.MsgEncap)
-
-         // set the encoding from header
-         o.MdtOutSetEncoding(mdtGetEncodeStr(hdr.MsgEncap))
-         // write to data channel
-         dataChan <- buf[12:n]
-     }
+         hdrbuf := bytes.NewReader(buf[:udpHdrLen])
+         binary.Read(hdrbuf, binary.BigEndian, &hdr)
+         telemetry_log.Debugf("From %s received message len: %v encode %v\n",
+                              addr, hdr.Msglen, hdr.MsgEncap)
+         if hdr.MsgType != ENC_ST_HDR_MSG_TYPE_TELEMETRY_DATA {
+             // heartbeat
+             continue
+         }
+         if !tcpHdrKnown(&hdr) {
+             telemetry_log.Errorf("From %s dropped message, header version %d encap %d not supported\n", s.peer, hdr.MsgHdrVersion, hdr.MsgEncap)
+             continue
+         }
 
-     return nil
+         data := buf[udpHdrLen:n]
+         want := int(hdr.Msglen)
+         switch {
+         case want == 0:
+             // no length in header, datagram is the message
+         case want < len(data):
+             data = data[:want]
+         case want > len(data):
+             if !*udpReassemble || want > tcpMaxMsgLen {
+                 telemetry_log.Errorf("From %s dropped truncated message, got %d of %d bytes\n", s.peer, len(data), want)
+                 continue
+             }
+             s.partial = append(make([]byte, 0, want), data...)
+             s.want, s.encap, s.started = want, hdr.MsgEncap, now
+             continue
+         }
+         s.message(mdtGetEncodeStr(hdr.MsgEncap), data)
+     }
 }
@@ -0,0 +1,476 @@
+package telemetry_gnmi
+
+import (
+       "context"
+       "encoding/json"
+       "fmt"
+       "io"
+       "log"
+       "net"
+       "sort"
+       "strings"
+       "sync"
+       "time"
+
+       "github.com/openconfig/gnmi/proto/gnmi"
+       "google.golang.org/grpc"
+       "google.golang.org/grpc/codes"
+       "google.golang.org/grpc/credentials"
+       "google.golang.org/grpc/peer"
+       "google.golang.org/grpc/status"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                  g N M I   S E R V E R                  ///////
+///////////////////////////////////////////////////////////////////////
+// Serves the rows received by the collector to gNMI clients, Subscribe in
+// stream, once and poll modes, and Get, from a cache holding the latest
+// values of every row. A row becomes a notification, target is the router,
+// origin and path are the sensor path split at the ":", keys of the row go
+// to the last element of the path and leafs of the content are updates,
+//   Cisco-IOS-XR-infra-statsd-oper:infra-statistics/interfaces/interface/latest/generic-counters
+//   origin Cisco-IOS-XR-infra-statsd-oper
+//   path   /infra-statistics/interfaces/interface/latest/generic-counters[interface-name=Hu0/0/0/0]/bytes-received
+// Subscription paths select notifications by prefix, elements and keys
+// can be "*", "..." matches the rest of the path, empty target or origin
+// match any. Stream subscriptions get updates as rows arrive, subscription
+// and sample modes are not honoured. Leafs are typed values, lists are
+// json_ietf. A row not received again for gnmiExpireSamples of its sample
+// intervals, as seen between its last two updates, or for gnmiExpireOnce
+// if seen once, is dropped from the cache, rows of a router gone away or
+// of an interface removed are not served for ever. Cache holds at most
+// gnmiCacheMax rows, the least recently received go first.
+
+const gnmiBuffer = 10000
+
+const (
+      gnmiExpireSamples = 3
+      gnmiExpireOnce    = 10 * time.Minute
+      gnmiExpireCheck   = time.Minute
+      gnmiCacheMax      = 1000000
+)
+
+const gnmiVersion = "0.7.0"
+
+type gnmiSubscriber struct {
+     c       chan *gnmi.Notification
+     dropped uint64
+}
+
+// latest notification of a row, when it was received and the time
+// between its last two updates
+type gnmiCached struct {
+     n        *gnmi.Notification
+     seen     time.Time
+     interval time.Duration
+}
+
+type gnmiServer struct {
+     sync.RWMutex
+     // latest notification of every row, by target and path with keys
+     cache       map[string]*gnmiCached
+     subscribers map[*gnmiSubscriber]bool
+}
+
+// serve on addr, uses TLS if cert and key files are given, runs forever
+func Serve(addr, certFile, keyFile string, tlsReload time.Duration) error {
+     lis, err := net.Listen("tcp", addr)
+     if err != nil {
+         return err
+     }
+     var opts []grpc.ServerOption
+     if certFile != "" {
+         tlsConfig, err := telemetry_tls.NewServerConfig(certFile, keyFile, tlsReload)
+         if err != nil {
+             return err
+         }
+         opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+     } else {
+         log.Printf("gNMI server at %s is not using TLS", addr)
+     }
+     s := &gnmiServer{
+              cache:       make(map[string]*gnmiCached),
+              subscribers: make(map[*gnmiSubscriber]bool),
+          }
+     go s.feed()
+     srv := grpc.NewServer(opts...)
+     gnmi.RegisterGNMIServer(srv, s)
+     telemetry_log.Println("gNMI server listening at " + addr)
+     return srv.Serve(lis)
+}
+
+// keep cache up to date with received rows and pass them on to
+// subscribers
+func (s *gnmiServer) feed() {
+     w := telemetry_decode.MdtWatchStart(true, gnmiBuffer)
+     expire := time.NewTicker(gnmiExpireCheck)
+     defer expire.Stop()
+     for {
+         var m *telemetry_decode.MdtMessage
+         var ok bool
+         select {
+         case m, ok = <-w.C:
+             if !ok {
+                 return
+             }
+         case now := <-expire.C:
+             s.expire(now)
+             continue
+         }
+         now := time.Now()
+         for _, row := range m.Rows {
+             n := gnmiNotification(row)
+             key := gnmiPathString(n.Prefix)
+             s.Lock()
+             if c, ok := s.cache[key]; ok {
+                 c.n, c.interval, c.seen = n, now.Sub(c.seen), now
+             } else {
+                 if len(s.cache) >= gnmiCacheMax {
+                     s.evict()
+                 }
+                 s.cache[key] = &gnmiCached{n: n, seen: now}
+             }
+             for sub := range s.subscribers {
+                 select {
+                 case sub.c <- n:
+                 default:
+                     sub.dropped++
+                 }
+             }
+             s.Unlock()
+         }
+     }
+}
+
+// drop rows not received again in time
+func (s *gnmiServer) expire(now time.Time) {
+     s.Lock()
+     defer s.Unlock()
+     n := 0
+     for key, c := range s.cache {
+         ttl := gnmiExpireOnce
+         if c.interval > 0 {
+             ttl = gnmiExpireSamples * c.interval
+         }
+         if now.Sub(c.seen) > ttl {
+             delete(s.cache, key)
+             n++
+         }
+     }
+     if n > 0 {
+         telemetry_log.Debugf("gNMI: %d rows expired from cache, %d left\n", n, len(s.cache))
+     }
+}
+
+// cache is full, a tenth of it received least recently is dropped, called
+// locked
+func (s *gnmiServer) evict() {
+     keys := make([]string, 0, len(s.cache))
+     for key := range s.cache {
+         keys = append(keys, key)
+     }
+     sort.Slice(keys, func(i, j int) bool { return s.cache[keys[i]].seen.Before(s.cache[keys[j]].seen) })
+     keys = keys[:len(keys) / 10 + 1]
+     for _, key := range keys {
+         delete(s.cache, key)
+     }
+     telemetry_log.Errorf("gNMI: cache is full, %d rows received least recently dropped\n", len(keys))
+}
+
+func gnmiNotification(row *telemetry_decode.MdtRow) *gnmi.Notification {
+     prefix := &gnmi.Path{Target: row.NodeId}
+     path := row.EncodingPath
+     if i := strings.Index(path, ":"); i >= 0 {
+         prefix.Origin, path = path[:i], path[i+1:]
+     }
+     for _, name := range strings.Split(path, "/") {
+         if name != "" {
+             prefix.Elem = append(prefix.Elem, &gnmi.PathElem{Name: name})
+         }
+     }
+     if len(row.Keys) != 0 && len(prefix.Elem) != 0 {
+         keys := map[string]string{}
+         for k, v := range row.Keys {
+             keys[k] = fmt.Sprint(v)
+         }
+         prefix.Elem[len(prefix.Elem) - 1].Key = keys
+     }
+     n := &gnmi.Notification{
+               Timestamp: int64(row.Timestamp) * int64(time.Millisecond),
+               Prefix:    prefix,
+          }
+     gnmiUpdates(n, nil, row.Content)
+     return n
+}
+
+// a leaf is an update, nested containers add to its path
+func gnmiUpdates(n *gnmi.Notification, elems []*gnmi.PathElem, content map[string]interface{}) {
+     names := make([]string, 0, len(content))
+     for name := range content {
+         names = append(names, name)
+     }
+     sort.Strings(names)
+     for _, name := range names {
+         path := append(append([]*gnmi.PathElem(nil), elems...), &gnmi.PathElem{Name: name})
+         if m, ok := content[name].(map[string]interface{}); ok {
+             gnmiUpdates(n, path, m)
+             continue
+         }
+         n.Update = append(n.Update, &gnmi.Update{Path: &gnmi.Path{Elem: path}, Val: gnmiValue(content[name])})
+     }
+}
+
+func gnmiValue(v interface{}) *gnmi.TypedValue {
+     switch v := v.(type) {
+     case string:
+         return &gnmi.TypedValue{Value: &gnmi.TypedValue_StringVal{StringVal: v}}
+     case bool:
+         return &gnmi.TypedValue{Value: &gnmi.TypedValue_BoolVal{BoolVal: v}}
+     case int:
+         return &gnmi.TypedValue{Value: &gnmi.TypedValue_IntVal{IntVal: int64(v)}}
+     case int32:
+         return &gnmi.TypedValue{Value: &gnmi.TypedValue_IntVal{IntVal: int64(v)}}
+     case int64:
+         return &gnmi.TypedValue{Value: &gnmi.TypedValue_IntVal{IntVal: v}}
+     case uint32:
+         return &gnmi.TypedValue{Value: &gnmi.TypedValue_UintVal{UintVal: uint64(v)}}
+     case uint64:
+         return &gnmi.TypedValue{Value: &gnmi.TypedValue_UintVal{UintVal: v}}
+     case float32:
+         return &gnmi.TypedValue{Value: &gnmi.TypedValue_FloatVal{FloatVal: v}}
+     case float64:
+         return &gnmi.TypedValue{Value: &gnmi.TypedValue_FloatVal{FloatVal: float32(v)}}
+     }
+     b, _ := json.Marshal(v)
+     return &gnmi.TypedValue{Value: &gnmi.TypedValue_JsonIetfVal{JsonIetfVal: b}}
+}
+
+// cache key, elements with keys in sorted order
+func gnmiPathString(p *gnmi.Path) string {
+     var b strings.Builder
+     b.WriteString(p.Target)
+     b.WriteString("|")
+     b.WriteString(p.Origin)
+     for _, e := range p.Elem {
+         b.WriteString("/")
+         b.WriteString(e.Name)
+         keys := make([]string, 0, len(e.Key))
+         for k := range e.Key {
+             keys = append(keys, k)
+         }
+         sort.Strings(keys)
+         for _, k := range keys {
+             fmt.Fprintf(&b, "[%s=%s]", k, e.Key[k])
+         }
+     }
+     return b.String()
+}
+
+// subscription paths joined with the prefix of the request
+func gnmiPaths(prefix *gnmi.Path, paths []*gnmi.Path) []*gnmi.Path {
+     if len(paths) == 0 {
+         paths = []*gnmi.Path{{}}
+     }
+     var full []*gnmi.Path
+     for _, p := range paths {
+         f := &gnmi.Path{Target: prefix.GetTarget(), Origin: p.GetOrigin()}
+         if f.Origin == "" {
+             f.Origin = prefix.GetOrigin()
+         }
+         f.Elem = append(append([]*gnmi.PathElem(nil), prefix.GetElem()...), p.GetElem()...)
+         full = append(full, f)
+     }
+     return full
+}
+
+// true if elements of path p start with those of sub
+func gnmiMatch(sub []*gnmi.PathElem, p []*gnmi.PathElem) bool {
+     for i, e := range sub {
+         if e.Name == "..." {
+             return true
+         }
+         if i >= len(p) {
+             return false
+         }
+         if e.Name != "*" && e.Name != p[i].Name {
+             return false
+         }
+         for k, v := range e.Key {
+             if v != "*" && p[i].Key[k] != v {
+                 return false
+             }
+         }
+     }
+     return true
+}
+
+// notification with the updates selected by the subscription paths, nil
+// if there are none
+func gnmiFilter(n *gnmi.Notification, subs []*gnmi.Path) *gnmi.Notification {
+     var updates []*gnmi.Update
+     for _, u := range n.Update {
+         full := append(append([]*gnmi.PathElem(nil), n.Prefix.Elem...), u.Path.Elem...)
+         for _, sub := range subs {
+             if sub.Target != "" && sub.Target != "*" && sub.Target != n.Prefix.Target {
+                 continue
+             }
+             if sub.Origin != "" && sub.Origin != n.Prefix.Origin {
+                 continue
+             }
+             if gnmiMatch(sub.Elem, full) {
+                 updates = append(updates, u)
+                 break
+             }
+         }
+     }
+     if len(updates) == 0 {
+         return nil
+     }
+     if len(updates) == len(n.Update) {
+         return n
+     }
+     return &gnmi.Notification{Timestamp: n.Timestamp, Prefix: n.Prefix, Update: updates}
+}
+
+// cached notifications selected by the subscription paths
+func (s *gnmiServer) cached(subs []*gnmi.Path) []*gnmi.Notification {
+     s.RLock()
+     defer s.RUnlock()
+     keys := make([]string, 0, len(s.cache))
+     for k := range s.cache {
+         keys = append(keys, k)
+     }
+     sort.Strings(keys)
+     var out []*gnmi.Notification
+     for _, k := range keys {
+         if n := gnmiFilter(s.cache[k].n, subs); n != nil {
+             out = append(out, n)
+         }
+     }
+     return out
+}
+
+func (s *gnmiServer) Capabilities(ctx context.Context, req *gnmi.CapabilityRequest) (*gnmi.CapabilityResponse, error) {
+     origins := map[string]bool{}
+     s.RLock()
+     for _, c := range s.cache {
+         origins[c.n.Prefix.Origin] = true
+     }
+     s.RUnlock()
+     r := &gnmi.CapabilityResponse{
+              SupportedEncodings: []gnmi.Encoding{gnmi.Encoding_JSON_IETF, gnmi.Encoding_PROTO},
+              GNMIVersion:        gnmiVersion,
+          }
+     for origin := range origins {
+         if origin != "" {
+             r.SupportedModels = append(r.SupportedModels, &gnmi.ModelData{Name: origin})
+         }
+     }
+     sort.Slice(r.SupportedModels, func(i, j int) bool { return r.SupportedModels[i].Name < r.SupportedModels[j].Name })
+     return r, nil
+}
+
+func (s *gnmiServer) Get(ctx context.Context, req *gnmi.GetRequest) (*gnmi.GetResponse, error) {
+     return &gnmi.GetResponse{Notification: s.cached(gnmiPaths(req.GetPrefix(), req.GetPath()))}, nil
+}
+
+func (s *gnmiServer) Set(ctx context.Context, req *gnmi.SetRequest) (*gnmi.SetResponse, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by collector")
+}
+
+func (s *gnmiServer) Subscribe(stream gnmi.GNMI_SubscribeServer) error {
+     req, err := stream.Recv()
+     if err != nil {
+         return err
+     }
+     list := req.GetSubscribe()
+     if list == nil {
+         return status.Error(codes.InvalidArgument, "first request must be a subscription list")
+     }
+     var paths []*gnmi.Path
+     for _, sub := range list.GetSubscription() {
+         paths = append(paths, sub.GetPath())
+     }
+     subs := gnmiPaths(list.GetPrefix(), paths)
+
+     client := "unknown"
+     if p, ok := peer.FromContext(stream.Context()); ok {
+         client = p.Addr.String()
+     }
+     telemetry_log.Printf("gNMI: %s subscribed, mode %v, %d paths\n", client, list.GetMode(), len(subs))
+
+     sendCached := func() error {
+         for _, n := range s.cached(subs) {
+             if err := stream.Send(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: n}}); err != nil {
+                 return err
+             }
+         }
+         return stream.Send(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_SyncResponse{SyncResponse: true}})
+     }
+
+     switch list.GetMode() {
+     case gnmi.SubscriptionList_ONCE:
+         return sendCached()
+     case gnmi.SubscriptionList_POLL:
+         if err := sendCached(); err != nil {
+             return err
+         }
+         for {
+             req, err := stream.Recv()
+             if err == io.EOF {
+                 return nil
+             }
+             if err != nil {
+                 return err
+             }
+             if req.GetPoll() == nil {
+                 return status.Error(codes.InvalidArgument, "only poll requests are accepted after the subscription list")
+             }
+             if err := sendCached(); err != nil {
+                 return err
+             }
+         }
+     }
+
+     // register before sending the cache, rows arriving meanwhile are not
+     // lost
+     sub := &gnmiSubscriber{c: make(chan *gnmi.Notification, gnmiBuffer)}
+     s.Lock()
+     s.subscribers[sub] = true
+     s.Unlock()
+     sent := 0
+     defer func() {
+         s.Lock()
+         delete(s.subscribers, sub)
+         dropped := sub.dropped
+         s.Unlock()
+         telemetry_log.Printf("gNMI: %s gone, %d notifications sent, %d dropped\n", client, sent, dropped)
+     }()
+
+     if list.GetUpdatesOnly() {
+         err = stream.Send(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_SyncResponse{SyncResponse: true}})
+     } else {
+         err = sendCached()
+     }
+     if err != nil {
+         return err
+     }
+     for {
+         select {
+         case <-stream.Context().Done():
+             return nil
+         case n := <-sub.c:
+             if n = gnmiFilter(n, subs); n == nil {
+                 continue
+             }
+             if err := stream.Send(&gnmi.SubscribeResponse{Response: &gnmi.SubscribeResponse_Update{Update: n}}); err != nil {
+                 return err
+             }
+             sent++
+         }
+     }
+}
@@ -0,0 +1,77 @@
+package telemetry_harness
+
+import (
+       "context"
+       "strings"
+       "testing"
+       "time"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+)
+
+// example of the package doc
+func TestCounters(t *testing.T) {
+     m := StartMock(t)
+     c := &Collector{Server: m.Addr, Subscription: "s1", Encoding: "json", Out: "memory:t1"}
+     if err := c.Run(context.Background()); err != nil {
+         t.Fatal(err)
+     }
+     rows := WaitRows(t, "t1", 5, time.Second)
+     AssertLeaf(t, rows, "content.packets-received", int64(500))
+}
+
+func TestEncodings(t *testing.T) {
+     m := StartMock(t)
+     telemetry_decode.MdtRegisterDecoder(telemetry_decode.MdtGenerateDecoder{Path: mockPath})
+     // counters are numbers of json, uint64 of self-describing-gpb and
+     // numbers of the decoder's json with gpb
+     for _, tc := range []struct {
+                          encoding string
+                          packets  interface{}
+                          bytes    interface{}
+                      }{
+                          {"json", int64(100), int64(5 * 80 * 512)},
+                          {"self-describing-gpb", uint64(100), uint64(5 * 80 * 512)},
+                          {"gpb", int64(100), int64(5 * 80 * 512)},
+                      } {
+         encoding := tc.encoding
+         t.Run(encoding, func(t *testing.T) {
+             name := "encoding-" + encoding
+             defer MemoryReset(name)
+             c := &Collector{Server: m.Addr, Subscription: name, Encoding: encoding, Username: "u", Password: "p"}
+             if err := c.Run(context.Background()); err != nil {
+                 t.Fatal(err)
+             }
+             rows := RowsOf(WaitRows(t, name, 5, time.Second), mockPath)
+             if len(rows) != 5 {
+                 t.Fatalf("%d rows of %s, expected 5", len(rows), mockPath)
+             }
+             for _, row := range rows {
+                 if row.NodeId != "mock" || row.Subscription != name {
+                     t.Errorf("row of node %q subscription %q", row.NodeId, row.Subscription)
+                 }
+             }
+             AssertLeaf(t, rows, "keys.interface-name", "GigabitEthernet0/0/0/0")
+             AssertLeaf(t, rows, "content.packets-received", tc.packets)
+             AssertLeaf(t, rows, "content.bytes-sent", tc.bytes)
+         })
+     }
+     for _, sub := range m.Subscriptions() {
+         if sub.Username != "u" || sub.Password != "p" {
+             t.Errorf("subscription %s with username %q password %q", sub.Args.Subidstr, sub.Username, sub.Password)
+         }
+     }
+}
+
+func TestMissingSubscription(t *testing.T) {
+     m := StartMock(t)
+     m.Missing = []string{"nope"}
+     c := &Collector{Server: m.Addr, Subscription: "nope", Encoding: "json"}
+     err := c.Run(context.Background())
+     if err == nil || !strings.Contains(err.Error(), "subscription nope not found") {
+         t.Fatalf("expected subscription not found, got %v", err)
+     }
+     if rows := MemoryRows("nope"); len(rows) != 0 {
+         t.Errorf("%d rows of a missing subscription", len(rows))
+     }
+}
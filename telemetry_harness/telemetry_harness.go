@@ -0,0 +1,215 @@
+package telemetry_harness
+
+import (
+       "context"
+       "fmt"
+       "io"
+       "reflect"
+       "sync/atomic"
+       "testing"
+       "time"
+
+       "google.golang.org/grpc"
+
+       MdtDialin "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialin"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                T E S T   H A R N E S S                  ///////
+///////////////////////////////////////////////////////////////////////
+// End to end tests of subscribe, decode and outputs, without a router.
+// The mock server plays the router, Collector subscribes to it and runs
+// the output loop of the collector in-process, decoding to Out, any -out
+// of the collectors. With memory:<name> rows are kept for the test to
+// check,
+//   func TestCounters(t *testing.T) {
+//       m := telemetry_harness.StartMock(t)
+//       c := &telemetry_harness.Collector{Server: m.Addr, Subscription: "s1", Encoding: "json", Out: "memory:t1"}
+//       if err := c.Run(context.Background()); err != nil {
+//           t.Fatal(err)
+//       }
+//       rows := telemetry_harness.WaitRows(t, "t1", 5, time.Second)
+//       telemetry_harness.AssertLeaf(t, rows, "content.packets-received", int64(500))
+//   }
+// Options of the collectors set with telemetry_decode, -path_map,
+// -redact, -rate_limit and others, apply to the output loop as they do
+// in the collectors, they are global, tests setting them can't run in
+// parallel.
+
+// mock with the defaults of NewMockServer started, closed when the test ends
+func StartMock(t testing.TB) *MockServer {
+     t.Helper()
+     m := NewMockServer()
+     if err := m.Start(); err != nil {
+         t.Fatalf("mock: %v", err)
+     }
+     t.Cleanup(m.Close)
+     return m
+}
+
+var collectorReqId int64
+
+// a dialin subscription and its output loop
+type Collector struct {
+     // address of mock, or router
+     Server       string
+     Subscription string
+     // gpb, self-describing-gpb or json
+     Encoding     string
+     // -out, memory:<subscription> if not set
+     Out          string
+     Username     string
+     Password     string
+     // gpb decoding, as -proto, -plugin_dir and -plugin
+     ProtoFile    string
+     PluginDir    string
+     PluginFile   string
+}
+
+type harnessCredential struct {
+     username string
+     password string
+}
+
+func (c harnessCredential) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+     return map[string]string{
+                "username": c.username,
+                "password": c.password,
+            }, nil
+}
+
+func (c harnessCredential) RequireTransportSecurity() bool {
+     return false
+}
+
+// subscribe and decode the messages to Out till the server ends the
+// stream or ctx is done, Out is written out when it returns
+func (c *Collector) Run(ctx context.Context) error {
+     encode := int64(encodeSelfGPB)
+     switch c.Encoding {
+     case "gpb":
+         encode = encodeGPB
+     case "json":
+         encode = encodeJSON
+     case "", "self-describing-gpb":
+     default:
+         return fmt.Errorf("not supported encoding: %s, Options: gpb,self-describing-gpb,json", c.Encoding)
+     }
+     encoding := c.Encoding
+     if encoding == "" {
+         encoding = "self-describing-gpb"
+     }
+     out := c.Out
+     if out == "" {
+         out = "memory:" + c.Subscription
+     }
+
+     conn, err := grpc.DialContext(ctx, c.Server, grpc.WithInsecure(), grpc.WithBlock(),
+                                   grpc.WithPerRPCCredentials(harnessCredential{c.Username, c.Password}))
+     if err != nil {
+         return fmt.Errorf("dial %s: %v", c.Server, err)
+     }
+     defer conn.Close()
+     args := &MdtDialin.CreateSubsArgs{
+                 ReqId:    atomic.AddInt64(&collectorReqId, 1),
+                 Encode:   encode,
+                 Subidstr: c.Subscription,
+             }
+     stream, err := MdtDialin.NewGRPCConfigOperClient(conn).CreateSubs(ctx, args)
+     if err != nil {
+         return fmt.Errorf("subscribe %s: %v", c.Subscription, err)
+     }
+
+     dataChan := make(chan []byte, 10000)
+     done := make(chan struct{})
+     o := &telemetry_decode.MdtOut{
+                        Name:         "harness " + c.Subscription,
+                        ReqId:        args.ReqId,
+                        Router:       c.Server,
+                        Subscription: c.Subscription,
+                        OutFile:      out,
+                        Encoding:     encoding,
+                        ProtoFile:    c.ProtoFile,
+                        PluginDir:    c.PluginDir,
+                        PluginFile:   c.PluginFile,
+                        DataChan:     dataChan,
+     }
+     if err := o.MdtOutOpen(); err != nil {
+         return err
+     }
+     go func() {
+         o.MdtOutLoop()
+         close(done)
+     }()
+     defer func() {
+         close(dataChan)
+         <-done
+     }()
+
+     for {
+         reply, err := stream.Recv()
+         if err == io.EOF || ctx.Err() != nil {
+             return nil
+         }
+         if err != nil {
+             return fmt.Errorf("subscribe %s: %v", c.Subscription, err)
+         }
+         if reply.Errors != "" {
+             return fmt.Errorf("subscribe %s: %s", c.Subscription, reply.Errors)
+         }
+         if len(reply.Data) != 0 {
+             dataChan <- reply.Data
+         }
+     }
+}
+
+// rows of memory:<name>, fails t if there are not n of them within timeout
+func WaitRows(t testing.TB, name string, n int, timeout time.Duration) []*telemetry_decode.MdtRow {
+     t.Helper()
+     deadline := time.Now().Add(timeout)
+     for {
+         rows := MemoryRows(name)
+         if len(rows) >= n {
+             return rows
+         }
+         if time.Now().After(deadline) {
+             t.Fatalf("memory:%s: %d rows, expected %d", name, len(rows), n)
+         }
+         time.Sleep(10 * time.Millisecond)
+     }
+}
+
+// rows of sensor path
+func RowsOf(rows []*telemetry_decode.MdtRow, path string) []*telemetry_decode.MdtRow {
+     var of []*telemetry_decode.MdtRow
+     for _, row := range rows {
+         if row.EncodingPath == path {
+             of = append(of, row)
+         }
+     }
+     return of
+}
+
+// fails t unless a row has leaf, as flattened, keys.interface-name or
+// content.packets-received, equal to want in type and value, uint64(100)
+// is not int64(100) or "100"
+func AssertLeaf(t testing.TB, rows []*telemetry_decode.MdtRow, leaf string, want interface{}) {
+     t.Helper()
+     var seen []string
+     for _, row := range rows {
+         v, ok := row.Flatten()[leaf]
+         if !ok {
+             continue
+         }
+         if reflect.DeepEqual(v, want) {
+             return
+         }
+         seen = append(seen, fmt.Sprintf("%T(%v)", v, v))
+     }
+     if seen == nil {
+         t.Errorf("no row has %s", leaf)
+         return
+     }
+     t.Errorf("no row has %s %T(%v), rows have %v", leaf, want, want, seen)
+}
@@ -0,0 +1,64 @@
+package telemetry_harness
+
+import (
+       "fmt"
+       "net/url"
+       "sync"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                  M E M O R Y   S I N K                  ///////
+///////////////////////////////////////////////////////////////////////
+// -out memory:<name>
+// Rows are kept in memory under name, for tests to check what the
+// collector decoded, MemoryRows returns them. Output loops with the same
+// name add to the same rows. Nothing is ever dropped, the sink is only
+// registered in binaries importing this package, tests, not in the
+// collectors.
+
+func init() {
+     telemetry_decode.MdtRegisterSink("memory", newMemorySink)
+}
+
+var memory = struct {
+    sync.Mutex
+    rows map[string][]*telemetry_decode.MdtRow
+}{rows: make(map[string][]*telemetry_decode.MdtRow)}
+
+type memorySink struct {
+     name string
+}
+
+func newMemorySink(address string, options url.Values) (telemetry_decode.MdtSink, error) {
+     if address == "" {
+         return nil, fmt.Errorf("memory output needs a name, memory:<name>")
+     }
+     return &memorySink{name: address}, nil
+}
+
+func (s *memorySink) WriteRows(rows []*telemetry_decode.MdtRow) error {
+     memory.Lock()
+     defer memory.Unlock()
+     memory.rows[s.name] = append(memory.rows[s.name], rows...)
+     return nil
+}
+
+func (s *memorySink) Close() error {
+     return nil
+}
+
+// rows written to memory:<name> so far
+func MemoryRows(name string) []*telemetry_decode.MdtRow {
+     memory.Lock()
+     defer memory.Unlock()
+     return append([]*telemetry_decode.MdtRow(nil), memory.rows[name]...)
+}
+
+// forget rows of memory:<name>
+func MemoryReset(name string) {
+     memory.Lock()
+     defer memory.Unlock()
+     delete(memory.rows, name)
+}
@@ -0,0 +1,203 @@
+package telemetry_harness
+
+import (
+       "context"
+       "fmt"
+       "net"
+       "sync"
+       "time"
+
+       "google.golang.org/grpc"
+       "google.golang.org/grpc/codes"
+       "google.golang.org/grpc/metadata"
+       "google.golang.org/grpc/status"
+
+       MdtDialin "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialin"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                M O C K   M D T   S E R V E R            ///////
+///////////////////////////////////////////////////////////////////////
+// Plays a router serving the CreateSubs rpc of the IOS-XR dialin api.
+// Every subscription gets Messages messages of interface counters, one
+// of each of Paths in turn, every Interval, then the stream ends, or is
+// held open with Hold, as a router's is. Subscriptions in Missing get an
+// error reply, as subscriptions not configured on a router do. Encoding
+// is what the subscription asks for, gpb rows are compact, decoded with
+// telemetry_decode.MdtGenerateDecoder of the path registered, as a
+// decoder plugin of a router's sensor path.
+
+// encode values of CreateSubsArgs
+const (
+      encodeGPB     = 2
+      encodeSelfGPB = 3
+      encodeJSON    = 4
+)
+
+const mockPath = "Cisco-IOS-XR-infra-statsd-oper:infra-statistics/interfaces/interface/latest/generic-counters"
+
+type MockServer struct {
+     // node id of the messages, mock if not set
+     Node     string
+     // sensor paths, generic counters if not set
+     Paths    []string
+     // messages per subscription, 0 till the subscription is cancelled
+     Messages int
+     Interval time.Duration
+     // interfaces per message and counters per interface
+     Rows     int
+     Counters int
+     Hold     bool
+     Missing  []string
+
+     // listening address, set by Start
+     Addr     string
+
+     srv      *grpc.Server
+     mu       sync.Mutex
+     subs     []MockSubscription
+}
+
+// a CreateSubs call the mock got
+type MockSubscription struct {
+     Args     *MdtDialin.CreateSubsArgs
+     Username string
+     Password string
+}
+
+// mock sending 5 messages of a row per subscription, not started
+func NewMockServer() *MockServer {
+     return &MockServer{
+                Messages: 5,
+                Interval: 10 * time.Millisecond,
+                Rows:     1,
+                Counters: 4,
+            }
+}
+
+// listen on a free port of 127.0.0.1 and serve till Close
+func (m *MockServer) Start() error {
+     lis, err := net.Listen("tcp", "127.0.0.1:0")
+     if err != nil {
+         return err
+     }
+     m.Addr = lis.Addr().String()
+     m.srv = grpc.NewServer()
+     MdtDialin.RegisterGRPCConfigOperServer(m.srv, m)
+     go m.srv.Serve(lis)
+     return nil
+}
+
+// stop serving, streams are closed
+func (m *MockServer) Close() {
+     if m.srv != nil {
+         m.srv.Stop()
+     }
+}
+
+// CreateSubs calls so far
+func (m *MockServer) Subscriptions() []MockSubscription {
+     m.mu.Lock()
+     defer m.mu.Unlock()
+     return append([]MockSubscription(nil), m.subs...)
+}
+
+func (m *MockServer) CreateSubs(args *MdtDialin.CreateSubsArgs, stream MdtDialin.GRPCConfigOper_CreateSubsServer) error {
+     sub := MockSubscription{Args: args}
+     if md, ok := metadata.FromIncomingContext(stream.Context()); ok {
+         if v := md.Get("username"); len(v) > 0 {
+             sub.Username = v[0]
+         }
+         if v := md.Get("password"); len(v) > 0 {
+             sub.Password = v[0]
+         }
+     }
+     m.mu.Lock()
+     m.subs = append(m.subs, sub)
+     m.mu.Unlock()
+
+     for _, name := range m.Missing {
+         if name == args.Subidstr {
+             return stream.Send(&MdtDialin.CreateSubsReply{ResReqId: args.ReqId, Errors: fmt.Sprintf("subscription %s not found", name)})
+         }
+     }
+     encoding := "self-describing-gpb"
+     switch args.Encode {
+     case encodeGPB:
+         encoding = "gpb"
+     case encodeSelfGPB:
+     case encodeJSON:
+         encoding = "json"
+     default:
+         return status.Errorf(codes.InvalidArgument, "encode %d not supported", args.Encode)
+     }
+     node, paths := m.Node, m.Paths
+     if node == "" {
+         node = "mock"
+     }
+     if len(paths) == 0 {
+         paths = []string{mockPath}
+     }
+
+     for n := 0; m.Messages == 0 || n < m.Messages; n++ {
+         path := paths[n % len(paths)]
+         data, err := telemetry_decode.MdtGenerateMessage(encoding, node, args.Subidstr, path, uint64(n / len(paths) + 1), m.Rows, m.Counters)
+         if err != nil {
+             return status.Error(codes.Internal, err.Error())
+         }
+         if err = stream.Send(&MdtDialin.CreateSubsReply{ResReqId: args.ReqId, Data: data}); err != nil {
+             return err
+         }
+         select {
+         case <-stream.Context().Done():
+             return nil
+         case <-time.After(m.Interval):
+         }
+     }
+     if m.Hold {
+         <-stream.Context().Done()
+     }
+     return nil
+}
+
+// rest of the api is not served
+func (m *MockServer) GetConfig(*MdtDialin.ConfigGetArgs, MdtDialin.GRPCConfigOper_GetConfigServer) error {
+     return status.Error(codes.Unimplemented, "not served by mock")
+}
+
+func (m *MockServer) MergeConfig(context.Context, *MdtDialin.ConfigArgs) (*MdtDialin.ConfigReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by mock")
+}
+
+func (m *MockServer) DeleteConfig(context.Context, *MdtDialin.ConfigArgs) (*MdtDialin.ConfigReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by mock")
+}
+
+func (m *MockServer) ReplaceConfig(context.Context, *MdtDialin.ConfigArgs) (*MdtDialin.ConfigReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by mock")
+}
+
+func (m *MockServer) CliConfig(context.Context, *MdtDialin.CliConfigArgs) (*MdtDialin.CliConfigReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by mock")
+}
+
+func (m *MockServer) CommitReplace(context.Context, *MdtDialin.CommitReplaceArgs) (*MdtDialin.CommitReplaceReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by mock")
+}
+
+func (m *MockServer) CommitConfig(context.Context, *MdtDialin.CommitArgs) (*MdtDialin.CommitReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by mock")
+}
+
+func (m *MockServer) ConfigDiscardChanges(context.Context, *MdtDialin.DiscardChangesArgs) (*MdtDialin.DiscardChangesReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by mock")
+}
+
+func (m *MockServer) GetOper(*MdtDialin.GetOperArgs, MdtDialin.GRPCConfigOper_GetOperServer) error {
+     return status.Error(codes.Unimplemented, "not served by mock")
+}
+
+func (m *MockServer) GetProtoFile(*MdtDialin.GetProtoFileArgs, MdtDialin.GRPCConfigOper_GetProtoFileServer) error {
+     return status.Error(codes.Unimplemented, "not served by mock")
+}
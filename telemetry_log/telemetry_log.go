@@ -0,0 +1,190 @@
+package telemetry_log
+
+import (
+       "io"
+       "os"
+       "fmt"
+       "log"
+       "time"
+       "sync"
+       "strings"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////        V E R B O S I T Y   A N D   C O L O R             ///////
+///////////////////////////////////////////////////////////////////////
+// Messages printed by the collectors go through here so that -quiet,
+// -v and -vv apply to all of them,
+//   -quiet  errors only, for scripts and cron jobs
+//   default session and listener messages
+//   -v      a line for every received message, time, node, sensor path
+//   -vv     transport details, message length and encoding of every frame
+// Errors are always printed. With -color auto, the default, sensor paths,
+// errors and timestamps are highlighted if stdout is a terminal and
+// NO_COLOR is not set, -color always or never to force it.
+
+const (
+      LevelQuiet   = -1
+      LevelNormal  = 0
+      LevelVerbose = 1
+      LevelDebug   = 2
+)
+
+const (
+      colorReset = "\033[0m"
+      colorRed   = "\033[31m"
+      colorCyan  = "\033[36m"
+      colorDim   = "\033[2m"
+)
+
+var level = LevelNormal
+var color bool
+
+// where messages are printed, stdout unless taken over by -tui
+var out io.Writer = os.Stdout
+
+// last errors, for the dashboard
+const maxRecentErrors = 100
+
+type ErrorEntry struct {
+     Time    time.Time `json:"time"`
+     Message string    `json:"message"`
+}
+
+var recentErrors struct {
+    sync.Mutex
+    entries []ErrorEntry
+}
+
+// level from the -quiet, -v and -vv flags, most verbose wins
+func FlagLevel(quiet, verbose, debug bool) int {
+     switch {
+     case debug:
+         return LevelDebug
+     case verbose:
+         return LevelVerbose
+     case quiet:
+         return LevelQuiet
+     }
+     return LevelNormal
+}
+
+// set verbosity and color mode, auto, always or never
+func Setup(l int, colorMode string) {
+     level = l
+     switch colorMode {
+     case "always":
+         color = true
+     case "never":
+         color = false
+     case "", "auto":
+         color = isTerminal(os.Stdout) && os.Getenv("NO_COLOR") == ""
+     default:
+         log.Fatalf("Unsupported color mode %s, Options: auto,always,never", colorMode)
+     }
+     if color && (colorMode == "always" || isTerminal(os.Stderr)) {
+         // log.Printf lines are warnings, highlight them like errors
+         log.SetOutput(&colorWriter{color: colorRed})
+     }
+}
+
+func isTerminal(f *os.File) bool {
+     fi, err := f.Stat()
+     return err == nil && fi.Mode() & os.ModeCharDevice != 0
+}
+
+type colorWriter struct {
+     color string
+}
+
+func (w *colorWriter) Write(p []byte) (int, error) {
+     fmt.Fprint(os.Stderr, paint(w.color, string(p)))
+     return len(p), nil
+}
+
+// trailing newline is left out of the color, so that reset is on the
+// same line
+func paint(c string, s string) string {
+     if !color {
+         return s
+     }
+     line := strings.TrimSuffix(s, "\n")
+     return c + line + colorReset + s[len(line):]
+}
+
+// sensor path highlighted for printing
+func Path(path string) string {
+     return paint(colorCyan, path)
+}
+
+// time highlighted for printing, milliseconds are kept
+func Time(t time.Time) string {
+     return paint(colorDim, t.Format("15:04:05.000"))
+}
+
+// print messages to w instead of stdout, colors are turned off
+func SetOutput(w io.Writer) {
+     out = w
+     color = false
+}
+
+func Verbose() bool {
+     return level >= LevelVerbose
+}
+
+func Debug() bool {
+     return level >= LevelDebug
+}
+
+// session and listener messages, left out with -quiet
+func Println(a ...interface{}) {
+     if level >= LevelNormal {
+         fmt.Fprintln(out, a...)
+     }
+}
+
+func Printf(format string, a ...interface{}) {
+     if level >= LevelNormal {
+         fmt.Fprintf(out, format, a...)
+     }
+}
+
+// printed with -v
+func Verbosef(format string, a ...interface{}) {
+     if level >= LevelVerbose {
+         fmt.Fprintf(out, format, a...)
+     }
+}
+
+// printed with -vv
+func Debugf(format string, a ...interface{}) {
+     if level >= LevelDebug {
+         fmt.Fprintf(out, format, a...)
+     }
+}
+
+// errors are printed at every level
+func Errorln(a ...interface{}) {
+     printError(fmt.Sprintln(a...))
+}
+
+func Errorf(format string, a ...interface{}) {
+     printError(fmt.Sprintf(format, a...))
+}
+
+func printError(s string) {
+     recentErrors.Lock()
+     recentErrors.entries = append(recentErrors.entries, ErrorEntry{time.Now(), strings.TrimSpace(s)})
+     if len(recentErrors.entries) > maxRecentErrors {
+         recentErrors.entries = recentErrors.entries[1:]
+     }
+     recentErrors.Unlock()
+     fmt.Fprint(out, paint(colorRed, s))
+}
+
+// errors printed lately, oldest first
+func RecentErrors() []ErrorEntry {
+     recentErrors.Lock()
+     defer recentErrors.Unlock()
+     return append([]ErrorEntry{}, recentErrors.entries...)
+}
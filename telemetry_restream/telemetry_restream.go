@@ -0,0 +1,178 @@
+package telemetry_restream
+
+import (
+       "context"
+       "encoding/json"
+       "log"
+       "net"
+       "time"
+
+       "google.golang.org/grpc"
+       "google.golang.org/grpc/codes"
+       "google.golang.org/grpc/credentials"
+       "google.golang.org/grpc/peer"
+       "google.golang.org/grpc/status"
+
+       MdtDialin "github.com/ios-xr/telemetry-go-collector/mdt_grpc_dialin"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_decode"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+       "github.com/ios-xr/telemetry-go-collector/telemetry_tls"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////                   R E S T R E A M                       ///////
+///////////////////////////////////////////////////////////////////////
+// Serves the messages received by the collector again, to any number of
+// downstream consumers, over the CreateSubs rpc of the IOS-XR dialin api,
+// so a dialin client, this collector too, can subscribe to a collector as
+// it would to a router,
+//   telemetry_dialin_collector subscribe -server <restream_listen> -subscription intf-counters -encoding self-describing-gpb
+// Subscription names select the subscriptions of the router sessions,
+// for dialout the subscription in the message header, * or no name for
+// all. Encoding selects what is sent,
+//   gpb, self-describing-gpb   gpb messages as received, json and jti messages are skipped
+//   json                       every message as a json array of decoded rows
+// Consumers come and go without affecting router sessions, a consumer not
+// keeping up loses messages.
+
+const restreamBuffer = 10000
+
+// encode values of CreateSubsArgs
+const (
+      encodeGPB     = 2
+      encodeSelfGPB = 3
+      encodeJSON    = 4
+)
+
+type restreamServer struct{}
+
+// serve on addr, uses TLS if cert and key files are given, runs forever
+func Serve(addr, certFile, keyFile string, tlsReload time.Duration) error {
+     lis, err := net.Listen("tcp", addr)
+     if err != nil {
+         return err
+     }
+     var opts []grpc.ServerOption
+     if certFile != "" {
+         tlsConfig, err := telemetry_tls.NewServerConfig(certFile, keyFile, tlsReload)
+         if err != nil {
+             return err
+         }
+         opts = append(opts, grpc.Creds(credentials.NewTLS(tlsConfig)))
+     } else {
+         log.Printf("Restream at %s is not using TLS", addr)
+     }
+     srv := grpc.NewServer(opts...)
+     MdtDialin.RegisterGRPCConfigOperServer(srv, &restreamServer{})
+     telemetry_log.Println("Restream listening at " + addr)
+     return srv.Serve(lis)
+}
+
+func restreamMatch(names []string, subscription string) bool {
+     if len(names) == 0 {
+         return true
+     }
+     for _, name := range names {
+         if name == "*" || name == subscription {
+             return true
+         }
+     }
+     return false
+}
+
+func (s *restreamServer) CreateSubs(args *MdtDialin.CreateSubsArgs, stream MdtDialin.GRPCConfigOper_CreateSubsServer) error {
+     var names []string
+     if args.Subidstr != "" {
+         names = append(names, args.Subidstr)
+     }
+     names = append(names, args.Subscriptions...)
+
+     switch args.Encode {
+     case 0, encodeGPB, encodeSelfGPB, encodeJSON:
+     default:
+         return status.Errorf(codes.InvalidArgument, "encode %d not supported", args.Encode)
+     }
+     rows := args.Encode == encodeJSON
+     if !rows && telemetry_decode.MdtRedacting() {
+         return status.Errorf(codes.PermissionDenied, "messages are redacted, subscribe with json encode for redacted rows")
+     }
+
+     client := "unknown"
+     if p, ok := peer.FromContext(stream.Context()); ok {
+         client = p.Addr.String()
+     }
+     telemetry_log.Printf("Restream: %s subscribed to %v, encode %d\n", client, names, args.Encode)
+
+     w := telemetry_decode.MdtWatchStart(rows, restreamBuffer)
+     defer w.Stop()
+     sent := 0
+     defer func() {
+         telemetry_log.Printf("Restream: %s gone, %d messages sent, %d dropped\n", client, sent, w.Dropped())
+     }()
+
+     for {
+         select {
+         case <-stream.Context().Done():
+             return nil
+         case m := <-w.C:
+             if !restreamMatch(names, m.Subscription) {
+                 continue
+             }
+             data := m.Data
+             if rows {
+                 b, err := json.Marshal(m.Rows)
+                 if err != nil {
+                     continue
+                 }
+                 data = b
+             } else if m.Encoding == "json" || m.Encoding == "jti" {
+                 continue
+             }
+             if err := stream.Send(&MdtDialin.CreateSubsReply{ResReqId: args.ReqId, Data: data}); err != nil {
+                 return err
+             }
+             sent++
+         }
+     }
+}
+
+// rest of the api is not served
+func (s *restreamServer) GetConfig(*MdtDialin.ConfigGetArgs, MdtDialin.GRPCConfigOper_GetConfigServer) error {
+     return status.Error(codes.Unimplemented, "not served by collector")
+}
+
+func (s *restreamServer) MergeConfig(context.Context, *MdtDialin.ConfigArgs) (*MdtDialin.ConfigReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by collector")
+}
+
+func (s *restreamServer) DeleteConfig(context.Context, *MdtDialin.ConfigArgs) (*MdtDialin.ConfigReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by collector")
+}
+
+func (s *restreamServer) ReplaceConfig(context.Context, *MdtDialin.ConfigArgs) (*MdtDialin.ConfigReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by collector")
+}
+
+func (s *restreamServer) CliConfig(context.Context, *MdtDialin.CliConfigArgs) (*MdtDialin.CliConfigReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by collector")
+}
+
+func (s *restreamServer) CommitReplace(context.Context, *MdtDialin.CommitReplaceArgs) (*MdtDialin.CommitReplaceReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by collector")
+}
+
+func (s *restreamServer) CommitConfig(context.Context, *MdtDialin.CommitArgs) (*MdtDialin.CommitReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by collector")
+}
+
+func (s *restreamServer) ConfigDiscardChanges(context.Context, *MdtDialin.DiscardChangesArgs) (*MdtDialin.DiscardChangesReply, error) {
+     return nil, status.Error(codes.Unimplemented, "not served by collector")
+}
+
+func (s *restreamServer) GetOper(*MdtDialin.GetOperArgs, MdtDialin.GRPCConfigOper_GetOperServer) error {
+     return status.Error(codes.Unimplemented, "not served by collector")
+}
+
+func (s *restreamServer) GetProtoFile(*MdtDialin.GetProtoFileArgs, MdtDialin.GRPCConfigOper_GetProtoFileServer) error {
+     return status.Error(codes.Unimplemented, "not served by collector")
+}
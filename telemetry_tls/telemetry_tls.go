@@ -0,0 +1,238 @@
+package telemetry_tls
+
+import (
+       "os"
+       "fmt"
+       "log"
+       "sync"
+       "time"
+       "io/ioutil"
+       "crypto/tls"
+       "crypto/x509"
+
+       "github.com/ios-xr/telemetry-go-collector/telemetry_log"
+)
+
+///////////////////////////////////////////////////////////////////////
+///////         T L S   C E R T I F I C A T E   R E L O A D      ///////
+///////////////////////////////////////////////////////////////////////
+// Cert, key and CA files are checked for changes every reload interval,
+// and reloaded if modified, so that long running collector keeps working
+// across certificate rotations. New certificates are used for new
+// connections, established sessions are not affected. If reload fails,
+// previously loaded certificates continue to be used.
+type certWatcher struct {
+     certFile string
+     keyFile  string
+     caFile   string
+
+     mu       sync.RWMutex
+     cert     *tls.Certificate
+     pool     *x509.CertPool
+     modTime  map[string]time.Time
+}
+
+func newCertWatcher(certFile, keyFile, caFile string, reload time.Duration) (*certWatcher, error) {
+     w := &certWatcher{
+              certFile: certFile,
+              keyFile:  keyFile,
+              caFile:   caFile,
+              modTime:  make(map[string]time.Time),
+          }
+     if err := w.load(); err != nil {
+         return nil, err
+     }
+     if reload > 0 {
+         go w.watch(reload)
+     }
+     return w, nil
+}
+
+func (w *certWatcher) files() []string {
+     var files []string
+     for _, f := range []string{w.certFile, w.keyFile, w.caFile} {
+         if f != "" {
+             files = append(files, f)
+         }
+     }
+     return files
+}
+
+func (w *certWatcher) load() error {
+     var cert *tls.Certificate
+     var pool *x509.CertPool
+
+     modTime := make(map[string]time.Time)
+     for _, f := range w.files() {
+         fi, err := os.Stat(f)
+         if err != nil {
+             return err
+         }
+         modTime[f] = fi.ModTime()
+     }
+
+     if w.certFile != "" {
+         c, err := tls.LoadX509KeyPair(w.certFile, w.keyFile)
+         if err != nil {
+             return err
+         }
+         cert = &c
+     }
+     if w.caFile != "" {
+         b, err := ioutil.ReadFile(w.caFile)
+         if err != nil {
+             return err
+         }
+         pool = x509.NewCertPool()
+         if !pool.AppendCertsFromPEM(b) {
+             return fmt.Errorf("no certificates found in %s", w.caFile)
+         }
+     }
+
+     w.mu.Lock()
+     w.cert, w.pool, w.modTime = cert, pool, modTime
+     w.mu.Unlock()
+     return nil
+}
+
+func (w *certWatcher) modified() bool {
+     w.mu.RLock()
+     defer w.mu.RUnlock()
+     for _, f := range w.files() {
+         fi, err := os.Stat(f)
+         if err != nil {
+             // might be in the middle of being replaced
+             continue
+         }
+         if !fi.ModTime().Equal(w.modTime[f]) {
+             return true
+         }
+     }
+     return false
+}
+
+func (w *certWatcher) watch(reload time.Duration) {
+     for range time.Tick(reload) {
+         if !w.modified() {
+             continue
+         }
+         if err := w.load(); err != nil {
+             log.Printf("TLS: failed to reload %v, using previous certificates: %v", w.files(), err)
+         } else {
+             telemetry_log.Printf("TLS: reloaded %v\n", w.files())
+         }
+     }
+}
+
+func (w *certWatcher) certificate() *tls.Certificate {
+     w.mu.RLock()
+     defer w.mu.RUnlock()
+     return w.cert
+}
+
+func (w *certWatcher) certPool() *x509.CertPool {
+     w.mu.RLock()
+     defer w.mu.RUnlock()
+     return w.pool
+}
+
+// verify server certificate against the current CA, same checks as done
+// by crypto/tls which can't be used here as it uses fixed RootCAs
+func (w *certWatcher) verifyServer(cs tls.ConnectionState) error {
+     if len(cs.PeerCertificates) == 0 {
+         return fmt.Errorf("no server certificate")
+     }
+     opts := x509.VerifyOptions{
+                 Roots:         w.certPool(),
+                 DNSName:       cs.ServerName,
+                 Intermediates: x509.NewCertPool(),
+             }
+     for _, c := range cs.PeerCertificates[1:] {
+         opts.Intermediates.AddCert(c)
+     }
+     _, err := cs.PeerCertificates[0].Verify(opts)
+     return err
+}
+
+// TLS config for server using cert and key files, reloaded when modified
+func NewServerConfig(certFile, keyFile string, reload time.Duration) (*tls.Config, error) {
+     w, err := newCertWatcher(certFile, keyFile, "", reload)
+     if err != nil {
+         return nil, err
+     }
+     return &tls.Config{
+                GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+                    return w.certificate(), nil
+                },
+            }, nil
+}
+
+// verify client certificate against the current CA
+func (w *certWatcher) verifyClient(cs tls.ConnectionState) error {
+     if len(cs.PeerCertificates) == 0 {
+         return fmt.Errorf("no client certificate")
+     }
+     opts := x509.VerifyOptions{
+                 Roots:         w.certPool(),
+                 Intermediates: x509.NewCertPool(),
+                 KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+             }
+     for _, c := range cs.PeerCertificates[1:] {
+         opts.Intermediates.AddCert(c)
+     }
+     _, err := cs.PeerCertificates[0].Verify(opts)
+     return err
+}
+
+// TLS config for server requiring clients to present a certificate
+// signed by CA from clientCAFile, mutual TLS. All files are reloaded when
+// modified.
+func NewMutualServerConfig(certFile, keyFile, clientCAFile string, reload time.Duration) (*tls.Config, error) {
+     w, err := newCertWatcher(certFile, keyFile, clientCAFile, reload)
+     if err != nil {
+         return nil, err
+     }
+     return &tls.Config{
+                GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+                    return w.certificate(), nil
+                },
+                // verification is done in VerifyConnection using current CA
+                ClientAuth:       tls.RequireAnyClientCert,
+                VerifyConnection: w.verifyClient,
+            }, nil
+}
+
+// TLS config for client, server certificate is verified using CA from
+// caFile, reloaded when modified. serverName is the name expected in
+// server certificate.
+func NewClientConfig(caFile, serverName string, reload time.Duration) (*tls.Config, error) {
+     w, err := newCertWatcher("", "", caFile, reload)
+     if err != nil {
+         return nil, err
+     }
+     return &tls.Config{
+                ServerName:         serverName,
+                // verification is done in VerifyConnection using current CA
+                InsecureSkipVerify: true,
+                VerifyConnection:   w.verifyServer,
+            }, nil
+}
+
+// TLS config for client presenting certificate from certFile and keyFile,
+// mutual TLS, server certificate is verified as with NewClientConfig, using
+// system CAs if caFile is not given. All files are reloaded when modified.
+func NewMutualClientConfig(certFile, keyFile, caFile, serverName string, reload time.Duration) (*tls.Config, error) {
+     w, err := newCertWatcher(certFile, keyFile, caFile, reload)
+     if err != nil {
+         return nil, err
+     }
+     return &tls.Config{
+                ServerName:           serverName,
+                GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+                    return w.certificate(), nil
+                },
+                // verification is done in VerifyConnection using current CA
+                InsecureSkipVerify:   true,
+                VerifyConnection:     w.verifyServer,
+            }, nil
+}